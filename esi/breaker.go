@@ -0,0 +1,132 @@
+package esi
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const defaultCircuitBreakerCooldown = 30 * time.Second
+
+var breaker = &circuitBreaker{}
+
+// circuit tracks the consecutive failures of one fragment host
+type circuit struct {
+	// failures are the times of the consecutive failures within the failure window, oldest first
+	failures  []time.Time
+	open      bool
+	openUntil time.Time
+}
+
+// circuitBreaker stops fetching from a fragment host after Config.CircuitBreakerThreshold
+// consecutive failures within Config.FailureWindow, so a backend that is down doesn't add its
+// timeout to every page. Once Config.CircuitBreakerCooldown is over, a single fetch is let
+// through as a probe: a failure opens the circuit for another cooldown, a success closes it.
+type circuitBreaker struct {
+	mu       sync.Mutex
+	circuits map[string]*circuit
+}
+
+// circuitBreakerCooldown returns the configured cooldown
+func circuitBreakerCooldown() time.Duration {
+	if cooldown := config().CircuitBreakerCooldown; cooldown > 0 {
+		return cooldown
+	}
+
+	return defaultCircuitBreakerCooldown
+}
+
+// reset closes every circuit
+func (b *circuitBreaker) reset() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.circuits = nil
+}
+
+// allow returns errCircuitOpen if fetches from host are currently short-circuited. Once the
+// cooldown of an open circuit is over, it lets one fetch through and holds the others back
+// for another cooldown, unless that probe reports back earlier.
+func (b *circuitBreaker) allow(host string) error {
+	if config().CircuitBreakerThreshold <= 0 {
+		return nil
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	c, ok := b.circuits[host]
+	if !ok || !c.open {
+		return nil
+	}
+
+	current := now()
+	if current.Before(c.openUntil) {
+		return fmt.Errorf("%w: %s", errCircuitOpen, host)
+	}
+
+	c.openUntil = current.Add(circuitBreakerCooldown())
+
+	return nil
+}
+
+// record adds the outcome of a fetch from host, opening its circuit once the failures within the
+// failure window reach the threshold, or again for a failed probe
+func (b *circuitBreaker) record(host string, failed bool) {
+	threshold := config().CircuitBreakerThreshold
+	if threshold <= 0 {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	c, ok := b.circuits[host]
+	if !failed {
+		if ok {
+			delete(b.circuits, host)
+		}
+
+		return
+	}
+
+	if !ok {
+		if b.circuits == nil {
+			b.circuits = make(map[string]*circuit)
+		}
+		c = &circuit{}
+		b.circuits[host] = c
+	}
+
+	current := now()
+	cooldown := circuitBreakerCooldown()
+	if c.open {
+		c.openUntil = current.Add(cooldown)
+		return
+	}
+
+	// Failures older than the window no longer count towards the threshold
+	since := current.Add(-failureWindow())
+	for len(c.failures) > 0 && !c.failures[0].After(since) {
+		c.failures = c.failures[1:]
+	}
+
+	c.failures = append(c.failures, current)
+	if len(c.failures) < threshold {
+		return
+	}
+
+	c.failures = nil
+	c.open = true
+	c.openUntil = current.Add(cooldown)
+
+	if logger != nil {
+		logger.Warn("ESI circuit opened for fragment host, skipping its fetches",
+			zap.String("host", host),
+			zap.Int("consecutive_failures", threshold),
+			zap.Duration("window", failureWindow()),
+			zap.Duration("cooldown", cooldown))
+	}
+}
@@ -0,0 +1,161 @@
+package esi
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreakerShortCircuitsFailingHost(t *testing.T) {
+	cache.Reset()
+
+	clock := time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC)
+	withClock(t, &clock)
+	withConfig(t, Config{CircuitBreakerThreshold: 3, CircuitBreakerCooldown: 10 * time.Second})
+
+	var hits atomic.Int32
+	var down atomic.Bool
+	down.Store(true)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.Header().Set("Cache-Control", "no-store")
+		if down.Load() {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.Write([]byte("fragment"))
+	}))
+	defer backend.Close()
+
+	fallback := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "no-store")
+		w.Write([]byte("alt"))
+	}))
+	defer fallback.Close()
+
+	html := []byte(`<esi:include src="` + backend.URL + `/fragment" alt="` + fallback.URL + `/alt"/>`)
+	parse := func() string {
+		return string(Parse(html, httptest.NewRequest("GET", "http://example.com", nil)))
+	}
+
+	for range 3 {
+		if result := parse(); result != "alt" {
+			t.Fatalf("Expected the alt of a failing fragment, got %q", result)
+		}
+	}
+	if got := hits.Load(); got != 3 {
+		t.Fatalf("Expected the backend to be hit until the threshold, got %d hits", got)
+	}
+
+	// The circuit is open, the alt is served without hitting the backend
+	if result := parse(); result != "alt" {
+		t.Errorf("Expected the alt while the circuit is open, got %q", result)
+	}
+	if got := hits.Load(); got != 3 {
+		t.Errorf("Expected no hit while the circuit is open, got %d hits", got)
+	}
+
+	// After the cooldown a failed probe opens the circuit again
+	clock = clock.Add(10 * time.Second)
+	parse()
+	parse()
+	if got := hits.Load(); got != 4 {
+		t.Errorf("Expected a single probe after the cooldown, got %d hits", got)
+	}
+
+	// A successful probe closes it
+	down.Store(false)
+	clock = clock.Add(10 * time.Second)
+	for range 2 {
+		if result := parse(); result != "fragment" {
+			t.Errorf("Expected the fragment once the backend recovered, got %q", result)
+		}
+	}
+	if got := hits.Load(); got != 6 {
+		t.Errorf("Expected fetches to go through once the circuit closed, got %d hits", got)
+	}
+}
+
+func TestCircuitBreakerIsPerHost(t *testing.T) {
+	withConfig(t, Config{CircuitBreakerThreshold: 2})
+
+	b := &circuitBreaker{}
+	b.record("a.internal", true)
+	b.record("a.internal", false)
+	b.record("a.internal", true)
+	if err := b.allow("a.internal"); err != nil {
+		t.Errorf("Expected a success to reset the consecutive failures, got %v", err)
+	}
+
+	b.record("a.internal", true)
+	if err := b.allow("a.internal"); err == nil {
+		t.Error("Expected the circuit to open at the threshold")
+	}
+	if err := b.allow("b.internal"); err != nil {
+		t.Errorf("Expected another host to be unaffected, got %v", err)
+	}
+}
+
+func TestCircuitBreakerFailureWindow(t *testing.T) {
+	clock := time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC)
+	withClock(t, &clock)
+	withConfig(t, Config{CircuitBreakerThreshold: 3, FailureWindow: 10 * time.Second})
+
+	// Failures spread over more than the window don't open the circuit
+	b := &circuitBreaker{}
+	for range 3 {
+		b.record("a.internal", true)
+		clock = clock.Add(6 * time.Second)
+	}
+	if err := b.allow("a.internal"); err != nil {
+		t.Errorf("Expected failures outside the window not to count, got %v", err)
+	}
+
+	// The last two are still within it, so a third one right away does
+	clock = clock.Add(-5 * time.Second)
+	b.record("a.internal", true)
+	if err := b.allow("a.internal"); !errors.Is(err, errCircuitOpen) {
+		t.Errorf("Expected the circuit to open at the threshold within the window, got %v", err)
+	}
+}
+
+func TestCircuitBreakerHalfOpenProbe(t *testing.T) {
+	clock := time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC)
+	withClock(t, &clock)
+	withConfig(t, Config{CircuitBreakerThreshold: 1, CircuitBreakerCooldown: 10 * time.Second})
+
+	b := &circuitBreaker{}
+	b.record("a.internal", true)
+
+	// After the cooldown a single probe goes through, the others are held back
+	clock = clock.Add(10 * time.Second)
+	if err := b.allow("a.internal"); err != nil {
+		t.Fatalf("Expected a probe after the cooldown, got %v", err)
+	}
+	if err := b.allow("a.internal"); !errors.Is(err, errCircuitOpen) {
+		t.Errorf("Expected fetches held back while the probe is in flight, got %v", err)
+	}
+
+	// A failed probe opens the circuit for another cooldown
+	clock = clock.Add(time.Second)
+	b.record("a.internal", true)
+	clock = clock.Add(9 * time.Second)
+	if err := b.allow("a.internal"); !errors.Is(err, errCircuitOpen) {
+		t.Errorf("Expected a failed probe to open the circuit again, got %v", err)
+	}
+
+	// A successful one closes it
+	clock = clock.Add(time.Second)
+	if err := b.allow("a.internal"); err != nil {
+		t.Fatalf("Expected a probe after the cooldown, got %v", err)
+	}
+	b.record("a.internal", false)
+	for range 2 {
+		if err := b.allow("a.internal"); err != nil {
+			t.Errorf("Expected a successful probe to close the circuit, got %v", err)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package esi
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+
+	"go.uber.org/zap"
+)
+
+type budgetKey struct{}
+
+// outputBudget caps the bytes includes may insert while assembling one response, at every
+// nesting level, so fragments including several copies of each other can't grow the page
+// exponentially. Once exceeded, every further include of the response is removed.
+// The bytes of a fragment are charged as its nested includes are expanded, and the include of the
+// fragment then only charges the rest, so the page is charged once whether it was cached or not.
+type outputBudget struct {
+	limit    int64
+	used     atomic.Int64
+	exceeded atomic.Bool
+
+	// parent is the budget of the page a fetch charges its nested includes to, and used then
+	// counts the bytes it charged
+	parent *outputBudget
+}
+
+// WithOutputBudget attaches a fresh output budget of Config.MaxOutputBytes to the request, unless
+// it already carries one or no budget is configured. Parse does this on its own, callers parsing one
+// response in several calls (like the streaming writer) attach it once up front to share the budget.
+func WithOutputBudget(req *http.Request) *http.Request {
+	cfg := config()
+	if cfg.MaxOutputBytes <= 0 || budgetFrom(req) != nil {
+		return req
+	}
+
+	return req.WithContext(context.WithValue(req.Context(), budgetKey{}, &outputBudget{limit: cfg.MaxOutputBytes}))
+}
+
+// budgetFrom returns the output budget of the request, or nil if it has none
+func budgetFrom(req *http.Request) *outputBudget {
+	b, _ := req.Context().Value(budgetKey{}).(*outputBudget)
+	return b
+}
+
+// fetch returns the budget the nested includes of one fetch are charged to, which keeps count of them
+func (b *outputBudget) fetch() *outputBudget {
+	if b == nil {
+		return nil
+	}
+
+	return &outputBudget{parent: b}
+}
+
+// charged returns the bytes charged through a budget returned by fetch
+func (b *outputBudget) charged() int64 {
+	if b == nil {
+		return 0
+	}
+
+	return b.used.Load()
+}
+
+// consume charges n inserted bytes of the include url to the budget and reports whether they fit.
+// A nil budget is unlimited.
+func (b *outputBudget) consume(n int, url string) bool {
+	if b == nil {
+		return true
+	}
+
+	if b.parent != nil {
+		b.used.Add(int64(n))
+		return b.parent.consume(n, url)
+	}
+
+	if b.exceeded.Load() {
+		return false
+	}
+
+	if b.used.Add(int64(n)) <= b.limit {
+		return true
+	}
+
+	if !b.exceeded.Swap(true) && logger != nil {
+		logger.Error("ESI output budget exceeded, truncating further includes",
+			zap.String("url", url),
+			zap.Int64("max_output_bytes", b.limit))
+	}
+
+	return false
+}
+
+// isExceeded reports whether includes have been truncated because the budget ran out
+func (b *outputBudget) isExceeded() bool {
+	if b != nil && b.parent != nil {
+		return b.parent.isExceeded()
+	}
+
+	return b != nil && b.exceeded.Load()
+}
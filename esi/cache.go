@@ -1,30 +1,74 @@
 package esi
 
 import (
+	"bytes"
 	"container/list"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
 	"net/http"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"go.uber.org/zap"
 )
 
 const (
-	defaultTTL      = 300 // 5 minutes
-	maxCacheEntries = 1000
+	defaultTTL             = 300 // 5 minutes
+	defaultMaxCacheEntries = 1000
 )
 
+// maxCacheEntries returns the configured number of fragments held in memory
+func maxCacheEntries() int {
+	cfg := config()
+	if cfg.MaxCacheEntries > 0 {
+		return cfg.MaxCacheEntries
+	}
+
+	return defaultMaxCacheEntries
+}
+
 type cacheEntry struct {
-	data      []byte
-	expiresAt time.Time
-	url       string
+	data       []byte
+	sum        [sha256.Size]byte // content hash keying the shared blob
+	meta       fragmentMeta
+	expiresAt  time.Time
+	staleUntil time.Time // the expired content may be served while it is refreshed until then, if set
+	url        string
+}
+
+// fragmentMeta holds the response metadata kept alongside a fragment's content
+type fragmentMeta struct {
+	statusCode   int
+	lastModified time.Time
+	digest       [sha256.Size]byte // hash of the normalized content, see Config.NormalizeFragment
+	etag         string            // validators sent back when revalidating the fragment, see newFragmentMeta
+	modified     string
+
+	// fetched is set on the meta returned by fetchFragment when the lookup fetched the fragment
+	// rather than serving it from the cache, it is never cached itself
+	fetched bool
+	// charged is the output budget the nested includes of a fetched fragment consumed, see outputBudget
+	charged int64
+	// assembled is set when the fragment had nested ESI tags processed, its validators are then not used
+	assembled bool
+	// truncated is set when nested includes of the fragment were left out for depth or a cycle,
+	// which depends on where it was included, so the content is served but not cached
+	truncated bool
+	// ttl is the ttl attribute of the include the fragment was fetched for, when hasTTL
+	ttl    int
+	hasTTL bool
 }
 
 type inFlightRequest struct {
 	wg     sync.WaitGroup
 	result []byte
+	meta   fragmentMeta
 	err    error
 }
 
@@ -32,22 +76,42 @@ type fragmentCache struct {
 	mu       sync.RWMutex
 	entries  map[string]*list.Element
 	lru      *list.List
-	inFlight sync.Map // map[string]*inFlightRequest - prevents cache stampede
+	blobs    map[[sha256.Size]byte]*blob // content-addressed storage shared by entries with identical data
+	size     int64                       // bytes held by blobs
+	inFlight sync.Map                    // map[string]*inFlightRequest - prevents cache stampede
+	vary     sync.Map                    // map[string][]string - request headers each URL's responses vary by
+	failed   sync.Map                    // map[string]*failedFetch - negative cache of fetch errors
+	hits     atomic.Int64
+	misses   atomic.Int64
+}
+
+// failedFetch is a fetch error remembered for Config.NegativeTTL
+type failedFetch struct {
+	err       error
+	meta      fragmentMeta
+	expiresAt time.Time
+}
+
+// blob is a reference-counted fragment body shared by every entry with the same content
+type blob struct {
+	data []byte
+	refs int
 }
 
-// MetricsObserver is a callback interface for cache metrics
+// MetricsObserver is a callback interface for cache and fragment fetch metrics
 type MetricsObserver interface {
 	OnCacheHit()
 	OnCacheMiss()
 	OnCacheEviction()
 	OnStampedeWait()
+
+	// OnFragmentFetch reports each request to a fragment backend, timed until its body is read.
+	// status is 0 and err set when no response was received, err is set too when the body failed to read
+	OnFragmentFetch(duration time.Duration, status int, err error)
 }
 
 var (
-	cache = &fragmentCache{
-		entries: make(map[string]*list.Element),
-		lru:     list.New(),
-	}
+	cache           = newFragmentCache()
 	metricsObserver MetricsObserver
 )
 
@@ -56,31 +120,103 @@ func SetMetricsObserver(observer MetricsObserver) {
 	metricsObserver = observer
 }
 
-// Get retrieves a cached fragment if it exists and is not expired
+// observeFetch reports a fragment request to the metrics observer, if any
+func observeFetch(duration time.Duration, status int, err error) {
+	if metricsObserver != nil {
+		metricsObserver.OnFragmentFetch(duration, status, err)
+	}
+}
+
+// newFragmentCache creates an empty fragment cache
+func newFragmentCache() *fragmentCache {
+	return &fragmentCache{
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+		blobs:   make(map[[sha256.Size]byte]*blob),
+	}
+}
+
+// Load retrieves a cached fragment if it exists and is not expired, checking the memory tier
+// first and then the disk tier (if configured), promoting disk hits to memory.
 // Note: This is a low-level function. Metrics are recorded by GetOrFetch, not here.
-func (c *fragmentCache) Get(url string) ([]byte, bool) {
-	c.mu.RLock()
-	defer c.mu.RUnlock()
+func (c *fragmentCache) Load(url string) ([]byte, fragmentMeta, bool) {
+	if store := sharedStore(); store != nil {
+		entry, ok := getShared(store, url)
+		if !ok || now().After(entry.expiresAt) {
+			return nil, fragmentMeta{}, false
+		}
+
+		return entry.data, entry.meta, true
+	}
+
+	if data, meta, ok := c.getMemory(url); ok {
+		return data, meta, true
+	}
+
+	// An expired entry promoted from disk is left for GetStale to serve
+	entry, ok := c.promote(url)
+	if !ok || now().After(entry.expiresAt) {
+		return nil, fragmentMeta{}, false
+	}
+
+	return entry.data, entry.meta, true
+}
+
+// promote moves the entry for url from the disk tier to memory, expired or not, and returns a copy
+func (c *fragmentCache) promote(url string) (*cacheEntry, bool) {
+	disk := diskTier()
+	if disk == nil {
+		return nil, false
+	}
+
+	entry, ok := disk.Get(url)
+	if !ok {
+		return nil, false
+	}
+
+	if logger != nil {
+		logger.Info("Cache Get: disk hit, promoting to memory",
+			zap.String("url", url),
+			zap.Time("expires_at", entry.expiresAt))
+	}
+
+	promoted := *entry
+
+	c.mu.Lock()
+	evicted := c.insertLocked(entry)
+	c.mu.Unlock()
+
+	disk.Delete(url)
+	disk.spill(evicted)
+
+	return &promoted, true
+}
+
+// getMemory looks a fragment up in the in-memory tier only
+func (c *fragmentCache) getMemory(url string) ([]byte, fragmentMeta, bool) {
+	// A hit moves the entry in the LRU list, so even lookups take the write lock
+	c.mu.Lock()
+	defer c.mu.Unlock()
 
 	elem, ok := c.entries[url]
 	if !ok {
 		if logger != nil {
 			logger.Info("Cache Get: not found", zap.String("url", url))
 		}
-		return nil, false
+		return nil, fragmentMeta{}, false
 	}
 
 	entry := elem.Value.(*cacheEntry)
-	now := time.Now()
-	if now.After(entry.expiresAt) {
+	current := now()
+	if current.After(entry.expiresAt) {
 		// Expired, will be cleaned up by Put
 		if logger != nil {
 			logger.Info("Cache Get: expired",
 				zap.String("url", url),
 				zap.Time("expired_at", entry.expiresAt),
-				zap.Time("now", now))
+				zap.Time("now", current))
 		}
-		return nil, false
+		return nil, fragmentMeta{}, false
 	}
 
 	// Move to front (most recently used)
@@ -92,27 +228,67 @@ func (c *fragmentCache) Get(url string) ([]byte, bool) {
 			zap.Time("expires_at", entry.expiresAt))
 	}
 
-	return entry.data, true
+	return entry.data, entry.meta, true
+}
+
+// peek returns a copy of the entry for url, expired or not, without marking it as used.
+// The disk tier isn't consulted.
+func (c *fragmentCache) peek(url string) (*cacheEntry, bool) {
+	if store := sharedStore(); store != nil {
+		return getShared(store, url)
+	}
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	elem, ok := c.entries[url]
+	if !ok {
+		return nil, false
+	}
+
+	entry := *elem.Value.(*cacheEntry)
+
+	return &entry, true
+}
+
+// expiry returns when the entry for url expires, or false if there is none
+func (c *fragmentCache) expiry(url string) (time.Time, bool) {
+	entry, ok := c.peek(url)
+	if !ok {
+		return time.Time{}, false
+	}
+
+	return entry.expiresAt, true
 }
 
 // GetOrFetch retrieves from cache or ensures only one fetch happens for concurrent requests.
 // This prevents cache stampede when multiple requests arrive for an expired/missing entry.
 // The fetchFn is called only once per URL, other requests wait for the result.
-func (c *fragmentCache) GetOrFetch(url string, fetchFn func() ([]byte, *http.Response, error)) ([]byte, error) {
+func (c *fragmentCache) GetOrFetch(url string, fetchFn func() ([]byte, *http.Response, error)) ([]byte, fragmentMeta, error) {
 	// Fast path: check cache first
-	if cached, ok := c.Get(url); ok {
+	if cached, meta, ok := c.Load(url); ok {
 		if logger != nil {
 			logger.Info("ESI include cache hit", zap.String("url", url))
 		}
-		// Record cache hit metric
-		if metricsObserver != nil {
-			metricsObserver.OnCacheHit()
+		c.recordHit()
+		return cached, meta, nil
+	}
+
+	// A recent failure is reported again without hitting the origin
+	if failure, ok := c.failure(url); ok {
+		if logger != nil {
+			logger.Info("ESI include negative cache hit", zap.String("url", url), zap.Error(failure.err))
 		}
-		return cached, nil
+		// Nothing is served from the cache, so the lookup counts as a miss
+		c.recordMiss()
+		return nil, failure.meta, failure.err
 	}
 
 	// Cache miss - check if someone else is already fetching this URL
-	flight, loaded := c.inFlight.LoadOrStore(url, &inFlightRequest{})
+	// The wait group is armed before the request is published, so waiters can't pass Wait early
+	pending := &inFlightRequest{}
+	pending.wg.Add(1)
+	flight, loaded := c.inFlight.LoadOrStore(url, pending)
 	req := flight.(*inFlightRequest)
 
 	if loaded {
@@ -125,18 +301,90 @@ func (c *fragmentCache) GetOrFetch(url string, fetchFn func() ([]byte, *http.Res
 		}
 		req.wg.Wait()
 
+		// The fetcher's request was cancelled, which says nothing about this one, so it fetches anew,
+		// unless every fetch in flight was cancelled by Shutdown
+		if errors.Is(req.err, context.Canceled) && !errors.Is(req.err, errShutdown) {
+			return c.GetOrFetch(url, fetchFn)
+		}
+
 		// After waiting, the result is now available (either in cache or as error)
 		// This counts as a cache hit since we didn't fetch ourselves
-		if req.err == nil && metricsObserver != nil {
-			metricsObserver.OnCacheHit()
+		if req.err == nil {
+			c.recordHit()
 		}
 
 		// Return the shared result from the fetcher
-		return req.result, req.err
+		return req.result, req.meta, req.err
 	}
 
 	// We're the first one - do the fetch
-	req.wg.Add(1)
+	c.recordMiss()
+	return c.fetch(url, req, fetchFn)
+}
+
+// Refresh fetches url and caches the result like GetOrFetch, even if a fresh entry is cached, unless
+// a fetch of url is in flight already. A failed fetch keeps the current entry.
+func (c *fragmentCache) Refresh(url string, fetchFn func() ([]byte, *http.Response, error)) error {
+	pending := &inFlightRequest{}
+	pending.wg.Add(1)
+	if _, loaded := c.inFlight.LoadOrStore(url, pending); loaded {
+		return nil
+	}
+
+	_, _, err := c.fetch(url, pending, fetchFn)
+
+	return err
+}
+
+// fetching reports whether any fragment fetch is in flight
+func (c *fragmentCache) fetching() bool {
+	inFlight := false
+	c.inFlight.Range(func(any, any) bool {
+		inFlight = true
+		return false
+	})
+
+	return inFlight
+}
+
+// GetStale returns an entry that expired but is within its stale-while-revalidate window, and
+// refreshes it in the background with refreshFn unless a fetch of the URL is already in flight.
+// Fresh and missing entries are left to GetOrFetch. refreshFn runs after the caller has moved
+// on, so it must not depend on the caller's request being alive.
+func (c *fragmentCache) GetStale(url string, refreshFn func() ([]byte, *http.Response, error)) ([]byte, fragmentMeta, bool) {
+	entry, ok := c.peek(url)
+	if !ok && sharedStore() == nil {
+		entry, ok = c.promote(url)
+	}
+	current := now()
+	if !ok || !current.After(entry.expiresAt) || current.After(entry.staleUntil) {
+		return nil, fragmentMeta{}, false
+	}
+
+	pending := &inFlightRequest{}
+	pending.wg.Add(1)
+	if _, loaded := c.inFlight.LoadOrStore(url, pending); !loaded {
+		if logger != nil {
+			logger.Info("ESI include served stale, refreshing in background",
+				zap.String("url", url),
+				zap.Time("stale_until", entry.staleUntil))
+		}
+		// Tracked by the lifecycle from now on, so Shutdown waits for it however late it starts
+		_, done := lifecycle.begin()
+		go func() {
+			defer done()
+			c.fetch(url, pending, refreshFn)
+		}()
+	}
+
+	c.recordHit()
+
+	return entry.data, entry.meta, true
+}
+
+// fetch calls fetchFn for the in-flight request registered for url, caches a successful result
+// and hands it to the requests waiting on it
+func (c *fragmentCache) fetch(url string, req *inFlightRequest, fetchFn func() ([]byte, *http.Response, error)) ([]byte, fragmentMeta, error) {
 	defer func() {
 		req.wg.Done()
 		c.inFlight.Delete(url) // Clean up in-flight tracking
@@ -146,44 +394,201 @@ func (c *fragmentCache) GetOrFetch(url string, fetchFn func() ([]byte, *http.Res
 		logger.Info("ESI include cache miss, fetching", zap.String("url", url))
 	}
 
-	// Record cache miss metric (we're fetching from backend)
-	if metricsObserver != nil {
-		metricsObserver.OnCacheMiss()
-	}
-
 	// Call the fetch function
 	data, resp, err := fetchFn()
 
+	// A 304 answers a conditional request for the cached entry, whose content is reused
+	if err == nil && resp != nil && resp.StatusCode == http.StatusNotModified {
+		req.result, req.meta, req.err = c.notModified(url, resp)
+		return req.result, req.meta, req.err
+	}
+
+	meta := newFragmentMeta(resp)
+	if err == nil {
+		meta = c.validatedMeta(url, data, resp)
+	}
+
 	// Store result and error for waiting goroutines
 	req.result = data
+	req.meta = meta
 	req.err = err
 
 	if err != nil {
-		return nil, err
+		c.storeFailure(url, meta, err)
+		return nil, meta, err
 	}
+	c.failed.Delete(url)
 
-	if resp != nil && resp.StatusCode == http.StatusOK {
+	if resp != nil && resp.StatusCode == http.StatusOK && !meta.truncated {
 		// Cache the result
-		c.Put(url, data, resp)
+		c.store(url, data, resp, meta)
 		if logger != nil {
 			logger.Info("ESI include cached", zap.String("url", url))
 		}
 	}
 
-	return data, nil
+	return data, meta, nil
+}
+
+// notModified refreshes the cached entry for url from a 304 Not Modified response and returns its content
+func (c *fragmentCache) notModified(url string, resp *http.Response) ([]byte, fragmentMeta, error) {
+	entry, ok := c.peek(url)
+	if !ok {
+		return nil, newFragmentMeta(resp), fmt.Errorf("%w: %d without a cached entry", errUnexpectedStatus, resp.StatusCode)
+	}
+
+	// The content is still valid for this request, even if the 304 says it may no longer be cached
+	c.Revalidate(url, resp)
+
+	return entry.data, entry.meta, nil
+}
+
+// storeFailure remembers a fetch error for Config.NegativeTTL. Errors that depend on the request
+// rather than on the origin, like a cancelled request or a redirect to pass on, are not kept.
+func (c *fragmentCache) storeFailure(url string, meta fragmentMeta, err error) {
+	cfg := config()
+	var redirect *redirectError
+	if cfg.NegativeTTL <= 0 || errors.Is(err, context.Canceled) || errors.Is(err, errBudgetExceeded) ||
+		errors.Is(err, errCircuitOpen) || errors.As(err, &redirect) {
+		return
+	}
+
+	c.failed.Store(url, &failedFetch{err: err, meta: meta, expiresAt: now().Add(cfg.NegativeTTL)})
+}
+
+// failure returns the remembered error of a recent failed fetch of url
+func (c *fragmentCache) failure(url string) (*failedFetch, bool) {
+	value, ok := c.failed.Load(url)
+	if !ok {
+		return nil, false
+	}
+
+	failure := value.(*failedFetch)
+	if now().After(failure.expiresAt) {
+		c.failed.CompareAndDelete(url, value)
+		return nil, false
+	}
+
+	return failure, true
+}
+
+// newFragmentMeta extracts the metadata to keep from a fragment response
+func newFragmentMeta(resp *http.Response) fragmentMeta {
+	var meta fragmentMeta
+	if resp == nil {
+		return meta
+	}
+
+	meta.statusCode = resp.StatusCode
+	if notes := notesOf(resp); notes != nil {
+		meta.assembled, meta.truncated = notes.assembled, notes.truncated
+		meta.ttl, meta.hasTTL = notes.ttl, notes.hasTTL
+	}
+	if lm, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		meta.lastModified = lm
+	}
+
+	// Content assembled from nested includes can change while the fragment itself doesn't,
+	// so only fragments inserted verbatim are revalidated
+	if !meta.assembled {
+		meta.etag = resp.Header.Get("ETag")
+		meta.modified = resp.Header.Get("Last-Modified")
+	}
+
+	return meta
+}
+
+// validatedMeta builds the metadata of freshly fetched fragment content. Content whose normalized
+// form matches the cached version keeps that version's Last-Modified, so volatile bytes like
+// timestamps don't make an unchanged fragment look modified to conditional requests.
+func (c *fragmentCache) validatedMeta(url string, data []byte, resp *http.Response) fragmentMeta {
+	meta := newFragmentMeta(resp)
+	meta.digest = fragmentDigest(data)
+
+	// An expired entry still tells whether the content changed
+	if entry, ok := c.peek(url); ok {
+		previous := entry.meta
+		if previous.digest == meta.digest && !previous.lastModified.IsZero() {
+			meta.lastModified = previous.lastModified
+		}
+	}
+
+	return meta
+}
+
+// fragmentDigest hashes fragment content after Config.NormalizeFragment, if set
+func fragmentDigest(data []byte) [sha256.Size]byte {
+	if normalize := config().NormalizeFragment; normalize != nil {
+		data = normalize(bytes.Clone(data))
+	}
+
+	return sha256.Sum256(data)
 }
 
 // Put stores a fragment in cache with TTL parsed from response headers
 func (c *fragmentCache) Put(url string, data []byte, resp *http.Response) {
-	ttl := parseTTL(resp)
+	c.store(url, data, resp, c.validatedMeta(url, data, resp))
+}
+
+// store caches a fragment with the given metadata and a TTL parsed from response headers
+func (c *fragmentCache) store(url string, data []byte, resp *http.Response, meta fragmentMeta) {
+	cfg := config()
+
+	// A response varying by request headers is cached under a key carrying the values it was fetched
+	// with. A background refresh passes that key back in, so the variant part is recomputed.
+	key, _, _ := strings.Cut(url, responseVaryMarker)
+	if names := parseVary(resp); len(names) > 0 {
+		if slices.Contains(names, "*") {
+			if logger != nil {
+				logger.Info("Cache Put skipped: response varies by everything", zap.String("url", url))
+			}
+			return
+		}
+
+		var header http.Header
+		if resp.Request != nil {
+			header = resp.Request.Header
+		}
+
+		c.vary.Store(key, names)
+		url = responseVariantKey(key, names, header)
+	} else {
+		c.vary.Delete(key)
+		url = key
+	}
+
+	ttl := fragmentTTL(resp, meta)
+
+	// no-store or private: don't cache, and drop any previously cached version so it stops being served
+	if ttl == 0 {
+		if c.Remove(url) && logger != nil {
+			logger.Info("Cache purged entry for uncacheable response", zap.String("url", url))
+		}
+		return
+	}
 
-	// Apply minimum TTL if configured
-	if globalConfig.MinimumCacheTTL > 0 && ttl < globalConfig.MinimumCacheTTL {
-		ttl = globalConfig.MinimumCacheTTL
+	// Skip oversized fragments even if their headers permit caching
+	if cfg.MaxCacheableFragmentBytes > 0 && len(data) > cfg.MaxCacheableFragmentBytes {
+		if logger != nil {
+			logger.Info("Cache Put skipped: fragment exceeds max cacheable size",
+				zap.String("url", url),
+				zap.Int("data_size", len(data)),
+				zap.Int("max_cacheable_fragment_bytes", cfg.MaxCacheableFragmentBytes))
+		}
+		return
+	}
+
+	// A fragment larger than the whole memory budget would evict every other entry
+	if cfg.MaxCacheBytes > 0 && int64(len(data)) > cfg.MaxCacheBytes && sharedStore() == nil {
+		if logger != nil {
+			logger.Info("Cache Put skipped: fragment exceeds max cache bytes",
+				zap.String("url", url),
+				zap.Int("data_size", len(data)),
+				zap.Int64("max_cache_bytes", cfg.MaxCacheBytes))
+		}
+		return
 	}
 
-	// Apply TTL jitter if configured
-	ttl = applyTTLJitter(ttl)
 	if logger != nil {
 		cacheControl := ""
 		if resp != nil {
@@ -196,38 +601,155 @@ func (c *fragmentCache) Put(url string, data []byte, resp *http.Response) {
 			zap.Int("data_size", len(data)))
 	}
 
-	// Note: We removed the TTL=0 check - parseTTL always returns >= defaultTTL now
-	// ESI fragments are always cached, regardless of cache headers
+	entry := &cacheEntry{
+		data:      data,
+		meta:      meta,
+		expiresAt: now().Add(time.Duration(ttl) * time.Second),
+		url:       url,
+	}
+	if swr := parseStaleWhileRevalidate(resp); swr > 0 {
+		entry.staleUntil = entry.expiresAt.Add(time.Duration(swr) * time.Second)
+	}
+
+	if store := sharedStore(); store != nil {
+		setShared(store, entry)
+		return
+	}
+
+	c.mu.Lock()
+	evicted := c.insertLocked(entry)
+	c.mu.Unlock()
+
+	// Evicted entries overflow to the disk tier if configured
+	if disk := diskTier(); disk != nil {
+		disk.spill(evicted)
+	}
+}
+
+// Revalidate refreshes the expiry of a cached entry from a 304 Not Modified response.
+// The new TTL comes from the 304's own Cache-Control and Age, not from the original response.
+// It reports false if there is no entry left to refresh, in which case a full fetch is needed.
+func (c *fragmentCache) Revalidate(url string, resp *http.Response) bool {
+	ttl := fragmentTTL(resp, newFragmentMeta(resp))
+	if ttl == 0 {
+		c.Remove(url)
+		return false
+	}
+
+	if !c.refresh(url, ttl, resp) {
+		return false
+	}
+
+	if logger != nil {
+		logger.Info("Cache entry revalidated",
+			zap.String("url", url),
+			zap.Int("ttl", ttl),
+			zap.String("cache_control", resp.Header.Get("Cache-Control")))
+	}
+
+	return true
+}
+
+// refresh extends the lifetime of the entry for url by ttl seconds, taking the stale window and
+// Last-Modified of the revalidation response, and reports false if there is no entry
+func (c *fragmentCache) refresh(url string, ttl int, resp *http.Response) bool {
+	update := func(entry *cacheEntry) {
+		entry.expiresAt = now().Add(time.Duration(ttl) * time.Second)
+		entry.staleUntil = time.Time{}
+		if swr := parseStaleWhileRevalidate(resp); swr > 0 {
+			entry.staleUntil = entry.expiresAt.Add(time.Duration(swr) * time.Second)
+		}
+		if lastModified := newFragmentMeta(resp).lastModified; !lastModified.IsZero() {
+			entry.meta.lastModified = lastModified
+		}
+		if etag := resp.Header.Get("ETag"); etag != "" && entry.meta.etag != "" {
+			entry.meta.etag = etag
+		}
+		if modified := resp.Header.Get("Last-Modified"); modified != "" && entry.meta.modified != "" {
+			entry.meta.modified = modified
+		}
+	}
+
+	if store := sharedStore(); store != nil {
+		entry, ok := getShared(store, url)
+		if ok {
+			update(entry)
+			setShared(store, entry)
+		}
+		return ok
+	}
 
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	// Update existing entry
-	if elem, ok := c.entries[url]; ok {
-		entry := elem.Value.(*cacheEntry)
-		entry.data = data
-		entry.expiresAt = time.Now().Add(time.Duration(ttl) * time.Second)
-		c.lru.MoveToFront(elem)
-		return
+	elem, ok := c.entries[url]
+	if !ok {
+		return false
 	}
 
-	// Add new entry
-	entry := &cacheEntry{
-		data:      data,
-		expiresAt: time.Now().Add(time.Duration(ttl) * time.Second),
-		url:       url,
+	update(elem.Value.(*cacheEntry))
+	c.lru.MoveToFront(elem)
+
+	return true
+}
+
+// fragmentTTL returns the seconds a fragment response with meta is cached for, or 0 if it must not be
+// cached. The ttl attribute of the include it was fetched for is taken as is, otherwise the TTL comes
+// from the caching headers, adjusted by effectiveTTL.
+func fragmentTTL(resp *http.Response, meta fragmentMeta) int {
+	if meta.hasTTL {
+		return meta.ttl
 	}
 
-	elem := c.lru.PushFront(entry)
-	c.entries[url] = elem
+	ttl := parseTTL(resp)
+	if ttl == 0 {
+		return 0
+	}
+
+	return effectiveTTL(ttl)
+}
+
+// effectiveTTL applies the configured minimum TTL and jitter to a TTL derived from headers
+func effectiveTTL(ttl int) int {
+	cfg := config()
+	if cfg.MinimumCacheTTL > 0 && ttl < cfg.MinimumCacheTTL {
+		ttl = cfg.MinimumCacheTTL
+	}
 
-	// Evict oldest entries if cache is full
-	for c.lru.Len() > maxCacheEntries {
+	return applyTTLJitter(ttl)
+}
+
+// insertLocked adds or replaces an entry at the front of the LRU and evicts the oldest
+// entries if the cache is full, returning them. The caller must hold the write lock.
+func (c *fragmentCache) insertLocked(entry *cacheEntry) []*cacheEntry {
+	c.retainLocked(entry)
+
+	if elem, ok := c.entries[entry.url]; ok {
+		// Update existing entry
+		c.releaseLocked(elem.Value.(*cacheEntry))
+		elem.Value = entry
+		c.lru.MoveToFront(elem)
+	} else {
+		// Add new entry
+		c.entries[entry.url] = c.lru.PushFront(entry)
+	}
+
+	return c.evictLocked()
+}
+
+// evictLocked evicts the oldest entries until both the entry count and byte size fit the configured
+// limits, returning them. The caller must hold the write lock.
+func (c *fragmentCache) evictLocked() []*cacheEntry {
+	cfg := config()
+	var evicted []*cacheEntry
+	for c.lru.Len() > maxCacheEntries() || (cfg.MaxCacheBytes > 0 && c.size > cfg.MaxCacheBytes) {
 		oldest := c.lru.Back()
 		if oldest != nil {
 			c.lru.Remove(oldest)
 			oldEntry := oldest.Value.(*cacheEntry)
 			delete(c.entries, oldEntry.url)
+			c.releaseLocked(oldEntry)
+			evicted = append(evicted, oldEntry)
 
 			if logger != nil {
 				logger.Info("Cache evicted LRU entry", zap.String("url", oldEntry.url))
@@ -237,36 +759,234 @@ func (c *fragmentCache) Put(url string, data []byte, resp *http.Response) {
 			}
 		}
 	}
+
+	return evicted
+}
+
+// shrink evicts entries beyond limits lowered since they were cached, overflowing them to the disk tier
+func (c *fragmentCache) shrink() {
+	c.mu.Lock()
+	evicted := c.evictLocked()
+	c.mu.Unlock()
+
+	if disk := diskTier(); disk != nil {
+		disk.spill(evicted)
+	}
+}
+
+// Remove removes a fragment from both cache tiers, or the CacheStore, and forgets a failed fetch of it,
+// reporting whether it was in memory
+func (c *fragmentCache) Remove(url string) bool {
+	c.failed.Delete(url)
+
+	if store := sharedStore(); store != nil {
+		store.Delete(url)
+		return false
+	}
+
+	return c.removeLocal(url)
+}
+
+// removeLocal removes a fragment from both cache tiers, reporting whether it was in memory
+func (c *fragmentCache) removeLocal(url string) bool {
+	if disk := diskTier(); disk != nil {
+		disk.Delete(url)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[url]
+	if !ok {
+		return false
+	}
+
+	c.lru.Remove(elem)
+	delete(c.entries, url)
+	c.releaseLocked(elem.Value.(*cacheEntry))
+
+	return true
+}
+
+// DeletePrefix removes every fragment whose URL starts with prefix from both cache tiers, or the
+// CacheStore, and returns how many were removed. It fails if the CacheStore cannot list its keys.
+func (c *fragmentCache) DeletePrefix(prefix string) (int, error) {
+	c.failed.Range(func(url, _ any) bool {
+		if strings.HasPrefix(url.(string), prefix) {
+			c.failed.Delete(url)
+		}
+		return true
+	})
+
+	store := c.backend()
+	keys, err := listShared(store, prefix)
+	for _, key := range keys {
+		store.Delete(key)
+	}
+	removed := len(keys)
+
+	// Entries spilled to the disk tier aren't listed by the in-memory cache above it
+	if store == CacheStore(c) {
+		if disk := diskTier(); disk != nil {
+			removed += disk.DeletePrefix(prefix)
+		}
+	}
+
+	return removed, err
+}
+
+// varyBy returns the request headers the last response cached for url varied by, or nil
+func (c *fragmentCache) varyBy(url string) []string {
+	names, _ := c.vary.Load(url)
+	if names == nil {
+		return nil
+	}
+
+	return names.([]string)
+}
+
+// parseVary returns the canonical names of the request headers listed in a response's Vary header
+func parseVary(resp *http.Response) []string {
+	if resp == nil {
+		return nil
+	}
+
+	var names []string
+	for _, value := range resp.Header.Values("Vary") {
+		for name := range strings.SplitSeq(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				names = append(names, http.CanonicalHeaderKey(name))
+			}
+		}
+	}
+
+	return names
+}
+
+// responseVaryMarker separates a cache key from the variant part added for the Vary header of
+// the fragment's responses. Header names in keys are canonical, so it can't be mistaken for one.
+const responseVaryMarker = "\nvary"
+
+// responseVariantKey returns the key caching the variant of a fragment that responses varying by
+// the named request headers have for the given header values
+func responseVariantKey(key string, names []string, header http.Header) string {
+	return variantKey(key+responseVaryMarker, names, header)
+}
+
+// variantKey appends the values of the named request headers to a cache key, so each variant
+// of a fragment is cached separately
+func variantKey(key string, names []string, header http.Header) string {
+	var variant strings.Builder
+	variant.WriteString(key)
+
+	for _, name := range names {
+		// URLs can't contain a newline, so variants never collide with another URL
+		variant.WriteString("\n" + name + ": " + strings.Join(header.Values(name), ","))
+	}
+
+	return variant.String()
+}
+
+// removeExpired drops every expired entry from the memory tier and returns how many were removed
+func (c *fragmentCache) removeExpired() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	current := now()
+	removed := 0
+	for url, elem := range c.entries {
+		entry := elem.Value.(*cacheEntry)
+		if !current.After(entry.expiresAt) || !current.After(entry.staleUntil) {
+			continue
+		}
+
+		c.lru.Remove(elem)
+		delete(c.entries, url)
+		c.releaseLocked(entry)
+		removed++
+	}
+
+	return removed
+}
+
+// retainLocked points the entry's data at the shared blob holding identical content,
+// storing a new blob if none exists. The caller must hold the write lock.
+func (c *fragmentCache) retainLocked(entry *cacheEntry) {
+	if c.blobs == nil {
+		c.blobs = make(map[[sha256.Size]byte]*blob)
+	}
+
+	entry.sum = sha256.Sum256(entry.data)
+	b, ok := c.blobs[entry.sum]
+	if !ok {
+		b = &blob{data: entry.data}
+		c.blobs[entry.sum] = b
+		c.size += int64(len(b.data))
+	}
+
+	b.refs++
+	entry.data = b.data
+}
+
+// releaseLocked drops the entry's reference to its blob, freeing it once unused.
+// The caller must hold the write lock.
+func (c *fragmentCache) releaseLocked(entry *cacheEntry) {
+	if b, ok := c.blobs[entry.sum]; ok {
+		b.refs--
+		if b.refs <= 0 {
+			delete(c.blobs, entry.sum)
+			c.size -= int64(len(b.data))
+		}
+	}
 }
 
 // parseTTL extracts TTL from Cache-Control header, returns defaultTTL if not found
-// Note: Always returns at least defaultTTL, even if response has no-cache/no-store.
+// Note: Returns at least defaultTTL even if response has no-cache or max-age=0.
 // This is intentional - if ESI markup exists, developers want caching.
 // Missing cache headers is a configuration error, not an intent to disable caching.
+// Only no-store and private, explicit statements that the response must not be kept by a shared
+// cache such as this one, return 0.
+// A lifetime from s-maxage, max-age or Expires is reduced by the Age the response already spent in caches.
 func parseTTL(resp *http.Response) int {
 	if resp == nil {
 		return defaultTTL
 	}
 
 	cacheControl := resp.Header.Get("Cache-Control")
-	if cacheControl == "" {
-		return defaultTTL
-	}
 
-	// Parse max-age from Cache-Control header
-	// Example: "public, max-age=3600" or "max-age=3600, must-revalidate"
+	// Parse s-maxage or max-age from Cache-Control header
+	// Example: "public, max-age=3600" or "s-maxage=600, max-age=60"
 	directives := strings.Split(cacheControl, ",")
 	for _, directive := range directives {
-		directive = strings.TrimSpace(directive)
-		if strings.HasPrefix(directive, "max-age=") {
-			maxAgeStr := strings.TrimPrefix(directive, "max-age=")
-			if maxAge, err := strconv.Atoi(maxAgeStr); err == nil && maxAge > 0 {
-				return maxAge
-			}
+		// private="Set-Cookie" only restricts some fields, but the fragment is kept whole
+		name, _, _ := strings.Cut(strings.TrimSpace(directive), "=")
+		if strings.EqualFold(name, "no-store") || strings.EqualFold(name, "private") {
+			return 0
 		}
 	}
 
-	// Always return defaultTTL, even for no-cache/no-store/max-age=0
+	// s-maxage is meant for shared caches and overrides max-age
+	maxAge, hasSharedMaxAge := directiveSeconds(directives, "s-maxage")
+	hasMaxAge := hasSharedMaxAge
+	if maxAge == 0 {
+		maxAge, hasMaxAge = directiveSeconds(directives, "max-age")
+		hasMaxAge = hasMaxAge || hasSharedMaxAge
+	}
+	if maxAge > 0 {
+		// A response that used up its max-age upstream is still cached briefly, like max-age=0
+		return max(maxAge-responseAge(resp), 1)
+	}
+
+	// The legacy Expires header only applies when Cache-Control has no max-age
+	if expires, ok := resp.Header["Expires"]; ok && !hasMaxAge {
+		return max(expiresTTL(expires[0], resp.Header.Get("Date"))-responseAge(resp), 0)
+	}
+
+	if cacheControl == "" {
+		return defaultTTL
+	}
+
+	// Always return defaultTTL, even for no-cache/max-age=0
 	// If developers added ESI markup, they want caching - wrong headers are config errors
 	if logger != nil {
 		logger.Info("Using default TTL (ignoring cache directives)",
@@ -276,25 +996,197 @@ func parseTTL(resp *http.Response) int {
 	return defaultTTL
 }
 
-// Stats returns cache statistics for monitoring
+// directiveSeconds returns the first valid value of the name=seconds directive, 0 if none is valid,
+// and whether the directive is present at all
+func directiveSeconds(directives []string, name string) (int, bool) {
+	present := false
+	for _, directive := range directives {
+		value, ok := strings.CutPrefix(strings.TrimSpace(directive), name+"=")
+		if !ok {
+			continue
+		}
+
+		present = true
+		if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+			return seconds, true
+		}
+	}
+
+	return 0, present
+}
+
+// parseStaleWhileRevalidate returns the seconds an expired response may still be served while it
+// is refreshed, from the stale-while-revalidate Cache-Control directive, or 0 if there is none
+func parseStaleWhileRevalidate(resp *http.Response) int {
+	if resp == nil {
+		return 0
+	}
+
+	for _, directive := range strings.Split(resp.Header.Get("Cache-Control"), ",") {
+		value, ok := strings.CutPrefix(strings.TrimSpace(directive), "stale-while-revalidate=")
+		if !ok {
+			continue
+		}
+
+		if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+			return seconds
+		}
+	}
+
+	return 0
+}
+
+// responseAge returns the seconds a response spent in intermediate caches, from its Age header
+func responseAge(resp *http.Response) int {
+	age, err := strconv.Atoi(resp.Header.Get("Age"))
+	if err != nil || age < 0 {
+		return 0
+	}
+
+	return age
+}
+
+// expiresTTL returns the TTL in seconds left until an Expires date, relative to the response's
+// Date header or the current time. Past and invalid dates (e.g. "0") mean already expired.
+func expiresTTL(expires, date string) int {
+	expiresAt, err := http.ParseTime(expires)
+	if err != nil {
+		return 0
+	}
+
+	origin := now()
+	if d, err := http.ParseTime(date); err == nil {
+		origin = d
+	}
+
+	return max(int(expiresAt.Sub(origin)/time.Second), 0)
+}
+
+// Stats implements CacheStore, returning the statistics of the in-memory tier for monitoring
+// The size counts each distinct fragment body once, since identical content is shared.
 func (c *fragmentCache) Stats() (entries int, size int64) {
 	c.mu.RLock()
 	defer c.mu.RUnlock()
 
-	entries = len(c.entries)
-	for _, elem := range c.entries {
-		entry := elem.Value.(*cacheEntry)
-		size += int64(len(entry.data))
-	}
-
-	return entries, size
+	return len(c.entries), c.size
 }
 
-// Reset clears all cache entries (useful for testing)
+// Reset clears all in-memory cache entries (useful for testing)
 func (c *fragmentCache) Reset() {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
 	c.entries = make(map[string]*list.Element)
 	c.lru = list.New()
+	c.blobs = make(map[[sha256.Size]byte]*blob)
+	c.size = 0
+	c.vary.Clear()
+	c.failed.Clear()
+	c.hits.Store(0)
+	c.misses.Store(0)
+}
+
+// Keys implements CacheStoreLister, returning the keys of the in-memory entries starting with prefix, sorted
+func (c *fragmentCache) Keys(prefix string) []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	keys := make([]string, 0, len(c.entries))
+	for key := range c.entries {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	slices.Sort(keys)
+
+	return keys
+}
+
+func (c *fragmentCache) recordHit() {
+	c.hits.Add(1)
+	if metricsObserver != nil {
+		metricsObserver.OnCacheHit()
+	}
+}
+
+func (c *fragmentCache) recordMiss() {
+	c.misses.Add(1)
+	if metricsObserver != nil {
+		metricsObserver.OnCacheMiss()
+	}
+}
+
+// hitRatio returns the share of lookups served without fetching, or 0 before any lookup
+func (c *fragmentCache) hitRatio() float64 {
+	hits, misses := c.hits.Load(), c.misses.Load()
+	if hits+misses == 0 {
+		return 0
+	}
+
+	return float64(hits) / float64(hits+misses)
+}
+
+// CacheHitRatio returns the share of fragment lookups served from the cache since startup or the last ResetCache
+func CacheHitRatio() float64 {
+	return cache.hitRatio()
+}
+
+// CacheStats returns the number of entries in the in-memory fragment cache, or the CacheStore, and the
+// bytes they hold
+func CacheStats() (entries int, size int64) {
+	return cache.backend().Stats()
+}
+
+// CacheEntries returns the URLs of the fragments held in the in-memory cache, or the CacheStore, sorted.
+// Expired entries not swept yet are listed, and the keys of Vary variants and of Config.CacheKeyFunc are
+// returned as they are cached. It fails with ErrCacheStoreNotListable if the CacheStore cannot list its keys.
+func CacheEntries() ([]string, error) {
+	keys, err := listShared(cache.backend(), "")
+	slices.Sort(keys)
+
+	return keys, err
+}
+
+// ResetCache empties the in-memory and disk tiers, forgets failed fetches and restarts the hit ratio.
+// Fragments held by a CacheStore are not affected.
+func ResetCache() {
+	if disk := diskTier(); disk != nil {
+		disk.DeletePrefix("")
+	}
+	cache.Reset()
+
+	if logger != nil {
+		logger.Info("Cache reset")
+	}
+}
+
+// PurgeURL removes a cached fragment so the next include of url fetches it again
+func PurgeURL(url string) {
+	cache.Remove(url)
+
+	// Variants cached for the headers the URL's responses vary by are keyed below it
+	if cache.varyBy(url) != nil {
+		if _, err := cache.DeletePrefix(url + responseVaryMarker); err != nil && logger != nil {
+			logger.Warn("Cache purge of URL variants failed", zap.String("url", url), zap.Error(err))
+		}
+	}
+
+	if logger != nil {
+		logger.Info("Cache purged URL", zap.String("url", url))
+	}
+}
+
+// PurgePrefix removes every cached fragment whose URL starts with prefix and returns how many were removed.
+// It fails with ErrCacheStoreNotListable if the CacheStore cannot list its keys, removing none from it.
+func PurgePrefix(prefix string) (int, error) {
+	removed, err := cache.DeletePrefix(prefix)
+	if err != nil {
+		return removed, err
+	}
+
+	if logger != nil {
+		logger.Info("Cache purged prefix", zap.String("prefix", prefix), zap.Int("removed", removed))
+	}
+
+	return removed, nil
 }
@@ -0,0 +1,252 @@
+package esi
+
+import (
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// diskEntry is the serialized representation of a cached fragment, on disk or in a CacheStore
+type diskEntry struct {
+	URL          string
+	Data         []byte
+	StatusCode   int
+	LastModified time.Time
+	Digest       [sha256.Size]byte
+	ETag         string
+	Modified     string
+	ExpiresAt    time.Time
+	StaleUntil   time.Time
+}
+
+func newDiskEntry(entry *cacheEntry) diskEntry {
+	return diskEntry{
+		URL:          entry.url,
+		Data:         entry.data,
+		StatusCode:   entry.meta.statusCode,
+		LastModified: entry.meta.lastModified,
+		Digest:       entry.meta.digest,
+		ETag:         entry.meta.etag,
+		Modified:     entry.meta.modified,
+		ExpiresAt:    entry.expiresAt,
+		StaleUntil:   entry.staleUntil,
+	}
+}
+
+func (stored diskEntry) entry() *cacheEntry {
+	return &cacheEntry{
+		data: stored.Data,
+		meta: fragmentMeta{
+			statusCode:   stored.StatusCode,
+			lastModified: stored.LastModified,
+			digest:       stored.Digest,
+			etag:         stored.ETag,
+			modified:     stored.Modified,
+		},
+		expiresAt:  stored.ExpiresAt,
+		staleUntil: stored.StaleUntil,
+		url:        stored.URL,
+	}
+}
+
+// diskStore is the secondary cache tier: fragments evicted from the in-memory LRU are kept
+// on disk until they can't be served anymore, even stale, and persist across restarts.
+type diskStore struct {
+	dir      string
+	maxBytes int64 // 0 means unlimited
+}
+
+// diskTier returns the configured disk tier, or nil when disabled
+func diskTier() *diskStore {
+	cfg := config()
+	if cfg.DiskCacheDir == "" {
+		return nil
+	}
+
+	maxBytes := cfg.MaxDiskCacheBytes
+	if maxBytes == 0 {
+		maxBytes = cfg.MaxCacheBytes
+	}
+
+	return &diskStore{dir: cfg.DiskCacheDir, maxBytes: maxBytes}
+}
+
+func (d *diskStore) path(url string) string {
+	sum := sha256.Sum256([]byte(url))
+
+	return filepath.Join(d.dir, hex.EncodeToString(sum[:])+".frag")
+}
+
+// Get returns the entry stored for url, expired or not, removing it once it can't be served stale either
+func (d *diskStore) Get(url string) (*cacheEntry, bool) {
+	f, err := os.Open(d.path(url))
+	if err != nil {
+		return nil, false
+	}
+
+	var stored diskEntry
+	err = gob.NewDecoder(f).Decode(&stored)
+	f.Close()
+
+	if err != nil || stored.URL != url {
+		return nil, false
+	}
+
+	if current := now(); current.After(stored.ExpiresAt) && current.After(stored.StaleUntil) {
+		d.Delete(url)
+		return nil, false
+	}
+
+	return stored.entry(), true
+}
+
+// Set writes the entry to disk, replacing any previous version atomically. The file is dated by
+// the cache clock, which orders evictions.
+func (d *diskStore) Set(entry *cacheEntry) error {
+	if err := os.MkdirAll(d.dir, 0o755); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(d.dir, "frag-*")
+	if err != nil {
+		return err
+	}
+
+	err = gob.NewEncoder(tmp).Encode(newDiskEntry(entry))
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err == nil {
+		current := now()
+		if err = os.Chtimes(tmp.Name(), current, current); err == nil {
+			err = os.Rename(tmp.Name(), d.path(entry.url))
+		}
+	}
+
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+
+	return err
+}
+
+// Delete removes the entry stored for url, if any
+func (d *diskStore) Delete(url string) {
+	if err := os.Remove(d.path(url)); err != nil && !errors.Is(err, os.ErrNotExist) && logger != nil {
+		logger.Warn("Disk cache delete failed", zap.String("url", url), zap.Error(err))
+	}
+}
+
+// DeletePrefix removes every stored entry whose URL starts with prefix and returns how many were removed
+func (d *diskStore) DeletePrefix(prefix string) int {
+	paths, err := filepath.Glob(filepath.Join(d.dir, "*.frag"))
+	if err != nil {
+		return 0
+	}
+
+	removed := 0
+	for _, path := range paths {
+		f, err := os.Open(path)
+		if err != nil {
+			continue
+		}
+
+		var stored diskEntry
+		err = gob.NewDecoder(f).Decode(&stored)
+		f.Close()
+
+		if err != nil || !strings.HasPrefix(stored.URL, prefix) {
+			continue
+		}
+
+		if err := os.Remove(path); err == nil {
+			removed++
+		}
+	}
+
+	return removed
+}
+
+// spill moves entries evicted from memory to the disk tier if they can still be served, fresh
+// or stale, then evicts the files spilled longest ago beyond maxBytes
+func (d *diskStore) spill(entries []*cacheEntry) {
+	written := false
+	for _, entry := range entries {
+		if current := now(); current.After(entry.expiresAt) && current.After(entry.staleUntil) {
+			continue
+		}
+
+		// A fragment larger than the whole tier would evict every other file
+		if d.maxBytes > 0 && int64(len(entry.data)) > d.maxBytes {
+			continue
+		}
+
+		if err := d.Set(entry); err != nil {
+			if logger != nil {
+				logger.Warn("Disk cache write failed", zap.String("url", entry.url), zap.Error(err))
+			}
+			continue
+		}
+		written = true
+	}
+
+	if written {
+		d.evict()
+	}
+}
+
+// evict removes the files spilled longest ago until the tier fits in maxBytes
+func (d *diskStore) evict() {
+	if d.maxBytes <= 0 {
+		return
+	}
+
+	paths, err := filepath.Glob(filepath.Join(d.dir, "*.frag"))
+	if err != nil {
+		return
+	}
+
+	type file struct {
+		path    string
+		size    int64
+		modTime time.Time
+	}
+
+	files := make([]file, 0, len(paths))
+	var total int64
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		files = append(files, file{path: path, size: info.Size(), modTime: info.ModTime()})
+		total += info.Size()
+	}
+
+	slices.SortFunc(files, func(a, b file) int {
+		return a.modTime.Compare(b.modTime)
+	})
+
+	for _, f := range files {
+		if total <= d.maxBytes {
+			break
+		}
+
+		if err := os.Remove(f.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			if logger != nil {
+				logger.Warn("Disk cache eviction failed", zap.String("path", f.path), zap.Error(err))
+			}
+			continue
+		}
+		total -= f.size
+	}
+}
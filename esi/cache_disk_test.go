@@ -0,0 +1,222 @@
+package esi
+
+import (
+	"bytes"
+	"net/http"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func okResponse(cacheControl string) *http.Response {
+	resp := &http.Response{StatusCode: http.StatusOK, Header: http.Header{}}
+	resp.Header.Set("Cache-Control", cacheControl)
+
+	return resp
+}
+
+func TestDiskCachePromotesHits(t *testing.T) {
+	dir := t.TempDir()
+	withConfig(t, Config{DiskCacheDir: dir})
+
+	disk := diskTier()
+	if err := disk.Set(&cacheEntry{
+		data:      []byte("<p>From disk</p>"),
+		meta:      fragmentMeta{statusCode: http.StatusOK},
+		expiresAt: time.Now().Add(time.Minute),
+		url:       "http://example.com/disk",
+	}); err != nil {
+		t.Fatalf("Disk write failed: %v", err)
+	}
+
+	// A fresh cache (e.g. after a restart) finds the persisted entry
+	c := newFragmentCache()
+	data, _, ok := c.Load("http://example.com/disk")
+	if !ok || string(data) != "<p>From disk</p>" {
+		t.Fatalf("Expected disk hit, got %q (ok=%v)", data, ok)
+	}
+
+	if _, _, ok := c.getMemory("http://example.com/disk"); !ok {
+		t.Error("Expected disk hit to be promoted to memory")
+	}
+	if _, err := os.Stat(disk.path("http://example.com/disk")); !os.IsNotExist(err) {
+		t.Error("Expected promoted entry to be removed from disk")
+	}
+}
+
+func TestDiskCacheReceivesEvictions(t *testing.T) {
+	withConfig(t, Config{DiskCacheDir: t.TempDir()})
+
+	c := newFragmentCache()
+	for i := 0; i <= maxCacheEntries(); i++ {
+		c.Put("http://example.com/"+strconv.Itoa(i), []byte("<p>"+strconv.Itoa(i)+"</p>"), okResponse("max-age=300"))
+	}
+
+	if _, _, ok := c.getMemory("http://example.com/0"); ok {
+		t.Fatal("Expected oldest entry to be evicted from memory")
+	}
+
+	if _, ok := diskTier().Get("http://example.com/0"); !ok {
+		t.Fatal("Expected evicted entry to overflow to disk")
+	}
+
+	if data, _, ok := c.Load("http://example.com/0"); !ok || string(data) != "<p>0</p>" {
+		t.Errorf("Expected evicted entry to be served from disk, got %q (ok=%v)", data, ok)
+	}
+}
+
+func TestDiskCacheEnforcesExpiry(t *testing.T) {
+	withConfig(t, Config{DiskCacheDir: t.TempDir()})
+
+	disk := diskTier()
+	if err := disk.Set(&cacheEntry{
+		data:      []byte("<p>Stale</p>"),
+		expiresAt: time.Now().Add(-time.Second),
+		url:       "http://example.com/expired",
+	}); err != nil {
+		t.Fatalf("Disk write failed: %v", err)
+	}
+
+	c := newFragmentCache()
+	if _, _, ok := c.Load("http://example.com/expired"); ok {
+		t.Error("Expected expired disk entry to miss")
+	}
+	if _, err := os.Stat(disk.path("http://example.com/expired")); !os.IsNotExist(err) {
+		t.Error("Expected expired disk entry to be removed")
+	}
+
+	// Expired memory entries aren't spilled to disk
+	c.Put("http://example.com/memory", []byte("<p>Memory</p>"), okResponse("max-age=300"))
+	c.mu.Lock()
+	c.entries["http://example.com/memory"].Value.(*cacheEntry).expiresAt = time.Now().Add(-time.Second)
+	c.mu.Unlock()
+
+	if _, _, ok := c.Load("http://example.com/memory"); ok {
+		t.Error("Expected expired memory entry to miss")
+	}
+
+	disk.spill([]*cacheEntry{{url: "http://example.com/memory", expiresAt: time.Now().Add(-time.Second)}})
+	if _, ok := disk.Get("http://example.com/memory"); ok {
+		t.Error("Expected expired entry not to be written to disk")
+	}
+}
+
+func TestDiskCacheDeletePrefix(t *testing.T) {
+	withConfig(t, Config{DiskCacheDir: t.TempDir()})
+
+	c := newFragmentCache()
+	for i := 0; i <= maxCacheEntries(); i++ {
+		c.Put("http://example.com/"+strconv.Itoa(i), []byte("<p>"+strconv.Itoa(i)+"</p>"), okResponse("max-age=300"))
+	}
+	c.Put("http://other.example/0", []byte("<p>other</p>"), okResponse("max-age=300"))
+
+	// Entry 0 lives on disk after eviction, the rest in memory
+	if removed, _ := c.DeletePrefix("http://example.com/"); removed != maxCacheEntries()+1 {
+		t.Errorf("DeletePrefix removed %d entries, want %d", removed, maxCacheEntries()+1)
+	}
+
+	if _, ok := diskTier().Get("http://example.com/0"); ok {
+		t.Error("Expected matching entry to be removed from disk")
+	}
+	if _, _, ok := c.Load("http://other.example/0"); !ok {
+		t.Error("Expected entry outside the prefix to survive")
+	}
+}
+
+func TestDiskCacheKeepsStaleEntries(t *testing.T) {
+	clock := time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC)
+	withClock(t, &clock)
+	withConfig(t, Config{DiskCacheDir: t.TempDir()})
+
+	// Spilled while fresh, expired but within its stale window once looked up
+	disk := diskTier()
+	disk.spill([]*cacheEntry{{
+		data:       []byte("<p>Stale</p>"),
+		meta:       fragmentMeta{statusCode: http.StatusOK},
+		expiresAt:  clock.Add(time.Minute),
+		staleUntil: clock.Add(2 * time.Minute),
+		url:        "http://example.com/stale",
+	}})
+	clock = clock.Add(90 * time.Second)
+
+	c := newFragmentCache()
+	if _, _, ok := c.Load("http://example.com/stale"); ok {
+		t.Error("Expected the expired disk entry not to be served as fresh")
+	}
+
+	refresh := func() ([]byte, *http.Response, error) {
+		return []byte("<p>Fresh</p>"), okResponse("max-age=60"), nil
+	}
+	data, _, ok := c.GetStale("http://example.com/stale", refresh)
+	if !ok || string(data) != "<p>Stale</p>" {
+		t.Fatalf("Expected the disk entry to be served stale, got %q (ok=%v)", data, ok)
+	}
+	for c.fetching() {
+		time.Sleep(time.Millisecond)
+	}
+
+	// Past the stale window the entry is removed
+	disk.spill([]*cacheEntry{{
+		data:       []byte("<p>Old</p>"),
+		expiresAt:  clock.Add(time.Minute),
+		staleUntil: clock.Add(2 * time.Minute),
+		url:        "http://example.com/old",
+	}})
+	clock = clock.Add(3 * time.Minute)
+	if _, ok := disk.Get("http://example.com/old"); ok {
+		t.Error("Expected the disk entry to miss past its stale window")
+	}
+	if _, err := os.Stat(disk.path("http://example.com/old")); !os.IsNotExist(err) {
+		t.Error("Expected the disk entry to be removed past its stale window")
+	}
+}
+
+func TestDiskCacheEvictsBeyondMaxBytes(t *testing.T) {
+	clock := time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC)
+	withClock(t, &clock)
+	dir := t.TempDir()
+
+	entry := func(i int) *cacheEntry {
+		return &cacheEntry{
+			data:      bytes.Repeat([]byte{byte('a' + i)}, 100),
+			expiresAt: clock.Add(time.Hour),
+			url:       "http://example.com/" + strconv.Itoa(i),
+		}
+	}
+
+	// Room for two files
+	withConfig(t, Config{DiskCacheDir: dir})
+	diskTier().spill([]*cacheEntry{entry(0)})
+	info, err := os.Stat(diskTier().path(entry(0).url))
+	if err != nil {
+		t.Fatalf("Disk write failed: %v", err)
+	}
+	withConfig(t, Config{DiskCacheDir: dir, MaxDiskCacheBytes: 2*info.Size() + info.Size()/2})
+
+	disk := diskTier()
+	for i := 1; i < 5; i++ {
+		clock = clock.Add(time.Second)
+		disk.spill([]*cacheEntry{entry(i)})
+	}
+
+	for i := 0; i < 5; i++ {
+		_, ok := disk.Get(entry(i).url)
+		if want := i >= 3; ok != want {
+			t.Errorf("entry %d on disk = %v, want %v", i, ok, want)
+		}
+	}
+
+	// A fragment larger than the whole tier isn't written
+	large := &cacheEntry{data: bytes.Repeat([]byte("z"), 1000), expiresAt: clock.Add(time.Hour), url: "http://example.com/large"}
+	disk.spill([]*cacheEntry{large})
+	if _, ok := disk.Get(large.url); ok {
+		t.Error("Expected a fragment larger than the tier not to be written")
+	}
+
+	// Without a dedicated cap, the memory cap applies
+	withConfig(t, Config{DiskCacheDir: dir, MaxCacheBytes: 1000})
+	if got := diskTier().maxBytes; got != 1000 {
+		t.Errorf("Expected the disk tier to fall back to MaxCacheBytes, got %d", got)
+	}
+}
@@ -0,0 +1,155 @@
+package esi
+
+import (
+	"bytes"
+	"encoding/gob"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// CacheStore keeps fragments in place of the built-in in-memory LRU, e.g. in Redis or memcached
+// so that several instances share their cache. Values are opaque, stores must be safe for
+// concurrent use and may drop an entry any time after its ttl has elapsed. Fetches of a missing
+// fragment are still de-duplicated within each instance. The in-memory LRU is a CacheStore too.
+type CacheStore interface {
+	Get(key string) ([]byte, bool)
+	Set(key string, data []byte, ttl time.Duration)
+	Delete(key string)
+	Stats() (entries int, size int64)
+}
+
+// CacheStoreLister is implemented by a CacheStore that can list its keys, e.g. with Redis SCAN.
+// PurgePrefix and CacheEntries need it to reach the store.
+type CacheStoreLister interface {
+	// Keys returns the keys starting with prefix, in any order
+	Keys(prefix string) []string
+}
+
+// listShared returns the keys of the store starting with prefix
+func listShared(store CacheStore, prefix string) ([]string, error) {
+	lister, ok := store.(CacheStoreLister)
+	if !ok {
+		return nil, ErrCacheStoreNotListable
+	}
+
+	return lister.Keys(prefix), nil
+}
+
+// sharedStore returns the configured CacheStore, or nil to use the in-memory LRU
+func sharedStore() CacheStore {
+	return config().CacheStore
+}
+
+// backend returns the store fragments are kept in, the configured CacheStore or the cache itself
+func (c *fragmentCache) backend() CacheStore {
+	if store := sharedStore(); store != nil {
+		return store
+	}
+
+	return c
+}
+
+// encodeEntry returns the opaque value a CacheStore keeps for the entry
+func encodeEntry(entry *cacheEntry) ([]byte, error) {
+	var value bytes.Buffer
+	if err := gob.NewEncoder(&value).Encode(newDiskEntry(entry)); err != nil {
+		return nil, err
+	}
+
+	return value.Bytes(), nil
+}
+
+// decodeEntry returns the entry encoded in a CacheStore value kept for url
+func decodeEntry(url string, value []byte) (*cacheEntry, bool) {
+	var stored diskEntry
+	if err := gob.NewDecoder(bytes.NewReader(value)).Decode(&stored); err != nil || stored.URL != url {
+		if logger != nil {
+			logger.Warn("Cache store returned an undecodable entry", zap.String("url", url), zap.Error(err))
+		}
+		return nil, false
+	}
+
+	return stored.entry(), true
+}
+
+// getShared decodes the entry kept in the store for url, including an expired one
+func getShared(store CacheStore, url string) (*cacheEntry, bool) {
+	value, ok := store.Get(url)
+	if !ok {
+		return nil, false
+	}
+
+	return decodeEntry(url, value)
+}
+
+// setShared encodes the entry into the store, kept until it can no longer be served stale
+func setShared(store CacheStore, entry *cacheEntry) {
+	value, err := encodeEntry(entry)
+	if err != nil {
+		if logger != nil {
+			logger.Warn("Cache store entry encoding failed", zap.String("url", entry.url), zap.Error(err))
+		}
+		return
+	}
+
+	until := entry.expiresAt
+	if entry.staleUntil.After(until) {
+		until = entry.staleUntil
+	}
+
+	store.Set(entry.url, value, until.Sub(now()))
+}
+
+// Get implements CacheStore, returning the encoded in-memory entry for key, expired or not
+func (c *fragmentCache) Get(key string) ([]byte, bool) {
+	c.mu.RLock()
+	elem, ok := c.entries[key]
+	var entry cacheEntry
+	if ok {
+		entry = *elem.Value.(*cacheEntry)
+	}
+	c.mu.RUnlock()
+
+	if !ok {
+		return nil, false
+	}
+
+	value, err := encodeEntry(&entry)
+	if err != nil {
+		if logger != nil {
+			logger.Warn("Cache store entry encoding failed", zap.String("url", key), zap.Error(err))
+		}
+		return nil, false
+	}
+
+	return value, true
+}
+
+// Set implements CacheStore, keeping the encoded entry in memory. The entry carries its own expiry,
+// which ttl was derived from, and overflows to the disk tier like any other.
+func (c *fragmentCache) Set(key string, data []byte, ttl time.Duration) {
+	entry, ok := decodeEntry(key, data)
+	if !ok {
+		return
+	}
+
+	c.mu.Lock()
+	evicted := c.insertLocked(entry)
+	c.mu.Unlock()
+
+	if disk := diskTier(); disk != nil {
+		disk.spill(evicted)
+	}
+}
+
+// Delete implements CacheStore, removing the entry for key from both cache tiers
+func (c *fragmentCache) Delete(key string) {
+	c.removeLocal(key)
+}
+
+// Interface guards
+var (
+	_ CacheStore       = (*fragmentCache)(nil)
+	_ CacheStoreLister = (*fragmentCache)(nil)
+)
@@ -0,0 +1,246 @@
+package esi
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// mapStore is a CacheStore recording the calls it receives
+type mapStore struct {
+	mu      sync.Mutex
+	values  map[string][]byte
+	ttls    map[string]time.Duration
+	gets    int
+	deletes int
+}
+
+func newMapStore() *mapStore {
+	return &mapStore{values: map[string][]byte{}, ttls: map[string]time.Duration{}}
+}
+
+func (s *mapStore) Get(key string) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.gets++
+	value, ok := s.values[key]
+
+	return value, ok
+}
+
+func (s *mapStore) Set(key string, data []byte, ttl time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.values[key] = data
+	s.ttls[key] = ttl
+}
+
+func (s *mapStore) Delete(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.deletes++
+	delete(s.values, key)
+}
+
+func (s *mapStore) Stats() (int, int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.values), 42
+}
+
+// listingStore is a mapStore that can list its keys
+type listingStore struct {
+	*mapStore
+}
+
+func (s listingStore) Keys(prefix string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var keys []string
+	for key := range s.values {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+
+	return keys
+}
+
+func TestCacheStoreDelegation(t *testing.T) {
+	clock := time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC)
+	withClock(t, &clock)
+	store := newMapStore()
+	withConfig(t, Config{CacheStore: store})
+	cache.Reset()
+
+	requests := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.URL.Path == "/private" {
+			w.Header().Set("Cache-Control", "no-store")
+		} else {
+			w.Header().Set("Cache-Control", "max-age=600")
+			w.Header().Set("Last-Modified", "Mon, 01 Jan 2024 00:00:00 GMT")
+		}
+		w.Write([]byte("<p>" + r.URL.Path + "</p>"))
+	}))
+	defer ts.Close()
+
+	html := `<esi:include src="` + ts.URL + `/fragment"/>`
+	for range 2 {
+		req := httptest.NewRequest("GET", "http://example.com", nil)
+		if result := string(Parse([]byte(html), req)); result != "<p>/fragment</p>" {
+			t.Fatalf("Expected the fragment, got %q", result)
+		}
+	}
+
+	if requests != 1 {
+		t.Errorf("Expected the second parse to be served by the store, got %d requests", requests)
+	}
+	if store.gets == 0 {
+		t.Error("Expected lookups to be delegated to the store")
+	}
+	if ttl := store.ttls[ts.URL+"/fragment"]; ttl != 600*time.Second {
+		t.Errorf("Expected the store to keep the fragment for 600s, got %s", ttl)
+	}
+	if entries, size := CacheStats(); entries != 1 || size != 42 {
+		t.Errorf("Expected stats from the store, got %d entries of %d bytes", entries, size)
+	}
+
+	// The in-memory LRU is bypassed
+	cache.mu.RLock()
+	memoryEntries := len(cache.entries)
+	cache.mu.RUnlock()
+	if memoryEntries != 0 {
+		t.Errorf("Expected no in-memory entries, got %d", memoryEntries)
+	}
+
+	// Metadata survives the round trip through the store
+	_, meta, ok := cache.Load(ts.URL + "/fragment")
+	if !ok || meta.lastModified.IsZero() || meta.digest == [32]byte{} {
+		t.Errorf("Expected the fragment metadata to be kept, got %+v", meta)
+	}
+
+	// Expired entries are refetched
+	clock = clock.Add(601 * time.Second)
+	Parse([]byte(html), httptest.NewRequest("GET", "http://example.com", nil))
+	if requests != 2 {
+		t.Errorf("Expected the expired fragment to be refetched, got %d requests", requests)
+	}
+
+	Parse([]byte(`<esi:include src="`+ts.URL+`/private"/>`), httptest.NewRequest("GET", "http://example.com", nil))
+	if store.deletes != 1 {
+		t.Errorf("Expected a no-store response to delete the stored entry, got %d deletes", store.deletes)
+	}
+}
+
+func TestCacheStoreSharedBetweenInstances(t *testing.T) {
+	withConfig(t, Config{CacheStore: newMapStore()})
+
+	fetches := 0
+	fetch := func() ([]byte, *http.Response, error) {
+		fetches++
+		return []byte("content"), okResponse("max-age=300"), nil
+	}
+
+	// Two caches stand for two instances sharing the store
+	first, second := newFragmentCache(), newFragmentCache()
+	first.GetOrFetch("http://example.com/fragment", fetch)
+
+	data, _, err := second.GetOrFetch("http://example.com/fragment", fetch)
+	if err != nil || string(data) != "content" {
+		t.Fatalf("Expected the shared fragment, got %q, %v", data, err)
+	}
+	if fetches != 1 {
+		t.Errorf("Expected the second instance to reuse the stored fragment, got %d fetches", fetches)
+	}
+}
+
+// Test PurgePrefix and CacheEntries reach a CacheStore that can list its keys, and fail on one that can't
+func TestCacheStorePurgePrefix(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=600")
+		w.Write([]byte("<p>" + r.URL.Path + "</p>"))
+	}))
+	defer ts.Close()
+
+	html := `<esi:include src="` + ts.URL + `/news/1"/><esi:include src="` + ts.URL + `/news/2"/><esi:include src="` + ts.URL + `/header"/>`
+
+	store := listingStore{newMapStore()}
+	withConfig(t, Config{CacheStore: store})
+	cache.Reset()
+	Parse([]byte(html), httptest.NewRequest("GET", "http://example.com", nil))
+
+	expected := []string{ts.URL + "/header", ts.URL + "/news/1", ts.URL + "/news/2"}
+	if keys, err := CacheEntries(); err != nil || !slices.Equal(keys, expected) {
+		t.Errorf("Expected the stored URLs %v, got %v (err: %v)", expected, keys, err)
+	}
+	if removed, err := PurgePrefix(ts.URL + "/news/"); err != nil || removed != 2 {
+		t.Errorf("Expected 2 fragments purged from the store, removed %d (err: %v)", removed, err)
+	}
+	if entries, _ := store.Stats(); entries != 1 {
+		t.Errorf("Expected only the unrelated fragment left in the store, got %d entries", entries)
+	}
+
+	withConfig(t, Config{CacheStore: newMapStore()})
+	if _, err := PurgePrefix(ts.URL + "/news/"); !errors.Is(err, ErrCacheStoreNotListable) {
+		t.Errorf("Expected PurgePrefix to fail on a store that can't list its keys, got %v", err)
+	}
+	if _, err := CacheEntries(); !errors.Is(err, ErrCacheStoreNotListable) {
+		t.Errorf("Expected CacheEntries to fail on a store that can't list its keys, got %v", err)
+	}
+}
+
+// Test the in-memory cache can stand in for a CacheStore, e.g. one instance's LRU shared with another
+func TestCacheStoreInMemory(t *testing.T) {
+	clock := time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC)
+	withClock(t, &clock)
+
+	store := newFragmentCache()
+	withConfig(t, Config{CacheStore: store})
+
+	fetches := 0
+	fetch := func() ([]byte, *http.Response, error) {
+		fetches++
+		return []byte("content"), okResponse("max-age=300"), nil
+	}
+
+	first, second := newFragmentCache(), newFragmentCache()
+	first.GetOrFetch("http://example.com/news/1", fetch)
+	first.GetOrFetch("http://example.com/news/2", fetch)
+	first.GetOrFetch("http://example.com/header", fetch)
+
+	data, meta, err := second.GetOrFetch("http://example.com/news/1", fetch)
+	if err != nil || string(data) != "content" || meta.statusCode != http.StatusOK {
+		t.Fatalf("Expected the stored fragment, got %q (status %d, err: %v)", data, meta.statusCode, err)
+	}
+	if fetches != 3 {
+		t.Errorf("Expected the fragment to be served from the store, got %d fetches", fetches)
+	}
+	if entries, _ := store.Stats(); entries != 3 {
+		t.Errorf("Expected the store to hold 3 entries, got %d", entries)
+	}
+
+	if removed, err := second.DeletePrefix("http://example.com/news/"); err != nil || removed != 2 {
+		t.Errorf("Expected 2 fragments purged from the store, removed %d (err: %v)", removed, err)
+	}
+	if keys := store.Keys(""); !slices.Equal(keys, []string{"http://example.com/header"}) {
+		t.Errorf("Expected only the unrelated fragment left in the store, got %v", keys)
+	}
+
+	// Values that aren't cache entries are dropped
+	store.Set("http://example.com/raw", []byte("raw"), time.Minute)
+	if _, ok := store.Get("http://example.com/raw"); ok {
+		t.Error("Expected an undecodable value not to be stored")
+	}
+}
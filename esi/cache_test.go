@@ -1,10 +1,20 @@
 package esi
 
 import (
+	"bytes"
 	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"maps"
 	"net/http"
 	"net/http/httptest"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -119,9 +129,16 @@ func TestParseTTL(t *testing.T) {
 		{"max-age with other directives", "public, max-age=7200, must-revalidate", 7200},
 		{"no cache-control", "", defaultTTL},
 		{"no-cache directive", "no-cache", defaultTTL}, // Changed: now always caches
-		{"no-store directive", "no-store", defaultTTL}, // Changed: now always caches
+		{"no-store directive", "no-store", 0},
+		{"no-store with max-age", "max-age=3600, no-store", 0},
 		{"invalid max-age", "max-age=invalid", defaultTTL},
 		{"zero max-age", "max-age=0", defaultTTL}, // Changed: now always caches
+		{"s-maxage over max-age", "max-age=60, s-maxage=600", 600},
+		{"s-maxage only", "s-maxage=120", 120},
+		{"invalid s-maxage falls back to max-age", "s-maxage=invalid, max-age=60", 60},
+		{"private directive", "private, max-age=3600", 0},
+		{"private with field names", `private="Set-Cookie", s-maxage=3600`, 0},
+		{"public with max-age", "public, max-age=3600", 3600},
 	}
 
 	for _, tt := range tests {
@@ -142,9 +159,96 @@ func TestParseTTL(t *testing.T) {
 	}
 }
 
+func TestParseTTLExpires(t *testing.T) {
+	date := time.Date(2024, time.January, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name         string
+		cacheControl string
+		expires      string
+		date         string
+		expectedTTL  int
+	}{
+		{"future Expires", "", date.Add(10 * time.Minute).Format(http.TimeFormat), date.Format(http.TimeFormat), 600},
+		{"past Expires", "", date.Add(-time.Minute).Format(http.TimeFormat), date.Format(http.TimeFormat), 0},
+		{"invalid Expires", "", "0", date.Format(http.TimeFormat), 0},
+		{"Expires relative to now without Date", "", date.Add(time.Hour).Format(http.TimeFormat), "", 3600},
+		{"Expires alongside other directives", "public", date.Add(time.Minute).Format(http.TimeFormat), date.Format(http.TimeFormat), 60},
+		{"max-age wins over Expires", "max-age=120", date.Add(-time.Minute).Format(http.TimeFormat), date.Format(http.TimeFormat), 120},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := date
+			withClock(t, &clock)
+
+			resp := &http.Response{Header: http.Header{}}
+			if tt.cacheControl != "" {
+				resp.Header.Set("Cache-Control", tt.cacheControl)
+			}
+			resp.Header.Set("Expires", tt.expires)
+			if tt.date != "" {
+				resp.Header.Set("Date", tt.date)
+			}
+
+			if ttl := parseTTL(resp); ttl != tt.expectedTTL {
+				t.Errorf("Expected TTL %d, got %d for Expires: %s", tt.expectedTTL, ttl, tt.expires)
+			}
+		})
+	}
+}
+
+func TestParseTTLAge(t *testing.T) {
+	date := time.Date(2024, time.January, 1, 12, 0, 0, 0, time.UTC)
+	inTenMinutes := date.Add(10 * time.Minute).Format(http.TimeFormat)
+
+	tests := []struct {
+		name         string
+		cacheControl string
+		expires      string
+		age          string
+		expectedTTL  int
+	}{
+		{"max-age discounted by Age", "max-age=600", "", "100", 500},
+		{"max-age used up by Age", "max-age=60", "", "120", 1},
+		{"Expires only discounted by Age", "", inTenMinutes, "100", 500},
+		{"Expires used up by Age", "", inTenMinutes, "900", 0},
+		{"invalid Age ignored", "max-age=600", "", "soon", 600},
+		{"negative Age ignored", "max-age=600", "", "-5", 600},
+		{"max-age wins over Expires with Age", "max-age=300", inTenMinutes, "100", 200},
+		{"no-store wins over Expires", "no-store", inTenMinutes, "", 0},
+		{"no-store wins over max-age and Age", "max-age=600, no-store", "", "100", 0},
+		{"Age alone keeps default TTL", "", "", "100", defaultTTL},
+		{"no-cache with Age keeps default TTL", "no-cache", "", "100", defaultTTL},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := date
+			withClock(t, &clock)
+
+			resp := &http.Response{Header: http.Header{}}
+			resp.Header.Set("Date", date.Format(http.TimeFormat))
+			if tt.cacheControl != "" {
+				resp.Header.Set("Cache-Control", tt.cacheControl)
+			}
+			if tt.expires != "" {
+				resp.Header.Set("Expires", tt.expires)
+			}
+			if tt.age != "" {
+				resp.Header.Set("Age", tt.age)
+			}
+
+			if ttl := parseTTL(resp); ttl != tt.expectedTTL {
+				t.Errorf("Expected TTL %d, got %d", tt.expectedTTL, ttl)
+			}
+		})
+	}
+}
+
 func TestCacheLRUEviction(t *testing.T) {
-	// Create more servers than maxCacheEntries to test eviction
-	servers := make([]*httptest.Server, maxCacheEntries+5)
+	// Create more servers than the cache holds to test eviction
+	servers := make([]*httptest.Server, maxCacheEntries()+5)
 	for i := range servers {
 		i := i
 		servers[i] = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -165,8 +269,8 @@ func TestCacheLRUEviction(t *testing.T) {
 
 	// Check cache stats
 	entries, _ := cache.Stats()
-	if entries > maxCacheEntries {
-		t.Errorf("Cache exceeded max entries: got %d, max %d", entries, maxCacheEntries)
+	if entries > maxCacheEntries() {
+		t.Errorf("Cache exceeded max entries: got %d, max %d", entries, maxCacheEntries())
 	}
 }
 
@@ -254,3 +358,979 @@ func TestCacheStampedePrevention(t *testing.T) {
 		}
 	}
 }
+
+// withConfig replaces the global configuration for the duration of a test
+func withConfig(t *testing.T, cfg Config) {
+	t.Helper()
+
+	old, oldClient := globalConfig.Load(), httpClient.Load()
+	globalConfig.Store(&cfg)
+	httpClient.Store(createHTTPClient())
+	t.Cleanup(func() {
+		globalConfig.Store(old)
+		httpClient.Store(oldClient)
+	})
+}
+
+func TestCacheSkipsOversizedFragments(t *testing.T) {
+	cache.Reset()
+	withConfig(t, Config{MaxCacheableFragmentBytes: 64})
+
+	var largeCount, smallCount int
+	large := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		largeCount++
+		w.Header().Set("Cache-Control", "max-age=300")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("<p>" + strings.Repeat("x", 128) + "</p>"))
+	}))
+	defer large.Close()
+
+	small := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		smallCount++
+		w.Header().Set("Cache-Control", "max-age=300")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("<p>small</p>"))
+	}))
+	defer small.Close()
+
+	req := httptest.NewRequest("GET", "http://example.com", nil)
+
+	for i := 0; i < 2; i++ {
+		Parse([]byte(`<esi:include src="`+large.URL+`" /><esi:include src="`+small.URL+`" />`), req)
+	}
+
+	if largeCount != 2 {
+		t.Errorf("Expected oversized fragment to be fetched on every parse, got %d requests", largeCount)
+	}
+	if smallCount != 1 {
+		t.Errorf("Expected small fragment to be cached, got %d requests", smallCount)
+	}
+}
+
+func TestCacheNoStorePurgesExistingEntry(t *testing.T) {
+	cache.Reset()
+
+	requestCount := 0
+	noStore := false
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestCount++
+		if noStore {
+			w.Header().Set("Cache-Control", "no-store")
+		} else {
+			w.Header().Set("Cache-Control", "max-age=300")
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("<p>Fragment content</p>"))
+	}))
+	defer ts.Close()
+
+	req := httptest.NewRequest("GET", "http://example.com", nil)
+	Parse([]byte(`<esi:include src="`+ts.URL+`" />`), req)
+
+	if _, _, ok := cache.Load(ts.URL); !ok {
+		t.Fatal("Expected fragment to be cached")
+	}
+
+	// Backend switches to no-store; the cached entry is expired so the next parse refetches
+	cache.mu.Lock()
+	cache.entries[ts.URL].Value.(*cacheEntry).expiresAt = time.Now().Add(-time.Second)
+	cache.mu.Unlock()
+	noStore = true
+
+	Parse([]byte(`<esi:include src="`+ts.URL+`" />`), req)
+
+	cache.mu.RLock()
+	_, present := cache.entries[ts.URL]
+	cache.mu.RUnlock()
+	if present {
+		t.Error("Expected the previously cached entry to be purged after a no-store response")
+	}
+
+	Parse([]byte(`<esi:include src="`+ts.URL+`" />`), req)
+	if requestCount != 3 {
+		t.Errorf("Expected no-store fragment to be refetched on every parse, got %d requests", requestCount)
+	}
+}
+
+func TestCacheNoStorePurgesEntryWhenOversized(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  Config
+	}{
+		{"max cacheable fragment bytes", Config{MaxCacheableFragmentBytes: 64}},
+		{"max cache bytes", Config{MaxCacheBytes: 64}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withConfig(t, tt.cfg)
+			c := newFragmentCache()
+
+			c.Put("http://example.com/fragment", []byte("<p>small</p>"), okResponse("max-age=300"))
+			if _, _, ok := c.Load("http://example.com/fragment"); !ok {
+				t.Fatal("Expected the small fragment to be cached")
+			}
+
+			// Too large to be cached, the no-store response must still drop the cached version
+			c.Put("http://example.com/fragment", bytes.Repeat([]byte("a"), 100), okResponse("no-store"))
+			if _, _, ok := c.Load("http://example.com/fragment"); ok {
+				t.Error("Expected the previously cached entry to be purged after an oversized no-store response")
+			}
+		})
+	}
+}
+
+func TestCacheSharesIdenticalContent(t *testing.T) {
+	c := newFragmentCache()
+
+	c.Put("http://a.example.com/banner", []byte("<p>Same banner</p>"), okResponse("max-age=300"))
+	c.Put("http://b.example.com/banner", []byte("<p>Same banner</p>"), okResponse("max-age=300"))
+	c.Put("http://c.example.com/other", []byte("<p>Other</p>"), okResponse("max-age=300"))
+
+	a, _, _ := c.Load("http://a.example.com/banner")
+	b, _, _ := c.Load("http://b.example.com/banner")
+	if &a[0] != &b[0] {
+		t.Error("Expected identical fragments to share one backing store entry")
+	}
+
+	entries, size := c.Stats()
+	if entries != 3 || size != int64(len("<p>Same banner</p>")+len("<p>Other</p>")) {
+		t.Errorf("Expected 3 entries counting shared content once, got %d entries, %d bytes", entries, size)
+	}
+
+	// The shared content survives until its last reference is gone
+	c.Delete("http://a.example.com/banner")
+	if data, _, ok := c.Load("http://b.example.com/banner"); !ok || string(data) != "<p>Same banner</p>" {
+		t.Errorf("Expected remaining reference to keep the content, got %q", data)
+	}
+
+	c.Delete("http://b.example.com/banner")
+	if len(c.blobs) != 1 {
+		t.Errorf("Expected unused content to be released, %d blobs left", len(c.blobs))
+	}
+}
+
+func TestCacheRevalidateRecomputesTTL(t *testing.T) {
+	withConfig(t, Config{})
+
+	expiresIn := func(c *fragmentCache, url string) time.Duration {
+		c.mu.RLock()
+		defer c.mu.RUnlock()
+		return time.Until(c.entries[url].Value.(*cacheEntry).expiresAt)
+	}
+
+	notModified := func(cacheControl, age string) *http.Response {
+		resp := &http.Response{StatusCode: http.StatusNotModified, Header: http.Header{}}
+		resp.Header.Set("Cache-Control", cacheControl)
+		if age != "" {
+			resp.Header.Set("Age", age)
+		}
+		return resp
+	}
+
+	c := newFragmentCache()
+	c.Put("http://example.com/fragment", []byte("<p>Fragment</p>"), okResponse("max-age=60"))
+
+	if ttl := expiresIn(c, "http://example.com/fragment"); ttl > 60*time.Second {
+		t.Fatalf("Expected original entry to live 60s, got %v", ttl)
+	}
+
+	if !c.Revalidate("http://example.com/fragment", notModified("max-age=300", "")) {
+		t.Fatal("Expected cached entry to be revalidated")
+	}
+	if ttl := expiresIn(c, "http://example.com/fragment"); ttl < 299*time.Second || ttl > 300*time.Second {
+		t.Errorf("Expected refreshed entry to live 300s, got %v", ttl)
+	}
+	if data, _, ok := c.Load("http://example.com/fragment"); !ok || string(data) != "<p>Fragment</p>" {
+		t.Errorf("Expected cached body to be kept, got %q", data)
+	}
+
+	// Age reported by an intermediate cache shortens the new lifetime
+	c.Revalidate("http://example.com/fragment", notModified("max-age=300", "100"))
+	if ttl := expiresIn(c, "http://example.com/fragment"); ttl < 199*time.Second || ttl > 200*time.Second {
+		t.Errorf("Expected refreshed entry to live 200s, got %v", ttl)
+	}
+
+	if c.Revalidate("http://example.com/missing", notModified("max-age=300", "")) {
+		t.Error("Expected revalidation of a missing entry to report false")
+	}
+}
+
+func TestCacheHitRatio(t *testing.T) {
+	c := newFragmentCache()
+
+	if ratio := c.hitRatio(); ratio != 0 {
+		t.Errorf("Expected ratio 0 before any lookup, got %v", ratio)
+	}
+
+	fetch := func() ([]byte, *http.Response, error) {
+		return []byte("<p>Fragment</p>"), okResponse("max-age=300"), nil
+	}
+
+	// One miss per URL, then hits
+	c.GetOrFetch("http://example.com/a", fetch)
+	c.GetOrFetch("http://example.com/b", fetch)
+	for range 6 {
+		c.GetOrFetch("http://example.com/a", fetch)
+	}
+
+	if ratio := c.hitRatio(); ratio != 0.75 {
+		t.Errorf("Expected ratio 0.75 after 6 hits and 2 misses, got %v", ratio)
+	}
+
+	// A failure and its negative-cache hit serve nothing, so both are misses
+	withConfig(t, Config{NegativeTTL: time.Minute})
+	fail := func() ([]byte, *http.Response, error) {
+		return nil, nil, errors.New("connection refused")
+	}
+	c.GetOrFetch("http://example.com/down", fail)
+	if _, _, err := c.GetOrFetch("http://example.com/down", fail); err == nil {
+		t.Fatal("Expected the failure served from the negative cache")
+	}
+
+	if ratio := c.hitRatio(); ratio != 0.6 {
+		t.Errorf("Expected ratio 0.6 after 6 hits and 4 misses, got %v", ratio)
+	}
+
+	c.Reset()
+	if ratio := c.hitRatio(); ratio != 0 {
+		t.Errorf("Expected ratio 0 after Reset, got %v", ratio)
+	}
+}
+
+func TestCacheIntrospection(t *testing.T) {
+	dir := t.TempDir()
+	withConfig(t, Config{DiskCacheDir: dir})
+	cache.Reset()
+
+	fetch := func() ([]byte, *http.Response, error) {
+		return []byte("<p>Fragment</p>"), okResponse("max-age=300"), nil
+	}
+
+	urls := []string{"http://example.com/c", "http://example.com/a", "http://example.com/b"}
+	for _, url := range urls {
+		cache.GetOrFetch(url, fetch)
+	}
+	diskTier().spill([]*cacheEntry{{data: []byte("<p>Spilled</p>"), expiresAt: now().Add(time.Minute), url: "http://example.com/d"}})
+
+	if entries, size := CacheStats(); entries != 3 || size != int64(len("<p>Fragment</p>")) {
+		t.Errorf("Expected 3 entries sharing one body, got %d entries of %d bytes", entries, size)
+	}
+
+	expected := []string{"http://example.com/a", "http://example.com/b", "http://example.com/c"}
+	if keys, _ := CacheEntries(); !slices.Equal(keys, expected) {
+		t.Errorf("Expected the cached URLs %v, got %v", expected, keys)
+	}
+
+	ResetCache()
+
+	if entries, size := CacheStats(); entries != 0 || size != 0 {
+		t.Errorf("Expected an empty cache after ResetCache, got %d entries of %d bytes", entries, size)
+	}
+	if keys, _ := CacheEntries(); len(keys) != 0 {
+		t.Errorf("Expected no cached URLs after ResetCache, got %v", keys)
+	}
+	if files, _ := filepath.Glob(filepath.Join(dir, "*.frag")); len(files) != 0 {
+		t.Errorf("Expected the disk tier emptied by ResetCache, got %d files", len(files))
+	}
+}
+
+func TestCacheNormalizedContentKeepsLastModified(t *testing.T) {
+	clock := time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC)
+	withClock(t, &clock)
+	cache.Reset()
+
+	volatile := regexp.MustCompile(`<!-- generated [^>]* -->`)
+	withConfig(t, Config{
+		MinimumCacheTTL:   60,
+		NormalizeFragment: func(b []byte) []byte { return volatile.ReplaceAll(b, nil) },
+	})
+
+	var fetches int
+	content := "<p>same</p>"
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches++
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Last-Modified", clock.Format(http.TimeFormat))
+		fmt.Fprintf(w, "<!-- generated %d -->%s", fetches, content)
+	}))
+	defer ts.Close()
+
+	html := `<esi:include src="` + ts.URL + `/volatile"/>`
+	fetch := func() (string, Fragment) {
+		result, res := ParseWithResult([]byte(html), httptest.NewRequest("GET", ts.URL, nil))
+		if len(res.Fragments) != 1 {
+			t.Fatalf("Expected one fragment, got %d", len(res.Fragments))
+		}
+		return string(result), res.Fragments[0]
+	}
+
+	_, first := fetch()
+
+	// Only the timestamp comment changed, the fragment is still the original version for validation
+	clock = clock.Add(2 * time.Minute)
+	result, second := fetch()
+	if result != "<!-- generated 2 --><p>same</p>" {
+		t.Errorf("Expected the original content of the new response to be served, got %q", result)
+	}
+	if !second.LastModified.Equal(first.LastModified) || second.Digest != first.Digest {
+		t.Errorf("Expected an unchanged normalized fragment to keep %v / %s, got %v / %s",
+			first.LastModified, first.Digest, second.LastModified, second.Digest)
+	}
+
+	// A real change is still reported as a modification
+	clock = clock.Add(2 * time.Minute)
+	content = "<p>changed</p>"
+	_, third := fetch()
+	if !third.LastModified.After(first.LastModified) || third.Digest == first.Digest {
+		t.Errorf("Expected changed content to get a new Last-Modified and digest, got %v / %s", third.LastModified, third.Digest)
+	}
+}
+
+func TestCacheMinimumTTL(t *testing.T) {
+	clock := time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC)
+	withClock(t, &clock)
+
+	tests := []struct {
+		name         string
+		cacheControl string
+		jitter       int
+		minTTL       time.Duration
+		maxTTL       time.Duration
+	}{
+		{"short max-age is raised to the minimum", "max-age=5", 0, 300 * time.Second, 300 * time.Second},
+		{"longer max-age is kept", "max-age=600", 0, 600 * time.Second, 600 * time.Second},
+		{"jitter is added on top of the minimum", "max-age=5", 30, 300 * time.Second, 330 * time.Second},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withConfig(t, Config{MinimumCacheTTL: 300, CacheTTLJitter: tt.jitter})
+
+			c := newFragmentCache()
+			c.Put("http://example.com/fragment", []byte("content"), okResponse(tt.cacheControl))
+
+			elem, ok := c.entries["http://example.com/fragment"]
+			if !ok {
+				t.Fatal("Expected fragment to be cached")
+			}
+
+			ttl := elem.Value.(*cacheEntry).expiresAt.Sub(clock)
+			if ttl < tt.minTTL || ttl > tt.maxTTL {
+				t.Errorf("Expected TTL between %s and %s, got %s", tt.minTTL, tt.maxTTL, ttl)
+			}
+		})
+	}
+
+	t.Run("no-store is never cached", func(t *testing.T) {
+		withConfig(t, Config{MinimumCacheTTL: 3600})
+
+		c := newFragmentCache()
+		c.Put("http://example.com/fragment", []byte("content"), okResponse("no-store"))
+
+		if _, _, ok := c.Load("http://example.com/fragment"); ok {
+			t.Error("Expected no-store fragment not to be cached despite the minimum TTL")
+		}
+	})
+}
+
+func TestCacheTTLJitterPercent(t *testing.T) {
+	clock := time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC)
+	withClock(t, &clock)
+
+	tests := []struct {
+		name         string
+		cacheControl string
+		cfg          Config
+		minTTL       time.Duration
+		maxTTL       time.Duration
+	}{
+		{"short TTL gets a short jitter", "max-age=10", Config{MinimumCacheTTL: 1, CacheTTLJitterPercent: 50}, 10 * time.Second, 15 * time.Second},
+		{"long TTL gets a long jitter", "max-age=86400", Config{MinimumCacheTTL: 1, CacheTTLJitterPercent: 10}, 86400 * time.Second, 95040 * time.Second},
+		{"percent takes precedence over seconds", "max-age=100", Config{MinimumCacheTTL: 1, CacheTTLJitter: 3600, CacheTTLJitterPercent: 20}, 100 * time.Second, 120 * time.Second},
+		{"percent is capped at 100", "max-age=100", Config{MinimumCacheTTL: 1, CacheTTLJitterPercent: 500}, 100 * time.Second, 200 * time.Second},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withConfig(t, tt.cfg)
+
+			jittered := false
+			for range 50 {
+				c := newFragmentCache()
+				c.Put("http://example.com/fragment", []byte("content"), okResponse(tt.cacheControl))
+
+				ttl := c.entries["http://example.com/fragment"].Value.(*cacheEntry).expiresAt.Sub(clock)
+				if ttl < tt.minTTL || ttl > tt.maxTTL {
+					t.Fatalf("Expected TTL between %s and %s, got %s", tt.minTTL, tt.maxTTL, ttl)
+				}
+				jittered = jittered || ttl > tt.minTTL
+			}
+
+			if !jittered {
+				t.Errorf("Expected some TTL above %s", tt.minTTL)
+			}
+		})
+	}
+}
+
+// Test fragments can be cached concurrently with jitter enabled, run with -race
+func TestCacheTTLJitterConcurrent(t *testing.T) {
+	cache.Reset()
+	t.Cleanup(cache.Reset)
+
+	for _, cfg := range []Config{{CacheTTLJitter: 30, MaxCacheEntries: 8000}, {CacheTTLJitterPercent: 10, MaxCacheEntries: 8000}} {
+		withConfig(t, cfg)
+
+		// Enough fragments that the goroutines are preempted amid their Puts even on one CPU
+		var wg sync.WaitGroup
+		for i := range 8 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := range 1000 {
+					cache.Put(fmt.Sprintf("http://example.com/fragment/%d/%d", i, j), []byte("content"), okResponse("max-age=300"))
+				}
+			}()
+		}
+		wg.Wait()
+
+		if entries, _ := cache.Stats(); entries != 8000 {
+			t.Errorf("Expected 8000 cached fragments, got %d", entries)
+		}
+	}
+}
+
+// countingObserver counts the MetricsObserver callbacks it receives
+type countingObserver struct {
+	hits, misses, evictions, stampedeWaits atomic.Int64
+}
+
+func (o *countingObserver) OnCacheHit()      { o.hits.Add(1) }
+func (o *countingObserver) OnCacheMiss()     { o.misses.Add(1) }
+func (o *countingObserver) OnCacheEviction() { o.evictions.Add(1) }
+func (o *countingObserver) OnStampedeWait()  { o.stampedeWaits.Add(1) }
+
+func (o *countingObserver) OnFragmentFetch(time.Duration, int, error) {}
+
+func TestCacheNotifiesMetricsObserver(t *testing.T) {
+	withConfig(t, Config{})
+
+	observer := &countingObserver{}
+	SetMetricsObserver(observer)
+	t.Cleanup(func() { SetMetricsObserver(nil) })
+
+	c := newFragmentCache()
+	fetch := func() ([]byte, *http.Response, error) {
+		return []byte("content"), okResponse("max-age=300"), nil
+	}
+
+	c.GetOrFetch("http://example.com/a", fetch)
+	c.GetOrFetch("http://example.com/a", fetch)
+
+	if got := observer.misses.Load(); got != 1 {
+		t.Errorf("Expected 1 miss, got %d", got)
+	}
+	if got := observer.hits.Load(); got != 1 {
+		t.Errorf("Expected 1 hit, got %d", got)
+	}
+
+	// A second caller for a URL being fetched waits for the first one
+	release := make(chan struct{})
+	var wg sync.WaitGroup
+	for range 2 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.GetOrFetch("http://example.com/slow", func() ([]byte, *http.Response, error) {
+				<-release
+				return fetch()
+			})
+		}()
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for observer.stampedeWaits.Load() == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	wg.Wait()
+
+	if got := observer.stampedeWaits.Load(); got != 1 {
+		t.Errorf("Expected 1 stampede wait, got %d", got)
+	}
+
+	for i := range maxCacheEntries() {
+		c.Put(fmt.Sprintf("http://example.com/fill-%d", i), []byte("content"), okResponse("max-age=300"))
+	}
+
+	// The two entries already cached plus the fill overflow the cache by two
+	if got := observer.evictions.Load(); got != 2 {
+		t.Errorf("Expected 2 evictions, got %d", got)
+	}
+}
+
+// Test a waiter of a fetch whose own request was cancelled fetches the fragment itself
+func TestCacheCancelledFetchDoesNotPoisonWaiters(t *testing.T) {
+	withConfig(t, Config{})
+
+	observer := &countingObserver{}
+	SetMetricsObserver(observer)
+	t.Cleanup(func() { SetMetricsObserver(nil) })
+
+	c := newFragmentCache()
+	release := make(chan struct{})
+	leaderDone := make(chan struct{})
+
+	go func() {
+		defer close(leaderDone)
+		c.GetOrFetch("http://example.com/fragment", func() ([]byte, *http.Response, error) {
+			<-release
+			return nil, nil, context.Canceled
+		})
+	}()
+
+	// Wait for the leader to be in flight before joining it
+	for {
+		if _, ok := c.inFlight.Load("http://example.com/fragment"); ok {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	go func() {
+		for observer.stampedeWaits.Load() == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		close(release)
+	}()
+
+	data, _, err := c.GetOrFetch("http://example.com/fragment", func() ([]byte, *http.Response, error) {
+		return []byte("content"), okResponse("max-age=300"), nil
+	})
+	<-leaderDone
+
+	if err != nil || string(data) != "content" {
+		t.Errorf("Expected the waiter to fetch the fragment itself, got %q, %v", data, err)
+	}
+}
+
+func TestParseStaleWhileRevalidate(t *testing.T) {
+	tests := []struct {
+		cacheControl string
+		expected     int
+	}{
+		{"max-age=60, stale-while-revalidate=30", 30},
+		{"stale-while-revalidate=120,max-age=60", 120},
+		{"max-age=60", 0},
+		{"max-age=60, stale-while-revalidate=invalid", 0},
+	}
+
+	for _, tt := range tests {
+		if got := parseStaleWhileRevalidate(okResponse(tt.cacheControl)); got != tt.expected {
+			t.Errorf("%q: expected %d, got %d", tt.cacheControl, tt.expected, got)
+		}
+	}
+}
+
+func TestCacheStaleWhileRevalidate(t *testing.T) {
+	clock := time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC)
+	withClock(t, &clock)
+	withConfig(t, Config{MinimumCacheTTL: 60})
+	cache.Reset()
+
+	var version atomic.Int32
+	version.Store(1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		v := version.Load()
+		if v > 1 {
+			// The refresh is slow, the stale content must not wait for it
+			time.Sleep(200 * time.Millisecond)
+		}
+		w.Header().Set("Cache-Control", "max-age=60, stale-while-revalidate=30")
+		fmt.Fprintf(w, "<p>v%d</p>", v)
+	}))
+	defer ts.Close()
+
+	html := `<esi:include src="` + ts.URL + `/fragment"/>`
+	parse := func() string {
+		return string(Parse([]byte(html), httptest.NewRequest("GET", "http://example.com", nil)))
+	}
+
+	if result := parse(); result != "<p>v1</p>" {
+		t.Fatalf("Expected the first version, got %q", result)
+	}
+
+	// Expired, but within the stale window
+	clock = clock.Add(70 * time.Second)
+	version.Store(2)
+
+	start := time.Now()
+	if result := parse(); result != "<p>v1</p>" {
+		t.Errorf("Expected the stale version to be served, got %q", result)
+	}
+	if elapsed := time.Since(start); elapsed >= 200*time.Millisecond {
+		t.Errorf("Expected the stale version without waiting for the refresh, took %s", elapsed)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if data, _, ok := cache.Load(ts.URL + "/fragment"); ok && string(data) == "<p>v2</p>" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the background refresh to update the cache")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if result := parse(); result != "<p>v2</p>" {
+		t.Errorf("Expected the refreshed version, got %q", result)
+	}
+
+	// Past the stale window the request waits for the fetch
+	clock = clock.Add(100 * time.Second)
+	version.Store(3)
+	if result := parse(); result != "<p>v3</p>" {
+		t.Errorf("Expected a blocking fetch past the stale window, got %q", result)
+	}
+}
+
+func TestCacheByteBasedEviction(t *testing.T) {
+	withConfig(t, Config{MaxCacheBytes: 1000})
+	c := newFragmentCache()
+
+	for i := 0; i < 5; i++ {
+		c.Put(fmt.Sprintf("http://example.com/%d", i), bytes.Repeat([]byte{byte('a' + i)}, 300), okResponse("max-age=300"))
+
+		if _, size := c.Stats(); size > 1000 {
+			t.Fatalf("after put %d: cache holds %d bytes, want at most 1000", i, size)
+		}
+	}
+
+	entries, size := c.Stats()
+	if entries != 3 || size != 900 {
+		t.Errorf("Stats() = (%d, %d), want (3, 900)", entries, size)
+	}
+	for i := 0; i < 5; i++ {
+		_, _, ok := c.Load(fmt.Sprintf("http://example.com/%d", i))
+		if want := i >= 2; ok != want {
+			t.Errorf("fragment %d cached = %v, want %v", i, ok, want)
+		}
+	}
+
+	// A fragment larger than the whole budget is not cached and keeps the others
+	c.Put("http://example.com/huge", bytes.Repeat([]byte("z"), 2000), okResponse("max-age=300"))
+	if _, _, ok := c.Load("http://example.com/huge"); ok {
+		t.Error("fragment larger than MaxCacheBytes was cached")
+	}
+	if entries, _ := c.Stats(); entries != 3 {
+		t.Errorf("entries after oversized put = %d, want 3", entries)
+	}
+}
+
+func TestCachePurge(t *testing.T) {
+	cache.Reset()
+
+	var mu sync.Mutex
+	counts := map[string]int{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		counts[r.URL.Path]++
+		mu.Unlock()
+		w.Header().Set("Cache-Control", "max-age=300")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("<p>" + r.URL.Path + "</p>"))
+	}))
+	defer ts.Close()
+
+	paths := []string{"/header", "/footer", "/news/1", "/news/2"}
+	var html strings.Builder
+	for _, path := range paths {
+		html.WriteString(`<esi:include src="` + ts.URL + path + `" />`)
+	}
+
+	req := httptest.NewRequest("GET", "http://example.com", nil)
+	fetches := func() map[string]int {
+		Parse([]byte(html.String()), req)
+		mu.Lock()
+		defer mu.Unlock()
+		return maps.Clone(counts)
+	}
+
+	fetches()
+
+	PurgeURL(ts.URL + "/header")
+	got := fetches()
+	if got["/header"] != 2 {
+		t.Errorf("purged URL fetched %d times, want 2", got["/header"])
+	}
+	if got["/footer"] != 1 || got["/news/1"] != 1 {
+		t.Errorf("unrelated fragments refetched after PurgeURL: %v", got)
+	}
+
+	if removed, err := PurgePrefix(ts.URL + "/news/"); err != nil || removed != 2 {
+		t.Errorf("PurgePrefix removed %d entries (err: %v), want 2", removed, err)
+	}
+	got = fetches()
+	if got["/news/1"] != 2 || got["/news/2"] != 2 {
+		t.Errorf("fragments under purged prefix not refetched: %v", got)
+	}
+	if got["/header"] != 2 || got["/footer"] != 1 {
+		t.Errorf("unrelated fragments refetched after PurgePrefix: %v", got)
+	}
+}
+
+func TestCacheVariesByResponseVaryHeader(t *testing.T) {
+	cache.Reset()
+
+	var fetches atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		w.Header().Set("Cache-Control", "max-age=300")
+		w.Header().Set("Vary", "accept-language")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("<p>" + r.Header.Get("Accept-Language") + "</p>"))
+	}))
+	defer ts.Close()
+
+	parse := func(language string) string {
+		req := httptest.NewRequest("GET", "http://example.com", nil)
+		req.Header.Set("Accept-Language", language)
+		return string(Parse([]byte(`<esi:include src="`+ts.URL+`" />`), req))
+	}
+
+	if got := parse("fr"); got != "<p>fr</p>" {
+		t.Errorf("first request rendered %q, want <p>fr</p>", got)
+	}
+	if got := parse("en"); got != "<p>en</p>" {
+		t.Errorf("second request rendered %q, want <p>en</p>", got)
+	}
+	if got := fetches.Load(); got != 2 {
+		t.Errorf("expected both languages to miss, got %d fetches", got)
+	}
+
+	if got := parse("fr"); got != "<p>fr</p>" {
+		t.Errorf("third request rendered %q, want <p>fr</p>", got)
+	}
+	if got := fetches.Load(); got != 2 {
+		t.Errorf("expected the matching variant to hit, got %d fetches", got)
+	}
+
+	PurgeURL(ts.URL)
+	parse("en")
+	if got := fetches.Load(); got != 3 {
+		t.Errorf("expected PurgeURL to drop every variant, got %d fetches", got)
+	}
+}
+
+func TestCacheSkipsVaryStar(t *testing.T) {
+	c := newFragmentCache()
+
+	resp := okResponse("max-age=300")
+	resp.Header.Set("Vary", "*")
+	c.Put("http://example.com/star", []byte("<p>Star</p>"), resp)
+
+	if entries, _ := c.Stats(); entries != 0 {
+		t.Errorf("expected a Vary: * response not to be cached, got %d entries", entries)
+	}
+}
+
+func TestCacheNegativeTTL(t *testing.T) {
+	cache.Reset()
+	clock := time.Date(2024, time.January, 1, 12, 0, 0, 0, time.UTC)
+	withClock(t, &clock)
+	withConfig(t, Config{NegativeTTL: 30 * time.Second})
+
+	var failing, alt atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/alt" {
+			alt.Add(1)
+			w.Header().Set("Cache-Control", "max-age=300")
+			w.Write([]byte("<p>Alt</p>"))
+			return
+		}
+		failing.Add(1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer ts.Close()
+
+	req := httptest.NewRequest("GET", "http://example.com", nil)
+	withAlt := []byte(`<esi:include src="` + ts.URL + `/broken" alt="` + ts.URL + `/alt" />`)
+	continued := []byte(`<p>Before</p><esi:include src="` + ts.URL + `/broken" onerror="continue" /><p>After</p>`)
+
+	for range 3 {
+		if got := string(Parse(withAlt, req)); got != "<p>Alt</p>" {
+			t.Errorf("Expected the alt to render for a remembered failure, got %q", got)
+		}
+		if got := string(Parse(continued, req)); got != "<p>Before</p><p>After</p>" {
+			t.Errorf("Expected onerror=continue to remove a remembered failure, got %q", got)
+		}
+	}
+	if got := failing.Load(); got != 1 {
+		t.Errorf("Expected the failing fragment to be fetched once within the negative TTL, got %d", got)
+	}
+	if got := alt.Load(); got != 1 {
+		t.Errorf("Expected the alt to be fetched once and cached, got %d", got)
+	}
+
+	clock = clock.Add(31 * time.Second)
+	Parse(withAlt, req)
+	if got := failing.Load(); got != 2 {
+		t.Errorf("Expected the failing fragment to be retried after the negative TTL, got %d fetches", got)
+	}
+}
+
+func TestCacheNegativeTTLDisabled(t *testing.T) {
+	cache.Reset()
+	withConfig(t, Config{})
+
+	var fetches atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer ts.Close()
+
+	req := httptest.NewRequest("GET", "http://example.com", nil)
+	for range 3 {
+		Parse([]byte(`<esi:include src="`+ts.URL+`" onerror="continue" />`), req)
+	}
+
+	if got := fetches.Load(); got != 3 {
+		t.Errorf("Expected failures not to be cached by default, got %d fetches for 3 parses", got)
+	}
+}
+
+func TestCacheNegativeTTLSkipsOpenCircuit(t *testing.T) {
+	withConfig(t, Config{NegativeTTL: time.Minute})
+	c := newFragmentCache()
+
+	var fetches atomic.Int32
+	open := true
+	fetch := func() ([]byte, *http.Response, error) {
+		fetches.Add(1)
+		if open {
+			return nil, nil, fmt.Errorf("%w: example.com", errCircuitOpen)
+		}
+		return []byte("<p>Fragment</p>"), okResponse("max-age=300"), nil
+	}
+
+	if _, _, err := c.GetOrFetch("http://example.com/fragment", fetch); !errors.Is(err, errCircuitOpen) {
+		t.Fatalf("Expected the open circuit error, got %v", err)
+	}
+
+	// The circuit closing is the breaker's call, the failure isn't remembered past it
+	open = false
+	if data, _, err := c.GetOrFetch("http://example.com/fragment", fetch); err != nil || string(data) != "<p>Fragment</p>" {
+		t.Errorf("Expected the fragment once the circuit closed, got %q (err: %v)", data, err)
+	}
+	if got := fetches.Load(); got != 2 {
+		t.Errorf("Expected the fragment to be fetched again, got %d fetches", got)
+	}
+}
+
+func TestCacheConditionalRevalidation(t *testing.T) {
+	cache.Reset()
+	clock := time.Now()
+	withClock(t, &clock)
+	withConfig(t, Config{})
+
+	var full, notModified atomic.Int32
+	var conditions sync.Map
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conditions.Store(r.URL.Path, r.Header.Get("If-None-Match")+"|"+r.Header.Get("If-Modified-Since"))
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Last-Modified", "Mon, 01 Jan 2024 12:00:00 GMT")
+		if r.URL.Path == "/forged" {
+			w.Header().Set("X-ESI-Assembled", "1")
+		}
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			notModified.Add(1)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		full.Add(1)
+		if r.URL.Path == "/nested" {
+			w.Write([]byte(`<div><esi:include src="` + "http://" + r.Host + `/leaf" /></div>`))
+			return
+		}
+		w.Write([]byte("<p>" + r.URL.Path + "</p>"))
+	}))
+	defer ts.Close()
+
+	req := httptest.NewRequest("GET", "http://example.com", nil)
+	html := []byte(`<esi:include src="` + ts.URL + `/large" />`)
+
+	Parse(html, req)
+
+	clock = clock.Add(2 * time.Minute)
+	if got := string(Parse(html, req)); got != "<p>/large</p>" {
+		t.Errorf("Expected the cached body to be kept on 304, got %q", got)
+	}
+	if full.Load() != 1 || notModified.Load() != 1 {
+		t.Errorf("Expected 1 full fetch and 1 revalidation, got %d and %d", full.Load(), notModified.Load())
+	}
+	if got, _ := conditions.Load("/large"); got != `"v1"|Mon, 01 Jan 2024 12:00:00 GMT` {
+		t.Errorf("Expected If-None-Match and If-Modified-Since from the cached response, got %q", got)
+	}
+
+	expiresAt, ok := cache.expiry(ts.URL + "/large")
+	if !ok || !expiresAt.After(clock.Add(59*time.Second)) {
+		t.Errorf("Expected the revalidated entry to live another 60s, expires at %v (ok=%v)", expiresAt, ok)
+	}
+
+	// A fragment with nested includes is assembled anew, as the nested fragments may have changed
+	nested := []byte(`<esi:include src="` + ts.URL + `/nested" />`)
+	Parse(nested, req)
+	clock = clock.Add(2 * time.Minute)
+	Parse(nested, req)
+	if got, _ := conditions.Load("/nested"); got != "|" {
+		t.Errorf("Expected an assembled fragment to be fetched unconditionally, got %q", got)
+	}
+
+	// Whether a fragment was assembled isn't taken from its response headers
+	forged := []byte(`<esi:include src="` + ts.URL + `/forged" />`)
+	Parse(forged, req)
+	clock = clock.Add(2 * time.Minute)
+	Parse(forged, req)
+	if got, _ := conditions.Load("/forged"); got != `"v1"|Mon, 01 Jan 2024 12:00:00 GMT` {
+		t.Errorf("Expected a fragment claiming to be assembled to be revalidated, got %q", got)
+	}
+}
+
+func TestCacheMaxCacheEntries(t *testing.T) {
+	cache.Reset()
+	withConfig(t, Config{MaxCacheEntries: 5})
+
+	put := func(from, to int) {
+		for i := from; i < to; i++ {
+			cache.Put(fmt.Sprintf("http://example.com/%d", i), []byte("content"), okResponse("max-age=300"))
+		}
+	}
+
+	put(0, 10)
+	if entries, _ := cache.Stats(); entries != 5 {
+		t.Errorf("Expected eviction down to 5 entries, got %d", entries)
+	}
+	if _, _, ok := cache.Load("http://example.com/4"); ok {
+		t.Error("Expected the oldest entries to be evicted")
+	}
+
+	// Raising the limit applies to later puts
+	Configure(Config{MaxCacheEntries: 20})
+	put(10, 25)
+	if entries, _ := cache.Stats(); entries != 20 {
+		t.Errorf("Expected 20 entries after raising the limit, got %d", entries)
+	}
+
+	// Lowering it evicts at once, keeping the most recently used
+	Configure(Config{MaxCacheEntries: 3})
+	if entries, _ := cache.Stats(); entries != 3 {
+		t.Errorf("Expected eviction down to 3 entries after lowering the limit, got %d", entries)
+	}
+	if _, _, ok := cache.Load("http://example.com/24"); !ok {
+		t.Error("Expected the most recent entry to be kept")
+	}
+}
@@ -0,0 +1,90 @@
+package esi
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+func TestChooseTag(t *testing.T) {
+	html := `<esi:choose>` +
+		`<esi:when test="$(HTTP_COOKIE{loggedin}) == 'true'">member</esi:when>` +
+		`<esi:when test="$(HTTP_USER_AGENT) =~ '/^Googlebot/'">crawler</esi:when>` +
+		`<esi:otherwise>guest</esi:otherwise>` +
+		`</esi:choose>`
+
+	tests := []struct {
+		name      string
+		cookie    string
+		userAgent string
+		html      string
+		expected  string
+	}{
+		{"first matching when", "true", "Googlebot/2.1", html, "member"},
+		{"regex match", "", "Googlebot/2.1", html, "crawler"},
+		{"fall through to otherwise", "false", "Mozilla/5.0", html, "guest"},
+		{
+			"unmatched choose without otherwise",
+			"",
+			"Mozilla/5.0",
+			`a<esi:choose><esi:when test="$(HTTP_USER_AGENT) =~ 'bot'">crawler</esi:when></esi:choose>b`,
+			"ab",
+		},
+		{
+			"when branch is parsed",
+			"true",
+			"",
+			`<esi:choose><esi:when test="$(HTTP_COOKIE{loggedin}) != 'false'"><esi:vars>$(HTTP_COOKIE{loggedin})</esi:vars></esi:when></esi:choose>`,
+			"true",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rq := httptest.NewRequest(http.MethodGet, "http://domain.com", nil)
+			rq.Header.Set("User-Agent", tt.userAgent)
+			if tt.cookie != "" {
+				rq.AddCookie(&http.Cookie{Name: "loggedin", Value: tt.cookie})
+			}
+
+			if result := string(Parse([]byte(tt.html), rq)); result != tt.expected {
+				t.Errorf("Expected %q, got %q", tt.expected, result)
+			}
+		})
+	}
+}
+
+// Test only the includes of the selected branch are fetched, so one in a branch that isn't
+// selected can't fail the page
+func TestChooseFetchesSelectedBranchOnly(t *testing.T) {
+	cache.Reset()
+
+	var fetched sync.Map
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetched.Store(r.URL.Path, true)
+		if r.URL.Path == "/broken" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte("<p>" + r.URL.Path + "</p>"))
+	}))
+	defer ts.Close()
+
+	html := `<esi:choose>` +
+		`<esi:when test="$(HTTP_COOKIE{loggedin}) == 'true'"><esi:include src="` + ts.URL + `/broken" onerror="error"/></esi:when>` +
+		`<esi:otherwise><esi:include src="` + ts.URL + `/guest"/></esi:otherwise>` +
+		`</esi:choose>`
+
+	req := httptest.NewRequest("GET", "http://example.com/page", nil)
+	result, res := ParseWithResult([]byte(html), req)
+	if string(result) != "<p>/guest</p>" {
+		t.Errorf("Expected the otherwise branch, got %q", result)
+	}
+	if err := res.Err(); err != nil {
+		t.Errorf("Expected an include of an unselected branch not to fail the page, got %v", err)
+	}
+	if _, ok := fetched.Load("/broken"); ok {
+		t.Error("Expected the include of an unselected branch not to be fetched")
+	}
+}
@@ -7,27 +7,39 @@ import (
 
 const comment = "comment"
 
-var closeComment = regexp.MustCompile("/>((\n| +)+)?")
+var (
+	// The text may be quoted, holding "/>" itself, or unquoted up to a space or the closing "/>"
+	commentRg    = regexp.MustCompile(`^comment(?:\s+text=(?:"[^"]*"|'[^']*'|[^\s"']*?))?\s*/>`)
+	closeComment = regexp.MustCompile("/>")
+)
 
 type commentTag struct {
 	*baseTag
 }
 
 // Input (e.g. comment text="This is a comment." />).
+// The whole tag is removed, the content around it is left untouched.
 func (c *commentTag) Process(b []byte, req *http.Request) ([]byte, int) {
-	found := closeComment.FindIndex(b)
-	if found == nil {
+	end := c.GetClosePosition(b)
+	if end == 0 {
 		return nil, len(b)
 	}
 
-	return []byte{}, found[1]
+	c.length = end
+
+	return []byte{}, c.length
 }
 
-func (*commentTag) HasClose(b []byte) bool {
-	return closeComment.FindIndex(b) != nil
+func (c *commentTag) HasClose(b []byte) bool {
+	return c.GetClosePosition(b) != 0
 }
 
 func (*commentTag) GetClosePosition(b []byte) int {
+	if idx := commentRg.FindIndex(b); idx != nil {
+		return idx[1]
+	}
+
+	// A malformed tag ends at the first "/>"
 	if idx := closeComment.FindIndex(b); idx != nil {
 		return idx[1]
 	}
@@ -0,0 +1,30 @@
+package esi
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCommentTag(t *testing.T) {
+	tests := []struct {
+		html     string
+		expected string
+	}{
+		{`a <esi:comment text="This is a comment."/> b`, "a  b"},
+		{`a <esi:comment text="spaced" /> b`, "a  b"},
+		{`a <esi:comment text='single quoted'/> b`, "a  b"},
+		{`a <esi:comment text=unquoted/> b`, "a  b"},
+		{`a <esi:comment text=unquoted /> b`, "a  b"},
+		{`a <esi:comment text="closes /> inside"/> b`, "a  b"},
+		{"<p>\n\t<esi:comment text=\"x\"/>\n</p>", "<p>\n\t\n</p>"},
+		{`<esi:comment text="one"/><esi:comment text="two"/>end`, "end"},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com", nil)
+		if result := string(Parse([]byte(tt.html), req)); result != tt.expected {
+			t.Errorf("%q: expected %q, got %q", tt.html, tt.expected, result)
+		}
+	}
+}
@@ -1,15 +1,23 @@
 package esi
 
 import (
-	"math/rand"
+	"fmt"
+	"math/rand/v2"
+	"mime"
 	"net/http"
 	"net/url"
+	"slices"
 	"strings"
+	"sync/atomic"
 	"time"
 
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 )
 
+// FragmentTransform rewrites the content of a fragment fetched from url, e.g. to rewrite URLs or minify it
+type FragmentTransform func(url string, content []byte) []byte
+
 // Config holds the configuration for ESI processing
 type Config struct {
 	// MinimumCacheTTL is the minimum TTL in seconds for cached fragments (default: 300)
@@ -20,6 +28,10 @@ type Config struct {
 	// This helps prevent cache stampede by spreading out cache expirations
 	CacheTTLJitter int
 
+	// CacheTTLJitterPercent is the maximum random jitter to add to TTL, as a percentage of it (0-100, default: 0)
+	// It scales with each fragment's TTL, and takes precedence over CacheTTLJitter when both are set
+	CacheTTLJitterPercent int
+
 	// BaseURL is the base URL to use for ESI fragment requests (e.g. "http://localhost:9000")
 	// If set, all relative fragment URLs will be resolved against this URL instead of
 	// the original request URL. This allows fragments to be fetched from an internal
@@ -30,45 +42,301 @@ type Config struct {
 	// Example: {"X-Backend-Server": "internal", "X-Request-Source": "esi"}
 	// These headers are set with the specified values on every fragment request
 	Headers map[string]string
+
+	// MaxAttributeLength is the maximum length of an include src/alt attribute (default: 4096)
+	// Includes with longer values are treated as malformed and never fetched
+	MaxAttributeLength int
+
+	// MaxCacheableFragmentBytes is the maximum size in bytes of a fragment that may be cached (default: 0, unlimited)
+	// Larger fragments are still served but never stored, so one giant fragment
+	// can't evict many small useful ones
+	MaxCacheableFragmentBytes int
+
+	// DebugBoundaries wraps every resolved fragment in <!-- esi:begin src=... --> and <!-- esi:end -->
+	// comments so developers can see which parts of the assembled page came from where (default: false)
+	DebugBoundaries bool
+
+	// DebugPlaceholders replaces failed includes with an <!-- esi:include failed src=... status=... --> comment
+	// instead of removing them, so operators can see what broke in the rendered page (default: false)
+	// Includes with onerror="continue" are still removed silently
+	DebugPlaceholders bool
+
+	// FragmentUnixSocket is the path of a Unix domain socket to dial for all fragment fetches (default: "", use TCP)
+	// Fragment URLs keep their scheme and host for HTTP semantics (Host header, cache keys)
+	FragmentUnixSocket string
+
+	// JanitorInterval is how often expired fragments are swept from the in-memory cache (default: 0, disabled)
+	// Without it expired entries are only dropped when looked up again or evicted by the LRU
+	JanitorInterval time.Duration
+
+	// DiskCacheDir enables a secondary, on-disk cache tier in the given directory (default: "", disabled)
+	// Fragments evicted from the in-memory LRU overflow to disk until they expire, or their stale window
+	// ends, and are promoted back to memory on access. Disk entries keep their TTL across restarts
+	DiskCacheDir string
+
+	// MaxDiskCacheBytes caps the bytes of fragment files kept in DiskCacheDir (default: 0, MaxCacheBytes)
+	// The files spilled longest ago are removed first. Unlimited if neither is set
+	MaxDiskCacheBytes int64
+
+	// WarmUpPeriod is the window after Configure during which concurrent fragment fetches are throttled (default: 0, disabled)
+	// The allowed concurrency starts at 1 and rises linearly to WarmUpConcurrency, protecting
+	// backends from a burst of cold-cache fetches right after a deploy
+	WarmUpPeriod time.Duration
+
+	// WarmUpConcurrency is the fetch concurrency reached at the end of the warm-up period (default: 16)
+	WarmUpConcurrency int
+
+	// ClientCert and ClientKey are PEM files of a client certificate presented to fragment backends
+	// over TLS, for backends requiring mutual TLS (default: "", no client certificate)
+	ClientCert string
+	ClientKey  string
+
+	// CACert is a PEM file of the CA certificates trusted for fragment backends, used instead of
+	// the system roots (default: "", system roots)
+	CACert string
+
+	// BucketCookie and BucketHeader name the cookie, or else the header, identifying a user for
+	// $(BUCKET{experiment}) A/B test bucketing (default: "", the variable is empty)
+	BucketCookie string
+	BucketHeader string
+
+	// BucketCount is the number of buckets $(BUCKET{experiment}) assigns users to, from 0 to BucketCount-1 (default: 100)
+	BucketCount int
+
+	// DefaultOnError is the onerror behavior of includes without an onerror attribute (default: "", continue)
+	// OnErrorContinue removes failed includes, OnErrorAlt fails the page only for includes without
+	// an alt, and OnErrorError fails the page on any failed include (reported by Result.Err)
+	DefaultOnError string
+
+	// FailureRateThreshold is the share of failed fragment fetches (0-1) over FailureWindow above which
+	// GloballyFailing reports a backend-wide outage (default: 0, disabled)
+	FailureRateThreshold float64
+
+	// FailureWindow is the rolling window the fragment failure rate is measured over (default: 30s)
+	FailureWindow time.Duration
+
+	// CircuitBreakerThreshold is how many consecutive failed fetches from a fragment host within
+	// FailureWindow, network errors or 5xx responses, open its circuit (default: 0, disabled). Includes
+	// of the host then fail at once, so alt and onerror apply, until CircuitBreakerCooldown is over
+	CircuitBreakerThreshold int
+
+	// CircuitBreakerCooldown is how long a circuit stays open before a single fetch probes the host (default: 30s)
+	// A failed probe opens it for another cooldown, a successful one closes it
+	CircuitBreakerCooldown time.Duration
+
+	// FetchTimeout bounds each fragment fetch, from sending the request to reading the body (default: 5s)
+	// A fetch timing out fails like any other, so alt and onerror apply. A negative value disables it
+	FetchTimeout time.Duration
+
+	// HostTimeouts overrides FetchTimeout for fragments of the given hosts (default: none)
+	// Keys are matched against the fragment URL host with its port first, then without it
+	// Example: {"analytics.internal": 5 * time.Second, "header.internal:8080": 200 * time.Millisecond}
+	HostTimeouts map[string]time.Duration
+
+	// FragmentRetries is how many times the src of an include is fetched again after a network error
+	// or a 5xx response, before its alt and onerror apply (default: 0, no retries)
+	FragmentRetries int
+
+	// FragmentRetryBackoff is the wait before the first retry, doubled before each further one (default: 100ms)
+	FragmentRetryBackoff time.Duration
+
+	// MaxParallelFetches is the size of the worker pool fetching the includes of one document level (default: 64)
+	// Includes beyond it wait for a free worker, bounding the goroutines a single page can spawn
+	MaxParallelFetches int
+
+	// MaxConcurrentPerHost caps the fragment fetches in flight to one host across all pages (default: 0, unlimited)
+	// Unlike MaxParallelFetches it bounds the pressure on each backend rather than the work of one page
+	MaxConcurrentPerHost int
+
+	// PlaceholderThreshold is how long an include may wait for its fragment before a placeholder is
+	// rendered instead (default: 0, always wait). The fetch carries on in the background and fills
+	// the cache, so later requests get the fragment
+	PlaceholderThreshold time.Duration
+
+	// Placeholder is the markup rendered inside <span class="esi-placeholder" data-esi-src="...">
+	// for includes exceeding PlaceholderThreshold (default: "", an empty span). The data-esi-src
+	// attribute lets client-side code hydrate the placeholder
+	Placeholder string
+
+	// NormalizeFragment strips volatile bytes (timestamps, request ids) from fragment content before it is
+	// compared with the cached version (default: nil, compare as is). Content that is unchanged once
+	// normalized keeps its previous Last-Modified and Fragment.Digest, while the original is still served
+	NormalizeFragment func([]byte) []byte
+
+	// FragmentTransforms are applied in order to every fetched fragment, each receiving the output of the
+	// previous one, after its nested ESI tags are processed and before it is cached (default: none)
+	FragmentTransforms []FragmentTransform
+
+	// AllowedHosts restricts the hosts fragments may be fetched from (default: none, any host)
+	// An entry starting with "*." matches any subdomain, e.g. "*.internal.example.com", any other "*"
+	// is taken literally. Includes of other hosts, and redirects to them, fail without being fetched,
+	// so alt and onerror apply
+	AllowedHosts []string
+
+	// AllowedSchemes restricts the URL schemes fragments may be fetched over (default: none, any scheme)
+	AllowedSchemes []string
+
+	// AllowedFragmentContentTypes restricts the media types of fragment responses (default: none, any type)
+	// A fragment of another type, or without a Content-Type, fails so alt and onerror apply, e.g. a
+	// JSON error body or a full page returned by a misconfigured endpoint
+	AllowedFragmentContentTypes []string
+
+	// MaxFragmentRedirects is the number of redirects a fragment fetch follows (default: 10)
+	// A negative value forbids redirects. A fetch redirected once too often fails so alt and onerror apply
+	MaxFragmentRedirects int
+
+	// SameOriginRedirects only lets fragment fetches be redirected to the scheme and host they were
+	// sent to (default: false). Other redirects fail without being followed, so alt and onerror apply
+	SameOriginRedirects bool
+
+	// MaxCacheEntries caps the number of fragments held in memory (default: 1000)
+	// Least recently used entries are evicted beyond it, lowering it evicts them at once
+	MaxCacheEntries int
+
+	// MaxCacheBytes caps the bytes of fragment content held in memory (default: 0, unlimited)
+	// Least recently used entries are evicted until both it and the entry count limit are met
+	MaxCacheBytes int64
+
+	// NegativeTTL is how long a failed fragment fetch is remembered (default: 0, disabled)
+	// Includes of the fragment fail at once for that long instead of fetching it again, with
+	// their alt and onerror applied as for the original failure
+	NegativeTTL time.Duration
+
+	// CacheStore keeps fragments instead of the in-memory LRU (default: nil, in-memory)
+	// Use it to share the cache between instances, e.g. with a Redis-backed store. The disk tier,
+	// which holds fragments evicted from memory, is unused then. PurgePrefix and CacheEntries fail
+	// unless the store implements CacheStoreLister, and ResetCache leaves the store untouched
+	CacheStore CacheStore
+
+	// MaxIncludeDepth is how many levels of nested includes are expanded (default: 10)
+	// Deeper includes, and includes of a fragment they are nested in, fail with a warning so alt and
+	// onerror apply. A nested include failing its page with onerror="error" fails its fragment instead
+	MaxIncludeDepth int
+
+	// MaxOutputBytes caps the bytes includes may insert while assembling one response, counted at
+	// every nesting level (default: 0, unlimited). Includes beyond the cap are removed and an error is logged
+	MaxOutputBytes int64
+
+	// CacheKeyFunc returns the key a fragment URL is cached under for the request (default: nil, the URL)
+	// Use it to keep tenants sharing fragment URLs apart, e.g. prefixing the URL with a tenant header.
+	// Nested includes pass the fragment request. Purge with the keys it returns, or PurgePrefix for a tenant
+	CacheKeyFunc func(req *http.Request, url string) string
+
+	// HTTPClient fetches fragments instead of the built-in client (default: nil, built-in)
+	// Use it for proxies or custom transports. FragmentUnixSocket, ClientCert and CACert then have
+	// no effect; a client without a CheckRedirect keeps the redirect policy of the built-in one
+	HTTPClient *http.Client
+
+	// Tracer records OpenTelemetry spans of parsing and of each include (default: nil, no spans)
+	// Include spans carry the fragment URL, cache hit and status code, and their trace context
+	// is sent to the fragment backend in a traceparent header
+	Tracer trace.Tracer
 }
 
-var (
-	globalConfig Config
-	rng          = rand.New(rand.NewSource(time.Now().UnixNano()))
-)
+var globalConfig atomic.Pointer[Config]
+
+// config returns the configuration set by Configure, or the zero Config before. It is replaced as a
+// whole rather than modified, so the fields read from one call belong to the same configuration.
+func config() *Config {
+	if cfg := globalConfig.Load(); cfg != nil {
+		return cfg
+	}
+
+	return &Config{}
+}
 
 // Configure sets the global ESI configuration
+// It may be called while pages are being processed, e.g. on a configuration reload: fetches
+// already started keep the configuration they read, later ones use the new one.
 func Configure(cfg Config) {
-	globalConfig = cfg
-
 	// Set defaults if not specified
-	if globalConfig.MinimumCacheTTL == 0 {
-		globalConfig.MinimumCacheTTL = defaultTTL
+	if cfg.MinimumCacheTTL == 0 {
+		cfg.MinimumCacheTTL = defaultTTL
+	}
+
+	globalConfig.Store(&cfg)
+	// Fetches still using the previous client keep their connections, its idle ones are let go
+	if previous := httpClient.Swap(createHTTPClient()); previous != nil {
+		previous.CloseIdleConnections()
 	}
+	warmUp.reset()
+	hostLimit.reset()
+	failures.reset()
+	breaker.reset()
+	janitor.restart(cfg.JanitorInterval)
+	cache.shrink()
 
 	if logger != nil {
 		logger.Info("ESI configuration updated",
-			zap.Int("minimum_cache_ttl", globalConfig.MinimumCacheTTL),
-			zap.Int("cache_ttl_jitter", globalConfig.CacheTTLJitter),
-			zap.String("base_url", globalConfig.BaseURL),
-			zap.Any("headers", globalConfig.Headers))
+			zap.Int("minimum_cache_ttl", cfg.MinimumCacheTTL),
+			zap.Int("cache_ttl_jitter", cfg.CacheTTLJitter),
+			zap.Int("cache_ttl_jitter_percent", cfg.CacheTTLJitterPercent),
+			zap.String("base_url", cfg.BaseURL),
+			zap.Any("headers", cfg.Headers),
+			zap.Int("max_attribute_length", cfg.MaxAttributeLength),
+			zap.Int("max_cacheable_fragment_bytes", cfg.MaxCacheableFragmentBytes),
+			zap.Bool("debug_boundaries", cfg.DebugBoundaries),
+			zap.Bool("debug_placeholders", cfg.DebugPlaceholders),
+			zap.String("fragment_unix_socket", cfg.FragmentUnixSocket),
+			zap.Duration("janitor_interval", cfg.JanitorInterval),
+			zap.String("disk_cache_dir", cfg.DiskCacheDir),
+			zap.Int64("max_disk_cache_bytes", cfg.MaxDiskCacheBytes),
+			zap.Duration("warm_up_period", cfg.WarmUpPeriod),
+			zap.Int("warm_up_concurrency", cfg.WarmUpConcurrency),
+			zap.String("bucket_cookie", cfg.BucketCookie),
+			zap.String("bucket_header", cfg.BucketHeader),
+			zap.Int("bucket_count", cfg.BucketCount),
+			zap.String("default_onerror", cfg.DefaultOnError),
+			zap.String("client_cert", cfg.ClientCert),
+			zap.Bool("cache_key_func", cfg.CacheKeyFunc != nil),
+			zap.Bool("custom_http_client", cfg.HTTPClient != nil),
+			zap.Bool("tracing", cfg.Tracer != nil),
+			zap.String("ca_cert", cfg.CACert),
+			zap.Float64("failure_rate_threshold", cfg.FailureRateThreshold),
+			zap.Duration("failure_window", cfg.FailureWindow),
+			zap.Int("circuit_breaker_threshold", cfg.CircuitBreakerThreshold),
+			zap.Duration("circuit_breaker_cooldown", cfg.CircuitBreakerCooldown),
+			zap.Duration("fetch_timeout", cfg.FetchTimeout),
+			zap.Any("host_timeouts", cfg.HostTimeouts),
+			zap.Int("fragment_retries", cfg.FragmentRetries),
+			zap.Duration("fragment_retry_backoff", cfg.FragmentRetryBackoff),
+			zap.Int("max_parallel_fetches", cfg.MaxParallelFetches),
+			zap.Int("max_concurrent_per_host", cfg.MaxConcurrentPerHost),
+			zap.Duration("placeholder_threshold", cfg.PlaceholderThreshold),
+			zap.Int("fragment_transforms", len(cfg.FragmentTransforms)),
+			zap.Int64("max_output_bytes", cfg.MaxOutputBytes),
+			zap.Int("max_include_depth", cfg.MaxIncludeDepth),
+			zap.Strings("allowed_hosts", cfg.AllowedHosts),
+			zap.Strings("allowed_schemes", cfg.AllowedSchemes),
+			zap.Strings("allowed_fragment_content_types", cfg.AllowedFragmentContentTypes),
+			zap.Int("max_fragment_redirects", cfg.MaxFragmentRedirects),
+			zap.Bool("same_origin_redirects", cfg.SameOriginRedirects),
+			zap.Bool("cache_store", cfg.CacheStore != nil),
+			zap.Int("max_cache_entries", cfg.MaxCacheEntries),
+			zap.Int64("max_cache_bytes", cfg.MaxCacheBytes),
+			zap.Duration("negative_ttl", cfg.NegativeTTL))
 	}
 }
 
 // GetConfig returns the current global configuration
 func GetConfig() Config {
-	return globalConfig
+	return *config()
 }
 
-// resolveFragmentURL resolves a fragment URL, optionally using the configured BaseURL
-func resolveFragmentURL(fragmentURL string, requestURL *url.URL) string {
-	// If BaseURL is configured, use it instead of the request URL
-	if globalConfig.BaseURL != "" {
-		baseURL, err := url.Parse(globalConfig.BaseURL)
+// resolveFragmentURL resolves the URL of an include of the request. Includes of the page resolve
+// against the configured BaseURL, or else the page URL. Includes nested in a fragment resolve
+// against the fragment's URL, which BaseURL already applied to, like relative links in a document.
+func resolveFragmentURL(fragmentURL string, req *http.Request) string {
+	cfg := config()
+	requestURL := req.URL
+
+	// If BaseURL is configured, use it instead of the page URL
+	if cfg.BaseURL != "" && chainFrom(req) == nil {
+		baseURL, err := url.Parse(cfg.BaseURL)
 		if err != nil {
 			if logger != nil {
 				logger.Warn("Failed to parse configured base_url, falling back to request URL",
-					zap.String("base_url", globalConfig.BaseURL),
+					zap.String("base_url", cfg.BaseURL),
 					zap.Error(err))
 			}
 			return sanitizeURL(fragmentURL, requestURL)
@@ -85,7 +353,7 @@ func resolveFragmentURL(fragmentURL string, requestURL *url.URL) string {
 		if logger != nil {
 			logger.Debug("ESI fragment URL resolved using configured base_url",
 				zap.String("fragment", fragmentURL),
-				zap.String("base_url", globalConfig.BaseURL),
+				zap.String("base_url", cfg.BaseURL),
 				zap.String("resolved", resolved))
 		}
 
@@ -98,23 +366,141 @@ func resolveFragmentURL(fragmentURL string, requestURL *url.URL) string {
 
 // applyTTLJitter adds random jitter to the TTL if configured
 func applyTTLJitter(ttl int) int {
-	if globalConfig.CacheTTLJitter <= 0 {
+	cfg := config()
+
+	// Add random jitter between 0 and CacheTTLJitterPercent of the TTL, or 0 and CacheTTLJitter seconds.
+	// The top-level rand functions are safe for concurrent fetches, unlike a shared rand.Rand.
+	if percent := min(cfg.CacheTTLJitterPercent, 100); percent > 0 {
+		return ttl + rand.IntN(ttl*percent/100+1)
+	}
+
+	if cfg.CacheTTLJitter <= 0 {
 		return ttl
 	}
 
-	// Add random jitter between 0 and CacheTTLJitter
-	jitter := rng.Intn(globalConfig.CacheTTLJitter + 1)
+	jitter := rand.IntN(cfg.CacheTTLJitter + 1)
 	return ttl + jitter
 }
 
+const defaultFetchTimeout = 5 * time.Second
+
+// defaultFragmentRetryBackoff is the wait before the first retry of a fragment fetch
+const defaultFragmentRetryBackoff = 100 * time.Millisecond
+
+// fragmentRetryBackoff returns the configured wait before the first retry of a fragment fetch
+func fragmentRetryBackoff() time.Duration {
+	cfg := config()
+	if cfg.FragmentRetryBackoff > 0 {
+		return cfg.FragmentRetryBackoff
+	}
+
+	return defaultFragmentRetryBackoff
+}
+
+// fetchTimeout returns the timeout of fragment fetches from the given URL, 0 meaning none
+func fetchTimeout(u *url.URL) time.Duration {
+	cfg := config()
+	if timeout, ok := cfg.HostTimeouts[u.Host]; ok {
+		return timeout
+	}
+
+	if timeout, ok := cfg.HostTimeouts[u.Hostname()]; ok {
+		return timeout
+	}
+
+	switch {
+	case cfg.FetchTimeout < 0:
+		return 0
+	case cfg.FetchTimeout == 0:
+		return defaultFetchTimeout
+	default:
+		return cfg.FetchTimeout
+	}
+}
+
+// fragmentAllowed reports whether fragments may be fetched from u under AllowedHosts and AllowedSchemes
+func fragmentAllowed(u *url.URL) bool {
+	cfg := config()
+	if len(cfg.AllowedSchemes) > 0 && !slices.ContainsFunc(cfg.AllowedSchemes, func(scheme string) bool {
+		return strings.EqualFold(scheme, u.Scheme)
+	}) {
+		return false
+	}
+
+	if len(cfg.AllowedHosts) == 0 {
+		return true
+	}
+
+	host := strings.ToLower(u.Hostname())
+	for _, allowed := range cfg.AllowedHosts {
+		allowed = strings.ToLower(allowed)
+		if suffix, ok := strings.CutPrefix(allowed, "*."); ok {
+			if strings.HasSuffix(host, "."+suffix) {
+				return true
+			}
+		} else if host == allowed || strings.ToLower(u.Host) == allowed {
+			return true
+		}
+	}
+
+	return false
+}
+
+// checkContentType returns errContentType if the media type of a fragment response isn't one of
+// AllowedFragmentContentTypes
+func checkContentType(response *http.Response) error {
+	cfg := config()
+	if len(cfg.AllowedFragmentContentTypes) == 0 {
+		return nil
+	}
+
+	contentType := response.Header.Get("Content-Type")
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err == nil && slices.ContainsFunc(cfg.AllowedFragmentContentTypes, func(allowed string) bool {
+		return strings.EqualFold(allowed, mediaType)
+	}) {
+		return nil
+	}
+
+	return fmt.Errorf("%w: %q", errContentType, contentType)
+}
+
+// checkFragmentURL returns errHostNotAllowed, logging a warning, if fragments may not be fetched from rawURL
+func checkFragmentURL(rawURL string) error {
+	cfg := config()
+	if len(cfg.AllowedHosts) == 0 && len(cfg.AllowedSchemes) == 0 {
+		return nil
+	}
+
+	u, err := url.Parse(rawURL)
+	if err == nil && fragmentAllowed(u) {
+		return nil
+	}
+
+	if logger != nil {
+		logger.Warn("ESI include of a host not allowed, skipping it", zap.String("url", rawURL))
+	}
+
+	return fmt.Errorf("%w: %s", errHostNotAllowed, rawURL)
+}
+
+// transformFragment runs the fragment content of url through the configured transforms in order
+func transformFragment(url string, content []byte) []byte {
+	for _, transform := range config().FragmentTransforms {
+		content = transform(url, content)
+	}
+
+	return content
+}
+
 // getCustomHeaders returns the map of custom headers to set on requests
 func getCustomHeaders() map[string]string {
-	return globalConfig.Headers
+	return config().Headers
 }
 
 // setCustomHeaders sets configured custom headers on the request
 func setCustomHeaders(req *http.Request) {
-	for name, value := range globalConfig.Headers {
+	for name, value := range config().Headers {
 		// Special handling for Host header
 		// Go's HTTP client uses req.Host instead of req.Header["Host"]
 		if strings.EqualFold(name, "Host") {
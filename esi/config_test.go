@@ -0,0 +1,96 @@
+package esi
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Test Configure can replace the configuration while pages are parsed, run with -race
+func TestConfigureWhileParsing(t *testing.T) {
+	old := GetConfig()
+	t.Cleanup(func() { Configure(old) })
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte("<p>" + r.URL.Path + "</p>"))
+	}))
+	defer ts.Close()
+
+	configs := []Config{
+		{BaseURL: ts.URL, MaxConcurrentPerHost: 4},
+		{BaseURL: ts.URL, Headers: map[string]string{"X-Env": "test"}, NegativeTTL: time.Second},
+		{BaseURL: ts.URL, MaxCacheEntries: 2, MaxIncludeDepth: 2, DebugBoundaries: true},
+	}
+	Configure(configs[0])
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+
+				req := httptest.NewRequest("GET", "http://example.com/page", nil)
+				result := string(Parse([]byte(`<esi:include src="/a"/><esi:include src="/b"/><esi:include src="/c"/>`), req))
+				if !strings.Contains(result, "<p>/a</p>") || !strings.Contains(result, "<p>/c</p>") {
+					t.Errorf("Expected every fragment included, got %q", result)
+					return
+				}
+			}
+		}()
+	}
+
+	for i := range 200 {
+		Configure(configs[i%len(configs)])
+	}
+	close(done)
+	wg.Wait()
+
+	if cfg := GetConfig(); cfg.MaxConcurrentPerHost != configs[199%len(configs)].MaxConcurrentPerHost {
+		t.Errorf("Expected the last configuration to be kept, got %+v", cfg)
+	}
+}
+
+// Test Configure lets go of the idle connections of the client it replaces
+func TestConfigureClosesIdleConnections(t *testing.T) {
+	old := GetConfig()
+	t.Cleanup(func() { Configure(old) })
+
+	closed := make(chan struct{}, 1)
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "no-store")
+		w.Write([]byte("<p>fragment</p>"))
+	}))
+	ts.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateClosed {
+			closed <- struct{}{}
+		}
+	}
+	ts.Start()
+	defer ts.Close()
+
+	Configure(Config{BaseURL: ts.URL})
+	req := httptest.NewRequest("GET", "http://example.com/page", nil)
+	if result := string(Parse([]byte(`<esi:include src="/fragment"/>`), req)); result != "<p>fragment</p>" {
+		t.Fatalf("Expected the fragment, got %q", result)
+	}
+
+	Configure(Config{BaseURL: ts.URL, NegativeTTL: time.Second})
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Error("Expected the idle connection of the replaced client to be closed")
+	}
+}
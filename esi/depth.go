@@ -0,0 +1,86 @@
+package esi
+
+import (
+	"fmt"
+	"net/http"
+
+	"go.uber.org/zap"
+)
+
+const defaultMaxIncludeDepth = 10
+
+type includeChainKey struct{}
+
+// includeChain links a fragment being processed to the fragments that included it, so includes
+// nested too deep or forming a cycle are left out instead of recursing forever
+type includeChain struct {
+	url    string
+	level  int
+	parent *includeChain
+}
+
+// chainFrom returns the include chain of the request, or nil for the page itself
+func chainFrom(req *http.Request) *includeChain {
+	c, _ := req.Context().Value(includeChainKey{}).(*includeChain)
+	return c
+}
+
+// push returns the chain of url, included by the fragment c
+func (c *includeChain) push(url string) *includeChain {
+	return &includeChain{url: url, level: c.depth() + 1, parent: c}
+}
+
+// depth returns how many includes deep the chain is, 0 being the page
+func (c *includeChain) depth() int {
+	if c == nil {
+		return 0
+	}
+
+	return c.level
+}
+
+// contains reports whether url is one of the fragments of the chain
+func (c *includeChain) contains(url string) bool {
+	for ; c != nil; c = c.parent {
+		if c.url == url {
+			return true
+		}
+	}
+
+	return false
+}
+
+// maxIncludeDepth returns the configured number of nesting levels includes are expanded to
+func maxIncludeDepth() int {
+	if depth := config().MaxIncludeDepth; depth > 0 {
+		return depth
+	}
+
+	return defaultMaxIncludeDepth
+}
+
+// allowInclude returns errIncludeDepth if an include of url in the request is nested too deep, or
+// errIncludeCycle if it includes one of the fragments it is nested in, so it fails like a fetch
+func allowInclude(req *http.Request, url string) error {
+	chain := chainFrom(req)
+	limit := maxIncludeDepth()
+
+	switch {
+	case chain.depth() >= limit:
+		if logger != nil {
+			logger.Warn("ESI include exceeds max include depth, leaving it out",
+				zap.String("url", url),
+				zap.Int("max_include_depth", limit))
+		}
+		return fmt.Errorf("%w of %d", errIncludeDepth, limit)
+	case chain.contains(url):
+		if logger != nil {
+			logger.Warn("ESI include cycle detected, leaving it out",
+				zap.String("url", url),
+				zap.Int("depth", chain.depth()))
+		}
+		return fmt.Errorf("%w through %s", errIncludeCycle, url)
+	default:
+		return nil
+	}
+}
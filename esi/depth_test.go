@@ -0,0 +1,235 @@
+package esi
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestIncludeDepthIsBounded(t *testing.T) {
+	var fetches atomic.Int32
+	var ts *httptest.Server
+	ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+
+		// Every level includes the next one, forever
+		level, _ := strconv.Atoi(r.URL.Query().Get("level"))
+		w.Write([]byte(strconv.Itoa(level) + `<esi:include src="` + ts.URL + `/chain?level=` + strconv.Itoa(level+1) + `"/>`))
+	}))
+	defer ts.Close()
+
+	withConfig(t, Config{MaxIncludeDepth: 3})
+	cache.Reset()
+
+	req := httptest.NewRequest("GET", "http://example.com", nil)
+	result := string(Parse([]byte(`<esi:include src="`+ts.URL+`/chain?level=1"/>`), req))
+
+	if result != "123" {
+		t.Errorf("Expected includes expanded 3 levels deep, got %q", result)
+	}
+	if got := fetches.Load(); got != 3 {
+		t.Errorf("Expected 3 fetches, got %d", got)
+	}
+}
+
+func TestIncludeCycleTerminates(t *testing.T) {
+	var ts *httptest.Server
+	ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/self":
+			w.Write([]byte(`self<esi:include src="` + ts.URL + `/self"/>`))
+		case "/a":
+			w.Write([]byte(`a<esi:include src="` + ts.URL + `/b"/>`))
+		case "/b":
+			w.Write([]byte(`b<esi:include src="` + ts.URL + `/a"/>`))
+		}
+	}))
+	defer ts.Close()
+
+	withConfig(t, Config{})
+
+	tests := []struct {
+		src      string
+		expected string
+	}{
+		{"/self", "self"},
+		{"/a", "ab"},
+	}
+
+	for _, tt := range tests {
+		t.Run(strings.TrimPrefix(tt.src, "/"), func(t *testing.T) {
+			cache.Reset()
+
+			done := make(chan string, 1)
+			go func() {
+				req := httptest.NewRequest("GET", "http://example.com", nil)
+				done <- string(Parse([]byte(`<esi:include src="`+ts.URL+tt.src+`"/>`), req))
+			}()
+
+			select {
+			case result := <-done:
+				if result != tt.expected {
+					t.Errorf("Expected the cycle to be cut, got %q", result)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("Parse did not terminate on an include cycle")
+			}
+		})
+	}
+}
+
+// Test an include cut for its depth or a cycle fails like a fetch: its alts are tried, esi:try renders
+// the except block, and with onerror="error" it fails the fragment it is nested in, which is recorded
+func TestIncludeDepthAndCycleFail(t *testing.T) {
+	var ts *httptest.Server
+	ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/deep":
+			w.Write([]byte(`deep<esi:include src="` + ts.URL + `/leaf" alt="` + ts.URL + `/deep" alt2="` + ts.URL + `/fallback"/>`))
+		case "/cycle":
+			w.Write([]byte(`cycle<esi:try><esi:attempt><esi:include src="` + ts.URL + `/cycle"/></esi:attempt>` +
+				`<esi:except>except</esi:except></esi:try>`))
+		case "/strict":
+			w.Write([]byte(`strict<esi:include src="` + ts.URL + `/strict" onerror="error"/>`))
+		default:
+			w.Write([]byte(strings.TrimPrefix(r.URL.Path, "/")))
+		}
+	}))
+	defer ts.Close()
+
+	tests := []struct {
+		name     string
+		depth    int
+		html     string
+		expected string
+		err      error
+		pageErr  bool
+	}{
+		// /leaf is too deep, and so is the alt /deep, which is a cycle too, and then alt2
+		{"too deep falls through the alts", 1, `<esi:include src="` + ts.URL + `/deep"/>`, "deep", nil, false},
+		{"cycle renders the except block", 0, `<esi:include src="` + ts.URL + `/cycle"/>`, "cycleexcept", nil, false},
+		{"cycle with onerror=error fails the fragment", 0, `<esi:include src="` + ts.URL + `/strict" alt="` + ts.URL + `/fallback"/>`, "fallback", errIncludeCycle, false},
+		{"failed fragment fails the page", 0, `<esi:include src="` + ts.URL + `/strict" onerror="error"/>`, "", errIncludeCycle, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withConfig(t, Config{MaxIncludeDepth: tt.depth})
+			cache.Reset()
+
+			// Cold, then with the fragments cached
+			for range 2 {
+				req := httptest.NewRequest("GET", "http://example.com", nil)
+				result, res := ParseWithResult([]byte(tt.html), req)
+
+				if string(result) != tt.expected {
+					t.Errorf("Expected %q, got %q", tt.expected, result)
+				}
+				if errs := res.Errors(); tt.err != nil && !slices.ContainsFunc(errs, func(err error) bool { return errors.Is(err, tt.err) }) {
+					t.Errorf("Expected %v among the recorded errors, got %v", tt.err, errs)
+				}
+				if pageErr := res.Err() != nil; pageErr != tt.pageErr {
+					t.Errorf("Expected the page failed: %v, got %v", tt.pageErr, res.Err())
+				}
+			}
+		})
+	}
+}
+
+func TestNestedIncludesResolveAgainstTheirFragment(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		fetched []string
+	)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		fetched = append(fetched, r.URL.Path)
+		mu.Unlock()
+
+		switch r.URL.Path {
+		case "/widgets/box":
+			w.Write([]byte(`box<esi:include src="parts/title"/>`))
+		case "/widgets/parts/title":
+			w.Write([]byte(`title<esi:include src="../../legal"/>`))
+		case "/legal":
+			w.Write([]byte(`legal`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+
+	tests := []struct {
+		name    string
+		baseURL string
+		src     string
+	}{
+		{"page URL", "", "/widgets/box"},
+		{"configured base URL", ts.URL + "/", "widgets/box"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withConfig(t, Config{BaseURL: tt.baseURL})
+			cache.Reset()
+			fetched = nil
+
+			page := ts.URL + "/pages/home"
+			if tt.baseURL != "" {
+				page = "http://example.com/pages/home"
+			}
+
+			req := httptest.NewRequest("GET", page, nil)
+			result := string(Parse([]byte(`<esi:include src="`+tt.src+`"/>`), req))
+
+			if result != "boxtitlelegal" {
+				t.Errorf("Expected every level expanded, got %q", result)
+			}
+			if expected := []string{"/widgets/box", "/widgets/parts/title", "/legal"}; !slices.Equal(fetched, expected) {
+				t.Errorf("Expected fetches %v, got %v", expected, fetched)
+			}
+		})
+	}
+}
+
+// Test a fragment whose nested includes were cut for depth isn't cached, so an include of it at a
+// shallower depth gets it whole
+func TestIncludeCutForDepthIsNotCached(t *testing.T) {
+	var ts *httptest.Server
+	ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		switch r.URL.Path {
+		case "/outer":
+			w.Write([]byte(`outer<esi:include src="` + ts.URL + `/mid"/>`))
+		case "/mid":
+			w.Write([]byte(`mid<esi:include src="` + ts.URL + `/leaf"/>`))
+		case "/leaf":
+			w.Write([]byte(`leaf`))
+		}
+	}))
+	defer ts.Close()
+
+	withConfig(t, Config{MaxIncludeDepth: 2})
+	cache.Reset()
+
+	// /mid is included at the max depth, its include of /leaf is cut
+	req := httptest.NewRequest("GET", "http://example.com", nil)
+	if result := string(Parse([]byte(`<esi:include src="`+ts.URL+`/outer"/>`), req)); result != "outermid" {
+		t.Fatalf("Expected the include of /leaf cut at depth 2, got %q", result)
+	}
+
+	req = httptest.NewRequest("GET", "http://example.com", nil)
+	if result := string(Parse([]byte(`<esi:include src="`+ts.URL+`/mid"/>`), req)); result != "midleaf" {
+		t.Errorf("Expected /mid whole when included at depth 1, got %q", result)
+	}
+	if _, _, ok := cache.Load(ts.URL + "/outer"); ok {
+		t.Error("Expected the fragment holding a truncated one not to be cached either")
+	}
+}
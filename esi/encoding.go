@@ -0,0 +1,68 @@
+package esi
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// acceptedEncodings is the Accept-Encoding of fragment requests that don't set one of their own
+const acceptedEncodings = "gzip, deflate"
+
+// decodeContent returns the body of a fragment response with its Content-Encoding undone, and
+// removes the encoding headers of the response so its content is handled as plain from then on
+func decodeContent(response *http.Response, body []byte) ([]byte, error) {
+	header := response.Header.Get("Content-Encoding")
+	if header == "" || len(body) == 0 {
+		return body, nil
+	}
+
+	// Encodings are listed in the order they were applied, so they are undone last to first
+	encodings := strings.Split(header, ",")
+	for i := len(encodings) - 1; i >= 0; i-- {
+		encoding := strings.ToLower(strings.TrimSpace(encodings[i]))
+
+		var (
+			decoder io.ReadCloser
+			err     error
+		)
+		switch encoding {
+		case "", "identity":
+			continue
+		case "gzip", "x-gzip":
+			decoder, err = gzip.NewReader(bytes.NewReader(body))
+		case "deflate":
+			decoder, err = deflateReader(body)
+		default:
+			return nil, fmt.Errorf("unsupported content encoding %q", encoding)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("decode %s content: %w", encoding, err)
+		}
+
+		body, err = io.ReadAll(decoder)
+		decoder.Close()
+		if err != nil {
+			return nil, fmt.Errorf("decode %s content: %w", encoding, err)
+		}
+	}
+
+	response.Header.Del("Content-Encoding")
+	response.Header.Del("Content-Length")
+
+	return body, nil
+}
+
+// deflateReader reads deflate content, which servers send either zlib-wrapped as specified or as a raw stream
+func deflateReader(body []byte) (io.ReadCloser, error) {
+	if len(body) >= 2 && body[0]&0x0f == 8 && (uint16(body[0])<<8|uint16(body[1]))%31 == 0 {
+		return zlib.NewReader(bytes.NewReader(body))
+	}
+
+	return flate.NewReader(bytes.NewReader(body)), nil
+}
@@ -1,5 +1,29 @@
 package esi
 
-import "errors"
+import (
+	"context"
+	"errors"
+	"fmt"
+)
 
-var errNotFound = errors.New("not found")
+// ErrCacheStoreNotListable is returned by PurgePrefix and CacheEntries when the configured
+// CacheStore does not implement CacheStoreLister
+var ErrCacheStoreNotListable = errors.New("cache store cannot list its keys")
+
+var (
+	errNotFound         = errors.New("not found")
+	errAttributeTooLong = errors.New("attribute too long")
+	errUnexpectedStatus = errors.New("unexpected status code")
+	errElementNotFound  = errors.New("element not found")
+	errBudgetExceeded   = errors.New("output budget exceeded")
+	errHostNotAllowed   = errors.New("fragment host not allowed")
+	errMaxWaitExceeded  = errors.New("include maxwait exceeded")
+	errContentType      = errors.New("fragment content type not allowed")
+	errCircuitOpen      = errors.New("fragment host circuit open")
+	errRedirectPolicy   = errors.New("fragment redirect not allowed")
+	errIncludeDepth     = errors.New("include exceeds max include depth")
+	errIncludeCycle     = errors.New("include cycle")
+
+	// errShutdown is a cancellation, so it is never retried, remembered or counted as a failure
+	errShutdown = fmt.Errorf("fragment fetches shut down: %w", context.Canceled)
+)
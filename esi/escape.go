@@ -29,6 +29,9 @@ func (e *escapeTag) Process(b []byte, req *http.Request) ([]byte, int) {
 		startPosition = startIdx[1]
 	}
 
+	// The whitespace before --> may be all there is, as in <!--esi -->
+	startPosition = min(startPosition, closeIdx[0])
+
 	e.length = closeIdx[1]
 	b = b[startPosition:closeIdx[0]]
 
@@ -1,10 +1,43 @@
 package esi
 
 import (
+	"bytes"
+	"context"
 	"net/http"
 	"sync"
+	"sync/atomic"
+
+	"go.uber.org/zap"
 )
 
+const defaultMaxParallelFetches = 64
+
+// activeFetches counts the fetch workers currently running across all documents
+var activeFetches atomic.Int64
+
+// ActiveFetches returns the number of goroutines currently fetching includes
+func ActiveFetches() int64 {
+	return activeFetches.Load()
+}
+
+// TrackFetch counts a goroutine fetching includes outside of this package, e.g. a streaming writer
+// processing a tag, in ActiveFetches until the returned function is called
+func TrackFetch() func() {
+	activeFetches.Add(1)
+
+	return func() { activeFetches.Add(-1) }
+}
+
+// maxParallelFetches returns the configured size of the per-document fetch pool
+func maxParallelFetches() int {
+	cfg := config()
+	if cfg.MaxParallelFetches > 0 {
+		return cfg.MaxParallelFetches
+	}
+
+	return defaultMaxParallelFetches
+}
+
 func findTagName(b []byte) Tag {
 	name := tagname.FindSubmatch(b)
 	if name == nil {
@@ -33,6 +66,9 @@ func findTagName(b []byte) Tag {
 			baseTag: newBaseTag(),
 		}
 	case try:
+		return &tryTag{
+			baseTag: newBaseTag(),
+		}
 	case vars:
 		return &varsTag{
 			baseTag: newBaseTag(),
@@ -40,14 +76,33 @@ func findTagName(b []byte) Tag {
 	default:
 		return nil
 	}
-
-	return nil
 }
 
 func HasOpenedTags(b []byte) bool {
 	return esi.FindIndex(b) != nil || escapeRg.FindIndex(b) != nil
 }
 
+// HasProcessableTags reports whether b holds at least one known ESI tag with its close, unlike
+// HasOpenedTags which matches any mention of a tag opener, e.g. in a code sample or a sentence.
+// A document without one is left as is by Parse, so it can be passed on without parsing.
+func HasProcessableTags(b []byte) bool {
+	for pointer := 0; pointer < len(b); {
+		next := b[pointer:]
+		startPos, esiPointer, t := ReadToTag(next, pointer)
+		if t == nil && startPos == len(next) {
+			return false
+		}
+
+		if t != nil && t.HasClose(next[esiPointer:]) {
+			return true
+		}
+
+		pointer += startPos + 1
+	}
+
+	return false
+}
+
 func CanProcess(b []byte) bool {
 	if tag := findTagName(b); tag != nil {
 		return tag.HasClose(b)
@@ -84,8 +139,29 @@ func ReadToTag(next []byte, pointer int) (startTagPosition, esiPointer int, t Ta
 
 // Parse parses ESI tags with parallel fetching of includes.
 // All includes at the same level are fetched concurrently for optimal performance.
+// The input is never modified, tags are processed on a copy, so callers may reuse their buffer.
+// A document without tags is returned as is, sharing the input's memory.
 func Parse(b []byte, req *http.Request) []byte {
-	return parseParallel(b, req)
+	return ParseContext(req.Context(), b, req)
+}
+
+// ParseContext parses ESI tags like Parse, with includes fetched under ctx rather than the request's
+// context, so callers can set a deadline or cancel the fetches without building a request for it.
+// ctx replaces the request's context as with http.Request.WithContext: derive it from req.Context()
+// to keep the values attached there, such as a Result recorder.
+func ParseContext(ctx context.Context, b []byte, req *http.Request) []byte {
+	if !HasOpenedTags(b) {
+		return b
+	}
+
+	ctx, span := startSpan(ctx, "esi.parse")
+	defer span.End()
+
+	if ctx != req.Context() {
+		req = req.WithContext(ctx)
+	}
+
+	return parseParallel(bytes.Clone(b), WithOutputBudget(req))
 }
 
 // parseParallel processes ESI tags with parallel fetching of includes at the same level.
@@ -121,6 +197,30 @@ func collectIncludes(b []byte) []includeRequest {
 		esiPointer := tagIdx[1]
 		t := findTagName(next[esiPointer:])
 
+		// Includes of a try block are fetched when it is processed, to know whether they failed
+		if _, ok := t.(*tryTag); ok {
+			if closeIdx := closeTry.FindIndex(next[esiPointer:]); closeIdx != nil {
+				pointer += esiPointer + closeIdx[1]
+				continue
+			}
+		}
+
+		// Only the branch a choose block selects is parsed, so its includes are fetched then
+		if _, ok := t.(*chooseTag); ok {
+			if closeIdx := closeChoose.FindIndex(next[esiPointer:]); closeIdx != nil {
+				pointer += esiPointer + closeIdx[1]
+				continue
+			}
+		}
+
+		// A remove block is dropped whole, its includes are never fetched
+		if _, ok := t.(*removeTag); ok {
+			if closeIdx := closeRemove.FindIndex(next[esiPointer:]); closeIdx != nil {
+				pointer += esiPointer + closeIdx[1]
+				continue
+			}
+		}
+
 		// Only collect include tags
 		if includeTag, ok := t.(*includeTag); ok {
 			closeIdx := closeInclude.FindIndex(next[esiPointer:])
@@ -142,8 +242,11 @@ func collectIncludes(b []byte) []includeRequest {
 }
 
 // processNonIncludes handles all non-include ESI tags (choose, vars, remove, etc.)
+// The output is built in a fresh buffer: splicing in place would let a tag's result, which may
+// share memory with b, overwrite the bytes that follow it.
 func processNonIncludes(b []byte, req *http.Request) []byte {
-	pointer := 0
+	var out []byte
+	pointer, written := 0, 0
 
 	for pointer < len(b) {
 		var escapeTag bool
@@ -168,6 +271,16 @@ func processNonIncludes(b []byte, req *http.Request) []byte {
 			esiPointer += 7
 		}
 
+		// Unknown and unterminated tags are left verbatim, scanning resumes after their opening
+		if t == nil || !t.HasClose(next[esiPointer:]) {
+			if logger != nil {
+				logger.Warn("Malformed ESI tag left unprocessed",
+					zap.ByteString("tag", next[tagIdx[0]:min(tagIdx[0]+64, len(next))]))
+			}
+			pointer += esiPointer
+			continue
+		}
+
 		// Skip include tags (already processed)
 		if _, ok := t.(*includeTag); ok {
 			pointer += tagIdx[0] + tagIdx[1] + 1
@@ -178,55 +291,86 @@ func processNonIncludes(b []byte, req *http.Request) []byte {
 		res, p := t.Process(next[esiPointer:], req)
 		esiPointer += p
 
-		b = append(b[:pointer], append(next[:tagIdx[0]], append(res, next[esiPointer:]...)...)...)
-		pointer += len(res) + tagIdx[0]
+		if out == nil {
+			out = make([]byte, 0, len(b))
+		}
+		out = append(out, b[written:pointer+tagIdx[0]]...)
+		out = append(out, res...)
+		pointer += esiPointer
+		written = pointer
 	}
 
-	return b
+	if out == nil {
+		return b
+	}
+
+	return append(out, b[written:]...)
 }
 
 // fetchIncludesParallel fetches all includes concurrently and replaces them in the document.
+// A pool of at most Config.MaxParallelFetches workers does the fetching, so a page with
+// thousands of includes can't spawn a goroutine for each.
 func fetchIncludesParallel(b []byte, includes []includeRequest, req *http.Request) []byte {
 	results := make([]includeResult, len(includes))
+	jobs := make(chan int)
 	var wg sync.WaitGroup
 
-	// Fetch all includes in parallel
-	for i, inc := range includes {
+	for range min(len(includes), maxParallelFetches()) {
 		wg.Add(1)
-		go func(index int, incReq includeRequest) {
+		activeFetches.Add(1)
+		go func() {
 			defer wg.Done()
-
-			// Extract the tag bytes
-			endPos := incReq.position + incReq.length
-			if endPos > len(b) {
-				endPos = len(b)
+			defer activeFetches.Add(-1)
+
+			for index := range jobs {
+				incReq := includes[index]
+
+				// Includes still queued when the request is cancelled are left out without fetching
+				if req.Context().Err() != nil {
+					results[index] = includeResult{position: incReq.position, length: incReq.length}
+					continue
+				}
+
+				// Extract the tag bytes
+				endPos := incReq.position + incReq.length
+				if endPos > len(b) {
+					endPos = len(b)
+				}
+				tagBytes := b[incReq.position:endPos]
+
+				// Fetch content
+				content := incReq.tag.FetchContent(tagBytes, req)
+
+				results[index] = includeResult{
+					content:  content,
+					position: incReq.position,
+					length:   incReq.length,
+				}
 			}
-			tagBytes := b[incReq.position:endPos]
-
-			// Fetch content
-			content := incReq.tag.FetchContent(tagBytes, req)
+		}()
+	}
 
-			results[index] = includeResult{
-				content:  content,
-				position: incReq.position,
-				length:   incReq.length,
-			}
-		}(i, inc)
+	for index := range includes {
+		jobs <- index
 	}
+	close(jobs)
 
 	wg.Wait()
 
-	// Replace includes from end to start to maintain positions
-	for i := len(results) - 1; i >= 0; i-- {
-		res := results[i]
-		endPos := res.position + res.length
-		if endPos > len(b) {
-			endPos = len(b)
+	// Copy into a fresh buffer, as fetched content may be shared with the cache
+	out := make([]byte, 0, len(b))
+	written := 0
+	for _, res := range results {
+		if res.position < written {
+			continue
 		}
+		endPos := min(res.position+res.length, len(b))
 
 		// Replace the include tag with fetched content
-		b = append(b[:res.position], append(res.content, b[endPos:]...)...)
+		out = append(out, b[written:res.position]...)
+		out = append(out, res.content...)
+		written = endPos
 	}
 
-	return b
+	return append(out, b[written:]...)
 }
@@ -1,10 +1,14 @@
 package esi_test
 
 import (
+	"bytes"
+	"context"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/sc0rp10/go-esi/esi"
 )
@@ -112,6 +116,96 @@ func Test_Parse_fullMock(t *testing.T) {
 	verify(t, "full.html")
 }
 
+func Test_Parse_doesNotMutateInput(t *testing.T) {
+	t.Parallel()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("<p>a much longer fragment than the tag it replaces</p>"))
+	}))
+	defer server.Close()
+
+	page := `<html><esi:include src="` + server.URL + `/fragment"/><esi:comment text="dropped"/>` +
+		`<esi:remove>removed</esi:remove><!--esi <p>escaped</p> --><esi:vars>$(HTTP_HOST)</esi:vars></html>`
+
+	// Spare capacity is where an in-place append would write first
+	input := make([]byte, len(page), 4*len(page))
+	copy(input, page)
+	snapshot := bytes.Clone(input[:cap(input)])
+
+	result := esi.Parse(input, getRequest())
+	if !bytes.Contains(result, []byte("much longer fragment")) {
+		t.Fatalf("Expected tags to be processed, got %q", result)
+	}
+
+	if !bytes.Equal(input[:cap(input)], snapshot) {
+		t.Errorf("Expected Parse to leave its input untouched\nExpected: %q\nGiven:    %q", snapshot, input[:cap(input)])
+	}
+}
+
+func Test_Parse_adjacentTags(t *testing.T) {
+	t.Parallel()
+
+	req := getRequest()
+	req.AddCookie(&http.Cookie{Name: "a", Value: "first"})
+	req.AddCookie(&http.Cookie{Name: "b", Value: "second"})
+
+	tests := map[string]string{
+		`<esi:comment text="x"/><esi:comment text="y"/><esi:comment text="z"/>`:        ``,
+		`<esi:vars>$(HTTP_COOKIE{a})</esi:vars><esi:vars>$(HTTP_COOKIE{b})</esi:vars>`: `firstsecond`,
+		`<esi:comment text="x"/><esi:vars>[$(HTTP_COOKIE{a})]</esi:vars><esi:comment text="y"/>` +
+			`<esi:vars>[$(HTTP_COOKIE{b})]</esi:vars>|tail`: `[first][second]|tail`,
+		`<!--esi <b>1</b> --><!--esi <b>2</b> --><esi:vars>$(HTTP_COOKIE{b})</esi:vars>`: `<b>1</b><b>2</b>second`,
+		`a<esi:remove>x</esi:remove><esi:remove>y</esi:remove>b<esi:comment text="z"/>c`: `abc`,
+	}
+
+	for input, expected := range tests {
+		if result := string(esi.Parse([]byte(input), req)); result != expected {
+			t.Errorf("ESI parsing mismatch for %q\nExpected: %q\nGiven:    %q", input, expected, result)
+		}
+	}
+}
+
+func Test_ParseContext_cancellation(t *testing.T) {
+	t.Parallel()
+
+	var requests atomic.Int32
+	cancelled := make(chan struct{}, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		<-r.Context().Done()
+		cancelled <- struct{}{}
+	}))
+	defer server.Close()
+
+	page := []byte(`<p>Page</p><esi:include src="` + server.URL + `/slow" onerror="continue"/>`)
+
+	// A context cancelled beforehand starts no fetch at all
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if result := string(esi.ParseContext(ctx, page, getRequest())); result != "<p>Page</p>" {
+		t.Errorf("Expected the include to be left out, got %q", result)
+	}
+	if got := requests.Load(); got != 0 {
+		t.Errorf("Expected no fetch under a cancelled context, got %d", got)
+	}
+
+	// A deadline stops the fetch in flight
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	esi.ParseContext(ctx, page, getRequest())
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected ParseContext to return at the deadline, took %v", elapsed)
+	}
+
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Error("Expected the fragment request to be cancelled")
+	}
+}
+
 // Benchmarks.
 func BenchmarkInclude(b *testing.B) {
 	for i := 0; i < b.N; i++ {
@@ -178,3 +272,91 @@ func BenchmarkFull(b *testing.B) {
 		)
 	}
 }
+
+func Test_Parse_malformed(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name  string
+		input string
+	}{
+		{"unknown tag", `<p>a</p><esi:unknown text="x"/><p>b</p>`},
+		{"truncated tag name", `<p>a</p><esi:`},
+		{"unterminated include", `<p>a</p><esi:include src="http://127.0.0.1:1/x" <p>b</p>`},
+		{"unterminated comment", `<p>a</p><esi:comment text="x" <p>b</p>`},
+		{"mismatched quotes", `<p>a</p><esi:comment text="x' <p>b</p>`},
+		{"unclosed vars", `<p>a</p><esi:vars>$(HTTP_HOST) <p>b</p>`},
+		{"unclosed remove", `<p>a</p><esi:remove>hidden <p>b</p>`},
+		{"unclosed choose", `<p>a</p><esi:choose><esi:when test="1==1">x</esi:when><p>b</p>`},
+		{"unclosed try", `<p>a</p><esi:try><esi:attempt>x</esi:attempt><p>b</p>`},
+		{"unclosed escape", `<p>a</p><!--esi <p>b</p>`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if result := string(esi.Parse([]byte(tt.input), getRequest())); result != tt.input {
+				t.Errorf("Expected malformed tag to be left verbatim\nExpected: %q\nGiven:    %q", tt.input, result)
+			}
+		})
+	}
+
+	// A well-formed tag after a malformed one is still processed
+	input := `<esi:unknown/><esi:comment text="x"/><esi:comment text="y"`
+	if result := string(esi.Parse([]byte(input), getRequest())); result != `<esi:unknown/><esi:comment text="y"` {
+		t.Errorf("Expected only the well-formed comment to be removed, got %q", result)
+	}
+}
+
+func Test_HasProcessableTags(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name     string
+		input    string
+		expected bool
+	}{
+		{"escaped tag", `<pre>&lt;esi:include src="/x"/&gt;</pre>`, false},
+		{"escaped and real tag", `<pre>&lt;esi:include src="/x"/&gt;</pre><esi:include src="/x"/>`, true},
+		{"mention of the opener", `<p>Tags start with <esi: and end with /></p>`, false},
+		{"unknown tag", `<esi:unknown text="x"/>`, false},
+		{"unclosed tag", `<esi:remove>never closed`, false},
+		{"mention before a real tag", `<p>use <esi:</p><esi:comment text="x"/>`, true},
+		{"escape block", `<!--esi <p>x</p> -->`, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if result := esi.HasProcessableTags([]byte(tt.input)); result != tt.expected {
+				t.Errorf("Expected HasProcessableTags to be %v, got %v", tt.expected, result)
+			}
+		})
+	}
+}
+
+func FuzzParse(f *testing.F) {
+	for _, seed := range []string{
+		`<esi:comment text="x"/>`,
+		`<esi:vars>$(HTTP_HOST)</esi:vars>`,
+		`<esi:remove>x</esi:remove>`,
+		`<!--esi <p>x</p> -->`,
+		`<esi:choose><esi:when test="$(HTTP_HOST)=='a'">a</esi:when><esi:otherwise>b</esi:otherwise></esi:choose>`,
+		`<esi:try><esi:attempt>a</esi:attempt><esi:except>b</esi:except></esi:try>`,
+		`<esi:include src="http://127.0.0.1:1/x"/>`,
+		`<esi:include src="http://127.0.0.1:1/x`,
+		`<esi:comment text="x`,
+		`<esi:`,
+		`<!--esi`,
+		`<!--esi -->`,
+		`<esi:vars</esi:vars>`,
+	} {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, input string) {
+		result := esi.Parse([]byte(input), getRequest())
+
+		if !esi.HasProcessableTags([]byte(input)) && string(result) != input {
+			t.Errorf("Expected a document without processable tags to be returned as is, got %q", result)
+		}
+	})
+}
@@ -0,0 +1,116 @@
+package esi
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	defaultFailureWindow = 30 * time.Second
+	failureBuckets       = 10
+	minFailureSamples    = 10
+)
+
+var failures = &failureTracker{}
+
+// failureBucket counts fetch outcomes within one slice of the rolling window
+type failureBucket struct {
+	slot   int64
+	total  int
+	failed int
+}
+
+// failureTracker keeps a rolling failure rate of fragment fetches across all requests,
+// so a backend-wide outage can be told apart from a single broken fragment.
+type failureTracker struct {
+	mu      sync.Mutex
+	buckets [failureBuckets]failureBucket
+}
+
+// failureWindow returns the configured rolling window
+func failureWindow() time.Duration {
+	cfg := config()
+	if cfg.FailureWindow > 0 {
+		return cfg.FailureWindow
+	}
+
+	return defaultFailureWindow
+}
+
+// slot returns the index of the window slice the current time falls into
+func (f *failureTracker) slot() int64 {
+	width := int64(failureWindow()) / failureBuckets
+	if width <= 0 {
+		width = 1
+	}
+
+	return now().UnixNano() / width
+}
+
+// reset forgets all recorded outcomes
+func (f *failureTracker) reset() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.buckets = [failureBuckets]failureBucket{}
+}
+
+// record adds one fetch outcome to the current window slice
+func (f *failureTracker) record(failed bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	slot := f.slot()
+	b := &f.buckets[slot%failureBuckets]
+	if b.slot != slot {
+		*b = failureBucket{slot: slot}
+	}
+
+	b.total++
+	if failed {
+		b.failed++
+	}
+}
+
+// rate returns the failure rate over the window and the number of fetches it is based on
+func (f *failureTracker) rate() (float64, int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	slot := f.slot()
+
+	var total, failed int
+	for _, b := range f.buckets {
+		if b.total > 0 && slot-b.slot < failureBuckets {
+			total += b.total
+			failed += b.failed
+		}
+	}
+
+	if total == 0 {
+		return 0, 0
+	}
+
+	return float64(failed) / float64(total), total
+}
+
+// FailureRate returns the share of fragment fetches that failed over the rolling window
+func FailureRate() float64 {
+	rate, _ := failures.rate()
+
+	return rate
+}
+
+// GloballyFailing reports whether the fragment failure rate over the rolling window exceeds
+// Config.FailureRateThreshold, which indicates a backend-wide outage rather than one broken
+// fragment. It is always false when no threshold is configured.
+func GloballyFailing() bool {
+	threshold := config().FailureRateThreshold
+	if threshold <= 0 {
+		return false
+	}
+
+	rate, samples := failures.rate()
+
+	return samples >= minFailureSamples && rate >= threshold
+}
@@ -0,0 +1,49 @@
+package esi
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFailureTrackerRollingWindow(t *testing.T) {
+	clock := time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC)
+	withClock(t, &clock)
+	withConfig(t, Config{FailureRateThreshold: 0.5, FailureWindow: 10 * time.Second})
+
+	old := failures
+	failures = &failureTracker{}
+	t.Cleanup(func() { failures = old })
+
+	for range 5 {
+		failures.record(true)
+	}
+	if GloballyFailing() {
+		t.Error("Expected too few samples not to count as a global failure")
+	}
+
+	for range 5 {
+		failures.record(true)
+		failures.record(false)
+	}
+	if rate := FailureRate(); rate != 10.0/15.0 {
+		t.Errorf("Expected failure rate 10/15, got %v", rate)
+	}
+	if !GloballyFailing() {
+		t.Error("Expected sustained failures to be reported as a global failure")
+	}
+
+	// Successes in later slices dilute the older failures
+	clock = clock.Add(5 * time.Second)
+	for range 20 {
+		failures.record(false)
+	}
+	if GloballyFailing() {
+		t.Errorf("Expected recovery once failures subside, rate is %v", FailureRate())
+	}
+
+	// Everything ages out of the window
+	clock = clock.Add(11 * time.Second)
+	if rate := FailureRate(); rate != 0 {
+		t.Errorf("Expected empty window after it elapsed, got rate %v", rate)
+	}
+}
@@ -0,0 +1,52 @@
+package esi
+
+import (
+	"context"
+	"sync"
+)
+
+var hostLimit = &hostLimiter{}
+
+// hostLimiter caps the fragment fetches in flight to each origin across all the pages being
+// assembled, so a burst of renders can't pile up on one backend. It is a semaphore per host,
+// sized by Config.MaxConcurrentPerHost.
+type hostLimiter struct {
+	mu    sync.Mutex
+	hosts map[string]chan struct{}
+}
+
+// reset drops the semaphores so they are sized by the current configuration. Fetches in flight
+// release the semaphore they acquired.
+func (h *hostLimiter) reset() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.hosts = nil
+}
+
+// acquire blocks until a fetch from host is allowed or ctx is done, and returns the function
+// releasing the slot
+func (h *hostLimiter) acquire(ctx context.Context, host string) (func(), error) {
+	limit := config().MaxConcurrentPerHost
+	if limit <= 0 {
+		return func() {}, nil
+	}
+
+	h.mu.Lock()
+	sem, ok := h.hosts[host]
+	if !ok {
+		if h.hosts == nil {
+			h.hosts = make(map[string]chan struct{})
+		}
+		sem = make(chan struct{}, limit)
+		h.hosts[host] = sem
+	}
+	h.mu.Unlock()
+
+	select {
+	case sem <- struct{}{}:
+		return func() { <-sem }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
@@ -0,0 +1,80 @@
+package esi
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestHostLimitAcrossPages(t *testing.T) {
+	cache.Reset()
+	withConfig(t, Config{MaxConcurrentPerHost: 3})
+
+	var mu sync.Mutex
+	active, peak, total := 0, 0, 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		active++
+		total++
+		peak = max(peak, active)
+		mu.Unlock()
+
+		time.Sleep(10 * time.Millisecond)
+
+		mu.Lock()
+		active--
+		mu.Unlock()
+
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+
+	var wg sync.WaitGroup
+	for page := range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			html := []byte(fmt.Sprintf(`<esi:include src="%[1]s/%[2]d/1"/><esi:include src="%[1]s/%[2]d/2"/>`, ts.URL, page))
+			Parse(html, httptest.NewRequest("GET", "http://example.com", nil))
+		}()
+	}
+	wg.Wait()
+
+	if total != 20 {
+		t.Errorf("Expected every include to be fetched, got %d fetches", total)
+	}
+	if peak > 3 {
+		t.Errorf("Expected at most 3 concurrent fetches to the host, peak was %d", peak)
+	}
+}
+
+func TestHostLimitIsPerHost(t *testing.T) {
+	withConfig(t, Config{MaxConcurrentPerHost: 1})
+
+	h := &hostLimiter{}
+	release, err := h.acquire(context.Background(), "a.internal")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer release()
+
+	// Another host has its own slot
+	other, err := h.acquire(context.Background(), "b.internal")
+	if err != nil {
+		t.Fatalf("Expected another host not to wait, got %v", err)
+	}
+	other()
+
+	// The busy host waits until the context is done
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := h.acquire(ctx, "a.internal"); err != context.DeadlineExceeded {
+		t.Errorf("Expected the busy host to wait until the deadline, got %v", err)
+	}
+}
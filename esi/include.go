@@ -2,13 +2,26 @@ package esi
 
 import (
 	"bytes"
+	"cmp"
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"html"
 	"io"
+	"net"
 	"net/http"
 	"net/url"
+	"os"
 	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
 
+	"go.opentelemetry.io/otel/attribute"
 	"go.uber.org/zap"
 )
 
@@ -19,31 +32,194 @@ func SetLogger(l *zap.Logger) {
 	logger = l
 }
 
-const include = "include"
+// Events reported to the fetch observer.
+const (
+	FetchEventStart    = "start"
+	FetchEventComplete = "complete"
+)
 
-var (
-	closeInclude     = regexp.MustCompile("/>")
-	srcAttribute     = regexp.MustCompile(`src="?(.+?)"?( |/>)`)
-	altAttribute     = regexp.MustCompile(`alt="?(.+?)"?( |/>)`)
-	onErrorAttribute = regexp.MustCompile(`onerror="?(.+?)"?( |/>)`)
+// Values of the include onerror attribute and Config.DefaultOnError
+const (
+	// OnErrorContinue removes a failed include from the page
+	OnErrorContinue = "continue"
+	// OnErrorAlt removes a failed include only if it declares an alt, and fails the page otherwise
+	OnErrorAlt = "alt"
+	// OnErrorError fails the page when an include fails, even after trying its alt
+	OnErrorError = "error"
+)
+
+var fetchObserver atomic.Pointer[func(url string, event string)]
+
+// SetFetchObserver sets a callback notified when fragment fetches start and complete.
+// It is meant for tests and debugging (e.g. asserting fetch ordering) and may be called concurrently.
+func SetFetchObserver(observer func(url string, event string)) {
+	if observer == nil {
+		fetchObserver.Store(nil)
+		return
+	}
+	fetchObserver.Store(&observer)
+}
+
+func notifyFetch(url, event string) {
+	if observer := fetchObserver.Load(); observer != nil {
+		(*observer)(url, event)
+	}
+}
 
-	// HTTP client with increased connection pool for parallel ESI fetching
-	httpClient = createHTTPClient()
+const (
+	include = "include"
+
+	defaultMaxAttributeLength   = 4096
+	defaultMaxFragmentRedirects = 10
+	noRecurseHeader             = "X-ESI-No-Recurse"
 )
 
+var (
+	closeInclude      = regexp.MustCompile("/>")
+	srcAttribute      = regexp.MustCompile(`src="?(.+?)"?( |/>)`)
+	altAttribute      = regexp.MustCompile(`alt="?(.+?)"?( |/>)`)
+	altChainAttribute = regexp.MustCompile(`alt(\d+)="?(.+?)"?( |/>)`)
+	onErrorAttribute  = regexp.MustCompile(`onerror="?(.+?)"?( |/>)`)
+	redirectAttribute = regexp.MustCompile(`propagate-redirect="?(.+?)"?( |/>)`)
+	maxWaitAttribute  = regexp.MustCompile(`maxwait="?(\d+)"?( |/>)`)
+	ttlAttribute      = regexp.MustCompile(`ttl="?(\d+)"?( |/>)`)
+	methodAttribute   = regexp.MustCompile(`method="?([A-Za-z]+)"?( |/>)`)
+	entityAttribute   = regexp.MustCompile(`entity=(?:"([^"]*)"|([^\s"/>]+))`)
+	varyAttribute     = regexp.MustCompile(`vary=(?:"([^"]*)"|([^\s"/>]+))`)
+
+	// HTTP client with increased connection pool for parallel ESI fetching, replaced by Configure
+	httpClient atomic.Pointer[http.Client]
+)
+
+// fragmentClient returns the client fetching fragments, built for the current configuration
+func fragmentClient() *http.Client {
+	if client := httpClient.Load(); client != nil {
+		return client
+	}
+
+	httpClient.CompareAndSwap(nil, createHTTPClient())
+
+	return httpClient.Load()
+}
+
 func createHTTPClient() *http.Client {
+	cfg := config()
+
+	// A configured client is used as is, except that it keeps the fragment redirect policy
+	if cfg.HTTPClient != nil {
+		client := *cfg.HTTPClient
+		if client.CheckRedirect == nil {
+			client.CheckRedirect = checkFragmentRedirect
+		}
+
+		return &client
+	}
+
+	transport := &http.Transport{
+		MaxIdleConnsPerHost: 100, // Allow many parallel connections
+		MaxConnsPerHost:     100,
+	}
+
+	// Dial the fragment backend over a Unix socket while keeping HTTP semantics
+	if socket := cfg.FragmentUnixSocket; socket != "" {
+		transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, "unix", socket)
+		}
+	}
+
+	if tlsConfig, err := fragmentTLSConfig(cfg); err != nil {
+		if logger != nil {
+			logger.Error("Failed to load fragment TLS configuration, using defaults", zap.Error(err))
+		}
+	} else {
+		transport.TLSClientConfig = tlsConfig
+	}
+
 	return &http.Client{
-		Transport: &http.Transport{
-			MaxIdleConnsPerHost: 100, // Allow many parallel connections
-			MaxConnsPerHost:     100,
-		},
+		Transport:     transport,
+		CheckRedirect: checkFragmentRedirect,
 	}
 }
 
+// noFollowKey marks fragment requests whose redirects are returned instead of followed
+type noFollowKey struct{}
+
+// checkFragmentRedirect follows redirects like the default client policy, within the limits of
+// Config.MaxFragmentRedirects and Config.SameOriginRedirects, except for requests of includes that
+// propagate redirects to the client
+func checkFragmentRedirect(req *http.Request, via []*http.Request) error {
+	if req.Context().Value(noFollowKey{}) != nil {
+		return http.ErrUseLastResponse
+	}
+
+	if !fragmentAllowed(req.URL) {
+		return fmt.Errorf("%w: redirect to %s", errHostNotAllowed, req.URL)
+	}
+
+	if limit := maxFragmentRedirects(); len(via) > limit {
+		return fmt.Errorf("%w: stopped after %d redirects", errRedirectPolicy, limit)
+	}
+
+	if origin := via[0].URL; config().SameOriginRedirects && (req.URL.Scheme != origin.Scheme || req.URL.Host != origin.Host) {
+		return fmt.Errorf("%w: redirect from %s to another origin %s", errRedirectPolicy, origin, req.URL)
+	}
+
+	return nil
+}
+
+// maxFragmentRedirects returns the number of redirects a fragment fetch may follow
+func maxFragmentRedirects() int {
+	switch redirects := config().MaxFragmentRedirects; {
+	case redirects < 0:
+		return 0
+	case redirects == 0:
+		return defaultMaxFragmentRedirects
+	default:
+		return redirects
+	}
+}
+
+// fragmentTLSConfig builds the TLS configuration for fragment backends from the client certificate
+// and CA files of cfg, or returns nil when none is configured
+func fragmentTLSConfig(cfg *Config) (*tls.Config, error) {
+	if cfg.ClientCert == "" && cfg.CACert == "" {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{}
+
+	if cfg.ClientCert != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.ClientCert, cfg.ClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("loading client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	if cfg.CACert != "" {
+		pem, err := os.ReadFile(cfg.CACert)
+		if err != nil {
+			return nil, fmt.Errorf("reading CA certificate: %w", err)
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", cfg.CACert)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	return tlsConfig, nil
+}
+
 // safe to pass to any origin.
+// The W3C trace context headers are included so fragment fetches continue the page's trace.
 var headersSafe = []string{
 	"Accept",
 	"Accept-Language",
+	"Traceparent",
+	"Tracestate",
 }
 
 // safe to pass only to same-origin (same scheme, same host, same port).
@@ -54,9 +230,71 @@ var headersUnsafe = []string{
 
 type includeTag struct {
 	*baseTag
-	silent bool
-	alt    string
-	src    string
+	onError           string
+	alts              []string // alt, then alt2, alt3 and so on, tried in order when the src fails
+	src               string
+	vary              []string
+	propagateRedirect bool
+	maxWait           time.Duration // how long the include waits for each of its src and alt
+	ttl               int           // seconds the fragment is cached for when hasTTL, 0 not caching it
+	hasTTL            bool
+	method            string // HTTP method of the fragment requests, GET if empty
+	entity            string // request body sent with the method
+}
+
+// fetchOptions are the per-include settings that change how a fragment is fetched
+type fetchOptions struct {
+	// propagateRedirect returns a 3xx response as a redirectError instead of following it
+	propagateRedirect bool
+
+	// cacheKey is the key the fragment is cached under, whose entry is revalidated once expired
+	cacheKey string
+
+	// method and entity are the HTTP method and body of the request, a GET without body if empty
+	method string
+	entity string
+
+	// retry fetches the fragment again after transient failures, see Config.FragmentRetries
+	retry bool
+
+	// ttl overrides the caching headers of the response when hasTTL, see fragmentTTL
+	ttl    int
+	hasTTL bool
+}
+
+// fetchNotesKey attaches the fetchNotes of a fragment fetch to its request
+type fetchNotesKey struct{}
+
+// fetchNotes is what a fragment fetch tells the cache about its response. It travels on the request
+// of the response rather than in its headers, which the backend could set itself.
+type fetchNotes struct {
+	// assembled is set when nested ESI tags of the body were processed, see fragmentMeta
+	assembled bool
+	// truncated is set when a nested include was left out for depth or a cycle, see fragmentMeta
+	truncated bool
+	// ttl is the ttl attribute of the include when hasTTL, see fragmentTTL
+	ttl    int
+	hasTTL bool
+}
+
+// notesOf returns the notes of the fragment fetch resp answers, or nil
+func notesOf(resp *http.Response) *fetchNotes {
+	if resp == nil || resp.Request == nil {
+		return nil
+	}
+
+	notes, _ := resp.Request.Context().Value(fetchNotesKey{}).(*fetchNotes)
+	return notes
+}
+
+// redirectError reports a fragment redirect that must be passed on to the client
+type redirectError struct {
+	statusCode int
+	location   string
+}
+
+func (e *redirectError) Error() string {
+	return fmt.Sprintf("fragment redirected with %d to %s", e.statusCode, e.location)
 }
 
 func (i *includeTag) loadAttributes(b []byte) error {
@@ -65,21 +303,109 @@ func (i *includeTag) loadAttributes(b []byte) error {
 		return errNotFound
 	}
 
+	maxLength := config().MaxAttributeLength
+	if maxLength <= 0 {
+		maxLength = defaultMaxAttributeLength
+	}
+
+	if len(src[1]) > maxLength {
+		return errAttributeTooLong
+	}
+
 	i.src = string(src[1])
 
 	alt := altAttribute.FindSubmatch(b)
 	if alt != nil {
-		i.alt = string(alt[1])
+		if len(alt[1]) > maxLength {
+			return errAttributeTooLong
+		}
+		i.alts = append(i.alts, string(alt[1]))
+	}
+
+	// Further fallbacks are tried in the order of their number, alt2, alt3 and so on
+	chain := altChainAttribute.FindAllSubmatch(b, -1)
+	slices.SortStableFunc(chain, func(a, b [][]byte) int {
+		x, _ := strconv.Atoi(string(a[1]))
+		y, _ := strconv.Atoi(string(b[1]))
+		return cmp.Compare(x, y)
+	})
+	for _, alt := range chain {
+		if len(alt[2]) > maxLength {
+			return errAttributeTooLong
+		}
+		i.alts = append(i.alts, string(alt[2]))
 	}
 
 	onError := onErrorAttribute.FindSubmatch(b)
 	if onError != nil {
-		i.silent = string(onError[1]) == "continue"
+		i.onError = string(onError[1])
+	}
+
+	if redirect := redirectAttribute.FindSubmatch(b); redirect != nil {
+		i.propagateRedirect, _ = strconv.ParseBool(string(redirect[1]))
+	}
+
+	if method := methodAttribute.FindSubmatch(b); method != nil {
+		i.method = strings.ToUpper(string(method[1]))
+	}
+
+	if entity := entityAttribute.FindSubmatch(b); entity != nil {
+		if len(entity[1])+len(entity[2]) > maxLength {
+			return errAttributeTooLong
+		}
+		i.entity = html.UnescapeString(string(entity[1]) + string(entity[2]))
+	}
+
+	if maxWait := maxWaitAttribute.FindSubmatch(b); maxWait != nil {
+		if ms, err := strconv.Atoi(string(maxWait[1])); err == nil {
+			i.maxWait = time.Duration(ms) * time.Millisecond
+		}
+	}
+
+	if ttl := ttlAttribute.FindSubmatch(b); ttl != nil {
+		if seconds, err := strconv.Atoi(string(ttl[1])); err == nil {
+			i.ttl, i.hasTTL = seconds, true
+		}
+	}
+
+	// A quoted header list may contain spaces after the commas
+	vary := varyAttribute.FindSubmatch(b)
+	if vary != nil {
+		for _, name := range strings.Split(string(vary[1])+string(vary[2]), ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				i.vary = append(i.vary, http.CanonicalHeaderKey(name))
+			}
+		}
 	}
 
 	return nil
 }
 
+// cacheKey returns the cache key of a fragment URL for this include, which carries the values
+// of the request headers declared in its vary attribute so each variant is cached separately.
+// Config.CacheKeyFunc, if set, derives the key from the URL first.
+func (i *includeTag) cacheKey(url string, req *http.Request) string {
+	cfg := config()
+	base := url
+	if cfg.CacheKeyFunc != nil {
+		base = cfg.CacheKeyFunc(req, url)
+	}
+
+	if len(i.vary) == 0 && !i.propagateRedirect {
+		return base
+	}
+
+	var key strings.Builder
+	key.WriteString(base)
+
+	// Redirects are followed for other includes of the URL, so their content differs
+	if i.propagateRedirect {
+		key.WriteString("\npropagate-redirect")
+	}
+
+	return variantKey(key.String(), i.vary, req.Header)
+}
+
 func sanitizeURL(u string, reqURL *url.URL) string {
 	parsed, err := url.Parse(u)
 	if err != nil || parsed == nil {
@@ -102,6 +428,30 @@ func addHeaders(headers []string, req *http.Request, rq *http.Request) {
 	}
 }
 
+// forwardHeaders sets the headers of a fragment request: those of the page request that are safe
+// to forward to the fragment's origin, then the configured ones
+func forwardHeaders(req *http.Request, rq *http.Request) {
+	addHeaders(headersSafe, req, rq)
+
+	if rq.URL.Scheme == req.URL.Scheme && rq.URL.Host == req.URL.Host {
+		addHeaders(headersUnsafe, req, rq)
+	}
+
+	// Set custom headers if configured (like proxy_set_header), whatever the fragment's origin.
+	// They come last so the operator's values replace any forwarded from the client
+	setCustomHeaders(rq)
+}
+
+// setConditionalHeaders makes a fragment request conditional on the validators of its cached version
+func setConditionalHeaders(rq *http.Request, meta fragmentMeta) {
+	if meta.etag != "" {
+		rq.Header.Set("If-None-Match", meta.etag)
+	}
+	if meta.modified != "" {
+		rq.Header.Set("If-Modified-Since", meta.modified)
+	}
+}
+
 // Input (e.g. include src="https://domain.com/esi-include" alt="https://domain.com/alt-esi-include" />)
 // With or without the alt
 // With or without a space separator before the closing
@@ -118,72 +468,519 @@ func (i *includeTag) Process(b []byte, req *http.Request) ([]byte, int) {
 		return nil, len(b)
 	}
 
+	result, err := i.fetch(req)
+	if err != nil {
+		return result, len(b)
+	}
+
+	return result, i.length
+}
+
+// fetch retrieves the include content through the fragment cache, falling back to the alt URL
+// when the main one fails. The alt fallback is applied per tag, so includes sharing a src
+// share its cached success while keeping their own fallback.
+func (i *includeTag) fetch(req *http.Request) ([]byte, error) {
+	cfg := config()
+
 	// Resolve fragment URL (uses configured base_url if set)
-	cacheKey := resolveFragmentURL(i.src, req.URL)
-	startTime := time.Now()
+	fragmentURL := resolveFragmentURL(i.src, req)
+
+	opts := fetchOptions{
+		propagateRedirect: i.propagateRedirect,
+		method:            i.method,
+		entity:            i.entity,
+		retry:             true,
+		ttl:               i.ttl,
+		hasTTL:            i.hasTTL,
+	}
+	var (
+		result []byte
+		meta   fragmentMeta
+	)
+	start := now()
+
+	// An include nested too deep or in a cycle fails without being fetched, so its alt and onerror apply
+	err := allowInclude(req, fragmentURL)
+	if err == nil {
+		var ok bool
+		result, meta, ok, err = fetchWithin(cfg.PlaceholderThreshold, i.maxWait, fragmentURL, i.cacheKey(fragmentURL, req), req, opts)
+		if !ok {
+			return placeholder(i.src), nil
+		}
+	}
+	recordFragment(req, fragmentURL, meta, now().Sub(start), err)
+
+	// A propagated redirect replaces the whole page, the alt is irrelevant
+	var redirect *redirectError
+	if errors.As(err, &redirect) {
+		redirectPage(req, redirect.statusCode, redirect.location)
+		return nil, err
+	}
+
+	// Try the alt URLs in order while the previous one failed
+	for _, alt := range i.alts {
+		if err == nil {
+			break
+		}
+
+		fragmentURL = resolveFragmentURL(alt, req)
+		opts.retry = false
+
+		start = now()
+		result, meta = nil, fragmentMeta{}
+		if err = allowInclude(req, fragmentURL); err == nil {
+			result, meta, _, err = fetchWithin(0, i.maxWait, fragmentURL, i.cacheKey(fragmentURL, req), req, opts)
+		}
+		recordFragment(req, fragmentURL, meta, now().Sub(start), err)
+	}
+
+	if err == nil && cfg.DebugBoundaries {
+		result = wrapBoundaries(result, fragmentURL)
+	}
+
+	// The bytes of nested includes expanded by this fetch were charged already
+	if err == nil && !budgetFrom(req).consume(max(len(result)-int(meta.charged), 0), fragmentURL) {
+		result, err = nil, errBudgetExceeded
+	}
+
+	// Within an esi:attempt block the failure renders the except block instead
+	if err != nil && !failAttempt(req) && i.failsPage() {
+		failPage(req, fmt.Errorf("include %s: %w", fragmentURL, err))
+	}
+
+	// Rather than vanishing, the include leaves a trace of its failure in the page
+	if err != nil && cfg.DebugPlaceholders && i.onError != OnErrorContinue {
+		result = failurePlaceholder(fragmentURL, meta.statusCode)
+	}
+
+	return result, err
+}
+
+// failsPage reports whether a failed include must fail the whole page rather than being
+// removed, following its onerror attribute or else Config.DefaultOnError
+func (i *includeTag) failsPage() bool {
+	mode := i.onError
+	if mode == "" {
+		mode = config().DefaultOnError
+	}
+
+	switch mode {
+	case OnErrorError:
+		return true
+	case OnErrorAlt:
+		return len(i.alts) == 0
+	default:
+		return false
+	}
+}
+
+// fetchWithin fetches a fragment like fetchFragment, but gives up waiting after threshold and reports
+// false, or after maxWait and fails with errMaxWaitExceeded, leaving the fetch to complete in the
+// background, where it fills the cache. A threshold or maxWait <= 0 doesn't limit the wait.
+func fetchWithin(threshold, maxWait time.Duration, url, key string, req *http.Request, opts fetchOptions) ([]byte, fragmentMeta, bool, error) {
+	if threshold <= 0 && maxWait <= 0 {
+		result, meta, err := fetchFragment(url, key, req, opts)
+		return result, meta, true, err
+	}
+
+	type outcome struct {
+		result []byte
+		meta   fragmentMeta
+		err    error
+	}
+
+	// The fetch outlives the request when the wait is cut short, so it isn't cancelled with it
+	req = req.WithContext(context.WithoutCancel(req.Context()))
+
+	done := make(chan outcome, 1)
+	go func() {
+		result, meta, err := fetchFragment(url, key, req, opts)
+		done <- outcome{result, meta, err}
+	}()
+
+	// A nil channel never fires, leaving the corresponding limit out of the select
+	var thresholdC, maxWaitC <-chan time.Time
+	if threshold > 0 {
+		timer := time.NewTimer(threshold)
+		defer timer.Stop()
+		thresholdC = timer.C
+	}
+	if maxWait > 0 {
+		timer := time.NewTimer(maxWait)
+		defer timer.Stop()
+		maxWaitC = timer.C
+	}
+
+	select {
+	case o := <-done:
+		return o.result, o.meta, true, o.err
+	case <-thresholdC:
+		if logger != nil {
+			logger.Info("ESI include exceeded placeholder threshold, rendering placeholder",
+				zap.String("url", url),
+				zap.Duration("threshold", threshold))
+		}
+		return nil, fragmentMeta{}, false, nil
+	case <-maxWaitC:
+		if logger != nil {
+			logger.Warn("ESI include exceeded maxwait, abandoning it",
+				zap.String("url", url),
+				zap.Duration("maxwait", maxWait))
+		}
+		return nil, fragmentMeta{}, true, fmt.Errorf("%w: %s", errMaxWaitExceeded, maxWait)
+	}
+}
+
+// placeholder returns the markup standing in for an include whose fragment is still being fetched
+func placeholder(src string) []byte {
+	return []byte(`<span class="esi-placeholder" data-esi-src="` + html.EscapeString(src) + `">` +
+		config().Placeholder + `</span>`)
+}
+
+// wrapBoundaries surrounds fragment content with comments marking where it came from
+func wrapBoundaries(content []byte, url string) []byte {
+	wrapped := make([]byte, 0, len(content)+len(url)+40)
+	wrapped = append(wrapped, "<!-- esi:begin src="+url+" -->"...)
+	wrapped = append(wrapped, content...)
+
+	return append(wrapped, "<!-- esi:end -->"...)
+}
+
+// failurePlaceholder returns the comment replacing an include of url that failed with the given
+// status code, 0 if no response was received
+func failurePlaceholder(url string, statusCode int) []byte {
+	if statusCode == 0 {
+		return []byte("<!-- esi:include failed src=" + url + " -->")
+	}
+
+	return []byte("<!-- esi:include failed src=" + url + " status=" + strconv.Itoa(statusCode) + " -->")
+}
+
+// cancelContext carries the deadline and cancellation of a request's context but none of its
+// values, which belong to the page being processed rather than to the fragment fetched for it
+type cancelContext struct {
+	context.Context
+}
+
+func (cancelContext) Value(any) any {
+	return nil
+}
+
+// fetchFragment fetches a single fragment URL through the cache and recursively parses nested ESI tags.
+// Responses with a status >= 400 are reported as errors. The result of a GET is cached under key.
+func fetchFragment(url, key string, req *http.Request, opts fetchOptions) (data []byte, meta fragmentMeta, err error) {
+	if err := checkFragmentURL(url); err != nil {
+		return nil, fragmentMeta{}, err
+	}
+
+	// The span is the parent of the backend request, and of the spans of nested includes
+	ctx, span := startSpan(req.Context(), "esi.include", attribute.String("esi.fragment_url", url))
+
+	// The nested includes of a fragment this request fetches are charged as they are expanded
+	budget := budgetFrom(req).fetch()
+	if budget != nil {
+		ctx = context.WithValue(ctx, budgetKey{}, budget)
+	}
+	req = req.WithContext(ctx)
+	var fetched atomic.Bool
+	defer func() {
+		meta.fetched = fetched.Load()
+		if meta.fetched {
+			meta.charged = budget.charged()
+		}
+		endIncludeSpan(span, meta, err)
+	}()
+	fetcher := func(req *http.Request) func() ([]byte, *http.Response, error) {
+		fetch := fragmentFetcher(url, req, opts)
+		return func() ([]byte, *http.Response, error) {
+			fetched.Store(true)
+			return fetch()
+		}
+	}
+
+	// Only GET requests without a body are cached, others may have side effects or vary by their body.
+	// An include with ttl="0" opts out of the cache too.
+	if (opts.method != "" && opts.method != http.MethodGet) || opts.entity != "" || (opts.hasTTL && opts.ttl == 0) {
+		data, resp, err := fetcher(req)()
+		return data, newFragmentMeta(resp), err
+	}
+
+	key = lookupKey(url, key, req)
+	opts.cacheKey = key
+
+	// Expired content within its stale-while-revalidate window is served at once, while it is
+	// refreshed in the background, detached from the request that may be over by then
+	detached := req.WithContext(context.WithoutCancel(req.Context()))
+	if data, meta, ok := cache.GetStale(key, fragmentFetcher(url, detached, opts)); ok {
+		return data, meta, nil
+	}
 
 	// Use GetOrFetch to prevent cache stampede
-	result, err := cache.GetOrFetch(cacheKey, func() ([]byte, *http.Response, error) {
-		// Fetch the main URL
-		rq, _ := http.NewRequestWithContext(context.Background(), http.MethodGet, cacheKey, nil)
-		addHeaders(headersSafe, req, rq)
+	return cache.GetOrFetch(key, fetcher(req))
+}
+
+// lookupKey returns the key the fragment url is looked up under for req: key itself, or the key
+// of a variant if its responses varied by request headers, by the values a fetch for req would send
+func lookupKey(url, key string, req *http.Request) string {
+	if names := cache.varyBy(key); len(names) > 0 {
+		if rq, err := http.NewRequest(http.MethodGet, url, nil); err == nil {
+			forwardHeaders(req, rq)
+			key = responseVariantKey(key, names, rq.Header)
+		}
+	}
+
+	return key
+}
 
-		// Set custom headers if configured (like proxy_set_header)
-		setCustomHeaders(rq)
+// fragmentFetcher returns the function fetching url from its backend, bypassing the cache
+func fragmentFetcher(url string, req *http.Request, opts fetchOptions) func() ([]byte, *http.Response, error) {
+	cfg := config()
+	fetch := fragmentAttempt(url, req, opts)
+	if !opts.retry || cfg.FragmentRetries <= 0 {
+		return fetch
+	}
 
-		if rq.URL.Scheme == req.URL.Scheme && rq.URL.Host == req.URL.Host {
-			addHeaders(headersUnsafe, req, rq)
+	// Retrying within the fetch function keeps it to the request fetching for the cache, the
+	// others sharing its result wait for the last attempt
+	return func() ([]byte, *http.Response, error) {
+		backoff := fragmentRetryBackoff()
+		for attempt := 0; ; attempt++ {
+			data, resp, err := fetch()
+			if attempt == cfg.FragmentRetries || !transientFailure(resp, err) {
+				return data, resp, err
+			}
+
+			if logger != nil {
+				logger.Warn("ESI include fetch failed, retrying",
+					zap.String("url", url),
+					zap.Int("attempt", attempt+1),
+					zap.Duration("backoff", backoff),
+					zap.Error(err))
+			}
+
+			timer := time.NewTimer(backoff)
+			select {
+			case <-req.Context().Done():
+				timer.Stop()
+				return data, resp, err
+			case <-timer.C:
+			}
+			backoff *= 2
 		}
+	}
+}
 
-		response, fetchErr := httpClient.Do(rq)
+// pageCancelled marks the error of a fetch aborted because the page request was cancelled or hit
+// its deadline as a cancellation, which says nothing about the fragment: it is neither retried nor
+// remembered, and the requests sharing the fetch make their own
+func pageCancelled(req *http.Request, err error) error {
+	if req.Context().Err() == nil || errors.Is(err, context.Canceled) {
+		return err
+	}
+
+	return fmt.Errorf("%w: %w", context.Canceled, err)
+}
+
+// transientFailure reports whether a failed fetch may succeed if tried again: network errors
+// and 5xx responses, but not a cancelled request or a fragment refused by configuration
+func transientFailure(resp *http.Response, err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, errHostNotAllowed) || errors.Is(err, errCircuitOpen) ||
+		errors.Is(err, errRedirectPolicy) {
+		return false
+	}
+
+	return resp == nil || resp.StatusCode >= http.StatusInternalServerError
+}
+
+// fragmentAttempt returns the function making one request for url to its backend
+func fragmentAttempt(url string, req *http.Request, opts fetchOptions) func() ([]byte, *http.Response, error) {
+	return func() (data []byte, resp *http.Response, err error) {
+		startTime := time.Now()
+		notifyFetch(url, FetchEventStart)
+		defer notifyFetch(url, FetchEventComplete)
+		defer func() {
+			failures.record(err != nil && !errors.Is(err, errBudgetExceeded) && !errors.Is(err, context.Canceled))
+		}()
+
+		// Cancelled along with the request, e.g. when the client disconnects, and by Shutdown
+		ctx, stop, current := withShutdown(cancelContext{req.Context()})
+		defer stop()
+		defer func() {
+			if err != nil && current.Err() != nil {
+				err = fmt.Errorf("%w: %w", errShutdown, err)
+			}
+		}()
+		if opts.propagateRedirect {
+			ctx = context.WithValue(ctx, noFollowKey{}, true)
+		}
+
+		// The backend request and nested includes are traced under the span of the include
+		ctx = withSpanOf(ctx, req.Context())
+
+		// Nested includes draw from the budget of the page being assembled
+		budget := budgetFrom(req)
+		if budget != nil {
+			ctx = context.WithValue(ctx, budgetKey{}, budget)
+		}
+
+		// Nested includes know which fragments they are nested in
+		ctx = context.WithValue(ctx, includeChainKey{}, chainFrom(req).push(url))
+
+		notes := &fetchNotes{ttl: opts.ttl, hasTTL: opts.hasTTL}
+		ctx = context.WithValue(ctx, fetchNotesKey{}, notes)
+
+		method, body := http.MethodGet, io.Reader(nil)
+		if opts.method != "" {
+			method = opts.method
+		}
+		if opts.entity != "" {
+			body = strings.NewReader(opts.entity)
+		}
+
+		rq, err := http.NewRequestWithContext(ctx, method, url, body)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		// A host whose circuit is open fails at once, rather than making the page wait for it again
+		if err := breaker.allow(rq.URL.Host); err != nil {
+			return nil, nil, err
+		}
+		defer func() {
+			if !errors.Is(err, context.Canceled) {
+				breaker.record(rq.URL.Host, transientFailure(resp, err))
+			}
+		}()
+
+		// The timeout covers reading the body too, so it is applied to the whole closure
+		if timeout := fetchTimeout(rq.URL); timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+			rq = rq.WithContext(ctx)
+		}
+
+		forwardHeaders(req, rq)
+		injectTraceContext(ctx, rq)
+
+		// Compressed fragments are decoded once read, whatever the client accepts
+		if rq.Header.Get("Accept-Encoding") == "" {
+			rq.Header.Set("Accept-Encoding", acceptedEncodings)
+		}
+
+		// The entity is sent form-encoded unless a configured header says otherwise
+		if body != nil && rq.Header.Get("Content-Type") == "" {
+			rq.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+
+		// An expired entry is revalidated rather than downloaded again
+		if opts.cacheKey != "" {
+			if cached, ok := cache.peek(opts.cacheKey); ok {
+				setConditionalHeaders(rq, cached.meta)
+			}
+		}
+
+		// The host and warm-up slots are held until the body is read, but not while parsing nested includes
+		releaseHost, err := hostLimit.acquire(ctx, rq.URL.Host)
+		if err != nil {
+			return nil, nil, pageCancelled(req, err)
+		}
+		if err := warmUp.acquire(ctx); err != nil {
+			releaseHost()
+			return nil, nil, pageCancelled(req, err)
+		}
+		response, fetchErr := fragmentClient().Do(rq)
 		elapsed := time.Since(startTime)
 		if logger != nil {
 			logger.Info("ESI include fetch completed",
-				zap.String("url", cacheKey),
+				zap.String("url", url),
 				zap.Duration("duration", elapsed),
 				zap.Error(fetchErr))
 		}
-		newReq := rq
 
-		// Try alt URL if main failed
-		if (fetchErr != nil || response.StatusCode >= 400) && i.alt != "" {
-			altKey := sanitizeURL(i.alt, req.URL)
-			rq, _ = http.NewRequestWithContext(context.Background(), http.MethodGet, altKey, nil)
-			addHeaders(headersSafe, req, rq)
+		if fetchErr != nil {
+			warmUp.release()
+			releaseHost()
+			observeFetch(elapsed, 0, fetchErr)
+			return nil, nil, pageCancelled(req, fetchErr)
+		}
 
-			if rq.URL.Scheme == req.URL.Scheme && rq.URL.Host == req.URL.Host {
-				addHeaders(headersUnsafe, req, rq)
+		// A connection dropped mid-stream (e.g. a truncated chunked body) is a failure,
+		// the partial content must not be served or cached as complete
+		var buf bytes.Buffer
+		_, readErr := io.Copy(&buf, response.Body)
+		response.Body.Close()
+		warmUp.release()
+		releaseHost()
+		observeFetch(time.Since(startTime), response.StatusCode, readErr)
+
+		if readErr != nil {
+			if logger != nil {
+				logger.Warn("ESI include body read failed",
+					zap.String("url", url),
+					zap.Int("bytes_read", buf.Len()),
+					zap.Error(readErr))
 			}
+			return nil, nil, pageCancelled(req, readErr)
+		}
+
+		if location := response.Header.Get("Location"); opts.propagateRedirect && location != "" &&
+			response.StatusCode >= 300 && response.StatusCode < 400 {
+			return nil, response, &redirectError{statusCode: response.StatusCode, location: location}
+		}
+
+		if response.StatusCode >= 400 {
+			return nil, response, fmt.Errorf("%w: %d", errUnexpectedStatus, response.StatusCode)
+		}
+
+		// The cache reuses the content of the entry it revalidated
+		if response.StatusCode == http.StatusNotModified {
+			return nil, response, nil
+		}
+
+		if err := checkContentType(response); err != nil {
+			return nil, response, err
+		}
 
-			response, fetchErr = httpClient.Do(rq)
-			newReq = rq
+		content, decodeErr := decodeContent(response, buf.Bytes())
+		if decodeErr != nil {
+			return nil, response, decodeErr
+		}
 
-			if !i.silent && (fetchErr != nil || response.StatusCode >= 400) {
-				return nil, nil, fetchErr
+		// A fragment identifier selects the element with that id instead of the whole document
+		if id := rq.URL.Fragment; id != "" {
+			element, ok := selectElementByID(content, id)
+			if !ok {
+				return nil, response, fmt.Errorf("%w: #%s", errElementNotFound, id)
 			}
+			content = element
 		}
 
-		if response == nil {
-			return nil, nil, fetchErr
+		// A fragment may opt out of re-scanning, its body is then inserted verbatim
+		if noRecurse, _ := strconv.ParseBool(response.Header.Get(noRecurseHeader)); noRecurse {
+			return transformFragment(url, content), response, nil
 		}
 
-		var buf bytes.Buffer
-		defer response.Body.Close()
-		_, _ = io.Copy(&buf, response.Body)
+		// Recursively parse nested ESI tags, the result then changes with the nested fragments
+		notes.assembled = HasOpenedTags(content)
+		parsedContent, nested := ParseWithResult(content, rq)
 
-		rawContent := buf.Bytes()
+		// Content missing truncated includes must not be cached as complete
+		if budget.isExceeded() {
+			return nil, response, errBudgetExceeded
+		}
 
-		// Recursively parse nested ESI tags
-		parsedContent := Parse(rawContent, newReq)
+		// A nested include failing its page fails the fragment, so the include of the fragment
+		// handles it with its alt and onerror whether the fragment is cached or not
+		if err := nested.Err(); err != nil {
+			return nil, response, err
+		}
 
-		return parsedContent, response, nil
-	})
+		// Content missing includes cut for depth or a cycle is only complete where it was included
+		notes.truncated = nested.isTruncated()
 
-	if err != nil {
-		return nil, len(b)
+		return transformFragment(url, parsedContent), response, nil
 	}
-
-	return result, i.length
 }
 
 func (*includeTag) HasClose(b []byte) bool {
@@ -212,62 +1009,8 @@ func (i *includeTag) FetchContent(b []byte, req *http.Request) []byte {
 		return nil
 	}
 
-	// Resolve fragment URL (uses configured base_url if set)
-	cacheKey := resolveFragmentURL(i.src, req.URL)
-
-	// Use GetOrFetch to prevent cache stampede
-	result, err := cache.GetOrFetch(cacheKey, func() ([]byte, *http.Response, error) {
-		// Fetch the main URL
-		rq, _ := http.NewRequestWithContext(context.Background(), http.MethodGet, cacheKey, nil)
-		addHeaders(headersSafe, req, rq)
-
-		// Set custom headers if configured (like proxy_set_header)
-		setCustomHeaders(rq)
-
-		if rq.URL.Scheme == req.URL.Scheme && rq.URL.Host == req.URL.Host {
-			addHeaders(headersUnsafe, req, rq)
-		}
-
-		response, fetchErr := httpClient.Do(rq)
-		newReq := rq
-
-		// Try alt URL if main failed
-		if (fetchErr != nil || response.StatusCode >= 400) && i.alt != "" {
-			altKey := sanitizeURL(i.alt, req.URL)
-			rq, _ = http.NewRequestWithContext(context.Background(), http.MethodGet, altKey, nil)
-			addHeaders(headersSafe, req, rq)
-
-			if rq.URL.Scheme == req.URL.Scheme && rq.URL.Host == req.URL.Host {
-				addHeaders(headersUnsafe, req, rq)
-			}
-
-			response, fetchErr = httpClient.Do(rq)
-			newReq = rq
-
-			if !i.silent && (fetchErr != nil || response.StatusCode >= 400) {
-				return nil, nil, fetchErr
-			}
-		}
-
-		if response == nil {
-			return nil, nil, fetchErr
-		}
-
-		var buf bytes.Buffer
-		defer response.Body.Close()
-		_, _ = io.Copy(&buf, response.Body)
-
-		rawContent := buf.Bytes()
-
-		// Recursively parse nested ESI tags
-		parsedContent := Parse(rawContent, newReq)
-
-		return parsedContent, response, nil
-	})
-
-	if err != nil {
-		return nil
-	}
+	// A failed include is removed, unless it is replaced by a debug placeholder
+	result, _ := i.fetch(req)
 
 	return result
 }
@@ -0,0 +1,1455 @@
+package esi
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestIncludeDebugBoundaries(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("<p>Fragment</p>"))
+	}))
+	defer ts.Close()
+
+	html := `<div><esi:include src="` + ts.URL + `/boundaries" /></div>`
+	req := httptest.NewRequest("GET", "http://example.com", nil)
+
+	if result := string(Parse([]byte(html), req)); result != "<div><p>Fragment</p></div>" {
+		t.Errorf("Expected no boundary comments by default, got %q", result)
+	}
+
+	withConfig(t, Config{DebugBoundaries: true})
+
+	expected := "<div><!-- esi:begin src=" + ts.URL + "/boundaries --><p>Fragment</p><!-- esi:end --></div>"
+	if result := string(Parse([]byte(html), req)); result != expected {
+		t.Errorf("Expected boundary comments around fragment\nExpected: %q\nGiven:    %q", expected, result)
+	}
+}
+
+func TestIncludeDebugPlaceholders(t *testing.T) {
+	cache.Reset()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer ts.Close()
+
+	html := `<div><esi:include src="` + ts.URL + `/broken" /></div>`
+	req := httptest.NewRequest("GET", "http://example.com", nil)
+
+	withConfig(t, Config{})
+	if result := string(Parse([]byte(html), req)); result != "<div></div>" {
+		t.Errorf("Expected failed includes to be removed by default, got %q", result)
+	}
+
+	withConfig(t, Config{DebugPlaceholders: true})
+
+	expected := "<div><!-- esi:include failed src=" + ts.URL + "/broken status=500 --></div>"
+	if result := string(Parse([]byte(html), req)); result != expected {
+		t.Errorf("Expected a placeholder for the failed include\nExpected: %q\nGiven:    %q", expected, result)
+	}
+
+	// A fetch without a response has no status
+	unreachable := `<div><esi:include src="http://127.0.0.1:1/down" /></div>`
+	expected = "<div><!-- esi:include failed src=http://127.0.0.1:1/down --></div>"
+	if result := string(Parse([]byte(unreachable), req)); result != expected {
+		t.Errorf("Expected a placeholder without status\nExpected: %q\nGiven:    %q", expected, result)
+	}
+
+	// onerror="continue" asks for the include to be removed silently
+	silent := `<div><esi:include src="` + ts.URL + `/broken" onerror="continue" /></div>`
+	if result := string(Parse([]byte(silent), req)); result != "<div></div>" {
+		t.Errorf("Expected onerror=continue to remove the include, got %q", result)
+	}
+}
+
+func TestIncludeTruncatedBodyFallsBack(t *testing.T) {
+	cache.Reset()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/alt" {
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte("<p>Alt</p>"))
+			return
+		}
+
+		// Start a chunked response and drop the connection mid-stream
+		conn, buf, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Errorf("Hijack failed: %v", err)
+			return
+		}
+		buf.WriteString("HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n8\r\n<p>Part")
+		buf.Flush()
+		conn.Close()
+	}))
+	defer ts.Close()
+
+	html := `<esi:include src="` + ts.URL + `/truncated" alt="` + ts.URL + `/alt" />`
+	req := httptest.NewRequest("GET", "http://example.com", nil)
+
+	if result := string(Parse([]byte(html), req)); result != "<p>Alt</p>" {
+		t.Errorf("Expected truncated fragment to fall back to alt, got %q", result)
+	}
+
+	if _, _, ok := cache.Load(ts.URL + "/truncated"); ok {
+		t.Error("Expected truncated fragment not to be cached")
+	}
+}
+
+func TestIncludeOverUnixSocket(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "fragments.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Skipf("Unix sockets unavailable: %v", err)
+	}
+
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("<p>" + r.Host + r.URL.Path + "</p>"))
+	}))
+	ts.Listener = listener
+	ts.Start()
+	defer ts.Close()
+
+	withConfig(t, Config{FragmentUnixSocket: socket})
+
+	html := `<esi:include src="http://fragments.internal/over-socket" />`
+	result := Parse([]byte(html), httptest.NewRequest("GET", "http://example.com", nil))
+	if string(result) != "<p>fragments.internal/over-socket</p>" {
+		t.Errorf("Expected fragment fetched over the Unix socket, got %q", result)
+	}
+}
+
+func TestIncludeForwardsTraceContext(t *testing.T) {
+	const traceparent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+	var gotParent, gotState string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotParent = r.Header.Get("traceparent")
+		gotState = r.Header.Get("tracestate")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+
+	// The page is served from another origin than the fragment
+	req := httptest.NewRequest("GET", "http://example.com", nil)
+	req.Header.Set("traceparent", traceparent)
+	req.Header.Set("tracestate", "vendor=value")
+
+	Parse([]byte(`<esi:include src="`+ts.URL+`/traced" />`), req)
+
+	if gotParent != traceparent {
+		t.Errorf("Expected traceparent %q on fragment request, got %q", traceparent, gotParent)
+	}
+	if gotState != "vendor=value" {
+		t.Errorf("Expected tracestate on fragment request, got %q", gotState)
+	}
+}
+
+func TestIncludeRejectsOverlongAttributes(t *testing.T) {
+	withConfig(t, Config{MaxAttributeLength: 256})
+
+	requestCount := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestCount++
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+
+	req := httptest.NewRequest("GET", "http://example.com", nil)
+	long := strings.Repeat("a", 300)
+
+	Parse([]byte(`<esi:include src="`+ts.URL+`/`+long+`" />`), req)
+	Parse([]byte(`<esi:include src="`+ts.URL+`/missing" alt="`+ts.URL+`/`+long+`" />`), req)
+	if requestCount != 0 {
+		t.Errorf("Expected includes with over-long attributes not to be fetched, got %d requests", requestCount)
+	}
+
+	i := &includeTag{baseTag: newBaseTag()}
+	if err := i.loadAttributes([]byte(`src="` + ts.URL + `/` + long + `" `)); !errors.Is(err, errAttributeTooLong) {
+		t.Errorf("Expected errAttributeTooLong, got %v", err)
+	}
+}
+
+func TestIncludeNoRecurseHeader(t *testing.T) {
+	cache.Reset()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/nested" {
+			t.Errorf("Nested include should not be fetched")
+		}
+
+		w.Header().Set("X-ESI-No-Recurse", "1")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(`<p><esi:include src="/nested" /></p>`))
+	}))
+	defer ts.Close()
+
+	html := `<div><esi:include src="` + ts.URL + `/verbatim" /></div>`
+	req := httptest.NewRequest("GET", ts.URL, nil)
+
+	expected := `<div><p><esi:include src="/nested" /></p></div>`
+	if result := string(Parse([]byte(html), req)); result != expected {
+		t.Errorf("Expected nested tag to be left literal\nExpected: %q\nGiven:    %q", expected, result)
+	}
+}
+
+func TestIncludeVaryAttribute(t *testing.T) {
+	cache.Reset()
+
+	counts := map[string]int{}
+	var mu sync.Mutex
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		counts[r.URL.Path]++
+		mu.Unlock()
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("<p>" + r.URL.Path + "</p>"))
+	}))
+	defer ts.Close()
+
+	html := `<esi:include src="` + ts.URL + `/themed" vary="Accept-Language, x-theme" /><esi:include src="` + ts.URL + `/plain" />`
+
+	for _, theme := range []string{"dark", "light", "dark"} {
+		req := httptest.NewRequest("GET", "http://example.com", nil)
+		req.Header.Set("X-Theme", theme)
+
+		if result := string(Parse([]byte(html), req)); result != "<p>/themed</p><p>/plain</p>" {
+			t.Errorf("Unexpected result for theme %s: %q", theme, result)
+		}
+	}
+
+	if counts["/themed"] != 2 {
+		t.Errorf("Expected one fetch per X-Theme variant, got %d", counts["/themed"])
+	}
+	if counts["/plain"] != 1 {
+		t.Errorf("Expected header-agnostic sibling to be fetched once, got %d", counts["/plain"])
+	}
+	if entries, _ := cache.Stats(); entries != 3 {
+		t.Errorf("Expected 3 cache entries (2 variants + 1 sibling), got %d", entries)
+	}
+}
+
+// writePEM writes a single PEM block to a file in dir and returns its path
+func writePEM(t *testing.T, dir, name, blockType string, der []byte) string {
+	t.Helper()
+
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0o600); err != nil {
+		t.Fatalf("Writing %s failed: %v", name, err)
+	}
+
+	return path
+}
+
+func TestIncludeWithClientCertificate(t *testing.T) {
+	dir := t.TempDir()
+
+	// A CA issuing the client certificate the backend requires
+	caKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "fragments CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	caDER, _ := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	caCert, _ := x509.ParseCertificate(caDER)
+
+	clientKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	clientTemplate := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "surrogate"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	clientDER, _ := x509.CreateCertificate(rand.Reader, clientTemplate, caCert, &clientKey.PublicKey, caKey)
+	clientKeyDER, _ := x509.MarshalECPrivateKey(clientKey)
+
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("<p>Authenticated</p>"))
+	}))
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(caCert)
+	ts.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs}
+	ts.StartTLS()
+	defer ts.Close()
+
+	certFile := writePEM(t, dir, "client.pem", "CERTIFICATE", clientDER)
+	keyFile := writePEM(t, dir, "client-key.pem", "EC PRIVATE KEY", clientKeyDER)
+	caFile := writePEM(t, dir, "server-ca.pem", "CERTIFICATE", ts.Certificate().Raw)
+
+	html := `<esi:include src="` + ts.URL + `/mtls" />`
+	req := httptest.NewRequest("GET", "http://example.com", nil)
+
+	cache.Reset()
+	withConfig(t, Config{CACert: caFile})
+	if result := string(Parse([]byte(html), req)); result != "" {
+		t.Errorf("Expected fetch without client certificate to fail, got %q", result)
+	}
+
+	cache.Reset()
+	withConfig(t, Config{ClientCert: certFile, ClientKey: keyFile, CACert: caFile})
+	if result := string(Parse([]byte(html), req)); result != "<p>Authenticated</p>" {
+		t.Errorf("Expected fragment fetched with client certificate, got %q", result)
+	}
+}
+
+func TestIncludeFragmentIdentifierSelectsElement(t *testing.T) {
+	cache.Reset()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		if r.URL.Path == "/alt" {
+			w.Write([]byte("<p>Alt</p>"))
+			return
+		}
+		w.Write([]byte(`<html><body><nav>Menu</nav><div id="widget"><esi:comment text="nested"/><p>Widget</p></div></body></html>`))
+	}))
+	defer ts.Close()
+
+	req := httptest.NewRequest("GET", "http://example.com", nil)
+
+	html := `<aside><esi:include src="` + ts.URL + `/page#widget" /></aside>`
+	if result := string(Parse([]byte(html), req)); result != `<aside><div id="widget"><p>Widget</p></div></aside>` {
+		t.Errorf("Expected only the targeted element, got %q", result)
+	}
+
+	html = `<aside><esi:include src="` + ts.URL + `/page#missing" alt="` + ts.URL + `/alt" /></aside>`
+	if result := string(Parse([]byte(html), req)); result != "<aside><p>Alt</p></aside>" {
+		t.Errorf("Expected missing element to fall back to alt, got %q", result)
+	}
+
+	html = `<aside><esi:include src="` + ts.URL + `/page#missing" /></aside>`
+	if result := string(Parse([]byte(html), req)); result != "<aside></aside>" {
+		t.Errorf("Expected missing element without alt to be empty, got %q", result)
+	}
+}
+
+func TestIncludeDefaultOnError(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer ts.Close()
+
+	tests := []struct {
+		name        string
+		defaultMode string
+		attributes  string
+		failsPage   bool
+	}{
+		{"unset default removes the include", "", "", false},
+		{"continue default removes the include", OnErrorContinue, "", false},
+		{"error default fails the page", OnErrorError, "", true},
+		{"alt default fails the page without an alt", OnErrorAlt, "", true},
+		{"alt default removes an include with a failed alt", OnErrorAlt, `alt="` + ts.URL + `/alt"`, false},
+		{"per-tag continue overrides an error default", OnErrorError, `onerror="continue"`, false},
+		{"per-tag error overrides a continue default", OnErrorContinue, `onerror="error"`, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withConfig(t, Config{DefaultOnError: tt.defaultMode})
+
+			html := `<p>before</p><esi:include src="` + ts.URL + `/broken" ` + tt.attributes + ` /><p>after</p>`
+			req := httptest.NewRequest("GET", "http://example.com", nil)
+
+			result, res := ParseWithResult([]byte(html), req)
+			if string(result) != "<p>before</p><p>after</p>" {
+				t.Errorf("Expected failed include to be removed from the output, got %q", result)
+			}
+			if failed := res.Err() != nil; failed != tt.failsPage {
+				t.Errorf("Expected page failure %v, got error %v", tt.failsPage, res.Err())
+			}
+		})
+	}
+}
+
+// Test a redirected include with propagate-redirect="true" surfaces the redirect instead of following it
+func TestIncludePropagateRedirect(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/login" {
+			w.Write([]byte("<p>login form</p>"))
+			return
+		}
+		http.Redirect(w, r, "/login", http.StatusFound)
+	}))
+	defer ts.Close()
+
+	withConfig(t, Config{})
+
+	html := `<p>before</p><esi:include src="` + ts.URL + `/account" propagate-redirect="true" /><p>after</p>`
+	req := httptest.NewRequest("GET", "http://example.com", nil)
+
+	_, res := ParseWithResult([]byte(html), req)
+	status, location := res.Redirect()
+	if status != http.StatusFound || location != "/login" {
+		t.Errorf("Expected a 302 redirect to /login, got %d %q", status, location)
+	}
+
+	// Without the attribute the redirect is followed as before, even once the URL is cached
+	html = `<esi:include src="` + ts.URL + `/account" />`
+	result, res := ParseWithResult([]byte(html), req)
+	if string(result) != "<p>login form</p>" {
+		t.Errorf("Expected redirect to be followed, got %q", result)
+	}
+	if status, _ := res.Redirect(); status != 0 {
+		t.Errorf("Expected no propagated redirect, got %d", status)
+	}
+}
+
+// Test an exponential include tree is truncated once the output budget is spent
+func TestIncludeOutputBudget(t *testing.T) {
+	const leaf = 1024
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		level, _ := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/level/"))
+		if level == 0 {
+			w.Write(bytes.Repeat([]byte("x"), leaf))
+			return
+		}
+
+		// Every level includes two copies of the one below, doubling the assembled size
+		child := fmt.Sprintf(`<esi:include src="/level/%d"/>`, level-1)
+		w.Write([]byte(child + child))
+	}))
+	defer ts.Close()
+
+	const budget = 64 * leaf
+	withConfig(t, Config{MaxOutputBytes: budget})
+
+	// Unbounded, 30 levels would assemble a terabyte
+	page := `<html><esi:include src="` + ts.URL + `/level/30"/><esi:include src="` + ts.URL + `/level/3"/></html>`
+	req := httptest.NewRequest("GET", ts.URL+"/page", nil)
+
+	result := Parse([]byte(page), req)
+	if len(result) > len(page)+budget {
+		t.Errorf("Expected output within %d bytes, got %d", len(page)+budget, len(result))
+	}
+	if !bytes.HasPrefix(result, []byte("<html>")) || !bytes.HasSuffix(result, []byte("</html>")) {
+		t.Errorf("Expected the page around truncated includes to be kept, got %q", result[:min(len(result), 64)])
+	}
+
+	// A new request gets a fresh budget, and the truncated expansion wasn't cached
+	result = Parse([]byte(`<esi:include src="`+ts.URL+`/level/3"/>`), httptest.NewRequest("GET", ts.URL+"/page", nil))
+	if len(result) != 8*leaf {
+		t.Errorf("Expected a small tree to be fully expanded on a new request, got %d bytes", len(result))
+	}
+}
+
+// Test the bytes of nested includes are charged once, so the budget trips alike with a cold or warm cache
+func TestIncludeOutputBudgetCacheState(t *testing.T) {
+	const leaf = 1000
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		if r.URL.Path == "/inner" {
+			w.Write(bytes.Repeat([]byte("x"), leaf))
+			return
+		}
+		w.Write([]byte(`<esi:include src="/inner"/><esi:include src="/inner"/>`))
+	}))
+	defer ts.Close()
+
+	cache.Reset()
+
+	// Room for the page once, not for its nested fragments counted again
+	withConfig(t, Config{MaxOutputBytes: 3 * leaf})
+
+	for _, state := range []string{"cold", "warm"} {
+		result := Parse([]byte(`<esi:include src="`+ts.URL+`/outer"/>`), httptest.NewRequest("GET", ts.URL+"/page", nil))
+		if len(result) != 2*leaf {
+			t.Errorf("Expected the whole page within the budget with a %s cache, got %d bytes", state, len(result))
+		}
+	}
+}
+
+// Test every fragment host gets its own fetch timeout, falling back to FetchTimeout
+func TestIncludeHostTimeouts(t *testing.T) {
+	slow := func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(100 * time.Millisecond)
+		w.Write([]byte("<p>" + r.URL.Path + "</p>"))
+	}
+	header := httptest.NewServer(http.HandlerFunc(slow))
+	defer header.Close()
+	analytics := httptest.NewServer(http.HandlerFunc(slow))
+	defer analytics.Close()
+	other := httptest.NewServer(http.HandlerFunc(slow))
+	defer other.Close()
+
+	withConfig(t, Config{
+		FetchTimeout: 20 * time.Millisecond,
+		HostTimeouts: map[string]time.Duration{
+			strings.TrimPrefix(header.URL, "http://"):    30 * time.Millisecond,
+			strings.TrimPrefix(analytics.URL, "http://"): time.Second,
+		},
+	})
+
+	html := `<esi:include src="` + header.URL + `/header"/><esi:include src="` + analytics.URL + `/analytics"/>` +
+		`<esi:include src="` + other.URL + `/other"/>`
+	req := httptest.NewRequest("GET", "http://example.com", nil)
+
+	if result := string(Parse([]byte(html), req)); result != "<p>/analytics</p>" {
+		t.Errorf("Expected only the include with a long enough host timeout to resolve, got %q", result)
+	}
+}
+
+// Test a fetch exceeding the timeout fails like any other, falling back to alt or onerror
+func TestIncludeFetchTimeout(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/hung" {
+			time.Sleep(200 * time.Millisecond)
+		}
+		w.Write([]byte("<p>" + r.URL.Path + "</p>"))
+	}))
+	defer ts.Close()
+
+	withConfig(t, Config{FetchTimeout: 20 * time.Millisecond})
+
+	html := `<esi:include src="` + ts.URL + `/hung" alt="` + ts.URL + `/alt"/>` +
+		`<esi:include src="` + ts.URL + `/hung" onerror="continue"/>`
+	req := httptest.NewRequest("GET", "http://example.com", nil)
+
+	start := time.Now()
+	if result := string(Parse([]byte(html), req)); result != "<p>/alt</p>" {
+		t.Errorf("Expected the timed out includes to fall back, got %q", result)
+	}
+	if elapsed := time.Since(start); elapsed >= 200*time.Millisecond {
+		t.Errorf("Expected the timed out fetches not to hold the response, took %s", elapsed)
+	}
+}
+
+// Test fragment fetches are cancelled along with the request they are made for
+func TestIncludeCancelledWithRequest(t *testing.T) {
+	started := make(chan struct{})
+	cancelled := make(chan error, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		select {
+		case <-r.Context().Done():
+			cancelled <- r.Context().Err()
+		case <-time.After(2 * time.Second):
+			cancelled <- nil
+		}
+	}))
+	defer ts.Close()
+
+	withConfig(t, Config{})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req := httptest.NewRequest("GET", "http://example.com", nil).WithContext(ctx)
+
+	go func() {
+		<-started
+		cancel()
+	}()
+
+	if result := string(Parse([]byte(`<esi:include src="`+ts.URL+`/fragment"/>`), req)); result != "" {
+		t.Errorf("Expected the cancelled include to be removed, got %q", result)
+	}
+
+	if err := <-cancelled; !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected the fragment request to be cancelled, got %v", err)
+	}
+}
+
+func TestFetchTimeoutDefault(t *testing.T) {
+	u, _ := url.Parse("http://example.com/fragment")
+
+	tests := []struct {
+		configured time.Duration
+		expected   time.Duration
+	}{
+		{0, defaultFetchTimeout},
+		{time.Second, time.Second},
+		{-1, 0},
+	}
+
+	for _, tt := range tests {
+		withConfig(t, Config{FetchTimeout: tt.configured})
+
+		if got := fetchTimeout(u); got != tt.expected {
+			t.Errorf("FetchTimeout %s: expected %s, got %s", tt.configured, tt.expected, got)
+		}
+	}
+}
+
+// Test a placeholder is rendered for a fragment slower than the threshold, and the fragment once cached
+func TestIncludePlaceholderThreshold(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			time.Sleep(200 * time.Millisecond)
+		}
+		w.Header().Set("Cache-Control", "max-age=300")
+		w.Write([]byte("<p>" + r.URL.Path + "</p>"))
+	}))
+	defer ts.Close()
+
+	withConfig(t, Config{PlaceholderThreshold: 50 * time.Millisecond, Placeholder: "Loading…"})
+	cache.Reset()
+
+	html := `<esi:include src="` + ts.URL + `/fast"/><esi:include src="` + ts.URL + `/slow"/>`
+	req := httptest.NewRequest("GET", "http://example.com", nil)
+
+	expected := `<p>/fast</p><span class="esi-placeholder" data-esi-src="` + ts.URL + `/slow">Loading…</span>`
+	if result := string(Parse([]byte(html), req)); result != expected {
+		t.Errorf("Expected placeholder for the slow include\nExpected: %q\nGiven:    %q", expected, result)
+	}
+
+	// The fetch carried on in the background and filled the cache
+	deadline := time.Now().Add(2 * time.Second)
+	for _, _, ok := cache.Load(ts.URL + "/slow"); !ok && time.Now().Before(deadline); _, _, ok = cache.Load(ts.URL + "/slow") {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if result := string(Parse([]byte(html), req)); result != "<p>/fast</p><p>/slow</p>" {
+		t.Errorf("Expected the slow fragment once cached, got %q", result)
+	}
+}
+
+func TestIncludeMaxWait(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			time.Sleep(300 * time.Millisecond)
+		}
+		w.Header().Set("Cache-Control", "max-age=300")
+		w.Write([]byte("<p>" + r.URL.Path + "</p>"))
+	}))
+	defer ts.Close()
+
+	withConfig(t, Config{})
+	cache.Reset()
+	req := httptest.NewRequest("GET", "http://example.com", nil)
+
+	tests := []struct {
+		name     string
+		attrs    string
+		expected string
+	}{
+		{"falls back to alt", `src="` + ts.URL + `/slow" alt="` + ts.URL + `/alt" maxwait="50"`, "<p>/alt</p>"},
+		{"removed with onerror continue", `src="` + ts.URL + `/slow?continue" onerror="continue" maxwait=50`, ""},
+		{"fast include within maxwait", `src="` + ts.URL + `/fast" maxwait="200"`, "<p>/fast</p>"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start := time.Now()
+			result := string(Parse([]byte(`<esi:include `+tt.attrs+` />`), req))
+			elapsed := time.Since(start)
+
+			if result != tt.expected {
+				t.Errorf("Expected %q, got %q", tt.expected, result)
+			}
+			if elapsed >= 250*time.Millisecond {
+				t.Errorf("Expected the include to be abandoned at its maxwait, took %v", elapsed)
+			}
+		})
+	}
+}
+
+// Test fragment transforms apply in order, each receiving the previous one's output
+func TestIncludeFragmentTransforms(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("<p>fragment</p>"))
+	}))
+	defer ts.Close()
+
+	prefix := func(url string, content []byte) []byte {
+		return append([]byte("<!-- "+strings.TrimPrefix(url, ts.URL)+" -->"), content...)
+	}
+	upper := func(_ string, content []byte) []byte {
+		return bytes.ToUpper(content)
+	}
+	withConfig(t, Config{FragmentTransforms: []FragmentTransform{prefix, upper}})
+
+	html := `<esi:include src="` + ts.URL + `/transformed"/>`
+	req := httptest.NewRequest("GET", "http://example.com", nil)
+
+	if result := string(Parse([]byte(html), req)); result != "<!-- /TRANSFORMED --><P>FRAGMENT</P>" {
+		t.Errorf("Expected prefixing then uppercasing, got %q", result)
+	}
+}
+
+// Test relative src and alt URLs are fetched from the configured BaseURL instead of the page's host
+func TestIncludeBaseURL(t *testing.T) {
+	internal := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Cookie") != "" {
+			t.Errorf("Expected the page's cookies not to be sent to another host, got %q", r.Header.Get("Cookie"))
+		}
+		if r.URL.Path == "/broken" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte("<p>internal " + r.URL.Path + "</p>"))
+	}))
+	defer internal.Close()
+
+	withConfig(t, Config{BaseURL: internal.URL})
+
+	html := `<esi:include src="/fragment"/><esi:include src="/broken" alt="/alt"/>`
+	req := httptest.NewRequest("GET", "http://example.com/page", nil)
+	req.Header.Set("Cookie", "session=secret")
+
+	result, res := ParseWithResult([]byte(html), req)
+	if string(result) != "<p>internal /fragment</p><p>internal /alt</p>" {
+		t.Errorf("Expected fragments from the internal host, got %q", result)
+	}
+
+	// The fragments are recorded, and cached, under their resolved URLs
+	for _, f := range res.Fragments {
+		if !strings.HasPrefix(f.URL, internal.URL+"/") {
+			t.Errorf("Expected fragment URL resolved against BaseURL, got %q", f.URL)
+		}
+	}
+	if _, _, ok := cache.Load(internal.URL + "/fragment"); !ok {
+		t.Error("Expected the fragment to be cached under its resolved URL")
+	}
+}
+
+// Test the query of a src survives the resolution against BaseURL, including one with a path, and
+// separates the cache entries
+func TestIncludeBaseURLQuery(t *testing.T) {
+	var mu sync.Mutex
+	fetched := map[string]int{}
+	internal := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		fetched[r.URL.RequestURI()]++
+		mu.Unlock()
+		w.Header().Set("Cache-Control", "max-age=3600")
+		w.Write([]byte("<p>" + r.URL.Query().Get("lang") + "</p>"))
+	}))
+	defer internal.Close()
+
+	for _, base := range []string{internal.URL, internal.URL + "/esi/", internal.URL + "/esi?token=x"} {
+		t.Run(base, func(t *testing.T) {
+			cache.Reset()
+			clear(fetched)
+			withConfig(t, Config{BaseURL: base})
+
+			req := httptest.NewRequest("GET", "http://example.com/page?lang=en", nil)
+			for range 2 {
+				for _, lang := range []string{"de", "fr"} {
+					result := string(Parse([]byte(`<esi:include src="/frag?lang=`+lang+`"/>`), req))
+					if result != "<p>"+lang+"</p>" {
+						t.Errorf("Expected the fragment for lang=%s, got %q", lang, result)
+					}
+				}
+			}
+
+			if expected := map[string]int{"/frag?lang=de": 1, "/frag?lang=fr": 1}; !maps.Equal(fetched, expected) {
+				t.Errorf("Expected each query fetched once, got %v", fetched)
+			}
+			for _, lang := range []string{"de", "fr"} {
+				if _, _, ok := cache.Load(internal.URL + "/frag?lang=" + lang); !ok {
+					t.Errorf("Expected the fragment cached under its URL with lang=%s", lang)
+				}
+			}
+		})
+	}
+}
+
+// Test configured headers are sent on src and alt fetches of any origin, replacing forwarded ones
+func TestIncludeCustomHeaders(t *testing.T) {
+	var mu sync.Mutex
+	received := map[string]http.Header{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		received[r.URL.Path] = r.Header.Clone()
+		mu.Unlock()
+
+		if r.URL.Path == "/broken" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte("<p>" + r.URL.Path + "</p>"))
+	}))
+	defer ts.Close()
+
+	withConfig(t, Config{Headers: map[string]string{
+		"X-Backend-Server": "internal",
+		"Authorization":    "Bearer operator",
+	}})
+
+	html := `<esi:include src="/same-origin"/><esi:include src="` + ts.URL + `/broken" alt="` + ts.URL + `/alt"/>`
+	req := httptest.NewRequest("GET", ts.URL+"/page", nil)
+	req.Header.Set("Authorization", "Bearer client")
+
+	Parse([]byte(html), req)
+
+	for _, path := range []string{"/same-origin", "/broken", "/alt"} {
+		header, ok := received[path]
+		if !ok {
+			t.Errorf("Expected %s to be fetched", path)
+			continue
+		}
+		if got := header.Get("X-Backend-Server"); got != "internal" {
+			t.Errorf("Expected X-Backend-Server on %s, got %q", path, got)
+		}
+		if got := header.Values("Authorization"); len(got) != 1 || got[0] != "Bearer operator" {
+			t.Errorf("Expected the configured Authorization to replace the forwarded one on %s, got %q", path, got)
+		}
+	}
+}
+
+// Test only fragments of allowed hosts are fetched, the others falling back to their alt
+func TestIncludeAllowedHosts(t *testing.T) {
+	var fetched sync.Map
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetched.Store(r.Host+r.URL.Path, true)
+		if r.URL.Path == "/redirect" {
+			http.Redirect(w, r, "http://"+strings.Replace(r.Host, "127.0.0.1", "localhost", 1)+"/target", http.StatusFound)
+			return
+		}
+		w.Write([]byte("<p>" + r.URL.Path + "</p>"))
+	}))
+	defer ts.Close()
+
+	ip := strings.TrimPrefix(ts.URL, "http://")
+	port := ip[strings.LastIndex(ip, ":"):]
+	localhost := "http://localhost" + port
+
+	tests := []struct {
+		name     string
+		hosts    []string
+		schemes  []string
+		html     string
+		expected string
+	}{
+		{
+			"allowed host is fetched",
+			[]string{"127.0.0.1"},
+			nil,
+			`<esi:include src="` + ts.URL + `/allowed"/>`,
+			"<p>/allowed</p>",
+		},
+		{
+			"blocked host falls back to an allowed alt",
+			[]string{"127.0.0.1"},
+			nil,
+			`<esi:include src="` + localhost + `/blocked" alt="` + ts.URL + `/alt"/>`,
+			"<p>/alt</p>",
+		},
+		{
+			"wildcard matches subdomains only",
+			[]string{"*.localhost"},
+			nil,
+			`<esi:include src="` + localhost + `/apex"/>`,
+			"",
+		},
+		{
+			"redirect to a blocked host fails",
+			[]string{"127.0.0.1"},
+			nil,
+			`<esi:include src="` + ts.URL + `/redirect"/>`,
+			"",
+		},
+		{
+			"blocked scheme",
+			nil,
+			[]string{"https"},
+			`<esi:include src="` + ts.URL + `/plain"/>`,
+			"",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withConfig(t, Config{AllowedHosts: tt.hosts, AllowedSchemes: tt.schemes})
+			cache.Reset()
+			fetched.Clear()
+
+			req := httptest.NewRequest("GET", "http://example.com", nil)
+			if result := string(Parse([]byte(tt.html), req)); result != tt.expected {
+				t.Errorf("Expected %q, got %q", tt.expected, result)
+			}
+
+			for _, blocked := range []string{"localhost" + port + "/blocked", "localhost" + port + "/apex",
+				"localhost" + port + "/target", ip + "/plain"} {
+				if _, ok := fetched.Load(blocked); ok {
+					t.Errorf("Expected %s not to be fetched", blocked)
+				}
+			}
+		})
+	}
+}
+
+func TestFragmentAllowedWildcard(t *testing.T) {
+	withConfig(t, Config{AllowedHosts: []string{"*.internal.example.com", "cdn.example.com:8080"}})
+
+	tests := []struct {
+		url     string
+		allowed bool
+	}{
+		{"http://header.internal.example.com/fragment", true},
+		{"http://a.b.Internal.Example.com:9000/fragment", true},
+		{"http://internal.example.com/fragment", false},
+		{"http://evilinternal.example.com/fragment", false},
+		{"http://cdn.example.com:8080/fragment", true},
+		{"http://cdn.example.com/fragment", false},
+		{"http://169.254.169.254/latest/meta-data", false},
+	}
+
+	for _, tt := range tests {
+		u, _ := url.Parse(tt.url)
+		if got := fragmentAllowed(u); got != tt.allowed {
+			t.Errorf("%s: expected allowed=%v, got %v", tt.url, tt.allowed, got)
+		}
+	}
+
+	// Only the "*." form is a wildcard, a bare "*" prefix doesn't match hosts merely ending the same
+	withConfig(t, Config{AllowedHosts: []string{"*example.com"}})
+	for _, raw := range []string{"http://evilexample.com/fragment", "http://www.example.com/fragment"} {
+		u, _ := url.Parse(raw)
+		if fragmentAllowed(u) {
+			t.Errorf("%s: expected not allowed by *example.com", raw)
+		}
+	}
+}
+
+func TestIncludeMethodAndEntity(t *testing.T) {
+	var mu sync.Mutex
+	var received []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		received = append(received, r.Method+" "+r.Header.Get("Content-Type")+" "+string(body)+" "+r.Header.Get("Cookie"))
+		mu.Unlock()
+		w.Header().Set("Cache-Control", "max-age=300")
+		w.Write([]byte("<p>" + r.Method + "</p>"))
+	}))
+	defer ts.Close()
+
+	withConfig(t, Config{})
+	cache.Reset()
+
+	req := httptest.NewRequest("GET", ts.URL+"/page", nil)
+	req.Header.Set("Cookie", "session=abc")
+
+	html := []byte(`<esi:include src="` + ts.URL + `/cart" method="post" entity="item=42&amp;qty=1" />`)
+	for range 2 {
+		if result := string(Parse(html, req)); result != "<p>POST</p>" {
+			t.Errorf("Expected the POST response, got %q", result)
+		}
+	}
+
+	if result := string(Parse([]byte(`<esi:include src="`+ts.URL+`/plain" />`), req)); result != "<p>GET</p>" {
+		t.Errorf("Expected a GET without method attribute, got %q", result)
+	}
+
+	expected := []string{
+		"POST application/x-www-form-urlencoded item=42&qty=1 session=abc",
+		"POST application/x-www-form-urlencoded item=42&qty=1 session=abc",
+		"GET   session=abc",
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if !slices.Equal(received, expected) {
+		t.Errorf("Expected requests %q (POST never cached), got %q", expected, received)
+	}
+}
+
+func TestIncludeRetriesTransientFailures(t *testing.T) {
+	var mu sync.Mutex
+	requests := map[string]int{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests[r.URL.Path]++
+		attempt := requests[r.URL.Path]
+		mu.Unlock()
+
+		switch {
+		case r.URL.Path == "/flaky" && attempt == 1, r.URL.Path == "/down":
+			w.WriteHeader(http.StatusBadGateway)
+		case r.URL.Path == "/missing":
+			w.WriteHeader(http.StatusNotFound)
+		default:
+			w.Header().Set("Cache-Control", "max-age=300")
+			w.Write([]byte("<p>" + r.URL.Path + "</p>"))
+		}
+	}))
+	defer ts.Close()
+
+	withConfig(t, Config{FragmentRetries: 2, FragmentRetryBackoff: time.Millisecond})
+	cache.Reset()
+	req := httptest.NewRequest("GET", "http://example.com", nil)
+
+	// Includes sharing the src wait for the retrying fetch instead of retrying themselves
+	flaky := `<esi:include src="` + ts.URL + `/flaky" />`
+	if result := string(Parse([]byte(flaky+flaky+flaky), req)); result != "<p>/flaky</p><p>/flaky</p><p>/flaky</p>" {
+		t.Errorf("Expected every include to render after a retry, got %q", result)
+	}
+
+	html := `<esi:include src="` + ts.URL + `/down" alt="` + ts.URL + `/alt" />` +
+		`<esi:include src="` + ts.URL + `/missing" onerror="continue" />`
+	if result := string(Parse([]byte(html), req)); result != "<p>/alt</p>" {
+		t.Errorf("Expected the alt once retries are exhausted, got %q", result)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	expected := map[string]int{"/flaky": 2, "/down": 3, "/alt": 1, "/missing": 1}
+	if !maps.Equal(requests, expected) {
+		t.Errorf("Expected requests %v, got %v", expected, requests)
+	}
+}
+
+func TestIncludeErrorsAreReported(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/broken" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte("fallback"))
+	}))
+	defer ts.Close()
+
+	withConfig(t, Config{})
+	cache.Reset()
+
+	html := `<esi:include src="` + ts.URL + `/broken" alt="` + ts.URL + `/alt"/>`
+	result, res := ParseWithResult([]byte(html), httptest.NewRequest("GET", "http://example.com", nil))
+
+	if string(result) != "fallback" {
+		t.Errorf("Expected the alt content, got %q", result)
+	}
+
+	errs := res.Errors()
+	if len(errs) != 1 {
+		t.Fatalf("Expected 1 include error, got %v", errs)
+	}
+	if !errors.Is(errs[0], errUnexpectedStatus) || !strings.Contains(errs[0].Error(), ts.URL+"/broken") {
+		t.Errorf("Expected the src failure naming its URL, got %v", errs[0])
+	}
+}
+
+// roundTripperFunc adapts a function to http.RoundTripper
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestIncludeUsesConfiguredHTTPClient(t *testing.T) {
+	var requested []string
+	client := &http.Client{
+		Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			requested = append(requested, req.URL.String())
+
+			return &http.Response{
+				StatusCode: http.StatusOK,
+				Header:     http.Header{},
+				Body:       io.NopCloser(strings.NewReader("from injected client")),
+				Request:    req,
+			}, nil
+		}),
+	}
+
+	withConfig(t, Config{HTTPClient: client})
+	cache.Reset()
+
+	html := `<esi:include src="http://fragments.invalid/header"/>`
+	result := Parse([]byte(html), httptest.NewRequest("GET", "http://example.com", nil))
+
+	if string(result) != "from injected client" {
+		t.Errorf("Expected the fragment fetched by the injected client, got %q", result)
+	}
+	if !slices.Equal(requested, []string{"http://fragments.invalid/header"}) {
+		t.Errorf("Expected one request through the injected client, got %v", requested)
+	}
+	if fragmentClient().CheckRedirect == nil {
+		t.Error("Expected the fragment redirect policy on a client without one")
+	}
+}
+
+func TestIncludeDecodesCompressedFragments(t *testing.T) {
+	const fragment = `<div id="header">compressed</div>`
+
+	compress := map[string]func(io.Writer) io.WriteCloser{
+		"gzip":    func(w io.Writer) io.WriteCloser { return gzip.NewWriter(w) },
+		"deflate": func(w io.Writer) io.WriteCloser { return zlib.NewWriter(w) },
+		"raw-deflate": func(w io.Writer) io.WriteCloser {
+			fw, _ := flate.NewWriter(w, flate.DefaultCompression)
+			return fw
+		},
+	}
+
+	var acceptEncoding string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		acceptEncoding = r.Header.Get("Accept-Encoding")
+
+		encoding := strings.TrimPrefix(r.URL.Path, "/")
+		w.Header().Set("Content-Encoding", strings.TrimPrefix(encoding, "raw-"))
+
+		cw := compress[encoding](w)
+		cw.Write([]byte(fragment))
+		cw.Close()
+	}))
+	defer ts.Close()
+
+	for _, encoding := range []string{"gzip", "deflate", "raw-deflate"} {
+		t.Run(encoding, func(t *testing.T) {
+			withConfig(t, Config{})
+			cache.Reset()
+
+			html := `<esi:include src="` + ts.URL + `/` + encoding + `"/>`
+			result := Parse([]byte(html), httptest.NewRequest("GET", "http://example.com", nil))
+
+			if string(result) != fragment {
+				t.Errorf("Expected the decoded fragment, got %q", result)
+			}
+			if acceptEncoding != acceptedEncodings {
+				t.Errorf("Expected Accept-Encoding %q, got %q", acceptedEncodings, acceptEncoding)
+			}
+		})
+	}
+}
+
+// timingObserver records the OnFragmentFetch callbacks it receives
+type timingObserver struct {
+	countingObserver
+
+	mu      sync.Mutex
+	fetches []observedFetch
+}
+
+type observedFetch struct {
+	duration time.Duration
+	status   int
+	err      error
+}
+
+func (o *timingObserver) OnFragmentFetch(duration time.Duration, status int, err error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.fetches = append(o.fetches, observedFetch{duration, status, err})
+}
+
+func TestIncludeNotifiesFragmentFetch(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(20 * time.Millisecond)
+		if r.URL.Path == "/missing" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte("fragment"))
+	}))
+	defer ts.Close()
+
+	withConfig(t, Config{})
+	cache.Reset()
+
+	observer := &timingObserver{}
+	SetMetricsObserver(observer)
+	t.Cleanup(func() { SetMetricsObserver(nil) })
+
+	for _, path := range []string{"/found", "/missing"} {
+		Parse([]byte(`<esi:include src="`+ts.URL+path+`"/>`), httptest.NewRequest("GET", "http://example.com", nil))
+	}
+	Parse([]byte(`<esi:include src="http://127.0.0.1:1/refused"/>`), httptest.NewRequest("GET", "http://example.com", nil))
+
+	if len(observer.fetches) != 3 {
+		t.Fatalf("Expected 3 observed fetches, got %d", len(observer.fetches))
+	}
+	for i, status := range []int{http.StatusOK, http.StatusNotFound} {
+		fetch := observer.fetches[i]
+		if fetch.status != status || fetch.err != nil {
+			t.Errorf("Expected fetch %d to report status %d, got %d (%v)", i, status, fetch.status, fetch.err)
+		}
+		if fetch.duration < 20*time.Millisecond || fetch.duration > 5*time.Second {
+			t.Errorf("Expected fetch %d to take the backend's 20ms, got %v", i, fetch.duration)
+		}
+	}
+	if refused := observer.fetches[2]; refused.status != 0 || refused.err == nil {
+		t.Errorf("Expected a refused connection to report an error without status, got %d (%v)", refused.status, refused.err)
+	}
+}
+
+func TestIncludeTTLAttribute(t *testing.T) {
+	var fetches atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		w.Header().Set("Cache-Control", "max-age=3600")
+		w.Write([]byte("fragment"))
+	}))
+	defer ts.Close()
+
+	clock := time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC)
+	withClock(t, &clock)
+	withConfig(t, Config{MinimumCacheTTL: 300})
+
+	tests := []struct {
+		name      string
+		ttl       string
+		after     time.Duration
+		refetched bool
+	}{
+		{"tag ttl shorter than the headers, still fresh", "60", 60 * time.Second, false},
+		{"tag ttl shorter than the headers, expired", "60", 61 * time.Second, true},
+		{"ttl of 0 never caches", "0", 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cache.Reset()
+			fetches.Store(0)
+
+			html := `<esi:include src="` + ts.URL + `/ttl" ttl="` + tt.ttl + `"/>`
+			Parse([]byte(html), httptest.NewRequest("GET", "http://example.com", nil))
+			clock = clock.Add(tt.after)
+			result := Parse([]byte(html), httptest.NewRequest("GET", "http://example.com", nil))
+
+			if string(result) != "fragment" {
+				t.Errorf("Expected the fragment, got %q", result)
+			}
+			if expected := map[bool]int32{false: 1, true: 2}[tt.refetched]; fetches.Load() != expected {
+				t.Errorf("Expected %d fetches, got %d", expected, fetches.Load())
+			}
+		})
+	}
+}
+
+// Test a backend can't choose its own TTL with the header the ttl attribute used to travel in
+func TestIncludeTTLNotTakenFromResponse(t *testing.T) {
+	var fetches atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("X-ESI-Include-TTL", "3600")
+		w.Write([]byte("fragment"))
+	}))
+	defer ts.Close()
+
+	withConfig(t, Config{})
+	cache.Reset()
+
+	html := `<esi:include src="` + ts.URL + `/private"/>`
+	for range 2 {
+		Parse([]byte(html), httptest.NewRequest("GET", "http://example.com", nil))
+	}
+	if got := fetches.Load(); got != 2 {
+		t.Errorf("Expected a no-store fragment to be fetched each time, got %d fetches", got)
+	}
+}
+
+func TestIncludeCacheKeyFunc(t *testing.T) {
+	var fetches atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		tenant, _ := r.Cookie("tenant")
+		w.Header().Set("Cache-Control", "max-age=3600")
+		w.Write([]byte("fragment of " + tenant.Value))
+	}))
+	defer ts.Close()
+
+	cache.Reset()
+	withConfig(t, Config{CacheKeyFunc: func(req *http.Request, url string) string {
+		return req.Header.Get("X-Tenant") + "\n" + url
+	}})
+
+	parse := func(tenant string) string {
+		req := httptest.NewRequest("GET", ts.URL+"/page", nil)
+		req.Header.Set("X-Tenant", tenant)
+		req.AddCookie(&http.Cookie{Name: "tenant", Value: tenant})
+
+		return string(Parse([]byte(`<esi:include src="/fragment"/>`), req))
+	}
+
+	for range 2 {
+		for _, tenant := range []string{"a", "b"} {
+			if result := parse(tenant); result != "fragment of "+tenant {
+				t.Errorf("Expected the fragment of tenant %s, got %q", tenant, result)
+			}
+		}
+	}
+
+	if got := fetches.Load(); got != 2 {
+		t.Errorf("Expected one fetch per tenant, got %d", got)
+	}
+
+	// A tenant's fragments are purged by the prefix of its keys
+	if removed, err := PurgePrefix("a\n"); err != nil || removed != 1 {
+		t.Errorf("Expected the fragment of tenant a to be purged, removed %d (err: %v)", removed, err)
+	}
+}
+
+// Test redirects of fragment fetches are limited by MaxFragmentRedirects and SameOriginRedirects,
+// a disallowed one falling back to the alt
+func TestIncludeRedirectPolicy(t *testing.T) {
+	var externalFetches atomic.Int32
+	external := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		externalFetches.Add(1)
+		w.Write([]byte("<p>external</p>"))
+	}))
+	defer external.Close()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "no-store")
+		switch path := r.URL.Path; {
+		case path == "/external":
+			http.Redirect(w, r, external.URL+"/target", http.StatusFound)
+		case path == "/local":
+			http.Redirect(w, r, "/target", http.StatusFound)
+		case strings.HasPrefix(path, "/chain/"):
+			if n, _ := strconv.Atoi(strings.TrimPrefix(path, "/chain/")); n > 0 {
+				http.Redirect(w, r, "/chain/"+strconv.Itoa(n-1), http.StatusFound)
+				return
+			}
+			w.Write([]byte("<p>end of chain</p>"))
+		default:
+			w.Write([]byte("<p>" + path + "</p>"))
+		}
+	}))
+	defer ts.Close()
+
+	tests := []struct {
+		name     string
+		cfg      Config
+		src      string
+		expected string
+		external bool
+	}{
+		{"cross-origin redirect followed by default", Config{}, "/external", "<p>external</p>", true},
+		{"cross-origin redirect blocked", Config{SameOriginRedirects: true}, "/external", "<p>/alt</p>", false},
+		{"same-origin redirect followed", Config{SameOriginRedirects: true}, "/local", "<p>/target</p>", false},
+		{"redirects up to the limit followed", Config{MaxFragmentRedirects: 2}, "/chain/2", "<p>end of chain</p>", false},
+		{"redirects beyond the limit fail", Config{MaxFragmentRedirects: 2}, "/chain/3", "<p>/alt</p>", false},
+		{"default limit of 10 redirects", Config{}, "/chain/11", "<p>/alt</p>", false},
+		{"negative limit forbids redirects", Config{MaxFragmentRedirects: -1}, "/local", "<p>/alt</p>", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cache.Reset()
+			externalFetches.Store(0)
+			withConfig(t, tt.cfg)
+
+			req := httptest.NewRequest("GET", ts.URL+"/page", nil)
+			result := string(Parse([]byte(`<esi:include src="`+tt.src+`" alt="/alt"/>`), req))
+			if result != tt.expected {
+				t.Errorf("Expected %q, got %q", tt.expected, result)
+			}
+			if fetched := externalFetches.Load() > 0; fetched != tt.external {
+				t.Errorf("Expected the external host fetched: %v, got %v", tt.external, fetched)
+			}
+		})
+	}
+}
+
+func TestIncludeAllowedFragmentContentTypes(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "no-store")
+		if r.URL.Path == "/json" {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"error":"oops"}`))
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write([]byte("<p>alt</p>"))
+	}))
+	defer ts.Close()
+
+	tests := []struct {
+		name     string
+		allowed  []string
+		html     string
+		expected string
+	}{
+		{"any type by default", nil, `<esi:include src="/json"/>`, `{"error":"oops"}`},
+		{"rejected type falls back to alt", []string{"text/html"}, `<esi:include src="/json" alt="/alt"/>`, "<p>alt</p>"},
+		{"rejected type removed on error", []string{"text/html"}, `<esi:include src="/json" onerror="continue"/>`, ""},
+		{"allowed type with parameters", []string{"TEXT/HTML"}, `<esi:include src="/alt"/>`, "<p>alt</p>"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cache.Reset()
+			withConfig(t, Config{AllowedFragmentContentTypes: tt.allowed})
+
+			result := Parse([]byte(tt.html), httptest.NewRequest("GET", ts.URL+"/page", nil))
+			if string(result) != tt.expected {
+				t.Errorf("Expected %q, got %q", tt.expected, result)
+			}
+		})
+	}
+}
+
+func TestIncludeAltChain(t *testing.T) {
+	var mu sync.Mutex
+	var fetched []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		fetched = append(fetched, r.URL.Path)
+		mu.Unlock()
+
+		w.Header().Set("Cache-Control", "no-store")
+		if strings.HasPrefix(r.URL.Path, "/down") {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("<p>" + r.URL.Path + "</p>"))
+	}))
+	defer ts.Close()
+
+	withConfig(t, Config{})
+
+	tests := []struct {
+		name     string
+		html     string
+		expected string
+		fetched  []string
+	}{
+		{"third succeeds", `<esi:include src="/down-1" alt="/down-2" alt2="/static"/>`, "<p>/static</p>", []string{"/down-1", "/down-2", "/static"}},
+		{"ordered by number", `<esi:include src="/down-1" alt3="/last" alt2="/down-3" alt="/down-2"/>`, "<p>/last</p>", []string{"/down-1", "/down-2", "/down-3", "/last"}},
+		{"stops at the first success", `<esi:include src="/down-1" alt="/ok" alt2="/never"/>`, "<p>/ok</p>", []string{"/down-1", "/ok"}},
+		{"all failing with onerror continue", `<esi:include src="/down-1" alt="/down-2" alt2="/down-3" onerror="continue"/>`, "", []string{"/down-1", "/down-2", "/down-3"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cache.Reset()
+			fetched = nil
+
+			result := Parse([]byte(tt.html), httptest.NewRequest("GET", ts.URL+"/page", nil))
+			if string(result) != tt.expected {
+				t.Errorf("Expected %q, got %q", tt.expected, result)
+			}
+			if !slices.Equal(fetched, tt.fetched) {
+				t.Errorf("Expected fetches %v, got %v", tt.fetched, fetched)
+			}
+		})
+	}
+}
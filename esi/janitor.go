@@ -0,0 +1,65 @@
+package esi
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+var janitor = &cacheJanitor{}
+
+// cacheJanitor periodically removes expired entries from the memory tier, so fragments that are
+// never requested again don't hold cache slots until the LRU evicts them. Configure restarts it,
+// and at most one janitor goroutine runs at any time.
+type cacheJanitor struct {
+	mu      sync.Mutex
+	stop    chan struct{}
+	done    chan struct{}
+	running atomic.Int32
+}
+
+// restart stops the current janitor, waiting for it to exit, and starts a new one sweeping
+// every interval. An interval <= 0 leaves the janitor stopped.
+func (j *cacheJanitor) restart(interval time.Duration) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.stop != nil {
+		close(j.stop)
+		<-j.done
+		j.stop, j.done = nil, nil
+	}
+
+	if interval <= 0 {
+		return
+	}
+
+	j.stop = make(chan struct{})
+	j.done = make(chan struct{})
+	j.running.Add(1)
+	go j.run(interval, j.stop, j.done)
+}
+
+// run sweeps the cache every interval until stop is closed
+func (j *cacheJanitor) run(interval time.Duration, stop <-chan struct{}, done chan<- struct{}) {
+	defer func() {
+		j.running.Add(-1)
+		close(done)
+	}()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if removed := cache.removeExpired(); removed > 0 && logger != nil {
+				logger.Info("Cache janitor removed expired entries", zap.Int("removed", removed))
+			}
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package esi
+
+import (
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestConfigureRestartsJanitor(t *testing.T) {
+	old := GetConfig()
+	t.Cleanup(func() { Configure(old) })
+
+	goroutines := runtime.NumGoroutine()
+
+	Configure(Config{JanitorInterval: time.Hour})
+	Configure(Config{JanitorInterval: time.Minute})
+	if n := janitor.running.Load(); n != 1 {
+		t.Errorf("Expected exactly one janitor after reconfiguring, got %d", n)
+	}
+
+	Configure(Config{})
+	if n := janitor.running.Load(); n != 0 {
+		t.Errorf("Expected the janitor to stop when disabled, got %d running", n)
+	}
+
+	// Only idle connections of the replaced HTTP clients may linger, never a janitor
+	if n := runtime.NumGoroutine(); n > goroutines {
+		t.Errorf("Expected no leaked goroutines, had %d before and %d after", goroutines, n)
+	}
+}
+
+func TestJanitorRemovesExpiredEntries(t *testing.T) {
+	clock := time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC)
+	withClock(t, &clock)
+	withConfig(t, Config{MinimumCacheTTL: 60})
+	cache.Reset()
+
+	short := okResponse("max-age=60")
+	long := okResponse("max-age=600")
+	cache.Put("http://example.com/short", []byte("short"), short)
+	cache.Put("http://example.com/long", []byte("long"), long)
+
+	clock = clock.Add(2 * time.Minute)
+	if removed := cache.removeExpired(); removed != 1 {
+		t.Errorf("Expected one expired entry to be removed, got %d", removed)
+	}
+
+	if entries, _ := cache.Stats(); entries != 1 {
+		t.Errorf("Expected one entry left, got %d", entries)
+	}
+	if _, ok := cache.expiry("http://example.com/long"); !ok {
+		t.Error("Expected the fresh entry to be kept")
+	}
+}
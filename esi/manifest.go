@@ -0,0 +1,188 @@
+package esi
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const defaultManifestInterval = 30 * time.Second
+
+// ManifestWarmer keeps the fragments listed in a manifest warm in the cache, independently of
+// client traffic. The manifest is a file or http(s) URL listing one absolute fragment URL per
+// line, blank lines and lines starting with # are ignored. Every fragment is fetched on Start
+// and then refreshed in the background shortly before its cache entry expires.
+type ManifestWarmer struct {
+	source   string
+	interval time.Duration
+
+	mu   sync.Mutex
+	urls []string
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewManifestWarmer creates a warmer for the manifest at source, checked every interval (default: 30s)
+func NewManifestWarmer(source string, interval time.Duration) *ManifestWarmer {
+	if interval <= 0 {
+		interval = defaultManifestInterval
+	}
+
+	return &ManifestWarmer{
+		source:   source,
+		interval: interval,
+	}
+}
+
+// Start loads the manifest, failing if it can't be read, and starts warming its fragments in the background
+func (m *ManifestWarmer) Start() error {
+	urls, err := loadManifest(m.source)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	m.urls = urls
+	m.mu.Unlock()
+
+	m.stop = make(chan struct{})
+	m.done = make(chan struct{})
+	go m.run()
+
+	return nil
+}
+
+// Stop ends background refreshing and waits for a refresh in progress to finish
+func (m *ManifestWarmer) Stop() {
+	if m.stop == nil {
+		return
+	}
+
+	close(m.stop)
+	<-m.done
+	m.stop = nil
+}
+
+// run warms every fragment right away, then refreshes the due ones every interval
+func (m *ManifestWarmer) run() {
+	defer close(m.done)
+
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+
+	for {
+		m.refresh()
+
+		select {
+		case <-m.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// refresh reloads the manifest, keeping the previous URLs if that fails, and fetches every
+// fragment that isn't cached or expires before the refresh after next
+func (m *ManifestWarmer) refresh() {
+	if urls, err := loadManifest(m.source); err == nil {
+		m.mu.Lock()
+		m.urls = urls
+		m.mu.Unlock()
+	} else if logger != nil {
+		logger.Warn("ESI fragment manifest reload failed, keeping previous URLs",
+			zap.String("source", m.source),
+			zap.Error(err))
+	}
+
+	m.mu.Lock()
+	urls := m.urls
+	m.mu.Unlock()
+
+	deadline := now().Add(2 * m.interval)
+	for _, url := range urls {
+		if checkFragmentURL(url) != nil {
+			continue
+		}
+
+		req, key, err := warmRequest(url)
+		if err != nil {
+			if logger != nil {
+				logger.Warn("Invalid URL in ESI fragment manifest", zap.String("url", url), zap.Error(err))
+			}
+			continue
+		}
+
+		if expiresAt, ok := cache.expiry(key); ok && expiresAt.After(deadline) {
+			continue
+		}
+
+		warmFragment(url, key, req)
+	}
+}
+
+// warmRequest returns the request warming url, and the key it is cached under for it: the one an
+// include of url without attributes looks up, see Config.CacheKeyFunc
+func warmRequest(url string) (*http.Request, string, error) {
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, url, nil)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return req, lookupKey(url, (&includeTag{}).cacheKey(url, req), req), nil
+}
+
+// warmFragment fetches url from its backend and replaces its cache entry under key, keeping the
+// current one if the fetch fails
+func warmFragment(url, key string, req *http.Request) {
+	err := cache.Refresh(key, fragmentFetcher(url, req, fetchOptions{cacheKey: key}))
+	if err != nil && logger != nil {
+		logger.Warn("ESI fragment warm-up failed", zap.String("url", url), zap.Error(err))
+	}
+}
+
+// loadManifest reads the fragment URLs listed at source, a file path or an http(s) URL
+func loadManifest(source string) ([]string, error) {
+	var content []byte
+	if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
+		resp, err := fragmentClient().Get(source)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("%w: %d", errUnexpectedStatus, resp.StatusCode)
+		}
+
+		if content, err = io.ReadAll(resp.Body); err != nil {
+			return nil, err
+		}
+	} else {
+		var err error
+		if content, err = os.ReadFile(source); err != nil {
+			return nil, err
+		}
+	}
+
+	var urls []string
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		urls = append(urls, line)
+	}
+
+	return urls, scanner.Err()
+}
@@ -0,0 +1,140 @@
+package esi
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLoadManifest(t *testing.T) {
+	manifest := "# hot fragments\nhttp://example.com/header\n\n  http://example.com/footer  \n"
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(manifest))
+	}))
+	defer ts.Close()
+
+	path := filepath.Join(t.TempDir(), "fragments.txt")
+	if err := os.WriteFile(path, []byte(manifest), 0o644); err != nil {
+		t.Fatalf("Writing manifest failed: %v", err)
+	}
+
+	for _, source := range []string{path, ts.URL + "/fragments.txt"} {
+		urls, err := loadManifest(source)
+		if err != nil {
+			t.Fatalf("loadManifest(%q) failed: %v", source, err)
+		}
+		if len(urls) != 2 || urls[0] != "http://example.com/header" || urls[1] != "http://example.com/footer" {
+			t.Errorf("loadManifest(%q) = %q, expected the two fragment URLs", source, urls)
+		}
+	}
+
+	if _, err := loadManifest(filepath.Join(t.TempDir(), "missing.txt")); err == nil {
+		t.Error("Expected an error for a missing manifest")
+	}
+}
+
+func TestManifestWarmerRefreshesBeforeExpiry(t *testing.T) {
+	clock := time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC)
+	withClock(t, &clock)
+	withConfig(t, Config{MinimumCacheTTL: 60})
+
+	var fetches atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte("<p>header</p>"))
+	}))
+	defer ts.Close()
+
+	fragmentURL := ts.URL + "/header"
+	path := filepath.Join(t.TempDir(), "fragments.txt")
+	if err := os.WriteFile(path, []byte(fragmentURL+"\n"), 0o644); err != nil {
+		t.Fatalf("Writing manifest failed: %v", err)
+	}
+
+	m := NewManifestWarmer(path, 10*time.Second)
+	if err := m.Start(); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	m.Stop()
+
+	if data, _, ok := cache.Load(fragmentURL); !ok || string(data) != "<p>header</p>" {
+		t.Fatalf("Expected manifest fragment to be cached at startup, got %q (cached: %v)", data, ok)
+	}
+
+	// Well before expiry nothing is fetched
+	clock = clock.Add(30 * time.Second)
+	m.refresh()
+	if n := fetches.Load(); n != 1 {
+		t.Errorf("Expected no refresh 30s into a 60s TTL, got %d fetches", n)
+	}
+
+	// Within two intervals of expiry the fragment is refreshed ahead of time
+	clock = clock.Add(15 * time.Second)
+	m.refresh()
+	if n := fetches.Load(); n != 2 {
+		t.Errorf("Expected a refresh 15s before expiry, got %d fetches", n)
+	}
+
+	// Past the original TTL the refreshed entry is still served
+	clock = clock.Add(30 * time.Second)
+	if _, _, ok := cache.Load(fragmentURL); !ok {
+		t.Error("Expected the refreshed fragment to outlive its original TTL")
+	}
+}
+
+func TestManifestWarmerUsesIncludeCacheKey(t *testing.T) {
+	cache.Reset()
+	withConfig(t, Config{
+		MaxCacheableFragmentBytes: 32,
+		CacheKeyFunc: func(req *http.Request, url string) string {
+			return "tenant:" + url
+		},
+	})
+
+	var fetches atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		w.Header().Set("Cache-Control", "max-age=60")
+		if r.URL.Path == "/large" {
+			w.Write([]byte("<p>a fragment over the size cap</p>"))
+			return
+		}
+		w.Write([]byte("<p>header</p>"))
+	}))
+	defer ts.Close()
+
+	path := filepath.Join(t.TempDir(), "fragments.txt")
+	if err := os.WriteFile(path, []byte(ts.URL+"/header\n"+ts.URL+"/large\n"), 0o644); err != nil {
+		t.Fatalf("Writing manifest failed: %v", err)
+	}
+
+	m := NewManifestWarmer(path, 10*time.Second)
+	if err := m.Start(); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	m.Stop()
+
+	if _, _, ok := cache.Load("tenant:" + ts.URL + "/header"); !ok {
+		t.Error("Expected the fragment cached under the CacheKeyFunc key")
+	}
+	if _, _, ok := cache.Load(ts.URL + "/header"); ok {
+		t.Error("Expected nothing cached under the raw URL")
+	}
+	if _, _, ok := cache.Load("tenant:" + ts.URL + "/large"); ok {
+		t.Error("Expected a fragment over MaxCacheableFragmentBytes not to be cached")
+	}
+
+	req := httptest.NewRequest("GET", "http://example.com/page", nil)
+	result := string(Parse([]byte(`<esi:include src="`+ts.URL+`/header"/>`), req))
+	if result != "<p>header</p>" {
+		t.Errorf("Expected the warmed fragment included, got %q", result)
+	}
+	if n := fetches.Load(); n != 2 {
+		t.Errorf("Expected the include to hit the warmed entry, got %d fetches", n)
+	}
+}
@@ -30,9 +30,7 @@ func BenchmarkParallelIncludes(b *testing.B) {
 
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
-		htmlCopy := make([]byte, len(html))
-		copy(htmlCopy, html)
-		esi.Parse(htmlCopy, req)
+		esi.Parse(html, req)
 	}
 }
 
@@ -61,8 +59,6 @@ func BenchmarkManyIncludes(b *testing.B) {
 
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
-		htmlCopy := make([]byte, len(html))
-		copy(htmlCopy, html)
-		esi.Parse(htmlCopy, req)
+		esi.Parse(html, req)
 	}
 }
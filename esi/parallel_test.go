@@ -6,6 +6,7 @@ import (
 	"net/http/httptest"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -146,3 +147,170 @@ func TestParallelWithAltFallback(t *testing.T) {
 		t.Errorf("Alt fallback not working: %s", string(result))
 	}
 }
+
+// TestFetchObserverOrdering verifies all slow fetches start before any of them completes
+func TestFetchObserverOrdering(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(100 * time.Millisecond)
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, "<div>%s</div>", r.URL.Path)
+	}))
+	defer server.Close()
+
+	var mu sync.Mutex
+	var events []string
+	esi.SetFetchObserver(func(url string, event string) {
+		if !strings.HasPrefix(url, server.URL) {
+			return
+		}
+
+		mu.Lock()
+		events = append(events, event)
+		mu.Unlock()
+	})
+	defer esi.SetFetchObserver(nil)
+
+	html := []byte(fmt.Sprintf(`<esi:include src="%s/observed1"/><esi:include src="%s/observed2"/><esi:include src="%s/observed3"/>`,
+		server.URL, server.URL, server.URL))
+	esi.Parse(html, httptest.NewRequest(http.MethodGet, "http://test.com", nil))
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	expected := []string{
+		esi.FetchEventStart, esi.FetchEventStart, esi.FetchEventStart,
+		esi.FetchEventComplete, esi.FetchEventComplete, esi.FetchEventComplete,
+	}
+	if strings.Join(events, ",") != strings.Join(expected, ",") {
+		t.Errorf("Unexpected fetch event order: %v", events)
+	}
+}
+
+// TestDuplicateSrcWithDistinctAlts verifies includes sharing a src share its cached success
+// while each one falls back to its own alt when the src fails
+func TestDuplicateSrcWithDistinctAlts(t *testing.T) {
+	t.Parallel()
+
+	var mu sync.Mutex
+	sharedCount := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/shared":
+			mu.Lock()
+			sharedCount++
+			mu.Unlock()
+			w.WriteHeader(http.StatusOK)
+			fmt.Fprint(w, "<div>Shared</div>")
+		case "/alt-one":
+			w.WriteHeader(http.StatusOK)
+			fmt.Fprint(w, "<div>Alt One</div>")
+		case "/alt-two":
+			w.WriteHeader(http.StatusOK)
+			fmt.Fprint(w, "<div>Alt Two</div>")
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer server.Close()
+
+	req := httptest.NewRequest(http.MethodGet, "http://test.com", nil)
+
+	failing := esi.Parse([]byte(fmt.Sprintf(
+		`[<esi:include src="%[1]s/broken" alt="%[1]s/alt-one"/>][<esi:include src="%[1]s/broken" alt="%[1]s/alt-two"/>]`,
+		server.URL)), req)
+	if string(failing) != "[<div>Alt One</div>][<div>Alt Two</div>]" {
+		t.Errorf("Expected each include to use its own alt, got: %s", failing)
+	}
+
+	succeeding := esi.Parse([]byte(fmt.Sprintf(
+		`[<esi:include src="%[1]s/shared" alt="%[1]s/alt-one"/>][<esi:include src="%[1]s/shared" alt="%[1]s/alt-two"/>]`,
+		server.URL)), req)
+	if string(succeeding) != "[<div>Shared</div>][<div>Shared</div>]" {
+		t.Errorf("Expected both includes to render the shared src, got: %s", succeeding)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if sharedCount != 1 {
+		t.Errorf("Expected the shared src to be fetched once, got %d", sharedCount)
+	}
+}
+
+// TestParallelFetchPoolIsBounded verifies the fetch goroutines of a page never exceed the pool size
+func TestParallelFetchPoolIsBounded(t *testing.T) {
+	old := esi.GetConfig()
+	esi.Configure(esi.Config{MaxParallelFetches: 3})
+	t.Cleanup(func() { esi.Configure(old) })
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(20 * time.Millisecond)
+		fmt.Fprint(w, "<i></i>")
+	}))
+	defer server.Close()
+
+	var page strings.Builder
+	for i := range 12 {
+		fmt.Fprintf(&page, `<esi:include src="%s/pool/%d"/>`, server.URL, i)
+	}
+
+	var peak int64
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			active := esi.ActiveFetches()
+			peak = max(peak, active)
+			if active == 0 && peak > 0 {
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}()
+
+	result := esi.Parse([]byte(page.String()), httptest.NewRequest(http.MethodGet, "http://test.com", nil))
+	<-done
+
+	if got := strings.Count(string(result), "<i></i>"); got != 12 {
+		t.Errorf("Expected all 12 includes to be resolved, got %d", got)
+	}
+	if peak != 3 {
+		t.Errorf("Expected the fetch goroutines to peak at the pool size 3, got %d", peak)
+	}
+	if active := esi.ActiveFetches(); active != 0 {
+		t.Errorf("Expected no fetch goroutines left, got %d", active)
+	}
+}
+
+// TestParallelFetchesBoundBackendConcurrency verifies includes beyond the pool size queue instead
+// of reaching the backend at once
+func TestParallelFetchesBoundBackendConcurrency(t *testing.T) {
+	old := esi.GetConfig()
+	esi.Configure(esi.Config{MaxParallelFetches: 4})
+	t.Cleanup(func() { esi.Configure(old) })
+
+	var active, peak atomic.Int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		current := active.Add(1)
+		defer active.Add(-1)
+		for seen := peak.Load(); current > seen && !peak.CompareAndSwap(seen, current); seen = peak.Load() {
+		}
+
+		time.Sleep(10 * time.Millisecond)
+		fmt.Fprint(w, "<i></i>")
+	}))
+	defer server.Close()
+
+	var page strings.Builder
+	for i := range 40 {
+		fmt.Fprintf(&page, `<esi:include src="%s/bound/%d"/>`, server.URL, i)
+	}
+
+	result := esi.Parse([]byte(page.String()), httptest.NewRequest(http.MethodGet, "http://test.com", nil))
+
+	if got := strings.Count(string(result), "<i></i>"); got != 40 {
+		t.Errorf("Expected all 40 includes to be resolved, got %d", got)
+	}
+	if got := peak.Load(); got > 4 {
+		t.Errorf("Expected at most 4 concurrent backend requests, got %d", got)
+	}
+}
@@ -0,0 +1,135 @@
+package esi
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+)
+
+// readerChunkSize is how much of the source the reader pulls at once
+const readerChunkSize = 32 << 10
+
+// reader processes the ESI tags of a document as it is read, see NewReader
+type reader struct {
+	src   io.Reader
+	req   *http.Request
+	chunk []byte
+	// pending is the input not processed yet, from the start of a tag whose close didn't come yet
+	pending []byte
+	// out is the processed output not read yet
+	out bytes.Buffer
+	err error
+}
+
+// NewReader returns a reader of src with its ESI tags processed, producing the same output as
+// Parse without holding the whole document in memory. Literal content is passed on as soon as it
+// is read, and each tag once it is closed, its includes fetched before reading goes on; a tag is
+// buffered whole until then, so an unclosed one holds the rest of the document.
+func NewReader(src io.Reader, req *http.Request) io.Reader {
+	return &reader{
+		src:   src,
+		req:   WithOutputBudget(req),
+		chunk: make([]byte, readerChunkSize),
+	}
+}
+
+// Read implements io.Reader.
+func (r *reader) Read(p []byte) (int, error) {
+	for r.out.Len() == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+
+		n, err := r.src.Read(r.chunk)
+		r.pending = append(r.pending, r.chunk[:n]...)
+
+		if err != nil {
+			// A tag still open can't be completed anymore, Parse leaves it verbatim
+			r.out.Write(Parse(r.pending, r.req))
+			r.pending = nil
+			r.err = err
+
+			continue
+		}
+
+		r.scan()
+	}
+
+	return r.out.Read(p)
+}
+
+// scan moves the literal content and the closed tags of pending to out
+func (r *reader) scan() {
+	buf := r.pending
+	position := 0
+
+	for position < len(buf) {
+		next := buf[position:]
+		startPos, _, t := ReadToTag(next, position)
+
+		if startPos == len(next) {
+			// No more tags, but the chunk may end with the beginning of one
+			end := len(buf) - partialOpenerLength(next)
+			r.out.Write(buf[position:end])
+			position = end
+
+			break
+		}
+
+		r.out.Write(next[:startPos])
+
+		if t == nil && incompleteTagName(next[startPos:]) {
+			// Wait for the rest of the tag name
+			position += startPos
+
+			break
+		}
+
+		if t == nil {
+			// Not a tag we process, pass its opening bracket through and keep scanning
+			r.out.WriteByte(next[startPos])
+			position += startPos + 1
+
+			continue
+		}
+
+		closePosition := t.GetClosePosition(next[startPos:])
+		if closePosition == 0 {
+			// Wait for the rest of the tag
+			position += startPos
+
+			break
+		}
+
+		r.out.Write(Parse(next[startPos:startPos+closePosition], r.req))
+		position += startPos + closePosition
+	}
+
+	r.pending = append(r.pending[:0], buf[position:]...)
+}
+
+// incompleteTagName reports whether b, starting with an ESI tag opener, ends inside the tag name
+func incompleteTagName(b []byte) bool {
+	name := bytes.TrimPrefix(b, []byte("<esi:"))
+	for _, c := range name {
+		if c < 'a' || c > 'z' {
+			return false
+		}
+	}
+
+	return true
+}
+
+// partialOpenerLength returns the length of a trailing prefix of an ESI tag opener in b
+func partialOpenerLength(b []byte) int {
+	longest := 0
+	for _, opener := range []string{"<esi:", "<!--esi"} {
+		for n := len(opener) - 1; n > longest; n-- {
+			if bytes.HasSuffix(b, []byte(opener[:n])) {
+				longest = n
+			}
+		}
+	}
+
+	return longest
+}
@@ -0,0 +1,116 @@
+package esi_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"github.com/sc0rp10/go-esi/esi"
+)
+
+func TestReaderMatchesParse(t *testing.T) {
+	t.Parallel()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("<p>fragment " + r.URL.Path + "</p>"))
+	}))
+	defer server.Close()
+
+	documents := []string{
+		`<p>no tags at all</p>`,
+		`<html><esi:include src="` + server.URL + `/a"/><p>between</p><esi:include src="` + server.URL + `/b"/></html>`,
+		`<esi:comment text="x"/><esi:vars>$(HTTP_HOST)</esi:vars><esi:remove>x</esi:remove>|<!--esi <b>1</b> -->`,
+		`<esi:choose><esi:when test="$(HTTP_HOST)=='domain.com:9080'"><esi:include src="` + server.URL + `/when"/>` +
+			`</esi:when><esi:otherwise>b</esi:otherwise></esi:choose>`,
+		`<esi:try><esi:attempt><esi:include src="` + server.URL + `/try"/></esi:attempt><esi:except>b</esi:except></esi:try>`,
+		`<p>a</p><esi:unknown text="x"/><p>b</p><esi:comment text="y"/>`,
+		`<p>a</p><esi:vars>$(HTTP_HOST) <p>b</p>`,
+		`<p>a</p><esi:comment text="x" <p>b</p>`,
+		`<p>a</p><!--esi <p>b</p>`,
+		`<p>a</p><esi:`,
+		`<p>a</p><!--es`,
+		full,
+	}
+
+	for _, document := range documents {
+		expected := string(esi.Parse([]byte(document), getRequest()))
+
+		for name, src := range map[string]io.Reader{
+			"whole":    strings.NewReader(document),
+			"one byte": iotest.OneByteReader(strings.NewReader(document)),
+		} {
+			result, err := io.ReadAll(esi.NewReader(src, getRequest()))
+			if err != nil {
+				t.Fatalf("Unexpected error reading %q: %v", document, err)
+			}
+
+			if string(result) != expected {
+				t.Errorf("Streamed output mismatch reading %s of %q\nExpected: %q\nGiven:    %q", name, document, expected, result)
+			}
+		}
+	}
+}
+
+// generator produces count copies of a part without ever holding more than one
+type generator struct {
+	part  []byte
+	count int
+	off   int
+	// onPart is called after each copy is produced
+	onPart func(n int)
+}
+
+func (g *generator) Read(p []byte) (int, error) {
+	if g.count == 0 {
+		return 0, io.EOF
+	}
+
+	n := copy(p, g.part[g.off:])
+	g.off += n
+	if g.off == len(g.part) {
+		g.off = 0
+		g.count--
+		g.onPart(g.count)
+	}
+
+	return n, nil
+}
+
+func TestReaderMemoryStaysBounded(t *testing.T) {
+	const (
+		parts = 1 << 16
+		limit = 16 << 20
+	)
+
+	part := []byte(`<p>` + strings.Repeat("lorem ipsum ", 80) + `</p><esi:vars>$(HTTP_HOST)</esi:vars><esi:comment text="x"/>` + "\n")
+
+	var peak uint64
+	src := &generator{part: part, count: parts, onPart: func(n int) {
+		if n%(parts/8) != 0 {
+			return
+		}
+
+		var stats runtime.MemStats
+		runtime.GC()
+		runtime.ReadMemStats(&stats)
+		peak = max(peak, stats.HeapAlloc)
+	}}
+
+	written, err := io.Copy(io.Discard, esi.NewReader(src, getRequest()))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	expectedPart := strings.Replace(string(part), `<esi:vars>$(HTTP_HOST)</esi:vars><esi:comment text="x"/>`, "domain.com:9080", 1)
+	if expected := int64(len(expectedPart) * parts); written != expected {
+		t.Errorf("Expected %d bytes of output, got %d", expected, written)
+	}
+
+	if peak > limit {
+		t.Errorf("Expected the heap to stay under %d bytes for a %d bytes document, peaked at %d", limit, len(part)*parts, peak)
+	}
+}
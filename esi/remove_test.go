@@ -0,0 +1,59 @@
+package esi
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func TestRemoveTag(t *testing.T) {
+	var fetches atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer ts.Close()
+
+	tests := []struct {
+		name     string
+		html     string
+		expected string
+	}{
+		{
+			"nested markup with > characters",
+			`a <esi:remove><div class="fallback"><a href="/?x>y">link</a> 1 > 0</div></esi:remove> b`,
+			"a  b",
+		},
+		{
+			"several remove blocks",
+			"<p>one</p><esi:remove>\n<p>two</p>\n</esi:remove><p>three</p><esi:remove><p>four</p></esi:remove>",
+			"<p>one</p><p>three</p>",
+		},
+		{
+			"includes of a remove block are not fetched",
+			`a<esi:remove><esi:include src="` + ts.URL + `/fallback"/></esi:remove>b`,
+			"ab",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withConfig(t, Config{DefaultOnError: OnErrorError})
+			fetches.Store(0)
+
+			req := httptest.NewRequest("GET", "http://example.com", nil)
+			result, res := ParseWithResult([]byte(tt.html), req)
+			if string(result) != tt.expected {
+				t.Errorf("Expected %q, got %q", tt.expected, result)
+			}
+
+			if err := res.Err(); err != nil {
+				t.Errorf("Expected no page failure, got %v", err)
+			}
+			if got := fetches.Load(); got != 0 {
+				t.Errorf("Expected no fragment fetch, got %d", got)
+			}
+		})
+	}
+}
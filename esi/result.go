@@ -0,0 +1,171 @@
+package esi
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Fragment describes an include resolved while parsing a document.
+type Fragment struct {
+	URL          string
+	StatusCode   int
+	LastModified time.Time
+	// Digest is the hex SHA-256 of the content normalized by Config.NormalizeFragment, usable as a validator
+	Digest string
+	Err    error
+	// CacheHit is set when the fragment was served from the cache rather than fetched for this include
+	CacheHit bool
+	// Duration is how long the include waited for the fragment
+	Duration time.Duration
+}
+
+// Result collects the fragments resolved by ParseWithResult.
+type Result struct {
+	mu        sync.Mutex
+	Fragments []Fragment
+	err       error
+
+	redirectStatus   int
+	redirectLocation string
+
+	// truncated is set when an include was left out for depth or a cycle, itself or nested in its fragment
+	truncated bool
+}
+
+type resultKey struct{}
+
+// ParseWithResult parses ESI tags like Parse and also reports every top-level include that was resolved.
+func ParseWithResult(b []byte, req *http.Request) ([]byte, *Result) {
+	res := &Result{}
+	req = req.WithContext(context.WithValue(req.Context(), resultKey{}, res))
+
+	return Parse(b, req), res
+}
+
+// LastModified returns the most recent Last-Modified reported by the fragments, or the zero time if none did.
+func (r *Result) LastModified() time.Time {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var latest time.Time
+	for _, f := range r.Fragments {
+		if f.LastModified.After(latest) {
+			latest = f.LastModified
+		}
+	}
+
+	return latest
+}
+
+// Err returns the first failure of an include whose onerror mode fails the page, or nil.
+// The middleware should then serve an error instead of the assembled page.
+func (r *Result) Err() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.err
+}
+
+// Errors returns the failures of the recorded includes in the order they were resolved, each wrapped
+// with its fragment URL. A failed src is listed even when its alt or onerror handling took over.
+func (r *Result) Errors() []error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var errs []error
+	for _, f := range r.Fragments {
+		if f.Err != nil {
+			errs = append(errs, fmt.Errorf("include %s: %w", f.URL, f.Err))
+		}
+	}
+
+	return errs
+}
+
+// Redirect returns the redirect of an include with propagate-redirect="true", or a zero status if
+// there was none. The middleware should then send this redirect instead of the assembled page.
+func (r *Result) Redirect() (statusCode int, location string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.redirectStatus, r.redirectLocation
+}
+
+// isTruncated reports whether an include was left out for depth or a cycle, see fragmentMeta.truncated
+func (r *Result) isTruncated() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.truncated
+}
+
+func (r *Result) add(f Fragment) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.Fragments = append(r.Fragments, f)
+}
+
+// recordFragment adds the fragment to the Result attached to the request, if any
+func recordFragment(req *http.Request, url string, meta fragmentMeta, elapsed time.Duration, err error) {
+	res, ok := req.Context().Value(resultKey{}).(*Result)
+	if !ok {
+		return
+	}
+
+	fragment := Fragment{
+		URL:          url,
+		StatusCode:   meta.statusCode,
+		LastModified: meta.lastModified,
+		Err:          err,
+		CacheHit:     err == nil && !meta.fetched,
+		Duration:     elapsed,
+	}
+	if meta.digest != [sha256.Size]byte{} {
+		fragment.Digest = hex.EncodeToString(meta.digest[:])
+	}
+
+	res.add(fragment)
+
+	if meta.truncated || errors.Is(err, errIncludeDepth) || errors.Is(err, errIncludeCycle) {
+		res.mu.Lock()
+		res.truncated = true
+		res.mu.Unlock()
+	}
+}
+
+// failPage records an include failure that fails the page on the Result attached to the request, if any
+func failPage(req *http.Request, err error) {
+	res, ok := req.Context().Value(resultKey{}).(*Result)
+	if !ok {
+		return
+	}
+
+	res.mu.Lock()
+	defer res.mu.Unlock()
+
+	if res.err == nil {
+		res.err = err
+	}
+}
+
+// redirectPage records a propagated fragment redirect on the Result attached to the request, if any
+func redirectPage(req *http.Request, statusCode int, location string) {
+	res, ok := req.Context().Value(resultKey{}).(*Result)
+	if !ok {
+		return
+	}
+
+	res.mu.Lock()
+	defer res.mu.Unlock()
+
+	if res.redirectStatus == 0 {
+		res.redirectStatus, res.redirectLocation = statusCode, location
+	}
+}
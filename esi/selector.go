@@ -0,0 +1,55 @@
+package esi
+
+import (
+	"bytes"
+	"regexp"
+	"strings"
+)
+
+// voidElements never have a closing tag, so the opening tag is the whole element
+var voidElements = map[string]bool{
+	"area": true, "base": true, "br": true, "col": true, "embed": true, "hr": true, "img": true,
+	"input": true, "link": true, "meta": true, "source": true, "track": true, "wbr": true,
+}
+
+var tagBoundary = regexp.MustCompile(`(?i)<(/?)([a-z][a-z0-9-]*)\b[^>]*?(/?)>`)
+
+// selectElementByID returns the element of an HTML document carrying the given id attribute,
+// from its opening tag to the matching closing tag. Nested elements of the same name are
+// balanced, anything more elaborate than id selection is out of scope.
+func selectElementByID(doc []byte, id string) ([]byte, bool) {
+	quoted := regexp.QuoteMeta(id)
+	opening := regexp.MustCompile(`<([a-zA-Z][a-zA-Z0-9-]*)\b[^>]*?\s[iI][dD]\s*=\s*(?:"` + quoted + `"[^>]*|'` +
+		quoted + `'[^>]*|` + quoted + `(?:[\s/][^>]*)?)>`)
+
+	match := opening.FindSubmatchIndex(doc)
+	if match == nil {
+		return nil, false
+	}
+
+	start, end := match[0], match[1]
+	name := strings.ToLower(string(doc[match[2]:match[3]]))
+
+	if voidElements[name] || bytes.HasSuffix(doc[start:end], []byte("/>")) {
+		return doc[start:end], true
+	}
+
+	depth := 1
+	for _, tag := range tagBoundary.FindAllSubmatchIndex(doc[end:], -1) {
+		if !strings.EqualFold(string(doc[end+tag[4]:end+tag[5]]), name) || tag[7] > tag[6] {
+			continue
+		}
+
+		if tag[3] > tag[2] {
+			depth--
+		} else {
+			depth++
+		}
+
+		if depth == 0 {
+			return doc[start : end+tag[1]], true
+		}
+	}
+
+	return nil, false
+}
@@ -0,0 +1,36 @@
+package esi
+
+import "testing"
+
+func TestSelectElementByID(t *testing.T) {
+	doc := `<html><body>
+<div id="header"><h1>Title</h1></div>
+<div class="main" id='widget'><div><p>Nested</p></div><div>More</div></div>
+<section id=plain>Unquoted</section>
+<img src="/logo.png" id="logo">
+<widget-box id="custom" /><p id="Case">Upper</p>
+</body></html>`
+
+	tests := []struct {
+		id       string
+		expected string
+		found    bool
+	}{
+		{"header", `<div id="header"><h1>Title</h1></div>`, true},
+		{"widget", `<div class="main" id='widget'><div><p>Nested</p></div><div>More</div></div>`, true},
+		{"plain", `<section id=plain>Unquoted</section>`, true},
+		{"logo", `<img src="/logo.png" id="logo">`, true},
+		{"custom", `<widget-box id="custom" />`, true},
+		{"case", "", false},
+		{"missing", "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.id, func(t *testing.T) {
+			element, found := selectElementByID([]byte(doc), tt.id)
+			if found != tt.found || string(element) != tt.expected {
+				t.Errorf("selectElementByID(%q) = %q, %v; expected %q, %v", tt.id, element, found, tt.expected, tt.found)
+			}
+		})
+	}
+}
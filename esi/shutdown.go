@@ -0,0 +1,101 @@
+package esi
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+const shutdownPollInterval = 10 * time.Millisecond
+
+var lifecycle = &fetchLifecycle{}
+
+// fetchLifecycle holds the context every fragment fetch is bound to, cancelled by Shutdown, and
+// tracks the fetches bound to it, cached or not
+type fetchLifecycle struct {
+	mu       sync.Mutex
+	ctx      context.Context
+	cancel   context.CancelFunc
+	inFlight *sync.WaitGroup
+}
+
+// begin returns the context of a fetch started now, and the function to call once it has returned
+func (l *fetchLifecycle) begin() (context.Context, func()) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.ctx == nil {
+		l.ctx, l.cancel = context.WithCancel(context.Background())
+		l.inFlight = &sync.WaitGroup{}
+	}
+	l.inFlight.Add(1)
+
+	return l.ctx, l.inFlight.Done
+}
+
+// cancelAll cancels the fetches started so far and returns the group they are tracked in. Later
+// fetches get a fresh context and group.
+func (l *fetchLifecycle) cancelAll() *sync.WaitGroup {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.cancel != nil {
+		l.cancel()
+	}
+	cancelled := l.inFlight
+	if cancelled == nil {
+		cancelled = &sync.WaitGroup{}
+	}
+	l.ctx, l.cancel = context.WithCancel(context.Background())
+	l.inFlight = &sync.WaitGroup{}
+
+	return cancelled
+}
+
+// withShutdown returns ctx cancelled by Shutdown too, along with the function releasing it, which
+// must be called once the fetch has returned, and the lifecycle context it is bound to
+func withShutdown(ctx context.Context) (context.Context, context.CancelFunc, context.Context) {
+	current, done := lifecycle.begin()
+	ctx, cancel := context.WithCancel(ctx)
+	stop := context.AfterFunc(current, cancel)
+
+	return ctx, func() {
+		stop()
+		cancel()
+		done()
+	}, current
+}
+
+// Shutdown cancels the fragment fetches in flight and waits until they have returned, or until ctx
+// is done, whose error it returns then. Requests waiting on a cancelled fetch fail with it rather than
+// fetching the fragment again. Fetches started afterwards are not affected, so the package stays
+// usable, e.g. across a configuration reload.
+func Shutdown(ctx context.Context) error {
+	cancelled := lifecycle.cancelAll()
+
+	drained := make(chan struct{})
+	go func() {
+		cancelled.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-drained:
+	}
+
+	// The requests that fetched for the cache are done once their result is shared
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+
+	for cache.fetching() {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,196 @@
+package esi
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestShutdownCancelsFetchesInFlight(t *testing.T) {
+	cache.Reset()
+	withConfig(t, Config{})
+
+	observer := &countingObserver{}
+	SetMetricsObserver(observer)
+	t.Cleanup(func() { SetMetricsObserver(nil) })
+
+	started := make(chan struct{}, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			started <- struct{}{}
+			<-r.Context().Done()
+			return
+		}
+		w.Write([]byte("fragment"))
+	}))
+	defer ts.Close()
+
+	baseline := runtime.NumGoroutine()
+
+	// One request fetches the fragment, the other waits for it
+	var wg sync.WaitGroup
+	results := make([]string, 2)
+	for i := range results {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i] = string(Parse([]byte(`<esi:include src="`+ts.URL+`/slow"/>`), httptest.NewRequest("GET", "http://example.com", nil)))
+		}()
+	}
+
+	<-started
+	deadline := time.Now().Add(5 * time.Second)
+	for observer.stampedeWaits.Load() == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := Shutdown(ctx); err != nil {
+		t.Fatalf("Expected the fetches in flight to return, got %v", err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Expected the fetching and waiting requests to return after Shutdown")
+	}
+
+	for i, result := range results {
+		if result != "" {
+			t.Errorf("Expected request %d to leave the cancelled include out, got %q", i, result)
+		}
+	}
+	if cache.fetching() {
+		t.Error("Expected no fetch left in flight")
+	}
+
+	// Fetches started after Shutdown are not affected
+	result := Parse([]byte(`<esi:include src="`+ts.URL+`/fast"/>`), httptest.NewRequest("GET", "http://example.com", nil))
+	if string(result) != "fragment" {
+		t.Errorf("Expected fetches to work after Shutdown, got %q", result)
+	}
+
+	// Idle connections are not goroutines of ours
+	fragmentClient().CloseIdleConnections()
+	deadline = time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > baseline && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := runtime.NumGoroutine(); got > baseline {
+		t.Errorf("Expected no goroutine left behind, %d running, %d before", got, baseline)
+	}
+}
+
+func TestShutdownWaitsForUncachedFetches(t *testing.T) {
+	cache.Reset()
+
+	transforming, release := make(chan struct{}), make(chan struct{})
+	withConfig(t, Config{FragmentTransforms: []FragmentTransform{func(url string, content []byte) []byte {
+		close(transforming)
+		<-release
+		return content
+	}}})
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("posted"))
+	}))
+	defer ts.Close()
+
+	parsed := make(chan string, 1)
+	go func() {
+		req := httptest.NewRequest("GET", "http://example.com", nil)
+		parsed <- string(Parse([]byte(`<esi:include src="`+ts.URL+`/form" method="POST" entity="a=1"/>`), req))
+	}()
+	<-transforming
+
+	// The POST bypasses the cache, Shutdown still waits for it
+	shutdown := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		shutdown <- Shutdown(ctx)
+	}()
+
+	select {
+	case err := <-shutdown:
+		t.Fatalf("Expected Shutdown to wait for the uncached fetch, returned %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	select {
+	case err := <-shutdown:
+		if err != nil {
+			t.Errorf("Expected the fetch to have returned, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected Shutdown to return once the fetch returned")
+	}
+	<-parsed
+}
+
+func TestShutdownWaitsForStaleRefreshes(t *testing.T) {
+	clock := time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC)
+	withClock(t, &clock)
+	cache.Reset()
+
+	var transforms atomic.Int32
+	refreshing, release := make(chan struct{}), make(chan struct{})
+	withConfig(t, Config{FragmentTransforms: []FragmentTransform{func(url string, content []byte) []byte {
+		if transforms.Add(1) > 1 {
+			close(refreshing)
+			<-release
+		}
+		return content
+	}}})
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60, stale-while-revalidate=30")
+		w.Write([]byte("fragment"))
+	}))
+	defer ts.Close()
+
+	html := `<esi:include src="` + ts.URL + `/fragment"/>`
+	Parse([]byte(html), httptest.NewRequest("GET", "http://example.com", nil))
+
+	// Served stale, the refresh runs after the request has returned
+	clock = clock.Add(70 * time.Second)
+	if result := string(Parse([]byte(html), httptest.NewRequest("GET", "http://example.com", nil))); result != "fragment" {
+		t.Fatalf("Expected the stale fragment, got %q", result)
+	}
+	<-refreshing
+
+	shutdown := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		shutdown <- Shutdown(ctx)
+	}()
+
+	select {
+	case err := <-shutdown:
+		t.Fatalf("Expected Shutdown to wait for the background refresh, returned %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	select {
+	case err := <-shutdown:
+		if err != nil {
+			t.Errorf("Expected the refresh to have returned, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected Shutdown to return once the refresh returned")
+	}
+}
@@ -0,0 +1,54 @@
+package esi
+
+import (
+	"context"
+	"net/http"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+// startSpan starts a span of Config.Tracer as a child of the span in ctx, if any. Without a
+// tracer the context is returned unchanged along with a span doing nothing.
+func startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	cfg := config()
+	if cfg.Tracer == nil {
+		return ctx, noop.Span{}
+	}
+
+	return cfg.Tracer.Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// withSpanOf returns ctx carrying the span of from, which values of the page's context don't reach otherwise
+func withSpanOf(ctx, from context.Context) context.Context {
+	if config().Tracer == nil {
+		return ctx
+	}
+
+	return trace.ContextWithSpan(ctx, trace.SpanFromContext(from))
+}
+
+// endIncludeSpan records the outcome of a fragment lookup on its span and ends it
+func endIncludeSpan(span trace.Span, meta fragmentMeta, err error) {
+	span.SetAttributes(attribute.Bool("esi.cache_hit", !meta.fetched))
+	if meta.statusCode != 0 {
+		span.SetAttributes(attribute.Int("http.response.status_code", meta.statusCode))
+	}
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+
+	span.End()
+}
+
+// injectTraceContext sets the traceparent of the span in ctx on a fragment request, replacing
+// the one forwarded from the client, so the backend's spans nest under the include's
+func injectTraceContext(ctx context.Context, rq *http.Request) {
+	if config().Tracer != nil {
+		propagation.TraceContext{}.Inject(ctx, propagation.HeaderCarrier(rq.Header))
+	}
+}
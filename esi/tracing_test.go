@@ -0,0 +1,83 @@
+package esi
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestTracingSpans(t *testing.T) {
+	var (
+		mu           sync.Mutex
+		traceparents []string
+	)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		traceparents = append(traceparents, r.Header.Get("traceparent"))
+		mu.Unlock()
+
+		w.Header().Set("Cache-Control", "max-age=300")
+		w.Write([]byte(r.URL.Path))
+	}))
+	defer ts.Close()
+
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	withConfig(t, Config{Tracer: provider.Tracer("esi")})
+	cache.Reset()
+
+	// The second include of /a is served from the cache
+	html := `<esi:include src="` + ts.URL + `/a"/><esi:include src="` + ts.URL + `/b"/>`
+	Parse([]byte(html), httptest.NewRequest("GET", "http://example.com", nil))
+	Parse([]byte(`<esi:include src="`+ts.URL+`/a"/>`), httptest.NewRequest("GET", "http://example.com", nil))
+
+	spans := recorder.Ended()
+	var parses, includes []sdktrace.ReadOnlySpan
+	for _, span := range spans {
+		switch span.Name() {
+		case "esi.parse":
+			parses = append(parses, span)
+		case "esi.include":
+			includes = append(includes, span)
+		}
+	}
+	if len(parses) != 2 || len(includes) != 3 {
+		t.Fatalf("Expected 2 parse and 3 include spans, got %d and %d", len(parses), len(includes))
+	}
+
+	hits := 0
+	for _, include := range includes {
+		attrs := attribute.NewSet(include.Attributes()...)
+		if hit, _ := attrs.Value("esi.cache_hit"); hit.AsBool() {
+			hits++
+		}
+		if status, _ := attrs.Value("http.response.status_code"); status.AsInt64() != http.StatusOK {
+			t.Errorf("Expected status 200 on the include span, got %v", status.AsInt64())
+		}
+
+		parent := include.Parent().SpanID()
+		if parent != parses[0].SpanContext().SpanID() && parent != parses[1].SpanContext().SpanID() {
+			t.Errorf("Expected include span %v to be a child of a parse span", attrs)
+		}
+	}
+	if hits != 1 {
+		t.Errorf("Expected 1 cache hit among the include spans, got %d", hits)
+	}
+
+	// Backends receive the trace context of the include span fetching them
+	if len(traceparents) != 2 {
+		t.Fatalf("Expected 2 backend requests, got %d", len(traceparents))
+	}
+	for _, traceparent := range traceparents {
+		if !strings.Contains(traceparent, parses[0].SpanContext().TraceID().String()) &&
+			!strings.Contains(traceparent, parses[1].SpanContext().TraceID().String()) {
+			t.Errorf("Expected traceparent of a parse trace, got %q", traceparent)
+		}
+	}
+}
@@ -1 +1,92 @@
 package esi
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+	"sync/atomic"
+)
+
+const try = "try"
+
+var (
+	closeTry  = regexp.MustCompile("</esi:try>")
+	attemptRg = regexp.MustCompile(`(?s)<esi:attempt>(.*?)</esi:attempt>`)
+	exceptRg  = regexp.MustCompile(`(?s)<esi:except>(.*?)</esi:except>`)
+)
+
+type attemptKey struct{}
+
+// attempt tracks whether an include of an esi:attempt block failed
+type attempt struct {
+	failed atomic.Bool
+}
+
+type tryTag struct {
+	*baseTag
+}
+
+// Input (e.g.
+// <esi:try>
+//
+//	<esi:attempt>
+//	    <esi:include src="http://www.example.com/personalized.html"/>
+//	</esi:attempt>
+//	<esi:except>
+//	    <esi:include src="http://www.example.com/generic.html"/>
+//	</esi:except>
+//
+// </esi:try>
+// ).
+// The attempt block is rendered unless one of its includes fails even after its alt, in which
+// case the except block is rendered instead.
+func (t *tryTag) Process(b []byte, req *http.Request) ([]byte, int) {
+	found := closeTry.FindIndex(b)
+	if found == nil {
+		return nil, len(b)
+	}
+
+	t.length = found[1]
+	body := b[:found[0]]
+
+	if attemptIdx := attemptRg.FindSubmatch(body); attemptIdx != nil {
+		a := &attempt{}
+		res := Parse(attemptIdx[1], req.WithContext(context.WithValue(req.Context(), attemptKey{}, a)))
+
+		if !a.failed.Load() {
+			return res, t.length
+		}
+	}
+
+	var res []byte
+	if exceptIdx := exceptRg.FindSubmatch(body); exceptIdx != nil {
+		res = Parse(exceptIdx[1], req)
+	}
+
+	return res, t.length
+}
+
+func (*tryTag) HasClose(b []byte) bool {
+	return closeTry.FindIndex(b) != nil
+}
+
+func (*tryTag) GetClosePosition(b []byte) int {
+	if idx := closeTry.FindIndex(b); idx != nil {
+		return idx[1]
+	}
+
+	return 0
+}
+
+// failAttempt marks the esi:attempt block the request is processing as failed, reporting false
+// if the request isn't within one
+func failAttempt(req *http.Request) bool {
+	a, ok := req.Context().Value(attemptKey{}).(*attempt)
+	if !ok {
+		return false
+	}
+
+	a.failed.Store(true)
+
+	return true
+}
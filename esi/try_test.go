@@ -0,0 +1,70 @@
+package esi
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTryTag(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/broken" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte("<p>" + r.URL.Path + "</p>"))
+	}))
+	defer ts.Close()
+
+	tests := []struct {
+		name     string
+		html     string
+		expected string
+	}{
+		{
+			"failing attempt falls back to except",
+			`<esi:try><esi:attempt><esi:include src="` + ts.URL + `/broken"/></esi:attempt>` +
+				`<esi:except><esi:include src="` + ts.URL + `/generic"/></esi:except></esi:try>`,
+			"<p>/generic</p>",
+		},
+		{
+			"succeeding attempt hides except",
+			`<esi:try><esi:attempt><esi:include src="` + ts.URL + `/personal"/></esi:attempt>` +
+				`<esi:except><esi:include src="` + ts.URL + `/generic"/></esi:except></esi:try>`,
+			"<p>/personal</p>",
+		},
+		{
+			"attempt with a working alt still succeeds",
+			`<esi:try><esi:attempt><esi:include src="` + ts.URL + `/broken" alt="` + ts.URL + `/alt"/></esi:attempt>` +
+				`<esi:except>fallback</esi:except></esi:try>`,
+			"<p>/alt</p>",
+		},
+		{
+			"failing attempt without except renders nothing",
+			`before<esi:try><esi:attempt><esi:include src="` + ts.URL + `/broken"/></esi:attempt></esi:try>after`,
+			"beforeafter",
+		},
+		{
+			"try without except keeps a successful attempt",
+			`<esi:try><esi:attempt>static <esi:include src="` + ts.URL + `/personal"/></esi:attempt></esi:try>`,
+			"static <p>/personal</p>",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withConfig(t, Config{DefaultOnError: OnErrorError})
+
+			req := httptest.NewRequest("GET", "http://example.com", nil)
+			result, res := ParseWithResult([]byte(tt.html), req)
+			if string(result) != tt.expected {
+				t.Errorf("Expected %q, got %q", tt.expected, result)
+			}
+
+			// The try block handles the failure, it never fails the whole page
+			if err := res.Err(); err != nil {
+				t.Errorf("Expected no page failure, got %v", err)
+			}
+		})
+	}
+}
@@ -1,8 +1,12 @@
 package esi
 
 import (
+	"context"
+	"hash/fnv"
+	"maps"
 	"net/http"
 	"regexp"
+	"strconv"
 	"strings"
 )
 
@@ -13,31 +17,73 @@ const (
 	httpReferrer       = "HTTP_REFERER"
 	httpUserAgent      = "HTTP_USER_AGENT"
 	httpQueryString    = "QUERY_STRING"
+	requestMethod      = "REQUEST_METHOD"
+	bucketVar          = "BUCKET"
+	customVar          = "VAR"
+
+	defaultBucketCount = 100
 
 	vars = "vars"
 )
 
 var (
-	interpretedVar   = regexp.MustCompile(`\$\((.+?)(\{(.+)\}(.+)?)?\)`)
-	defaultExtractor = regexp.MustCompile(`\|('|")(.+?)('|")`)
+	// $(NAME), $(NAME{key}) and either with a |default, quoted or not
+	interpretedVar   = regexp.MustCompile(`\$\(([A-Z_]+)(?:\{([^}]*)\})?(\|[^)]*)?\)`)
+	defaultExtractor = regexp.MustCompile(`^\|\s*(?:'(.*)'|"(.*)"|(.*?))\s*$`)
 	stringExtractor  = regexp.MustCompile(`('|")(.+)('|")`)
 
 	closeVars = regexp.MustCompile("((\n| +)+)?</esi:vars>")
 )
 
+type varsKey struct{}
+
+// WithVars returns a copy of ctx carrying application values for $(VAR{name}) in esi:vars and
+// esi:when tests, added to those ctx already carries. Attach it to the request of the page, e.g.
+// with req.WithContext, before parsing; fragments' own nested tags don't see the values, as the
+// fragments are cached for every page.
+func WithVars(ctx context.Context, vars map[string]string) context.Context {
+	merged := maps.Clone(varsFromContext(ctx))
+	if merged == nil {
+		merged = make(map[string]string, len(vars))
+	}
+	maps.Copy(merged, vars)
+
+	return context.WithValue(ctx, varsKey{}, merged)
+}
+
+// varsFromContext returns the values attached with WithVars, or nil
+func varsFromContext(ctx context.Context) map[string]string {
+	vars, _ := ctx.Value(varsKey{}).(map[string]string)
+	return vars
+}
+
+// varsFrom returns the values attached to the request with WithVars, or nil
+func varsFrom(req *http.Request) map[string]string {
+	return varsFromContext(req.Context())
+}
+
 func parseVariables(b []byte, req *http.Request) string {
 	interprets := interpretedVar.FindSubmatch(b)
 
 	if interprets != nil {
+		key := string(interprets[2])
+
 		switch string(interprets[1]) {
 		case httpAcceptLanguage:
-			if strings.Contains(req.Header.Get("Accept-Language"), string(interprets[3])) {
+			if key == "" {
+				return req.Header.Get("Accept-Language")
+			}
+			if strings.Contains(req.Header.Get("Accept-Language"), key) {
 				return "true"
 			} else {
 				return "false"
 			}
 		case httpCookie:
-			if c, e := req.Cookie(string(interprets[3])); e == nil && c.Value != "" {
+			if key == "" {
+				if cookie := req.Header.Get("Cookie"); cookie != "" {
+					return cookie
+				}
+			} else if c, e := req.Cookie(key); e == nil && c.Value != "" {
 				return c.Value
 			}
 		case httpHost:
@@ -47,20 +93,30 @@ func parseVariables(b []byte, req *http.Request) string {
 		case httpUserAgent:
 			return req.UserAgent()
 		case httpQueryString:
-			if q := req.URL.Query().Get(string(interprets[3])); q != "" {
+			if key == "" {
+				if req.URL.RawQuery != "" {
+					return req.URL.RawQuery
+				}
+			} else if q := req.URL.Query().Get(key); q != "" {
 				return q
 			}
-		}
-
-		if len(interprets) > 3 {
-			defaultValues := defaultExtractor.FindSubmatch(interprets[4])
-
-			if len(defaultValues) > 2 {
-				return string(defaultValues[2])
+		case requestMethod:
+			return req.Method
+		case bucketVar:
+			if b, ok := experimentBucket(key, req); ok {
+				return strconv.Itoa(b)
 			}
+		case customVar:
+			if v := varsFrom(req)[key]; v != "" {
+				return v
+			}
+		}
 
-			return ""
+		if defaultValues := defaultExtractor.FindSubmatch(interprets[3]); defaultValues != nil {
+			return string(defaultValues[1]) + string(defaultValues[2]) + string(defaultValues[3])
 		}
+
+		return ""
 	} else {
 		strs := stringExtractor.FindSubmatch(b)
 
@@ -72,6 +128,37 @@ func parseVariables(b []byte, req *http.Request) string {
 	return string(b)
 }
 
+// experimentBucket assigns the user to one of Config.BucketCount buckets of an experiment by
+// hashing the configured identifying cookie or header. The same user always lands in the same
+// bucket of an experiment, while different experiments are bucketed independently.
+func experimentBucket(experiment string, req *http.Request) (int, bool) {
+	cfg := config()
+	var identity string
+	if name := cfg.BucketCookie; name != "" {
+		if c, err := req.Cookie(name); err == nil {
+			identity = c.Value
+		}
+	}
+	if identity == "" && cfg.BucketHeader != "" {
+		identity = req.Header.Get(cfg.BucketHeader)
+	}
+	if identity == "" {
+		return 0, false
+	}
+
+	count := cfg.BucketCount
+	if count <= 0 {
+		count = defaultBucketCount
+	}
+
+	h := fnv.New64a()
+	h.Write([]byte(experiment))
+	h.Write([]byte{0})
+	h.Write([]byte(identity))
+
+	return int(h.Sum64() % uint64(count)), true
+}
+
 type varsTag struct {
 	*baseTag
 }
@@ -85,7 +172,10 @@ func (c *varsTag) Process(b []byte, req *http.Request) ([]byte, int) {
 
 	c.length = found[1]
 
-	return interpretedVar.ReplaceAllFunc(b[5:found[0]], func(b []byte) []byte {
+	// Skip "vars>", unless the close tag follows a truncated opening tag
+	start := min(len("vars>"), found[0])
+
+	return interpretedVar.ReplaceAllFunc(b[start:found[0]], func(b []byte) []byte {
 		return []byte(parseVariables(b, req))
 	}), c.length
 }
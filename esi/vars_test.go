@@ -1,6 +1,8 @@
 package esi
 
 import (
+	"context"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"testing"
@@ -10,3 +12,127 @@ func Test_parseVars(t *testing.T) {
 	t.Parallel()
 	parseVariables(logicalAndTest, httptest.NewRequest(http.MethodGet, "http://domain.com", nil))
 }
+
+func TestBucketVariable(t *testing.T) {
+	withConfig(t, Config{BucketCookie: "uid", BucketHeader: "X-User-Id", BucketCount: 4})
+
+	bucketFor := func(uid string) string {
+		rq := httptest.NewRequest(http.MethodGet, "http://domain.com", nil)
+		rq.AddCookie(&http.Cookie{Name: "uid", Value: uid})
+		return parseVariables([]byte("$(BUCKET{checkout-button})"), rq)
+	}
+
+	first := bucketFor("user-42")
+	for range 10 {
+		if again := bucketFor("user-42"); again != first {
+			t.Fatalf("Expected the same cookie to stay in bucket %s, got %s", first, again)
+		}
+	}
+
+	// The header identifies users without the cookie
+	rq := httptest.NewRequest(http.MethodGet, "http://domain.com", nil)
+	rq.Header.Set("X-User-Id", "user-42")
+	if fromHeader := parseVariables([]byte("$(BUCKET{checkout-button})"), rq); fromHeader != first {
+		t.Errorf("Expected header identity to land in bucket %s, got %s", first, fromHeader)
+	}
+
+	// Anonymous users fall back to the default value
+	rq = httptest.NewRequest(http.MethodGet, "http://domain.com", nil)
+	if anonymous := parseVariables([]byte("$(BUCKET{checkout-button}|'none')"), rq); anonymous != "none" {
+		t.Errorf("Expected anonymous user to get the default value, got %q", anonymous)
+	}
+
+	const users = 10000
+	counts := map[string]int{}
+	for i := range users {
+		counts[bucketFor(fmt.Sprintf("user-%d", i))]++
+	}
+
+	if len(counts) != 4 {
+		t.Fatalf("Expected 4 buckets, got %v", counts)
+	}
+	for bucket, count := range counts {
+		if count < users/4*9/10 || count > users/4*11/10 {
+			t.Errorf("Expected bucket %s to hold about %d users, got %d", bucket, users/4, count)
+		}
+	}
+}
+
+func TestBucketVariableInChoose(t *testing.T) {
+	withConfig(t, Config{BucketCookie: "uid", BucketCount: 2})
+
+	html := `<esi:choose><esi:when test="$(BUCKET{banner}) == 0">A</esi:when><esi:otherwise>B</esi:otherwise></esi:choose>`
+
+	seen := map[string]bool{}
+	for i := range 20 {
+		rq := httptest.NewRequest(http.MethodGet, "http://domain.com", nil)
+		rq.AddCookie(&http.Cookie{Name: "uid", Value: fmt.Sprintf("user-%d", i)})
+		seen[string(Parse([]byte(html), rq))] = true
+	}
+
+	if !seen["A"] || !seen["B"] {
+		t.Errorf("Expected both variants to be served across users, got %v", seen)
+	}
+}
+
+func TestVarsSubstitution(t *testing.T) {
+	rq := httptest.NewRequest(http.MethodPost, "http://domain.com/page?foo=bar&lang=fr", nil)
+	rq.Header.Set("User-Agent", "Mozilla/5.0")
+	rq.Header.Set("Accept-Language", "fr-FR,en")
+	rq.AddCookie(&http.Cookie{Name: "group", Value: "beta"})
+
+	tests := []struct {
+		vars     string
+		expected string
+	}{
+		{"$(HTTP_HOST)", "domain.com"},
+		{"$(HTTP_USER_AGENT)", "Mozilla/5.0"},
+		{"$(HTTP_COOKIE{group})", "beta"},
+		{"$(HTTP_COOKIE{missing}|anonymous)", "anonymous"},
+		{"$(HTTP_COOKIE{missing}|'quoted default')", "quoted default"},
+		{"$(HTTP_COOKIE{missing})", ""},
+		{"$(HTTP_COOKIE)", "group=beta"},
+		{"$(QUERY_STRING{foo})", "bar"},
+		{"$(QUERY_STRING{missing}|default)", "default"},
+		{"$(QUERY_STRING)", "foo=bar&lang=fr"},
+		{"$(REQUEST_METHOD)", "POST"},
+		{"$(HTTP_ACCEPT_LANGUAGE)", "fr-FR,en"},
+		{"$(HTTP_ACCEPT_LANGUAGE{en})", "true"},
+		{"$(HTTP_ACCEPT_LANGUAGE{de})", "false"},
+		{"Hello $(HTTP_COOKIE{group}) on $(HTTP_HOST)!", "Hello beta on domain.com!"},
+	}
+
+	for _, tt := range tests {
+		if result := string(Parse([]byte("<esi:vars>"+tt.vars+"</esi:vars>"), rq)); result != tt.expected {
+			t.Errorf("%s: expected %q, got %q", tt.vars, tt.expected, result)
+		}
+	}
+}
+
+func TestRequestScopedVars(t *testing.T) {
+	ctx := WithVars(context.Background(), map[string]string{"tier": "gold", "region": "eu"})
+	ctx = WithVars(ctx, map[string]string{"region": "us"})
+	rq := httptest.NewRequest(http.MethodGet, "http://domain.com", nil).WithContext(ctx)
+
+	tests := []struct {
+		html     string
+		expected string
+	}{
+		{"<esi:vars>$(VAR{tier})</esi:vars>", "gold"},
+		{"<esi:vars>$(VAR{region})</esi:vars>", "us"},
+		{"<esi:vars>$(VAR{missing}|none)</esi:vars>", "none"},
+		{`<esi:choose><esi:when test="$(VAR{tier}) == 'gold'">premium</esi:when><esi:otherwise>basic</esi:otherwise></esi:choose>`, "premium"},
+		{`<esi:choose><esi:when test="$(VAR{region}) == 'eu'">eu</esi:when><esi:otherwise>elsewhere</esi:otherwise></esi:choose>`, "elsewhere"},
+	}
+
+	for _, tt := range tests {
+		if result := string(Parse([]byte(tt.html), rq)); result != tt.expected {
+			t.Errorf("%s: expected %q, got %q", tt.html, tt.expected, result)
+		}
+	}
+
+	// Without values attached the default applies
+	if result := string(Parse([]byte("<esi:vars>$(VAR{tier}|basic)</esi:vars>"), httptest.NewRequest(http.MethodGet, "http://domain.com", nil))); result != "basic" {
+		t.Errorf("Expected the default without vars, got %q", result)
+	}
+}
@@ -0,0 +1,113 @@
+package esi
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+const defaultWarmUpConcurrency = 16
+
+var (
+	// now is the clock used for throttling and cache expiry, replaced in tests
+	now = time.Now
+
+	warmUp = &warmUpLimiter{}
+)
+
+// warmUpLimiter caps concurrent fragment fetches right after Configure and raises the cap
+// linearly over Config.WarmUpPeriod, so a cold cache doesn't hit backends with a fetch spike
+// of distinct URLs right after a deploy.
+type warmUpLimiter struct {
+	mu        sync.Mutex
+	startedAt time.Time
+	active    int
+	// changed is closed, and replaced, when a fetch releases its slot or the window is reset
+	changed chan struct{}
+}
+
+// reset starts a new warm-up window
+func (w *warmUpLimiter) reset() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.startedAt = now()
+	w.notifyLocked()
+}
+
+// limit returns the number of concurrent fetches currently allowed, or 0 when unlimited, and how long
+// until it is raised
+func (w *warmUpLimiter) limit() (int, time.Duration) {
+	cfg := config()
+	period := cfg.WarmUpPeriod
+	if period <= 0 || w.startedAt.IsZero() {
+		return 0, 0
+	}
+
+	elapsed := now().Sub(w.startedAt)
+	if elapsed >= period {
+		return 0, 0
+	}
+
+	target := cfg.WarmUpConcurrency
+	if target <= 0 {
+		target = defaultWarmUpConcurrency
+	}
+
+	steps := int64(target - 1)
+	if steps <= 0 {
+		return 1, period - elapsed
+	}
+
+	limit := 1 + int(steps*int64(elapsed)/int64(period))
+
+	// The limit goes up by one every period/steps
+	next := time.Duration((int64(limit)*int64(period) + steps - 1) / steps)
+
+	return limit, min(next, period) - elapsed
+}
+
+// acquire blocks until the warm-up limit allows one more fetch, or returns the error of ctx once it is done
+func (w *warmUpLimiter) acquire(ctx context.Context) error {
+	for {
+		w.mu.Lock()
+		limit, raised := w.limit()
+		if limit == 0 || w.active < limit {
+			w.active++
+			w.mu.Unlock()
+
+			return nil
+		}
+		if w.changed == nil {
+			w.changed = make(chan struct{})
+		}
+		changed := w.changed
+		w.mu.Unlock()
+
+		timer := time.NewTimer(raised)
+		select {
+		case <-changed:
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+		timer.Stop()
+	}
+}
+
+func (w *warmUpLimiter) release() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.active--
+	w.notifyLocked()
+}
+
+// notifyLocked wakes the fetches waiting for a slot. The caller must hold the lock.
+func (w *warmUpLimiter) notifyLocked() {
+	if w.changed != nil {
+		close(w.changed)
+		w.changed = nil
+	}
+}
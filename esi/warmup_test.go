@@ -0,0 +1,122 @@
+package esi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// withClock replaces the throttling clock with a fake one for the duration of a test
+func withClock(t *testing.T, current *time.Time) {
+	t.Helper()
+
+	old := now
+	now = func() time.Time { return *current }
+	t.Cleanup(func() { now = old })
+}
+
+func TestWarmUpLimitRamp(t *testing.T) {
+	clock := time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC)
+	withClock(t, &clock)
+	withConfig(t, Config{WarmUpPeriod: 10 * time.Second, WarmUpConcurrency: 11})
+
+	w := &warmUpLimiter{}
+	w.reset()
+
+	if limit, raised := w.limit(); limit != 1 || raised != time.Second {
+		t.Errorf("Expected concurrency 1 right after Configure, raised in 1s, got %d in %s", limit, raised)
+	}
+
+	clock = clock.Add(5500 * time.Millisecond)
+	if limit, raised := w.limit(); limit != 6 || raised != 500*time.Millisecond {
+		t.Errorf("Expected concurrency 6 halfway through warm-up, raised in 500ms, got %d in %s", limit, raised)
+	}
+
+	clock = clock.Add(4500 * time.Millisecond)
+	if limit, _ := w.limit(); limit != 0 {
+		t.Errorf("Expected no limit after warm-up, got %d", limit)
+	}
+}
+
+func TestWarmUpAcquireWaits(t *testing.T) {
+	withConfig(t, Config{WarmUpPeriod: time.Hour, WarmUpConcurrency: 2})
+
+	w := &warmUpLimiter{}
+	w.reset()
+	if err := w.acquire(context.Background()); err != nil {
+		t.Fatalf("Expected the first fetch let through, got %v", err)
+	}
+
+	// A waiter gives up with its context
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := w.acquire(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected the context error while waiting, got %v", err)
+	}
+
+	// and is woken up by a release, long before the limit is raised
+	acquired := make(chan error, 1)
+	go func() { acquired <- w.acquire(context.Background()) }()
+
+	time.Sleep(10 * time.Millisecond)
+	w.release()
+
+	select {
+	case err := <-acquired:
+		if err != nil {
+			t.Errorf("Expected the waiter let through, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected the release to wake the waiting fetch")
+	}
+}
+
+func TestWarmUpThrottlesFetches(t *testing.T) {
+	cache.Reset()
+
+	clock := time.Now()
+	withClock(t, &clock)
+	withConfig(t, Config{WarmUpPeriod: time.Minute, WarmUpConcurrency: 8})
+
+	var mu sync.Mutex
+	active, peak := 0, 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		active++
+		if active > peak {
+			peak = active
+		}
+		mu.Unlock()
+
+		time.Sleep(20 * time.Millisecond)
+
+		mu.Lock()
+		active--
+		mu.Unlock()
+
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+
+	html := []byte(fmt.Sprintf(`<esi:include src="%[1]s/1"/><esi:include src="%[1]s/2"/><esi:include src="%[1]s/3"/><esi:include src="%[1]s/4"/>`, ts.URL))
+	req := httptest.NewRequest("GET", "http://example.com", nil)
+
+	warmUp.reset()
+	Parse(html, req)
+	if peak != 1 {
+		t.Errorf("Expected fetches to be serialized right after Configure, peak concurrency was %d", peak)
+	}
+
+	clock = clock.Add(time.Minute)
+	peak = 0
+	Parse(html, req)
+	if peak < 2 {
+		t.Errorf("Expected concurrent fetches after warm-up, peak concurrency was %d", peak)
+	}
+}
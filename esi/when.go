@@ -1,13 +1,18 @@
 package esi
 
 import (
+	"bytes"
 	"net/http"
 	"regexp"
+	"strconv"
 	"strings"
+
+	"go.uber.org/zap"
 )
 
 var (
 	unaryNegation = regexp.MustCompile(`!\((\$\((.+)\)|(.+))\)`)
+	regexMatch    = regexp.MustCompile(`(.+?)=~(.+)`)
 	comparison    = regexp.MustCompile(`(.+)(==|!=|<=|>=|<|>)(.+)`)
 	logicalAnd    = regexp.MustCompile(`\((.+?)\)&\((.+?)\)`)
 	logicalOr     = regexp.MustCompile(`\((.+?)\)\|\((.+?)\)`)
@@ -20,22 +25,33 @@ func validateTest(b []byte, req *http.Request) bool {
 		return validateTest(r[1], req) && validateTest(r[2], req)
 	} else if r := logicalOr.FindSubmatch(b); r != nil {
 		return validateTest(r[1], req) || validateTest(r[2], req)
+	} else if r := regexMatch.FindSubmatch(b); r != nil {
+		return matchesPattern(strings.TrimSpace(parseVariables(r[1], req)), strings.TrimSpace(parseVariables(r[2], req)))
 	} else if r := comparison.FindSubmatch(b); r != nil {
 		r1 := strings.TrimSpace(parseVariables(r[1], req))
 		r2 := strings.TrimSpace(parseVariables(r[3], req))
+
+		// Operands are compared as numbers when both are numeric, otherwise as strings
+		cmp := strings.Compare(r1, r2)
+		if n1, ok := numericOperand(r[1], r1); ok {
+			if n2, ok := numericOperand(r[3], r2); ok {
+				cmp = compareNumbers(n1, n2)
+			}
+		}
+
 		switch string(r[2]) {
 		case "==":
-			return r1 == r2
+			return cmp == 0
 		case "!=":
-			return r1 != r2
+			return cmp != 0
 		case "<":
-			return r1 < r2
+			return cmp < 0
 		case ">":
-			return r1 > r2
+			return cmp > 0
 		case "<=":
-			return r1 <= r2
+			return cmp <= 0
 		case ">=":
-			return r1 >= r2
+			return cmp >= 0
 		}
 	} else {
 		vars := interpretedVar.FindSubmatch(b)
@@ -48,3 +64,45 @@ func validateTest(b []byte, req *http.Request) bool {
 
 	return false
 }
+
+// matchesPattern reports whether value matches the regular expression pattern, which may be
+// delimited by slashes like '/^Mozilla/'. An invalid pattern matches nothing.
+func matchesPattern(value, pattern string) bool {
+	if len(pattern) >= 2 && pattern[0] == '/' && pattern[len(pattern)-1] == '/' {
+		pattern = pattern[1 : len(pattern)-1]
+	}
+
+	rg, err := regexp.Compile(pattern)
+	if err != nil {
+		if logger != nil {
+			logger.Warn("Invalid regular expression in esi:when test", zap.String("pattern", pattern), zap.Error(err))
+		}
+		return false
+	}
+
+	return rg.MatchString(value)
+}
+
+// numericOperand returns the numeric value of an evaluated operand. Quoted literals
+// such as '18' are strings by definition and never treated as numbers.
+func numericOperand(raw []byte, value string) (float64, bool) {
+	raw = bytes.TrimSpace(raw)
+	if len(raw) > 0 && (raw[0] == '\'' || raw[0] == '"') {
+		return 0, false
+	}
+
+	n, err := strconv.ParseFloat(value, 64)
+
+	return n, err == nil
+}
+
+func compareNumbers(a, b float64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	default:
+		return 0
+	}
+}
@@ -41,3 +41,56 @@ func Test_validateTest(t *testing.T) {
 		t.Error("The complexTest must return true")
 	}
 }
+
+func Test_validateTestNumeric(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name     string
+		query    string
+		test     string
+		expected bool
+	}{
+		{"numeric >= true", "age=21", "$(QUERY_STRING{age}) >= 18", true},
+		{"numeric >= false where strings would say true", "age=9", "$(QUERY_STRING{age}) >= 18", false},
+		{"numeric < true where strings would say false", "age=9", "$(QUERY_STRING{age}) < 18", true},
+		{"numeric == across notations", "price=18.0", "$(QUERY_STRING{price}) == 18", true},
+		{"non-numeric operand falls back to strings", "age=abc", "$(QUERY_STRING{age}) >= 18", true},
+		{"quoted literals compare as strings", "", "'10' < '9'", true},
+		{"string variables compare as strings", "name=alice", "$(QUERY_STRING{name}) < 'bob'", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rq := httptest.NewRequest(http.MethodGet, "http://domain.com/?"+tt.query, nil)
+			if got := validateTest([]byte(tt.test), rq); got != tt.expected {
+				t.Errorf("validateTest(%q) with %q = %v, expected %v", tt.test, tt.query, got, tt.expected)
+			}
+		})
+	}
+}
+
+func Test_validateTestRegexMatch(t *testing.T) {
+	t.Parallel()
+
+	rq := httptest.NewRequest(http.MethodGet, "http://domain.com/?path=/products/42", nil)
+	rq.Header.Set("User-Agent", "Mozilla/5.0 (iPhone)")
+
+	tests := []struct {
+		test     string
+		expected bool
+	}{
+		{"$(HTTP_USER_AGENT) =~ '/iPhone|Android/'", true},
+		{"$(HTTP_USER_AGENT) =~ 'iPhone'", true},
+		{"$(HTTP_USER_AGENT) =~ '/^iPhone/'", false},
+		{"$(QUERY_STRING{path}) =~ '^/products/[0-9]+$'", true},
+		{"!($(HTTP_USER_AGENT) =~ 'Android')", true},
+		{"$(HTTP_USER_AGENT) =~ '/(unclosed/'", false},
+	}
+
+	for _, tt := range tests {
+		if got := validateTest([]byte(tt.test), rq); got != tt.expected {
+			t.Errorf("validateTest(%q) = %v, expected %v", tt.test, got, tt.expected)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package caddy_esi
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/sc0rp10/go-esi/esi"
+)
+
+func init() {
+	caddy.RegisterModule(adminAPI{})
+}
+
+// adminAPI exposes fragment cache maintenance on Caddy's admin endpoint:
+//
+//	POST /esi/purge?url=<fragment URL>     removes one cached fragment
+//	POST /esi/purge?prefix=<URL prefix>    removes every cached fragment under the prefix, answering 501
+//	                                       if the configured CacheStore cannot list its keys
+type adminAPI struct{}
+
+// CaddyModule returns the Caddy module information.
+func (adminAPI) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "admin.api.esi",
+		New: func() caddy.Module { return new(adminAPI) },
+	}
+}
+
+// Routes returns the admin routes served by the module.
+func (a adminAPI) Routes() []caddy.AdminRoute {
+	return []caddy.AdminRoute{
+		{
+			Pattern: "/esi/purge",
+			Handler: caddy.AdminHandlerFunc(a.handlePurge),
+		},
+	}
+}
+
+func (adminAPI) handlePurge(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodPost {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+
+	query := r.URL.Query()
+	switch {
+	case query.Get("url") != "":
+		esi.PurgeURL(query.Get("url"))
+	case query.Get("prefix") != "":
+		if _, err := esi.PurgePrefix(query.Get("prefix")); err != nil {
+			return caddy.APIError{
+				HTTPStatus: http.StatusNotImplemented,
+				Err:        err,
+			}
+		}
+	default:
+		return caddy.APIError{
+			HTTPStatus: http.StatusBadRequest,
+			Err:        fmt.Errorf("url or prefix query parameter required"),
+		}
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+
+	return nil
+}
+
+// Interface guards
+var (
+	_ caddy.Module      = (*adminAPI)(nil)
+	_ caddy.AdminRouter = (*adminAPI)(nil)
+)
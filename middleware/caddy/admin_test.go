@@ -0,0 +1,69 @@
+package caddy_esi
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func TestAdminAPI_Purge(t *testing.T) {
+	var fetches atomic.Int32
+	fragments := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		w.Header().Set("Cache-Control", "max-age=300")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("<p>Fragment</p>"))
+	}))
+	defer fragments.Close()
+
+	e := &ESI{}
+	upstream := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		w.Header().Set("Content-Type", "text/html")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(`<html><esi:include src="` + fragments.URL + `/purge-me"/></html>`))
+		return nil
+	})
+	serve := func() {
+		req := httptest.NewRequest("GET", "http://example.com/page", nil)
+		if err := e.ServeHTTP(httptest.NewRecorder(), req, upstream); err != nil {
+			t.Fatalf("ServeHTTP failed: %v", err)
+		}
+	}
+
+	serve()
+	serve()
+	if got := fetches.Load(); got != 1 {
+		t.Fatalf("Expected the fragment to be cached after 1 fetch, got %d", got)
+	}
+
+	handler := adminAPI{}.Routes()[0].Handler
+	rec := httptest.NewRecorder()
+	purge := httptest.NewRequest(http.MethodPost, "/esi/purge?prefix="+fragments.URL+"/purge", nil)
+	if err := handler.ServeHTTP(rec, purge); err != nil {
+		t.Fatalf("Purge failed: %v", err)
+	}
+	if rec.Code != http.StatusNoContent {
+		t.Errorf("Expected status 204, got %d", rec.Code)
+	}
+
+	serve()
+	if got := fetches.Load(); got != 2 {
+		t.Errorf("Expected the purged fragment to be fetched again, got %d fetches", got)
+	}
+
+	var apiErr caddy.APIError
+	err := handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/esi/purge", nil))
+	if !errors.As(err, &apiErr) || apiErr.HTTPStatus != http.StatusBadRequest {
+		t.Errorf("Expected 400 without url or prefix, got %v", err)
+	}
+
+	err = handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/esi/purge?url=x", nil))
+	if !errors.As(err, &apiErr) || apiErr.HTTPStatus != http.StatusMethodNotAllowed {
+		t.Errorf("Expected 405 for GET, got %v", err)
+	}
+}
@@ -2,11 +2,24 @@ package caddy_esi
 
 import (
 	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/sc0rp10/go-esi/esi"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
 )
 
 // Test the new buffered approach with a simple HTML response
@@ -167,3 +180,891 @@ func TestBufferedESI_LargeResponse(t *testing.T) {
 
 	t.Logf("Large response handled successfully: %d bytes in, %d bytes out", len(largeHTML), rec.Body.Len())
 }
+
+// Test the assembled page carries the newest fragment Last-Modified and honors If-Modified-Since
+func TestBufferedESI_LastModifiedFromFragments(t *testing.T) {
+	older := time.Date(2024, time.January, 1, 10, 0, 0, 0, time.UTC)
+	newer := time.Date(2024, time.March, 1, 10, 0, 0, 0, time.UTC)
+
+	fragments := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lastModified := older
+		if r.URL.Path == "/newer" {
+			lastModified = newer
+		}
+		w.Header().Set("Last-Modified", lastModified.Format(http.TimeFormat))
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("<p>" + r.URL.Path + "</p>"))
+	}))
+	defer fragments.Close()
+
+	e := &ESI{}
+	upstream := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		w.Header().Set("Content-Type", "text/html")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(`<html><esi:include src="` + fragments.URL + `/older"/><esi:include src="` + fragments.URL + `/newer"/></html>`))
+		return nil
+	})
+
+	req := httptest.NewRequest("GET", "http://example.com/page", nil)
+	rec := httptest.NewRecorder()
+	if err := e.ServeHTTP(rec, req, upstream); err != nil {
+		t.Fatalf("ServeHTTP failed: %v", err)
+	}
+
+	if got := rec.Header().Get("Last-Modified"); got != newer.Format(http.TimeFormat) {
+		t.Errorf("Expected Last-Modified %q, got %q", newer.Format(http.TimeFormat), got)
+	}
+
+	req = httptest.NewRequest("GET", "http://example.com/page", nil)
+	req.Header.Set("If-Modified-Since", newer.Format(http.TimeFormat))
+	rec = httptest.NewRecorder()
+	if err := e.ServeHTTP(rec, req, upstream); err != nil {
+		t.Fatalf("ServeHTTP failed: %v", err)
+	}
+
+	if rec.Code != http.StatusNotModified {
+		t.Errorf("Expected status 304, got %d", rec.Code)
+	}
+	if rec.Body.Len() != 0 {
+		t.Errorf("Expected empty body for 304, got %q", rec.Body.String())
+	}
+}
+
+// Test the "esi=process" Content-Type parameter opts a response into processing and is stripped
+func TestBufferedESI_ContentTypeHint(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		expectedCT  string
+	}{
+		{"non-HTML opted in", "text/plain; esi=process", "text/plain"},
+		{"HTML keeps other parameters", "text/html; esi=process; charset=utf-8", "text/html; charset=utf-8"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := &ESI{}
+
+			upstream := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+				w.Header().Set("Content-Type", tt.contentType)
+				w.Header().Set("Content-Length", "30")
+				w.WriteHeader(http.StatusOK)
+				w.Write([]byte(`a<esi:comment text="hidden"/>b`))
+				return nil
+			})
+
+			req := httptest.NewRequest("GET", "http://example.com/hint", nil)
+			rec := httptest.NewRecorder()
+
+			if err := e.ServeHTTP(rec, req, upstream); err != nil {
+				t.Fatalf("ServeHTTP failed: %v", err)
+			}
+
+			if body := rec.Body.String(); body != "ab" {
+				t.Errorf("Expected ESI to be processed, got %q", body)
+			}
+			if ct := rec.Header().Get("Content-Type"); ct != tt.expectedCT {
+				t.Errorf("Expected Content-Type %q, got %q", tt.expectedCT, ct)
+			}
+		})
+	}
+}
+
+// Test the "esi=process" Content-Type parameter is stripped from responses that pass through unprocessed
+func TestBufferedESI_ContentTypeHintStrippedOnPassThrough(t *testing.T) {
+	tests := []struct {
+		name     string
+		status   int
+		header   string
+		encoding string
+		chunked  bool
+	}{
+		{"not found", http.StatusNotFound, "", "", false},
+		{"decided by X-ESI", http.StatusOK, "0", "", false},
+		{"chunked", http.StatusOK, "", "", true},
+		{"compressed", http.StatusOK, "", "gzip", false},
+	}
+
+	for _, tt := range tests {
+		for _, streaming := range []bool{false, true} {
+			t.Run(fmt.Sprintf("%s/streaming=%v", tt.name, streaming), func(t *testing.T) {
+				if tt.chunked && streaming {
+					t.Skip("streaming mode processes chunked responses")
+				}
+
+				e := &ESI{Streaming: streaming}
+
+				upstream := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+					w.Header().Set("Content-Type", "text/html; esi=process")
+					if tt.header != "" {
+						w.Header().Set("X-ESI", tt.header)
+					}
+					if tt.encoding != "" {
+						w.Header().Set("Content-Encoding", tt.encoding)
+					}
+					if tt.chunked {
+						w.Header().Set("Transfer-Encoding", "chunked")
+					}
+					w.WriteHeader(tt.status)
+					w.Write([]byte(`a<esi:comment text="kept"/>b`))
+					return nil
+				})
+
+				req := httptest.NewRequest("GET", "http://example.com/hint", nil)
+				rec := httptest.NewRecorder()
+
+				if err := e.ServeHTTP(rec, req, upstream); err != nil {
+					t.Fatalf("ServeHTTP failed: %v", err)
+				}
+
+				if rec.Code != tt.status {
+					t.Errorf("Expected status %d, got %d", tt.status, rec.Code)
+				}
+				if ct := rec.Header().Get("Content-Type"); ct != "text/html" {
+					t.Errorf("Expected Content-Type %q, got %q", "text/html", ct)
+				}
+			})
+		}
+	}
+}
+
+// Test the upstream Content-Length is replaced by the length of the assembled page
+func TestBufferedESI_ContentLengthOfProcessedPage(t *testing.T) {
+	fragments := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(strings.Repeat("<p>expanded</p>", 100)))
+	}))
+	defer fragments.Close()
+
+	page := `<html><esi:include src="` + fragments.URL + `/long"/>` + strings.Repeat(" ", 600) + `</html>`
+
+	e := &ESI{}
+	upstream := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		w.Header().Set("Content-Type", "text/html")
+		w.Header().Set("Content-Length", strconv.Itoa(len(page)))
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(page))
+		return nil
+	})
+
+	req := httptest.NewRequest("GET", "http://example.com/page", nil)
+	rec := httptest.NewRecorder()
+	if err := e.ServeHTTP(rec, req, upstream); err != nil {
+		t.Fatalf("ServeHTTP failed: %v", err)
+	}
+
+	if !strings.Contains(rec.Body.String(), "<p>expanded</p>") {
+		t.Fatalf("Expected the include to be expanded, got %q", rec.Body.String())
+	}
+	if cl := rec.Header().Get("Content-Length"); cl != strconv.Itoa(rec.Body.Len()) {
+		t.Errorf("Expected Content-Length %d, got %s", rec.Body.Len(), cl)
+	}
+}
+
+// Test a request with the configured passthrough header gets the page with its ESI tags intact
+func TestBufferedESI_PassthroughHeader(t *testing.T) {
+	const page = `<html><esi:comment text="kept"/></html>`
+
+	tests := []struct {
+		name     string
+		header   string
+		value    string
+		expected string
+	}{
+		{"header set", "X-ESI-Passthrough", "1", page},
+		{"header false", "X-ESI-Passthrough", "0", "<html></html>"},
+		{"header not configured", "", "1", "<html></html>"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := &ESI{PassthroughHeader: tt.header}
+			upstream := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+				w.Header().Set("Content-Type", "text/html")
+				w.WriteHeader(http.StatusOK)
+				w.Write([]byte(page))
+				return nil
+			})
+
+			req := httptest.NewRequest("GET", "http://example.com/page", nil)
+			req.Header.Set("X-ESI-Passthrough", tt.value)
+			rec := httptest.NewRecorder()
+			if err := e.ServeHTTP(rec, req, upstream); err != nil {
+				t.Fatalf("ServeHTTP failed: %v", err)
+			}
+
+			if body := rec.Body.String(); body != tt.expected {
+				t.Errorf("Expected body %q, got %q", tt.expected, body)
+			}
+		})
+	}
+}
+
+// Test debug mode logs one summary of the page's fragments with their cache status
+func TestBufferedESI_StrictTagDetection(t *testing.T) {
+	const page = `<pre>Includes start with "<esi:include", see &lt;esi:include src="..."/&gt;</pre>`
+
+	tests := []struct {
+		name      string
+		strict    bool
+		processed bool
+	}{
+		{"any opener processes the page", false, true},
+		{"strict detection passes a mere mention through", true, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := &ESI{StrictTagDetection: tt.strict}
+			upstream := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+				w.Header().Set("Content-Type", "text/html")
+				w.WriteHeader(http.StatusOK)
+				w.Write([]byte(page))
+				return nil
+			})
+
+			rec := httptest.NewRecorder()
+			if err := e.ServeHTTP(rec, httptest.NewRequest("GET", "http://example.com/page", nil), upstream); err != nil {
+				t.Fatalf("ServeHTTP failed: %v", err)
+			}
+
+			if body := rec.Body.String(); body != page {
+				t.Errorf("Expected the page unchanged, got %q", body)
+			}
+
+			// Only processed pages get the Content-Length of the assembled page
+			if processed := rec.Header().Get("Content-Length") != ""; processed != tt.processed {
+				t.Errorf("Expected processed to be %v, got %v", tt.processed, processed)
+			}
+		})
+	}
+}
+
+func TestBufferedESI_VarHeaders(t *testing.T) {
+	e := &ESI{VarHeaders: map[string]string{"tier": "X-Customer-Tier"}}
+	upstream := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		w.Header().Set("Content-Type", "text/html")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(`<esi:choose><esi:when test="$(VAR{tier}) == 'gold'">premium</esi:when>` +
+			`<esi:otherwise>basic</esi:otherwise></esi:choose> <esi:vars>$(VAR{tier}|none)</esi:vars>`))
+		return nil
+	})
+
+	for header, expected := range map[string]string{"gold": "premium gold", "": "basic none"} {
+		req := httptest.NewRequest("GET", "http://example.com/page", nil)
+		req.Header.Set("X-Customer-Tier", header)
+		rec := httptest.NewRecorder()
+		if err := e.ServeHTTP(rec, req, upstream); err != nil {
+			t.Fatalf("ServeHTTP failed: %v", err)
+		}
+
+		if body := rec.Body.String(); body != expected {
+			t.Errorf("Expected body %q for tier %q, got %q", expected, header, body)
+		}
+	}
+}
+
+func TestBufferedESI_DebugFragmentSummary(t *testing.T) {
+	fragments := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=300")
+		w.Write([]byte("<p>" + r.URL.Path + "</p>"))
+	}))
+	defer fragments.Close()
+
+	core, logs := observer.New(zapcore.InfoLevel)
+	e := &ESI{Debug: true, logger: zap.New(core)}
+
+	upstream := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		w.Header().Set("Content-Type", "text/html")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(`<html><esi:include src="` + fragments.URL + `/summary-a"/><esi:include src="` + fragments.URL + `/summary-b"/></html>`))
+		return nil
+	})
+
+	for range 2 {
+		req := httptest.NewRequest("GET", "http://example.com/page", nil)
+		if err := e.ServeHTTP(httptest.NewRecorder(), req, upstream); err != nil {
+			t.Fatalf("ServeHTTP failed: %v", err)
+		}
+	}
+
+	summaries := logs.FilterMessage("ESI fragments resolved").All()
+	if len(summaries) != 2 {
+		t.Fatalf("Expected one summary per request, got %d", len(summaries))
+	}
+
+	for i, expectedHit := range []bool{false, true} {
+		fragments, _ := summaries[i].ContextMap()["fragments"].([]any)
+		if len(fragments) != 2 {
+			t.Fatalf("Expected 2 fragments in summary %d, got %v", i, summaries[i].ContextMap()["fragments"])
+		}
+		for _, f := range fragments {
+			fragment := f.(map[string]any)
+			if !strings.Contains(fragment["url"].(string), "/summary-") || fragment["cache_hit"] != expectedHit {
+				t.Errorf("Expected fragment with cache_hit %v in summary %d, got %v", expectedHit, i, fragment)
+			}
+		}
+	}
+}
+
+// Test configured content types replace the HTML defaults
+func TestBufferedESI_ConfiguredContentTypes(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		processed   bool
+	}{
+		{"configured type", "application/rss+xml; charset=utf-8", true},
+		{"configured type in another case", "Image/SVG+XML", true},
+		{"default type no longer configured", "text/html", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := &ESI{ContentTypes: []string{"application/rss+xml", "image/svg+xml"}}
+
+			upstream := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+				w.Header().Set("Content-Type", tt.contentType)
+				w.WriteHeader(http.StatusOK)
+				w.Write([]byte(`a<esi:comment text="hidden"/>b`))
+				return nil
+			})
+
+			req := httptest.NewRequest("GET", "http://example.com/feed", nil)
+			rec := httptest.NewRecorder()
+
+			if err := e.ServeHTTP(rec, req, upstream); err != nil {
+				t.Fatalf("ServeHTTP failed: %v", err)
+			}
+
+			expected := `a<esi:comment text="hidden"/>b`
+			if tt.processed {
+				expected = "ab"
+			}
+			if body := rec.Body.String(); body != expected {
+				t.Errorf("Expected body %q, got %q", expected, body)
+			}
+		})
+	}
+}
+
+// Test that an X-ESI header from the upstream overrides the buffering heuristics both ways
+func TestBufferedESI_ESIHeaderOverride(t *testing.T) {
+	tests := []struct {
+		name          string
+		contentType   string
+		contentLength string
+		header        string
+		processed     bool
+	}{
+		{"X-ESI: 1 forces processing of non-HTML", "application/json", "", "1", true},
+		{"X-ESI: 1 forces processing of small responses", "text/html", "30", "1", true},
+		{"X-ESI: 0 skips processing of HTML", "text/html", "", "0", false},
+		{"X-ESI: 0 wins over the Content-Type hint", "text/html; esi=process", "", "0", false},
+		{"invalid X-ESI falls back to the heuristics", "text/html", "", "maybe", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := &ESI{}
+
+			upstream := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+				w.Header().Set("Content-Type", tt.contentType)
+				if tt.contentLength != "" {
+					w.Header().Set("Content-Length", tt.contentLength)
+				}
+				w.Header().Set("X-ESI", tt.header)
+				w.WriteHeader(http.StatusOK)
+				w.Write([]byte(`a<esi:comment text="hidden"/>b`))
+				return nil
+			})
+
+			req := httptest.NewRequest("GET", "http://example.com/hint", nil)
+			rec := httptest.NewRecorder()
+
+			if err := e.ServeHTTP(rec, req, upstream); err != nil {
+				t.Fatalf("ServeHTTP failed: %v", err)
+			}
+
+			if processed := rec.Body.String() == "ab"; processed != tt.processed {
+				t.Errorf("Expected processed %v, got body %q", tt.processed, rec.Body.String())
+			}
+			if value := rec.Header().Get("X-ESI"); value != "" {
+				t.Errorf("Expected X-ESI to be stripped from the response, got %q", value)
+			}
+		})
+	}
+}
+
+// Test that the X-ESI header is stripped from error responses, which are never processed
+func TestBufferedESI_ESIHeaderStrippedOnErrorStatus(t *testing.T) {
+	for _, streaming := range []bool{false, true} {
+		t.Run(fmt.Sprintf("streaming=%v", streaming), func(t *testing.T) {
+			e := &ESI{Streaming: streaming}
+
+			upstream := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+				w.Header().Set("Content-Type", "text/html")
+				w.Header().Set("X-ESI", "1")
+				w.WriteHeader(http.StatusNotFound)
+				w.Write([]byte(`a<esi:comment text="kept"/>b`))
+				return nil
+			})
+
+			req := httptest.NewRequest("GET", "http://example.com/missing", nil)
+			rec := httptest.NewRecorder()
+
+			if err := e.ServeHTTP(rec, req, upstream); err != nil {
+				t.Fatalf("ServeHTTP failed: %v", err)
+			}
+
+			if rec.Code != http.StatusNotFound {
+				t.Errorf("Expected status 404, got %d", rec.Code)
+			}
+			if value := rec.Header().Get("X-ESI"); value != "" {
+				t.Errorf("Expected X-ESI to be stripped from the response, got %q", value)
+			}
+		})
+	}
+}
+
+// Test that event streams and multipart streams pass through even when processing is requested
+func TestBufferedESI_StreamingContentTypesPassThrough(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		header      string
+	}{
+		{"event stream", "text/event-stream", ""},
+		{"event stream forced with X-ESI", "text/event-stream", "1"},
+		{"event stream with the Content-Type hint", "text/event-stream; esi=process", ""},
+		{"multipart stream", "multipart/x-mixed-replace; boundary=frame", ""},
+		{"multipart stream forced with X-ESI", "multipart/x-mixed-replace; boundary=frame", "1"},
+	}
+
+	for _, tt := range tests {
+		for _, streaming := range []bool{false, true} {
+			t.Run(fmt.Sprintf("%s/streaming=%v", tt.name, streaming), func(t *testing.T) {
+				e := &ESI{Streaming: streaming}
+
+				const body = `data: <esi:comment text="kept"/>` + "\n\n"
+				upstream := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+					w.Header().Set("Content-Type", tt.contentType)
+					if tt.header != "" {
+						w.Header().Set("X-ESI", tt.header)
+					}
+					w.WriteHeader(http.StatusOK)
+					w.Write([]byte(body))
+					return nil
+				})
+
+				req := httptest.NewRequest("GET", "http://example.com/events", nil)
+				rec := httptest.NewRecorder()
+
+				if err := e.ServeHTTP(rec, req, upstream); err != nil {
+					t.Fatalf("ServeHTTP failed: %v", err)
+				}
+
+				if got := rec.Body.String(); got != body {
+					t.Errorf("Expected the stream to pass through untouched, got %q", got)
+				}
+			})
+		}
+	}
+}
+
+// Test that a huge response doesn't leave its buffer capacity pinned in the pool
+func TestBufferedESI_PoolDiscardsHugeBuffers(t *testing.T) {
+	const limit = 64 << 10
+
+	e := &ESI{MaxPooledBufferBytes: limit}
+
+	serve := func(body []byte) {
+		upstream := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+			w.Header().Set("Content-Type", "text/html")
+			w.WriteHeader(http.StatusOK)
+			w.Write(body)
+			return nil
+		})
+
+		req := httptest.NewRequest("GET", "http://example.com/test", nil)
+		rec := httptest.NewRecorder()
+		if err := e.ServeHTTP(rec, req, upstream); err != nil {
+			t.Fatalf("ServeHTTP failed: %v", err)
+		}
+		if rec.Body.Len() != len(body) {
+			t.Fatalf("Expected %d bytes, got %d", len(body), rec.Body.Len())
+		}
+	}
+
+	serve(bytes.Repeat([]byte("a"), 4*limit))
+	serve([]byte("<html><body>" + strings.Repeat("small ", 100) + "</body></html>"))
+
+	// Drain the pool until it hands out a fresh buffer
+	for range 100 {
+		buf := bufPool.Get().(*bytes.Buffer)
+		if buf.Cap() > limit {
+			t.Fatalf("Expected pooled buffers to stay within %d bytes, got capacity %d", limit, buf.Cap())
+		}
+		if buf.Cap() == 0 {
+			break
+		}
+	}
+}
+
+// Test the maintenance page replaces assemblies during a backend-wide outage and recovery afterwards
+func TestBufferedESI_MaintenancePageOnGlobalFailure(t *testing.T) {
+	esi.Configure(esi.Config{FailureRateThreshold: 0.5, FailureWindow: time.Second})
+	t.Cleanup(func() { esi.Configure(esi.Config{}) })
+
+	var failing atomic.Bool
+	failing.Store(true)
+	fragments := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failing.Load() {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("<p>Fragment</p>"))
+	}))
+	defer fragments.Close()
+
+	e := &ESI{maintenance: []byte("<html>Down for maintenance</html>")}
+	upstream := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		w.Header().Set("Content-Type", "text/html")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(`<html><esi:include src="` + fragments.URL + `/fragment"/></html>`))
+		return nil
+	})
+
+	serve := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "http://example.com/page", nil)
+		rec := httptest.NewRecorder()
+		if err := e.ServeHTTP(rec, req, upstream); err != nil {
+			t.Fatalf("ServeHTTP failed: %v", err)
+		}
+		return rec
+	}
+
+	// Sustained failures push the rate over the threshold
+	var rec *httptest.ResponseRecorder
+	for range 20 {
+		if rec = serve(); rec.Code == http.StatusServiceUnavailable {
+			break
+		}
+	}
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("Expected maintenance page with status 503, got %d", rec.Code)
+	}
+	if body := rec.Body.String(); body != "<html>Down for maintenance</html>" {
+		t.Errorf("Expected maintenance page body, got %q", body)
+	}
+
+	// Once the failures age out of the window, pages are assembled again
+	failing.Store(false)
+	time.Sleep(1100 * time.Millisecond)
+
+	rec = serve()
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected status 200 after recovery, got %d", rec.Code)
+	}
+	if body := rec.Body.String(); body != "<html><p>Fragment</p></html>" {
+		t.Errorf("Expected assembled page after recovery, got %q", body)
+	}
+}
+
+// Test that an include failing under onerror="error" turns the page into a 502
+func TestBufferedESI_FailedIncludeFailsPage(t *testing.T) {
+	fragments := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer fragments.Close()
+
+	e := &ESI{}
+	upstream := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		w.Header().Set("Content-Type", "text/html")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(`<html><esi:include src="` + fragments.URL + `/broken" onerror="error"/></html>`))
+		return nil
+	})
+
+	req := httptest.NewRequest("GET", "http://example.com/page", nil)
+	rec := httptest.NewRecorder()
+	err := e.ServeHTTP(rec, req, upstream)
+
+	var handlerErr caddyhttp.HandlerError
+	if !errors.As(err, &handlerErr) || handlerErr.StatusCode != http.StatusBadGateway {
+		t.Fatalf("Expected a 502 handler error, got %v", err)
+	}
+	if rec.Body.Len() != 0 {
+		t.Errorf("Expected nothing to be written for a failed page, got %q", rec.Body.String())
+	}
+}
+
+// Test the hit ratio gauge follows the cache's hits and misses
+func TestMetrics_CacheHitRatio(t *testing.T) {
+	fragments := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=300")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("<p>Fragment</p>"))
+	}))
+	defer fragments.Close()
+
+	e := &ESI{}
+	e.initMetrics(prometheus.NewRegistry())
+
+	upstream := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		w.Header().Set("Content-Type", "text/html")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(`<html><esi:include src="` + fragments.URL + `/ratio"/></html>`))
+		return nil
+	})
+
+	ratio := func() float64 {
+		for range 4 {
+			req := httptest.NewRequest("GET", "http://example.com/page", nil)
+			if err := e.ServeHTTP(httptest.NewRecorder(), req, upstream); err != nil {
+				t.Fatalf("ServeHTTP failed: %v", err)
+			}
+		}
+		var m dto.Metric
+		if err := e.cacheHitRatio.Write(&m); err != nil {
+			t.Fatalf("Reading gauge failed: %v", err)
+		}
+		return m.GetGauge().GetValue()
+	}
+
+	// The first request misses and the following ones hit, so the ratio rises
+	first := ratio()
+	if expected := esi.CacheHitRatio(); first != expected || first <= 0 {
+		t.Errorf("Expected gauge %v to match a positive cache hit ratio %v", first, expected)
+	}
+	if second := ratio(); second <= first || second != esi.CacheHitRatio() {
+		t.Errorf("Expected gauge to rise with further hits, got %v after %v", second, first)
+	}
+}
+
+// Test the client receives the redirect of an include with propagate-redirect="true"
+func TestBufferedESI_PropagatesFragmentRedirect(t *testing.T) {
+	fragments := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "https://example.com/login", http.StatusSeeOther)
+	}))
+	defer fragments.Close()
+
+	e := &ESI{}
+	upstream := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		w.Header().Set("Content-Type", "text/html")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(`<html><esi:include src="` + fragments.URL + `/account" propagate-redirect="true"/></html>`))
+		return nil
+	})
+
+	req := httptest.NewRequest("GET", "http://example.com/page", nil)
+	rec := httptest.NewRecorder()
+	if err := e.ServeHTTP(rec, req, upstream); err != nil {
+		t.Fatalf("ServeHTTP failed: %v", err)
+	}
+
+	if rec.Code != http.StatusSeeOther {
+		t.Errorf("Expected status 303, got %d", rec.Code)
+	}
+	if location := rec.Header().Get("Location"); location != "https://example.com/login" {
+		t.Errorf("Expected Location https://example.com/login, got %q", location)
+	}
+	if rec.Body.Len() != 0 {
+		t.Errorf("Expected no assembled page to be written, got %q", rec.Body.String())
+	}
+}
+
+// Test a gzipped upstream page is decompressed to find and process its ESI tags
+func TestBufferedESI_GzipUpstream(t *testing.T) {
+	fragments := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("<nav>menu</nav>"))
+	}))
+	defer fragments.Close()
+
+	gzipped := func(content string) []byte {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		zw.Write([]byte(content))
+		zw.Close()
+		return buf.Bytes()
+	}
+
+	tests := []struct {
+		name             string
+		page             string
+		expectedBody     string
+		expectedEncoding string
+	}{
+		{"with ESI tags", `<html><esi:include src="` + fragments.URL + `/menu"/></html>`, "<html><nav>menu</nav></html>", ""},
+		{"without ESI tags", "<html>plain</html>", string(gzipped("<html>plain</html>")), "gzip"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := &ESI{}
+			upstream := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+				w.Header().Set("Content-Type", "text/html")
+				w.Header().Set("Content-Encoding", "gzip")
+				w.WriteHeader(http.StatusOK)
+				w.Write(gzipped(tt.page))
+				return nil
+			})
+
+			req := httptest.NewRequest("GET", "http://example.com/page", nil)
+			rec := httptest.NewRecorder()
+			if err := e.ServeHTTP(rec, req, upstream); err != nil {
+				t.Fatalf("ServeHTTP failed: %v", err)
+			}
+
+			if rec.Body.String() != tt.expectedBody {
+				t.Errorf("Expected body %q, got %q", tt.expectedBody, rec.Body.String())
+			}
+			if encoding := rec.Header().Get("Content-Encoding"); encoding != tt.expectedEncoding {
+				t.Errorf("Expected Content-Encoding %q, got %q", tt.expectedEncoding, encoding)
+			}
+		})
+	}
+}
+
+func TestMetrics_FragmentFetches(t *testing.T) {
+	fragments := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/broken" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte("<p>Fragment</p>"))
+	}))
+	defer fragments.Close()
+
+	e := &ESI{}
+	e.initMetrics(prometheus.NewRegistry())
+	esi.SetMetricsObserver(e)
+	t.Cleanup(func() { esi.SetMetricsObserver(nil) })
+
+	upstream := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		w.Header().Set("Content-Type", "text/html")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(`<html><esi:include src="` + fragments.URL + `/timed"/><esi:include src="` + fragments.URL + `/broken"/></html>`))
+		return nil
+	})
+
+	req := httptest.NewRequest("GET", "http://example.com/page", nil)
+	if err := e.ServeHTTP(httptest.NewRecorder(), req, upstream); err != nil {
+		t.Fatalf("ServeHTTP failed: %v", err)
+	}
+
+	var m dto.Metric
+	if err := e.fragmentFetchDuration.Write(&m); err != nil {
+		t.Fatalf("Reading histogram failed: %v", err)
+	}
+	if got := m.GetHistogram().GetSampleCount(); got != 2 {
+		t.Errorf("Expected 2 timed fetches, got %d", got)
+	}
+
+	for _, status := range []string{"200", "500"} {
+		var m dto.Metric
+		if err := e.fragmentFetches.WithLabelValues(status).Write(&m); err != nil {
+			t.Fatalf("Reading counter failed: %v", err)
+		}
+		if got := m.GetCounter().GetValue(); got != 1 {
+			t.Errorf("Expected 1 fetch with status %s, got %v", status, got)
+		}
+	}
+}
+
+// Test the active fetch gauge rises while includes are being fetched and falls back afterwards
+func TestMetrics_CacheSize(t *testing.T) {
+	fragments := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=300")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("<p>Fragment " + r.URL.Path + "</p>"))
+	}))
+	defer fragments.Close()
+
+	e := &ESI{}
+	e.initMetrics(prometheus.NewRegistry())
+
+	gauge := func(g prometheus.GaugeFunc) float64 {
+		var m dto.Metric
+		if err := g.Write(&m); err != nil {
+			t.Fatalf("Reading gauge failed: %v", err)
+		}
+		return m.GetGauge().GetValue()
+	}
+
+	entriesBefore := gauge(e.cacheEntries)
+
+	upstream := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		w.Header().Set("Content-Type", "text/html")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(`<html><esi:include src="` + fragments.URL + `/size-a"/><esi:include src="` +
+			fragments.URL + `/size-b"/><esi:include src="` + fragments.URL + `/size-c"/></html>`))
+		return nil
+	})
+
+	req := httptest.NewRequest("GET", "http://example.com/page", nil)
+	if err := e.ServeHTTP(httptest.NewRecorder(), req, upstream); err != nil {
+		t.Fatalf("ServeHTTP failed: %v", err)
+	}
+
+	entries, size := esi.CacheStats()
+	if got := gauge(e.cacheEntries); got != float64(entries) || got < entriesBefore+3 {
+		t.Errorf("Expected cache_entries %v to match %d and count the 3 new fragments", got, entries)
+	}
+	if got := gauge(e.cacheSizeBytes); got != float64(size) || got <= 0 {
+		t.Errorf("Expected cache_size_bytes %v to match a positive size %d", got, size)
+	}
+}
+
+func TestMetrics_ActiveFetchGoroutines(t *testing.T) {
+	release := make(chan struct{})
+	fragments := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("<p>Fragment</p>"))
+	}))
+	defer fragments.Close()
+
+	e := &ESI{}
+	e.initMetrics(prometheus.NewRegistry())
+
+	active := func() float64 {
+		var m dto.Metric
+		if err := e.activeFetches.Write(&m); err != nil {
+			t.Fatalf("Reading gauge failed: %v", err)
+		}
+		return m.GetGauge().GetValue()
+	}
+
+	upstream := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		w.Header().Set("Content-Type", "text/html")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(`<html><esi:include src="` + fragments.URL + `/a"/><esi:include src="` +
+			fragments.URL + `/b"/><esi:include src="` + fragments.URL + `/c"/></html>`))
+		return nil
+	})
+
+	served := make(chan struct{})
+	go func() {
+		defer close(served)
+		req := httptest.NewRequest("GET", "http://example.com/page", nil)
+		if err := e.ServeHTTP(httptest.NewRecorder(), req, upstream); err != nil {
+			t.Errorf("ServeHTTP failed: %v", err)
+		}
+	}()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for active() != 3 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if got := active(); got != 3 {
+		t.Errorf("Expected 3 active fetch goroutines while fragments are pending, got %v", got)
+	}
+
+	close(release)
+	<-served
+
+	if got := active(); got != 0 {
+		t.Errorf("Expected no active fetch goroutines once the page is served, got %v", got)
+	}
+}
@@ -2,11 +2,19 @@ package caddy_esi
 
 import (
 	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"mime"
 	"net/http"
 	"os"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
@@ -25,6 +33,22 @@ var bufPool *sync.Pool = &sync.Pool{
 	},
 }
 
+const (
+	// defaultMaxPooledBufferBytes is the largest buffer capacity returned to bufPool by default
+	defaultMaxPooledBufferBytes = 1 << 20
+
+	// esiHeader lets the upstream force ("1") or skip ("0") processing of a response
+	esiHeader = "X-ESI"
+
+	// shutdownTimeout bounds how long Cleanup waits for the fragment fetches in flight to return
+	shutdownTimeout = 10 * time.Second
+)
+
+// provisioned counts the handlers provisioned and not cleaned up yet. On a reload Caddy provisions
+// the new configuration before it cleans up the old one, so the fragment fetches, which are global,
+// are only shut down with the last handler.
+var provisioned atomic.Int64
+
 func init() {
 	caddy.RegisterModule(ESI{})
 	httpcaddyfile.RegisterGlobalOption("esi", func(h *caddyfile.Dispenser, _ interface{}) (interface{}, error) {
@@ -65,6 +89,273 @@ func (e *ESI) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 					return d.Errf("invalid cache_ttl_jitter: %v", err)
 				}
 				e.CacheTTLJitter = jitter
+			case "cache_ttl_jitter_percent":
+				var percentStr string
+				if !d.Args(&percentStr) {
+					return d.ArgErr()
+				}
+				percent, err := strconv.Atoi(percentStr)
+				if err != nil || percent < 0 || percent > 100 {
+					return d.Errf("invalid cache_ttl_jitter_percent: must be between 0 and 100, got %s", percentStr)
+				}
+				e.CacheTTLJitterPercent = percent
+			case "max_cacheable_fragment_bytes":
+				var sizeStr string
+				if !d.Args(&sizeStr) {
+					return d.ArgErr()
+				}
+				size, err := strconv.Atoi(sizeStr)
+				if err != nil {
+					return d.Errf("invalid max_cacheable_fragment_bytes: %v", err)
+				}
+				e.MaxCacheableFragmentBytes = size
+			case "max_cache_entries":
+				var entriesStr string
+				if !d.Args(&entriesStr) {
+					return d.ArgErr()
+				}
+				entries, err := strconv.Atoi(entriesStr)
+				if err != nil {
+					return d.Errf("invalid max_cache_entries: %v", err)
+				}
+				e.MaxCacheEntries = entries
+			case "max_cache_bytes":
+				var sizeStr string
+				if !d.Args(&sizeStr) {
+					return d.ArgErr()
+				}
+				size, err := strconv.ParseInt(sizeStr, 10, 64)
+				if err != nil {
+					return d.Errf("invalid max_cache_bytes: %v", err)
+				}
+				e.MaxCacheBytes = size
+			case "negative_ttl":
+				var ttlStr string
+				if !d.Args(&ttlStr) {
+					return d.ArgErr()
+				}
+				ttl, err := caddy.ParseDuration(ttlStr)
+				if err != nil {
+					return d.Errf("invalid negative_ttl: %v", err)
+				}
+				e.NegativeTTL = caddy.Duration(ttl)
+			case "max_include_depth":
+				var depthStr string
+				if !d.Args(&depthStr) {
+					return d.ArgErr()
+				}
+				depth, err := strconv.Atoi(depthStr)
+				if err != nil {
+					return d.Errf("invalid max_include_depth: %v", err)
+				}
+				e.MaxIncludeDepth = depth
+			case "max_output_bytes":
+				var sizeStr string
+				if !d.Args(&sizeStr) {
+					return d.ArgErr()
+				}
+				size, err := strconv.ParseInt(sizeStr, 10, 64)
+				if err != nil {
+					return d.Errf("invalid max_output_bytes: %v", err)
+				}
+				e.MaxOutputBytes = size
+			case "max_parallel_fetches":
+				var sizeStr string
+				if !d.Args(&sizeStr) {
+					return d.ArgErr()
+				}
+				size, err := strconv.Atoi(sizeStr)
+				if err != nil {
+					return d.Errf("invalid max_parallel_fetches: %v", err)
+				}
+				e.MaxParallelFetches = size
+			case "max_concurrent_per_host":
+				var limitStr string
+				if !d.Args(&limitStr) {
+					return d.ArgErr()
+				}
+				limit, err := strconv.Atoi(limitStr)
+				if err != nil {
+					return d.Errf("invalid max_concurrent_per_host: %v", err)
+				}
+				e.MaxConcurrentPerHost = limit
+			case "max_pooled_buffer_bytes":
+				var sizeStr string
+				if !d.Args(&sizeStr) {
+					return d.ArgErr()
+				}
+				size, err := strconv.Atoi(sizeStr)
+				if err != nil {
+					return d.Errf("invalid max_pooled_buffer_bytes: %v", err)
+				}
+				e.MaxPooledBufferBytes = size
+			case "fragment_unix_socket":
+				if !d.Args(&e.FragmentUnixSocket) {
+					return d.ArgErr()
+				}
+			case "fragment_client_cert":
+				// Client certificate presented to fragment backends requiring mutual TLS
+				// Format: fragment_client_cert /path/to/cert.pem /path/to/key.pem
+				if !d.Args(&e.FragmentClientCert, &e.FragmentClientKey) {
+					return d.Err("fragment_client_cert requires certificate and key files")
+				}
+			case "fragment_ca_cert":
+				if !d.Args(&e.FragmentCACert) {
+					return d.ArgErr()
+				}
+			case "cache_janitor_interval":
+				var intervalStr string
+				if !d.Args(&intervalStr) {
+					return d.ArgErr()
+				}
+				interval, err := caddy.ParseDuration(intervalStr)
+				if err != nil {
+					return d.Errf("invalid cache_janitor_interval: %v", err)
+				}
+				e.CacheJanitorInterval = caddy.Duration(interval)
+			case "disk_cache_dir":
+				if !d.Args(&e.DiskCacheDir) {
+					return d.ArgErr()
+				}
+			case "max_disk_cache_bytes":
+				var sizeStr string
+				if !d.Args(&sizeStr) {
+					return d.ArgErr()
+				}
+				size, err := strconv.ParseInt(sizeStr, 10, 64)
+				if err != nil {
+					return d.Errf("invalid max_disk_cache_bytes: %v", err)
+				}
+				e.MaxDiskCacheBytes = size
+			case "warm_up_period":
+				var periodStr string
+				if !d.Args(&periodStr) {
+					return d.ArgErr()
+				}
+				period, err := caddy.ParseDuration(periodStr)
+				if err != nil {
+					return d.Errf("invalid warm_up_period: %v", err)
+				}
+				e.WarmUpPeriod = caddy.Duration(period)
+			case "warm_up_concurrency":
+				var concurrencyStr string
+				if !d.Args(&concurrencyStr) {
+					return d.ArgErr()
+				}
+				concurrency, err := strconv.Atoi(concurrencyStr)
+				if err != nil {
+					return d.Errf("invalid warm_up_concurrency: %v", err)
+				}
+				e.WarmUpConcurrency = concurrency
+			case "failure_rate_threshold":
+				var thresholdStr string
+				if !d.Args(&thresholdStr) {
+					return d.ArgErr()
+				}
+				threshold, err := strconv.ParseFloat(thresholdStr, 64)
+				if err != nil || threshold < 0 || threshold > 1 {
+					return d.Errf("invalid failure_rate_threshold: must be between 0 and 1, got %s", thresholdStr)
+				}
+				e.FailureRateThreshold = threshold
+			case "failure_window":
+				var windowStr string
+				if !d.Args(&windowStr) {
+					return d.ArgErr()
+				}
+				window, err := caddy.ParseDuration(windowStr)
+				if err != nil {
+					return d.Errf("invalid failure_window: %v", err)
+				}
+				e.FailureWindow = caddy.Duration(window)
+			case "circuit_breaker_threshold":
+				var thresholdStr string
+				if !d.Args(&thresholdStr) {
+					return d.ArgErr()
+				}
+				threshold, err := strconv.Atoi(thresholdStr)
+				if err != nil {
+					return d.Errf("invalid circuit_breaker_threshold: %v", err)
+				}
+				e.CircuitBreakerThreshold = threshold
+			case "circuit_breaker_cooldown":
+				var cooldownStr string
+				if !d.Args(&cooldownStr) {
+					return d.ArgErr()
+				}
+				cooldown, err := caddy.ParseDuration(cooldownStr)
+				if err != nil {
+					return d.Errf("invalid circuit_breaker_cooldown: %v", err)
+				}
+				e.CircuitBreakerCooldown = caddy.Duration(cooldown)
+			case "fragment_manifest":
+				if !d.Args(&e.FragmentManifest) {
+					return d.ArgErr()
+				}
+			case "fragment_manifest_interval":
+				var intervalStr string
+				if !d.Args(&intervalStr) {
+					return d.ArgErr()
+				}
+				interval, err := caddy.ParseDuration(intervalStr)
+				if err != nil {
+					return d.Errf("invalid fragment_manifest_interval: %v", err)
+				}
+				e.FragmentManifestInterval = caddy.Duration(interval)
+			case "placeholder_threshold":
+				var thresholdStr string
+				if !d.Args(&thresholdStr) {
+					return d.ArgErr()
+				}
+				threshold, err := caddy.ParseDuration(thresholdStr)
+				if err != nil {
+					return d.Errf("invalid placeholder_threshold: %v", err)
+				}
+				e.PlaceholderThreshold = caddy.Duration(threshold)
+			case "placeholder":
+				if !d.Args(&e.Placeholder) {
+					return d.ArgErr()
+				}
+			case "maintenance_page":
+				if !d.Args(&e.MaintenancePage) {
+					return d.ArgErr()
+				}
+			case "passthrough_header":
+				// Let requests carrying this header with a true value get the page unprocessed
+				// Format: passthrough_header X-ESI-Passthrough
+				if !d.Args(&e.PassthroughHeader) {
+					return d.ArgErr()
+				}
+			case "bucket_cookie":
+				if !d.Args(&e.BucketCookie) {
+					return d.ArgErr()
+				}
+			case "bucket_header":
+				if !d.Args(&e.BucketHeader) {
+					return d.ArgErr()
+				}
+			case "bucket_count":
+				var countStr string
+				if !d.Args(&countStr) {
+					return d.ArgErr()
+				}
+				count, err := strconv.Atoi(countStr)
+				if err != nil {
+					return d.Errf("invalid bucket_count: %v", err)
+				}
+				e.BucketCount = count
+			case "default_onerror":
+				// onerror behavior of includes without an onerror attribute
+				// Format: default_onerror continue|alt|error
+				var mode string
+				if !d.Args(&mode) {
+					return d.ArgErr()
+				}
+				switch mode {
+				case esi.OnErrorContinue, esi.OnErrorAlt, esi.OnErrorError:
+					e.DefaultOnError = mode
+				default:
+					return d.Errf("default_onerror must be 'continue', 'alt' or 'error', got: %s", mode)
+				}
 			case "esi_base_url":
 				if !d.Args(&e.ESIBaseURL) {
 					return d.ArgErr()
@@ -72,22 +363,136 @@ func (e *ESI) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 			case "debug":
 				// Enable or disable debug logging
 				// Format: debug on|off or debug {$ENV_VAR}
-				var debugValue string
-				if !d.Args(&debugValue) {
+				debug, err := parseOnOff(d)
+				if err != nil {
+					return err
+				}
+				e.Debug = debug
+			case "streaming":
+				// Stream processed responses as fragments resolve instead of buffering them
+				// Format: streaming on|off
+				streaming, err := parseOnOff(d)
+				if err != nil {
+					return err
+				}
+				e.Streaming = streaming
+			case "strict_tag_detection":
+				// Only process pages holding a known, closed ESI tag, not any mention of one
+				// Format: strict_tag_detection on|off
+				strict, err := parseOnOff(d)
+				if err != nil {
+					return err
+				}
+				e.StrictTagDetection = strict
+			case "debug_boundaries":
+				// Wrap fragments in <!-- esi:begin/end --> comments
+				// Format: debug_boundaries on|off
+				debugBoundaries, err := parseOnOff(d)
+				if err != nil {
+					return err
+				}
+				e.DebugBoundaries = debugBoundaries
+			case "debug_placeholders":
+				// Replace failed includes with <!-- esi:include failed src=... status=... --> comments
+				// Format: debug_placeholders on|off
+				debugPlaceholders, err := parseOnOff(d)
+				if err != nil {
+					return err
+				}
+				e.DebugPlaceholders = debugPlaceholders
+			case "fetch_timeout":
+				var timeoutStr string
+				if !d.Args(&timeoutStr) {
+					return d.ArgErr()
+				}
+				timeout, err := caddy.ParseDuration(timeoutStr)
+				if err != nil {
+					return d.Errf("invalid fetch_timeout: %v", err)
+				}
+				e.FetchTimeout = caddy.Duration(timeout)
+			case "fragment_retries":
+				var retriesStr string
+				if !d.Args(&retriesStr) {
+					return d.ArgErr()
+				}
+				retries, err := strconv.Atoi(retriesStr)
+				if err != nil {
+					return d.Errf("invalid fragment_retries: %v", err)
+				}
+				e.FragmentRetries = retries
+			case "fragment_retry_backoff":
+				var backoffStr string
+				if !d.Args(&backoffStr) {
 					return d.ArgErr()
 				}
+				backoff, err := caddy.ParseDuration(backoffStr)
+				if err != nil {
+					return d.Errf("invalid fragment_retry_backoff: %v", err)
+				}
+				e.FragmentRetryBackoff = caddy.Duration(backoff)
+			case "host_timeout":
+				// Override fetch_timeout for the fragments of one host (repeatable directive)
+				// Format: host_timeout analytics.internal 5s
+				var host, timeoutStr string
+				if !d.Args(&host, &timeoutStr) {
+					return d.Err("host_timeout requires host and timeout")
+				}
+				timeout, err := caddy.ParseDuration(timeoutStr)
+				if err != nil {
+					return d.Errf("invalid host_timeout for %s: %v", host, err)
+				}
 
-				// Accept: "on", "true", "1", "yes" for true
-				// Accept: "off", "false", "0", "no" for false
-				debugLower := strings.ToLower(strings.TrimSpace(debugValue))
-				switch debugLower {
-				case "on", "true", "1", "yes":
-					e.Debug = true
-				case "off", "false", "0", "no":
-					e.Debug = false
-				default:
-					return d.Errf("debug must be 'on' or 'off', got: %s", debugValue)
+				if e.HostTimeouts == nil {
+					e.HostTimeouts = make(map[string]caddy.Duration)
+				}
+				e.HostTimeouts[host] = caddy.Duration(timeout)
+			case "allowed_hosts":
+				// Restrict the hosts fragments are fetched from (repeatable, accumulates)
+				// Format: allowed_hosts header.internal *.fragments.example.com
+				hosts := d.RemainingArgs()
+				if len(hosts) == 0 {
+					return d.ArgErr()
+				}
+				e.AllowedHosts = append(e.AllowedHosts, hosts...)
+			case "esi_content_types":
+				// Replace the content types of the responses processed (repeatable, accumulates)
+				// Format: esi_content_types text/html application/rss+xml
+				types := d.RemainingArgs()
+				if len(types) == 0 {
+					return d.ArgErr()
 				}
+				e.ContentTypes = append(e.ContentTypes, types...)
+			case "allowed_schemes":
+				// Format: allowed_schemes https
+				schemes := d.RemainingArgs()
+				if len(schemes) == 0 {
+					return d.ArgErr()
+				}
+				e.AllowedSchemes = append(e.AllowedSchemes, schemes...)
+			case "allowed_fragment_content_types":
+				// Format: allowed_fragment_content_types text/html
+				contentTypes := d.RemainingArgs()
+				if len(contentTypes) == 0 {
+					return d.ArgErr()
+				}
+				e.AllowedFragmentContentTypes = append(e.AllowedFragmentContentTypes, contentTypes...)
+			case "max_fragment_redirects":
+				var redirectsStr string
+				if !d.Args(&redirectsStr) {
+					return d.ArgErr()
+				}
+				redirects, err := strconv.Atoi(redirectsStr)
+				if err != nil {
+					return d.Errf("invalid max_fragment_redirects: %v", err)
+				}
+				e.MaxFragmentRedirects = redirects
+			case "same_origin_redirects":
+				// Format: same_origin_redirects on|off
+				sameOrigin, err := parseOnOff(d)
+				if err != nil {
+					return err
+				}
+				e.SameOriginRedirects = sameOrigin
 			case "esi_set_header":
 				// Set a custom header on ESI fragment requests (repeatable directive)
 				// Format: esi_set_header X-Backend-Server "internal-server"
@@ -101,6 +506,18 @@ func (e *ESI) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 				}
 
 				e.ESIHeaders[headerName] = headerValue
+			case "esi_var":
+				// Expose a request header to the page's ESI tags as $(VAR{name}) (repeatable directive)
+				// Format: esi_var tier X-Customer-Tier
+				var name, header string
+				if !d.Args(&name, &header) {
+					return d.Err("esi_var requires a variable name and a header name")
+				}
+
+				if e.VarHeaders == nil {
+					e.VarHeaders = make(map[string]string)
+				}
+				e.VarHeaders[name] = header
 			default:
 				return d.Errf("unknown subdirective: %s", d.Val())
 			}
@@ -109,24 +526,119 @@ func (e *ESI) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 	return nil
 }
 
+// hostTimeouts converts the configured per-host timeouts to the esi package's type
+func hostTimeouts(timeouts map[string]caddy.Duration) map[string]time.Duration {
+	if len(timeouts) == 0 {
+		return nil
+	}
+
+	converted := make(map[string]time.Duration, len(timeouts))
+	for host, timeout := range timeouts {
+		converted[host] = time.Duration(timeout)
+	}
+
+	return converted
+}
+
+// parseOnOff parses the single on/off argument of the current subdirective
+func parseOnOff(d *caddyfile.Dispenser) (bool, error) {
+	name := d.Val()
+
+	var value string
+	if !d.Args(&value) {
+		return false, d.ArgErr()
+	}
+
+	// Accept: "on", "true", "1", "yes" for true
+	// Accept: "off", "false", "0", "no" for false
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "on", "true", "1", "yes":
+		return true, nil
+	case "off", "false", "0", "no":
+		return false, nil
+	default:
+		return false, d.Errf("%s must be 'on' or 'off', got: %s", name, value)
+	}
+}
+
 // ESI to handle, process and serve ESI tags.
 type ESI struct {
 	// Configuration
-	MinimumCacheTTL int               `json:"minimum_cache_ttl,omitempty"`
-	CacheTTLJitter  int               `json:"cache_ttl_jitter,omitempty"`
-	ESIBaseURL      string            `json:"esi_base_url,omitempty"`
-	ESIHeaders      map[string]string `json:"esi_headers,omitempty"`
-	Debug           bool              `json:"debug,omitempty"`
+	MinimumCacheTTL             int                       `json:"minimum_cache_ttl,omitempty"`
+	CacheTTLJitter              int                       `json:"cache_ttl_jitter,omitempty"`
+	CacheTTLJitterPercent       int                       `json:"cache_ttl_jitter_percent,omitempty"`
+	MaxCacheableFragmentBytes   int                       `json:"max_cacheable_fragment_bytes,omitempty"`
+	MaxCacheEntries             int                       `json:"max_cache_entries,omitempty"`
+	MaxCacheBytes               int64                     `json:"max_cache_bytes,omitempty"`
+	NegativeTTL                 caddy.Duration            `json:"negative_ttl,omitempty"`
+	MaxParallelFetches          int                       `json:"max_parallel_fetches,omitempty"`
+	MaxConcurrentPerHost        int                       `json:"max_concurrent_per_host,omitempty"`
+	MaxPooledBufferBytes        int                       `json:"max_pooled_buffer_bytes,omitempty"`
+	MaxOutputBytes              int64                     `json:"max_output_bytes,omitempty"`
+	MaxIncludeDepth             int                       `json:"max_include_depth,omitempty"`
+	FragmentUnixSocket          string                    `json:"fragment_unix_socket,omitempty"`
+	FragmentClientCert          string                    `json:"fragment_client_cert,omitempty"`
+	FragmentClientKey           string                    `json:"fragment_client_key,omitempty"`
+	FragmentCACert              string                    `json:"fragment_ca_cert,omitempty"`
+	CacheJanitorInterval        caddy.Duration            `json:"cache_janitor_interval,omitempty"`
+	DiskCacheDir                string                    `json:"disk_cache_dir,omitempty"`
+	MaxDiskCacheBytes           int64                     `json:"max_disk_cache_bytes,omitempty"`
+	FetchTimeout                caddy.Duration            `json:"fetch_timeout,omitempty"`
+	HostTimeouts                map[string]caddy.Duration `json:"host_timeouts,omitempty"`
+	FragmentRetries             int                       `json:"fragment_retries,omitempty"`
+	FragmentRetryBackoff        caddy.Duration            `json:"fragment_retry_backoff,omitempty"`
+	WarmUpPeriod                caddy.Duration            `json:"warm_up_period,omitempty"`
+	WarmUpConcurrency           int                       `json:"warm_up_concurrency,omitempty"`
+	FailureRateThreshold        float64                   `json:"failure_rate_threshold,omitempty"`
+	FailureWindow               caddy.Duration            `json:"failure_window,omitempty"`
+	CircuitBreakerThreshold     int                       `json:"circuit_breaker_threshold,omitempty"`
+	CircuitBreakerCooldown      caddy.Duration            `json:"circuit_breaker_cooldown,omitempty"`
+	PlaceholderThreshold        caddy.Duration            `json:"placeholder_threshold,omitempty"`
+	Placeholder                 string                    `json:"placeholder,omitempty"`
+	MaintenancePage             string                    `json:"maintenance_page,omitempty"`
+	PassthroughHeader           string                    `json:"passthrough_header,omitempty"`
+	FragmentManifest            string                    `json:"fragment_manifest,omitempty"`
+	FragmentManifestInterval    caddy.Duration            `json:"fragment_manifest_interval,omitempty"`
+	BucketCookie                string                    `json:"bucket_cookie,omitempty"`
+	BucketHeader                string                    `json:"bucket_header,omitempty"`
+	BucketCount                 int                       `json:"bucket_count,omitempty"`
+	DefaultOnError              string                    `json:"default_onerror,omitempty"`
+	ESIBaseURL                  string                    `json:"esi_base_url,omitempty"`
+	ESIHeaders                  map[string]string         `json:"esi_headers,omitempty"`
+	VarHeaders                  map[string]string         `json:"var_headers,omitempty"`
+	AllowedHosts                []string                  `json:"allowed_hosts,omitempty"`
+	AllowedSchemes              []string                  `json:"allowed_schemes,omitempty"`
+	AllowedFragmentContentTypes []string                  `json:"allowed_fragment_content_types,omitempty"`
+	MaxFragmentRedirects        int                       `json:"max_fragment_redirects,omitempty"`
+	SameOriginRedirects         bool                      `json:"same_origin_redirects,omitempty"`
+	ContentTypes                []string                  `json:"content_types,omitempty"`
+	Debug                       bool                      `json:"debug,omitempty"`
+	DebugBoundaries             bool                      `json:"debug_boundaries,omitempty"`
+	DebugPlaceholders           bool                      `json:"debug_placeholders,omitempty"`
+	Streaming                   bool                      `json:"streaming,omitempty"`
+	StrictTagDetection          bool                      `json:"strict_tag_detection,omitempty"`
 
 	logger *zap.Logger
 
+	// maintenance is the content of MaintenancePage, loaded in Provision
+	maintenance []byte
+
+	// manifest keeps the fragments of FragmentManifest warm, stopped in Cleanup
+	manifest *esi.ManifestWarmer
+
 	// Prometheus metrics
 	cacheHits          prometheus.Counter
 	cacheMisses        prometheus.Counter
 	cacheEvictions     prometheus.Counter
 	cacheStampedeWaits prometheus.Counter
-	cacheEntries       prometheus.Gauge
-	cacheSizeBytes     prometheus.Gauge
+	cacheEntries       prometheus.GaugeFunc
+	cacheSizeBytes     prometheus.GaugeFunc
+	bufferDiscards     prometheus.Counter
+	cacheHitRatio      prometheus.GaugeFunc
+	activeFetches      prometheus.GaugeFunc
+
+	fragmentFetchDuration prometheus.Histogram
+	fragmentFetches       *prometheus.CounterVec
 }
 
 // CaddyModule returns the Caddy module information.
@@ -139,37 +651,24 @@ func (ESI) CaddyModule() caddy.ModuleInfo {
 
 // ServeHTTP implements caddyhttp.MiddlewareHandler
 func (e *ESI) ServeHTTP(rw http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
-	// Determine if we should buffer the response
-	shouldBuffer := func(status int, header http.Header) bool {
-		// Only buffer successful HTML responses
-		if status != http.StatusOK {
-			return false
-		}
-
-		// Don't buffer if Transfer-Encoding is chunked (streaming response)
-		if header.Get("Transfer-Encoding") == "chunked" {
-			return false
-		}
+	// The page is served as the upstream emitted it, to inspect its ESI tags
+	if e.passthrough(r) {
+		return next.ServeHTTP(rw, r)
+	}
 
-		// Don't buffer very small responses (< 512 bytes) - unlikely to have ESI
-		if cl := header.Get("Content-Length"); cl != "" {
-			if size, err := strconv.Atoi(cl); err == nil && size < 512 {
-				return false
-			}
-		}
+	r = e.withVars(r)
 
-		// Only buffer HTML/XHTML content types
-		ct := header.Get("Content-Type")
-		return ct != "" && (bytes.Contains([]byte(ct), []byte("text/html")) ||
-			bytes.Contains([]byte(ct), []byte("application/xhtml+xml")))
+	// The maintenance page replaces the whole response, so during an outage pages are buffered
+	if e.Streaming && (e.maintenance == nil || !esi.GloballyFailing()) {
+		return e.serveStreaming(rw, r, next)
 	}
 
 	// Create recorder to buffer the response
 	buf := bufPool.Get().(*bytes.Buffer)
 	buf.Reset()
-	defer bufPool.Put(buf)
+	defer e.releaseBuffer(buf)
 
-	recorder := caddyhttp.NewResponseRecorder(rw, buf, shouldBuffer)
+	recorder := caddyhttp.NewResponseRecorder(rw, buf, e.shouldBuffer)
 
 	// Let upstream write to the recorder
 	err := next.ServeHTTP(recorder, r)
@@ -182,21 +681,43 @@ func (e *ESI) ServeHTTP(rw http.ResponseWriter, r *http.Request, next caddyhttp.
 		return nil
 	}
 
-	// Get the buffered response body
-	body := recorder.Buffer().Bytes()
+	// Get the buffered response body, a gzipped one is scanned and processed decompressed
+	raw := recorder.Buffer().Bytes()
+	body, decoded := decodeBody(rw.Header(), raw)
 
 	if e.logger != nil {
 		e.logger.Debug("ESI middleware received response",
 			zap.Int("status", recorder.Status()),
 			zap.Int("body_size", len(body)),
-			zap.Bool("has_esi", esi.HasOpenedTags(body)))
+			zap.Bool("has_esi", e.hasTags(body)))
 	}
 
 	// Check if response contains ESI tags
-	if !esi.HasOpenedTags(body) {
-		// No ESI tags, write buffered response as-is
+	if !decoded || !e.hasTags(body) {
+		// No ESI tags, or an encoding that can't be decoded, write buffered response as-is
 		rw.WriteHeader(recorder.Status())
-		_, err = rw.Write(body)
+		_, err = rw.Write(raw)
+		return err
+	}
+
+	// The assembled page is sent uncompressed, an encode handler in front of this one compresses it again
+	rw.Header().Del("Content-Encoding")
+
+	// During a backend-wide outage serve the maintenance page instead of a broken assembly
+	if e.maintenance != nil && esi.GloballyFailing() {
+		if e.logger != nil {
+			e.logger.Warn("Serving maintenance page, fragment failure rate above threshold",
+				zap.String("url", r.URL.String()),
+				zap.Float64("failure_rate", esi.FailureRate()))
+		}
+
+		rw.Header().Del("Content-Length")
+		rw.Header().Del("Last-Modified")
+		rw.Header().Del("ETag")
+		rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+		rw.Header().Set("Cache-Control", "no-store")
+		rw.WriteHeader(http.StatusServiceUnavailable)
+		_, err = rw.Write(e.maintenance)
 		return err
 	}
 
@@ -205,16 +726,294 @@ func (e *ESI) ServeHTTP(rw http.ResponseWriter, r *http.Request, next caddyhttp.
 		e.logger.Info("Processing ESI tags", zap.String("url", r.URL.String()))
 	}
 
-	processed := esi.Parse(body, r)
+	processed, result := esi.ParseWithResult(body, r)
+	if e.logger != nil {
+		for _, err := range result.Errors() {
+			e.logger.Warn("ESI include failed", zap.String("url", r.URL.String()), zap.Error(err))
+		}
+
+		// In debug mode, one line tells which fragments of the page were cache hits and how long they took
+		if e.Debug {
+			e.logger.Info("ESI fragments resolved",
+				zap.String("url", r.URL.String()),
+				zap.Objects("fragments", fragmentLogs(result.Fragments)))
+		}
+	}
+
+	// An include with propagate-redirect="true" was redirected, the client follows it instead
+	if status, location := result.Redirect(); status != 0 {
+		rw.Header().Set("Location", location)
+		rw.Header().Del("Content-Length")
+		rw.WriteHeader(status)
+		return nil
+	}
+
+	// An include whose onerror mode doesn't allow removing it failed the whole page
+	if err := result.Err(); err != nil {
+		return caddyhttp.Error(http.StatusBadGateway, err)
+	}
+
+	// The assembled page is as recent as its newest part
+	if lastModified := pageLastModified(rw.Header(), result); !lastModified.IsZero() {
+		rw.Header().Set("Last-Modified", lastModified.UTC().Format(http.TimeFormat))
 
-	// Write processed response
+		if notModifiedSince(r, lastModified) {
+			rw.Header().Del("Content-Length")
+			rw.WriteHeader(http.StatusNotModified)
+			return nil
+		}
+	}
+
+	// Write processed response, the upstream Content-Length is that of the unprocessed page
+	rw.Header().Set("Content-Length", strconv.Itoa(len(processed)))
 	rw.WriteHeader(recorder.Status())
 	_, err = rw.Write(processed)
 	return err
 }
 
+// releaseBuffer returns buf to bufPool unless it grew beyond the configured cap,
+// so a single huge page does not pin its memory in the pool forever
+func (e *ESI) releaseBuffer(buf *bytes.Buffer) {
+	limit := e.MaxPooledBufferBytes
+	if limit <= 0 {
+		limit = defaultMaxPooledBufferBytes
+	}
+
+	if buf.Cap() > limit {
+		if e.bufferDiscards != nil {
+			e.bufferDiscards.Inc()
+		}
+		return
+	}
+
+	bufPool.Put(buf)
+}
+
+// fragmentLog logs a fragment resolved for a page
+type fragmentLog esi.Fragment
+
+// MarshalLogObject implements zapcore.ObjectMarshaler
+func (f fragmentLog) MarshalLogObject(enc zapcore.ObjectEncoder) error {
+	enc.AddString("url", f.URL)
+	enc.AddBool("cache_hit", f.CacheHit)
+	enc.AddDuration("duration", f.Duration)
+	enc.AddInt("status", f.StatusCode)
+	if f.Err != nil {
+		enc.AddString("error", f.Err.Error())
+	}
+
+	return nil
+}
+
+// fragmentLogs converts the fragments of a Result for logging
+func fragmentLogs(fragments []esi.Fragment) []fragmentLog {
+	logs := make([]fragmentLog, len(fragments))
+	for i, f := range fragments {
+		logs[i] = fragmentLog(f)
+	}
+
+	return logs
+}
+
+// hasTags reports whether the body has ESI tags to process, only well-formed ones with StrictTagDetection
+func (e *ESI) hasTags(body []byte) bool {
+	if e.StrictTagDetection {
+		return esi.HasProcessableTags(body)
+	}
+
+	return esi.HasOpenedTags(body)
+}
+
+// withVars attaches the values of the VarHeaders request headers to the request, as $(VAR{name})
+// of the page's ESI tags
+func (e *ESI) withVars(r *http.Request) *http.Request {
+	if len(e.VarHeaders) == 0 {
+		return r
+	}
+
+	vars := make(map[string]string, len(e.VarHeaders))
+	for name, header := range e.VarHeaders {
+		vars[name] = r.Header.Get(header)
+	}
+
+	return r.WithContext(esi.WithVars(r.Context(), vars))
+}
+
+// passthrough reports whether the request asks for the page unprocessed with a true PassthroughHeader
+func (e *ESI) passthrough(r *http.Request) bool {
+	if e.PassthroughHeader == "" {
+		return false
+	}
+
+	passthrough, _ := strconv.ParseBool(r.Header.Get(e.PassthroughHeader))
+	return passthrough
+}
+
+// decodeBody returns the buffered upstream body with its gzip Content-Encoding undone. It reports
+// false for other encodings and for content failing to decode, which are then served unchanged
+func decodeBody(header http.Header, body []byte) ([]byte, bool) {
+	switch strings.ToLower(strings.TrimSpace(header.Get("Content-Encoding"))) {
+	case "", "identity":
+		return body, true
+	case "gzip", "x-gzip":
+	default:
+		return body, false
+	}
+
+	zr, err := gzip.NewReader(bytes.NewReader(body))
+	if err != nil {
+		return body, false
+	}
+	defer zr.Close()
+
+	decoded, err := io.ReadAll(zr)
+	if err != nil {
+		return body, false
+	}
+
+	return decoded, true
+}
+
+// pageLastModified returns the newest of the upstream page's and the fragments' Last-Modified
+func pageLastModified(header http.Header, result *esi.Result) time.Time {
+	lastModified := result.LastModified()
+	if upstream, err := http.ParseTime(header.Get("Last-Modified")); err == nil && upstream.After(lastModified) {
+		lastModified = upstream
+	}
+
+	return lastModified
+}
+
+// notModifiedSince reports whether the request's If-Modified-Since covers lastModified
+func notModifiedSince(r *http.Request, lastModified time.Time) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+
+	ims, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+
+	// HTTP dates have second precision
+	return !lastModified.Truncate(time.Second).After(ims)
+}
+
+// shouldBuffer determines if the response should be buffered for ESI processing
+func (e *ESI) shouldBuffer(status int, header http.Header) bool {
+	// The hints are stripped whatever the outcome, so they never reach the client
+	contentTypeHint := esiContentTypeHint(header)
+	process, hinted := esiHeaderHint(header)
+
+	// Only buffer successful HTML responses
+	if status != http.StatusOK {
+		return false
+	}
+
+	// Event streams and multipart streams may never end, buffering them would hang the client
+	// whatever the upstream or the other settings ask for
+	if isStreamingContentType(header.Get("Content-Type")) {
+		return false
+	}
+
+	// An explicit X-ESI header from the upstream overrides every heuristic below
+	if hinted {
+		return process
+	}
+
+	// Don't buffer if Transfer-Encoding is chunked (streaming response), streaming mode
+	// processes it as it arrives instead
+	if !e.Streaming && header.Get("Transfer-Encoding") == "chunked" {
+		return false
+	}
+
+	// An explicit "esi=process" Content-Type parameter opts the response in
+	if contentTypeHint {
+		return true
+	}
+
+	// Don't buffer very small responses (< 512 bytes) - unlikely to have ESI
+	if cl := header.Get("Content-Length"); cl != "" {
+		if size, err := strconv.Atoi(cl); err == nil && size < 512 {
+			return false
+		}
+	}
+
+	// Only buffer the configured content types, HTML and XHTML by default
+	mediaType, _, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		return false
+	}
+
+	return slices.ContainsFunc(e.processedContentTypes(), func(ct string) bool {
+		return strings.EqualFold(ct, mediaType)
+	})
+}
+
+// defaultContentTypes are the content types processed when ContentTypes is unset
+var defaultContentTypes = []string{"text/html", "application/xhtml+xml"}
+
+// processedContentTypes returns the media types of the responses the middleware processes
+func (e *ESI) processedContentTypes() []string {
+	if len(e.ContentTypes) == 0 {
+		return defaultContentTypes
+	}
+
+	return e.ContentTypes
+}
+
+// isStreamingContentType reports whether the Content-Type is one of an open-ended stream:
+// Server-Sent Events or any multipart type (e.g. multipart/x-mixed-replace for MJPEG)
+func isStreamingContentType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+
+	return mediaType == "text/event-stream" || strings.HasPrefix(mediaType, "multipart/")
+}
+
+// esiHeaderHint reports whether the upstream explicitly asked for processing ("X-ESI: 1") or
+// against it ("X-ESI: 0"), and false for ok if it didn't say. The header never reaches the client.
+func esiHeaderHint(header http.Header) (process, ok bool) {
+	value := header.Get(esiHeader)
+	if value == "" {
+		return false, false
+	}
+	header.Del(esiHeader)
+
+	process, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, false
+	}
+
+	return process, true
+}
+
+// esiContentTypeHint reports whether the Content-Type carries the non-standard "esi=process"
+// parameter, and strips that parameter so it never reaches the client.
+func esiContentTypeHint(header http.Header) bool {
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		return false
+	}
+
+	value, ok := params["esi"]
+	if !ok {
+		return false
+	}
+
+	delete(params, "esi")
+	header.Set("Content-Type", mime.FormatMediaType(mediaType, params))
+
+	return strings.EqualFold(value, "process")
+}
+
 // Provision implements caddy.Provisioner
 func (e *ESI) Provision(ctx caddy.Context) error {
+	// Counted first, as Caddy calls Cleanup when provisioning fails too
+	provisioned.Add(1)
+
 	e.logger = ctx.Logger()
 
 	// Check environment variable for debug logging
@@ -236,18 +1035,119 @@ func (e *ESI) Provision(ctx caddy.Context) error {
 
 	// Configure ESI package with user settings
 	config := esi.Config{
-		MinimumCacheTTL: e.MinimumCacheTTL,
-		CacheTTLJitter:  e.CacheTTLJitter,
-		BaseURL:         e.ESIBaseURL,
-		Headers:         e.ESIHeaders,
+		MinimumCacheTTL:             e.MinimumCacheTTL,
+		CacheTTLJitter:              e.CacheTTLJitter,
+		CacheTTLJitterPercent:       e.CacheTTLJitterPercent,
+		MaxCacheableFragmentBytes:   e.MaxCacheableFragmentBytes,
+		MaxCacheEntries:             e.MaxCacheEntries,
+		MaxCacheBytes:               e.MaxCacheBytes,
+		NegativeTTL:                 time.Duration(e.NegativeTTL),
+		MaxOutputBytes:              e.MaxOutputBytes,
+		MaxIncludeDepth:             e.MaxIncludeDepth,
+		MaxParallelFetches:          e.MaxParallelFetches,
+		MaxConcurrentPerHost:        e.MaxConcurrentPerHost,
+		FragmentUnixSocket:          e.FragmentUnixSocket,
+		ClientCert:                  e.FragmentClientCert,
+		ClientKey:                   e.FragmentClientKey,
+		CACert:                      e.FragmentCACert,
+		JanitorInterval:             time.Duration(e.CacheJanitorInterval),
+		DiskCacheDir:                e.DiskCacheDir,
+		MaxDiskCacheBytes:           e.MaxDiskCacheBytes,
+		FetchTimeout:                time.Duration(e.FetchTimeout),
+		FragmentRetries:             e.FragmentRetries,
+		FragmentRetryBackoff:        time.Duration(e.FragmentRetryBackoff),
+		HostTimeouts:                hostTimeouts(e.HostTimeouts),
+		WarmUpPeriod:                time.Duration(e.WarmUpPeriod),
+		WarmUpConcurrency:           e.WarmUpConcurrency,
+		PlaceholderThreshold:        time.Duration(e.PlaceholderThreshold),
+		Placeholder:                 e.Placeholder,
+		FailureRateThreshold:        e.FailureRateThreshold,
+		FailureWindow:               time.Duration(e.FailureWindow),
+		CircuitBreakerThreshold:     e.CircuitBreakerThreshold,
+		CircuitBreakerCooldown:      time.Duration(e.CircuitBreakerCooldown),
+		BucketCookie:                e.BucketCookie,
+		BucketHeader:                e.BucketHeader,
+		BucketCount:                 e.BucketCount,
+		DefaultOnError:              e.DefaultOnError,
+		BaseURL:                     e.ESIBaseURL,
+		Headers:                     e.ESIHeaders,
+		AllowedHosts:                e.AllowedHosts,
+		AllowedSchemes:              e.AllowedSchemes,
+		AllowedFragmentContentTypes: e.AllowedFragmentContentTypes,
+		MaxFragmentRedirects:        e.MaxFragmentRedirects,
+		SameOriginRedirects:         e.SameOriginRedirects,
+		DebugBoundaries:             e.DebugBoundaries,
+		DebugPlaceholders:           e.DebugPlaceholders,
 	}
 	esi.Configure(config)
 
+	if e.MaintenancePage != "" {
+		page, err := os.ReadFile(e.MaintenancePage)
+		if err != nil {
+			return fmt.Errorf("reading maintenance_page: %w", err)
+		}
+		e.maintenance = page
+	}
+
+	if e.FragmentManifest != "" {
+		e.manifest = esi.NewManifestWarmer(e.FragmentManifest, time.Duration(e.FragmentManifestInterval))
+		if err := e.manifest.Start(); err != nil {
+			return fmt.Errorf("loading fragment_manifest: %w", err)
+		}
+	}
+
 	e.logger.Info("ESI configuration applied",
 		zap.Int("minimum_cache_ttl", e.MinimumCacheTTL),
 		zap.Int("cache_ttl_jitter", e.CacheTTLJitter),
+		zap.Int("cache_ttl_jitter_percent", e.CacheTTLJitterPercent),
+		zap.Int("max_cacheable_fragment_bytes", e.MaxCacheableFragmentBytes),
+		zap.Int("max_cache_entries", e.MaxCacheEntries),
+		zap.Int64("max_cache_bytes", e.MaxCacheBytes),
+		zap.Duration("negative_ttl", time.Duration(e.NegativeTTL)),
+		zap.Int("max_pooled_buffer_bytes", e.MaxPooledBufferBytes),
+		zap.Int64("max_output_bytes", e.MaxOutputBytes),
+		zap.Int("max_include_depth", e.MaxIncludeDepth),
+		zap.Int("max_parallel_fetches", e.MaxParallelFetches),
+		zap.Int("max_concurrent_per_host", e.MaxConcurrentPerHost),
+		zap.String("fragment_unix_socket", e.FragmentUnixSocket),
+		zap.String("fragment_client_cert", e.FragmentClientCert),
+		zap.String("fragment_ca_cert", e.FragmentCACert),
+		zap.Duration("cache_janitor_interval", time.Duration(e.CacheJanitorInterval)),
+		zap.String("disk_cache_dir", e.DiskCacheDir),
+		zap.Int64("max_disk_cache_bytes", e.MaxDiskCacheBytes),
+		zap.Duration("fetch_timeout", time.Duration(e.FetchTimeout)),
+		zap.Int("fragment_retries", e.FragmentRetries),
+		zap.Duration("fragment_retry_backoff", time.Duration(e.FragmentRetryBackoff)),
+		zap.Any("host_timeouts", e.HostTimeouts),
+		zap.Duration("warm_up_period", time.Duration(e.WarmUpPeriod)),
+		zap.Int("warm_up_concurrency", e.WarmUpConcurrency),
+		zap.Float64("failure_rate_threshold", e.FailureRateThreshold),
+		zap.Duration("failure_window", time.Duration(e.FailureWindow)),
+		zap.Int("circuit_breaker_threshold", e.CircuitBreakerThreshold),
+		zap.Duration("circuit_breaker_cooldown", time.Duration(e.CircuitBreakerCooldown)),
+		zap.Duration("placeholder_threshold", time.Duration(e.PlaceholderThreshold)),
+		zap.String("placeholder", e.Placeholder),
+		zap.String("maintenance_page", e.MaintenancePage),
+		zap.String("passthrough_header", e.PassthroughHeader),
+		zap.String("fragment_manifest", e.FragmentManifest),
+		zap.Duration("fragment_manifest_interval", time.Duration(e.FragmentManifestInterval)),
+		zap.String("bucket_cookie", e.BucketCookie),
+		zap.String("bucket_header", e.BucketHeader),
+		zap.Int("bucket_count", e.BucketCount),
+		zap.String("default_onerror", e.DefaultOnError),
 		zap.String("esi_base_url", e.ESIBaseURL),
-		zap.Any("esi_headers", e.ESIHeaders))
+		zap.Any("esi_headers", e.ESIHeaders),
+		zap.Any("var_headers", e.VarHeaders),
+		zap.Strings("allowed_hosts", e.AllowedHosts),
+		zap.Strings("allowed_schemes", e.AllowedSchemes),
+		zap.Strings("allowed_fragment_content_types", e.AllowedFragmentContentTypes),
+		zap.Int("max_fragment_redirects", e.MaxFragmentRedirects),
+		zap.Bool("same_origin_redirects", e.SameOriginRedirects),
+		zap.Strings("content_types", e.processedContentTypes()),
+		zap.Bool("debug_boundaries", e.DebugBoundaries),
+		zap.Bool("debug_placeholders", e.DebugPlaceholders),
+		zap.Bool("streaming", e.Streaming),
+		zap.Bool("strict_tag_detection", e.StrictTagDetection))
 
 	// Initialize Prometheus metrics if registry is available
 	if reg := ctx.GetMetricsRegistry(); reg != nil {
@@ -300,6 +1200,22 @@ func (e *ESI) OnStampedeWait() {
 	}
 }
 
+// OnFragmentFetch implements esi.MetricsObserver
+func (e *ESI) OnFragmentFetch(duration time.Duration, status int, err error) {
+	if e.fragmentFetchDuration != nil {
+		e.fragmentFetchDuration.Observe(duration.Seconds())
+	}
+
+	// Requests without a response are counted under status "error"
+	if e.fragmentFetches != nil {
+		code := "error"
+		if status != 0 {
+			code = strconv.Itoa(status)
+		}
+		e.fragmentFetches.WithLabelValues(code).Inc()
+	}
+}
+
 // initMetrics initializes Prometheus metrics
 func (e *ESI) initMetrics(reg *prometheus.Registry) {
 	const ns, sub = "caddy", "esi"
@@ -334,19 +1250,80 @@ func (e *ESI) initMetrics(reg *prometheus.Registry) {
 		Help:      "Total number of requests that waited for in-flight fetches (stampede prevention)",
 	})
 
-	e.cacheEntries = factory.NewGauge(prometheus.GaugeOpts{
+	// Read from the cache itself whenever metrics are scraped
+	e.cacheEntries = factory.NewGaugeFunc(prometheus.GaugeOpts{
 		Namespace: ns,
 		Subsystem: sub,
 		Name:      "cache_entries",
 		Help:      "Current number of entries in the ESI fragment cache",
+	}, func() float64 {
+		entries, _ := esi.CacheStats()
+		return float64(entries)
 	})
 
-	e.cacheSizeBytes = factory.NewGauge(prometheus.GaugeOpts{
+	e.cacheSizeBytes = factory.NewGaugeFunc(prometheus.GaugeOpts{
 		Namespace: ns,
 		Subsystem: sub,
 		Name:      "cache_size_bytes",
 		Help:      "Current size of the ESI fragment cache in bytes",
+	}, func() float64 {
+		_, size := esi.CacheStats()
+		return float64(size)
+	})
+
+	// Computed from the esi package's own hit/miss counts whenever metrics are scraped
+	e.cacheHitRatio = factory.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "cache_hit_ratio",
+		Help:      "Share of ESI fragment lookups served from the cache",
+	}, esi.CacheHitRatio)
+
+	e.activeFetches = factory.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "active_fetch_goroutines",
+		Help:      "Current number of goroutines fetching ESI includes",
+	}, func() float64 { return float64(esi.ActiveFetches()) })
+
+	e.fragmentFetchDuration = factory.NewHistogram(prometheus.HistogramOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "fragment_fetch_duration_seconds",
+		Help:      "Duration of ESI fragment requests to their backends, until the body is read",
+		Buckets:   prometheus.DefBuckets,
 	})
+
+	e.fragmentFetches = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "fragment_fetches_total",
+		Help:      "Total number of ESI fragment requests by response status code, or \"error\" without a response",
+	}, []string{"status"})
+
+	e.bufferDiscards = factory.NewCounter(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "buffer_pool_discards_total",
+		Help:      "Total number of response buffers dropped instead of pooled for exceeding max_pooled_buffer_bytes",
+	})
+}
+
+// Cleanup stops background work started in Provision. The last handler cleaned up also cancels
+// the fragment fetches in flight and waits for them to return.
+func (e *ESI) Cleanup() error {
+	if e.manifest != nil {
+		e.manifest.Stop()
+	}
+
+	if provisioned.Add(-1) > 0 {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	return esi.Shutdown(ctx)
 }
 
 func (s ESI) Start() error { return nil }
@@ -358,5 +1335,6 @@ var (
 	_ caddyhttp.MiddlewareHandler = (*ESI)(nil)
 	_ caddy.Module                = (*ESI)(nil)
 	_ caddy.Provisioner           = (*ESI)(nil)
+	_ caddy.CleanerUpper          = (*ESI)(nil)
 	_ caddy.App                   = (*ESI)(nil)
 )
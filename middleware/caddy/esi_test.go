@@ -1,10 +1,15 @@
 package caddy_esi
 
 import (
+	"context"
 	"net/http"
+	"net/http/httptest"
 	"testing"
+	"time"
 
+	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/caddytest"
+	"github.com/sc0rp10/go-esi/esi"
 )
 
 const expectedOutput = `<html>
@@ -77,3 +82,60 @@ func TestUnitary(t *testing.T) {
 	_, _ = tester.AssertGetResponse(`http://domain.com:9080/include`, http.StatusOK, "<h1>CHAINED 2</h1>")
 	_, _ = tester.AssertGetResponse(`http://domain.com:9080/alt`, http.StatusOK, "<h1>ALTERNATE ESI INCLUDE</h1>")
 }
+
+// Test that only the last handler cleaned up shuts the fragment fetches down, as on a reload the old
+// configuration is cleaned up while the new one serves requests
+func TestCleanupShutsDownWithTheLastHandler(t *testing.T) {
+	t.Cleanup(func() { esi.Configure(esi.Config{}) })
+
+	started, release := make(chan struct{}, 1), make(chan struct{})
+	fragments := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		select {
+		case <-r.Context().Done():
+		case <-release:
+			w.Write([]byte("fragment"))
+		}
+	}))
+	defer fragments.Close()
+	defer close(release)
+
+	// Each configuration has its own context
+	old, current := &ESI{}, &ESI{}
+	for _, e := range []*ESI{old, current} {
+		ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+		defer cancel()
+		if err := e.Provision(ctx); err != nil {
+			t.Fatalf("Provision failed: %v", err)
+		}
+	}
+
+	parsed := make(chan string, 1)
+	go func() {
+		page := `<esi:include src="` + fragments.URL + `/slow"/>`
+		parsed <- string(esi.Parse([]byte(page), httptest.NewRequest("GET", "http://example.com", nil)))
+	}()
+	<-started
+
+	// The reload cleans up the old handler, the fetch of the current one goes on
+	if err := old.Cleanup(); err != nil {
+		t.Fatalf("Cleanup failed: %v", err)
+	}
+	select {
+	case result := <-parsed:
+		t.Fatalf("Expected the fetch to go on after the old handler was cleaned up, got %q", result)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if err := current.Cleanup(); err != nil {
+		t.Fatalf("Cleanup failed: %v", err)
+	}
+	select {
+	case result := <-parsed:
+		if result != "" {
+			t.Errorf("Expected the cancelled include to be left out, got %q", result)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected the last Cleanup to cancel the fetch in flight")
+	}
+}
@@ -0,0 +1,109 @@
+package caddy_esi
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/sc0rp10/go-esi/writer"
+	"go.uber.org/zap"
+)
+
+// streamWriter decides when the upstream writes the header whether the response is processed
+// and, if so, streams it through a writer.Writer instead of buffering the whole body
+type streamWriter struct {
+	*caddyhttp.ResponseWriterWrapper
+	e       *ESI
+	r       *http.Request
+	buf     *bytes.Buffer
+	esi     *writer.Writer
+	decided bool
+}
+
+// WriteHeader implements http.ResponseWriter
+func (sw *streamWriter) WriteHeader(status int) {
+	if sw.decided {
+		return
+	}
+	sw.decided = true
+
+	// Compressed content can't be scanned part by part, it is passed through unchanged
+	if !sw.e.shouldBuffer(status, sw.Header()) || sw.Header().Get("Content-Encoding") != "" {
+		sw.ResponseWriterWrapper.WriteHeader(status)
+		return
+	}
+
+	sw.buf = bufPool.Get().(*bytes.Buffer)
+	sw.buf.Reset()
+	sw.esi = writer.NewWriter(sw.buf, sw.ResponseWriterWrapper, sw.r)
+	sw.esi.WriteHeader(status)
+}
+
+// Write implements http.ResponseWriter
+func (sw *streamWriter) Write(b []byte) (int, error) {
+	if !sw.decided {
+		sw.WriteHeader(http.StatusOK)
+	}
+
+	if sw.esi != nil {
+		return sw.esi.Write(b)
+	}
+
+	return sw.ResponseWriterWrapper.Write(b)
+}
+
+// ReadFrom implements io.ReaderFrom, so copies can't bypass processing
+func (sw *streamWriter) ReadFrom(r io.Reader) (int64, error) {
+	if !sw.decided {
+		sw.WriteHeader(http.StatusOK)
+	}
+
+	if sw.esi != nil {
+		return io.Copy(sw.esi, r)
+	}
+
+	return sw.ResponseWriterWrapper.ReadFrom(r)
+}
+
+// Flush implements http.Flusher, processed responses are already flushed part by part
+func (sw *streamWriter) Flush() {
+	if sw.esi != nil {
+		return
+	}
+
+	http.NewResponseController(sw.ResponseWriterWrapper).Flush()
+}
+
+// close waits until the processed response has been fully streamed
+func (sw *streamWriter) close() {
+	if sw.esi == nil {
+		return
+	}
+
+	sw.esi.Close()
+	sw.e.releaseBuffer(sw.buf)
+
+	if err := sw.esi.Err(); err != nil && sw.e.logger != nil {
+		sw.e.logger.Warn("ESI include left out of a streamed page, it can't fail or redirect the page once sent",
+			zap.String("url", sw.r.URL.String()),
+			zap.Error(err))
+	}
+}
+
+// serveStreaming processes ESI tags while the upstream response is being written, sending
+// literal content right away and each fragment in document order as soon as it resolves.
+// Page-level outcomes derived from fragments (Last-Modified, 304s, a 502 for onerror="error",
+// propagated redirects) are not available here, since the header is sent before any fragment
+// is fetched: such includes are left out and logged. ServeHTTP buffers instead while the
+// maintenance page is due.
+func (e *ESI) serveStreaming(rw http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+	sw := &streamWriter{
+		ResponseWriterWrapper: &caddyhttp.ResponseWriterWrapper{ResponseWriter: rw},
+		e:                     e,
+		r:                     r,
+	}
+	defer sw.close()
+
+	return next.ServeHTTP(sw, r)
+}
@@ -0,0 +1,205 @@
+package caddy_esi
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/sc0rp10/go-esi/esi"
+)
+
+// Test that literal content reaches the client before a slow include completes
+func TestStreamingESI_EarlyBytesBeforeSlowInclude(t *testing.T) {
+	release := make(chan struct{})
+	fragments := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			<-release
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("<p>" + r.URL.Path + "</p>"))
+	}))
+	defer fragments.Close()
+
+	const head = "<html><head><title>Streamed</title></head><body>"
+	page := head + `<esi:include src="` + fragments.URL + `/slow"/><esi:comment text="dropped"/>` +
+		`<main>content</main><esi:include src="` + fragments.URL + `/fast"/></body></html>`
+
+	e := &ESI{Streaming: true}
+	upstream := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		w.Header().Set("Content-Type", "text/html")
+		w.Header().Set("Content-Length", "1024")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(page))
+		return nil
+	})
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := e.ServeHTTP(w, r, upstream); err != nil {
+			t.Errorf("ServeHTTP failed: %v", err)
+		}
+	}))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/page")
+	if err != nil {
+		close(release)
+		t.Fatalf("GET failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected status 200, got %d", resp.StatusCode)
+	}
+	if resp.ContentLength != -1 {
+		t.Errorf("Expected upstream Content-Length to be dropped, got %d", resp.ContentLength)
+	}
+
+	// The head must arrive while the slow include is still blocked
+	early := make(chan string, 1)
+	body := bufio.NewReader(resp.Body)
+	go func() {
+		b := make([]byte, len(head))
+		n, _ := io.ReadFull(body, b)
+		early <- string(b[:n])
+	}()
+
+	select {
+	case got := <-early:
+		if got != head {
+			t.Errorf("Expected early bytes %q, got %q", head, got)
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("Literal content was not streamed before the slow include completed")
+	}
+	close(release)
+
+	rest, err := io.ReadAll(body)
+	if err != nil {
+		t.Fatalf("Reading body failed: %v", err)
+	}
+
+	req := httptest.NewRequest("GET", server.URL+"/page", nil)
+	expected := string(esi.Parse([]byte(page), req))
+	if got := head + string(rest); got != expected {
+		t.Errorf("Expected streamed output to match Parse\nExpected: %q\nGiven:    %q", expected, got)
+	}
+}
+
+// Test that responses which aren't processed pass through the streaming writer untouched
+func TestStreamingESI_PassThrough(t *testing.T) {
+	e := &ESI{Streaming: true}
+	upstream := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(`{"tag": "<esi:comment text=\"kept\"/>", "padding": "` + strings.Repeat("x", 600) + `"}`))
+		return nil
+	})
+
+	req := httptest.NewRequest("GET", "http://example.com/api", nil)
+	rec := httptest.NewRecorder()
+	if err := e.ServeHTTP(rec, req, upstream); err != nil {
+		t.Fatalf("ServeHTTP failed: %v", err)
+	}
+
+	if !strings.Contains(rec.Body.String(), `<esi:comment text=\"kept\"/>`) {
+		t.Errorf("Expected non-HTML response to be left unprocessed, got %q", rec.Body.String())
+	}
+}
+
+// Test that a chunked upstream response, left alone in buffered mode, is processed in streaming mode
+func TestStreamingESI_ChunkedUpstream(t *testing.T) {
+	fragments := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("<p>" + r.URL.Path + "</p>"))
+	}))
+	defer fragments.Close()
+
+	chunks := []string{
+		`<html><body><esi:include src="` + fragments.URL + `/header"/>`,
+		`<main>content</main>`,
+		`<esi:include src="` + fragments.URL + `/footer"/></body></html>`,
+	}
+	upstream := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		w.Header().Set("Content-Type", "text/html")
+		w.Header().Set("Transfer-Encoding", "chunked")
+		w.WriteHeader(http.StatusOK)
+		for _, chunk := range chunks {
+			w.Write([]byte(chunk))
+			http.NewResponseController(w).Flush()
+		}
+		return nil
+	})
+
+	tests := []struct {
+		name      string
+		streaming bool
+		expected  string
+	}{
+		{"buffered", false, strings.Join(chunks, "")},
+		{"streaming", true, "<html><body><p>/header</p><main>content</main><p>/footer</p></body></html>"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := &ESI{Streaming: tt.streaming}
+
+			req := httptest.NewRequest("GET", "http://example.com/page", nil)
+			rec := httptest.NewRecorder()
+			if err := e.ServeHTTP(rec, req, upstream); err != nil {
+				t.Fatalf("ServeHTTP failed: %v", err)
+			}
+
+			if got := rec.Body.String(); got != tt.expected {
+				t.Errorf("Expected %q, got %q", tt.expected, got)
+			}
+		})
+	}
+}
+
+// Test that includes which would fail the page are left out of a streamed page, and that pages are
+// buffered to serve the maintenance page during an outage
+func TestStreamingESI_PageOutcomes(t *testing.T) {
+	esi.Configure(esi.Config{FailureRateThreshold: 0.5, FailureWindow: time.Minute})
+	t.Cleanup(func() { esi.Configure(esi.Config{}) })
+
+	fragments := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer fragments.Close()
+
+	e := &ESI{Streaming: true, maintenance: []byte("<html>Down for maintenance</html>")}
+	upstream := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		w.Header().Set("Content-Type", "text/html")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(`<html><esi:include src="` + fragments.URL + `/broken" onerror="error"/></html>`))
+		return nil
+	})
+	serve := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "http://example.com/page", nil)
+		rec := httptest.NewRecorder()
+		if err := e.ServeHTTP(rec, req, upstream); err != nil {
+			t.Fatalf("ServeHTTP failed: %v", err)
+		}
+		return rec
+	}
+
+	// The header went out before the include failed, so it is left out instead of a 502
+	rec := serve()
+	if rec.Code != http.StatusOK || rec.Body.String() != "<html></html>" {
+		t.Errorf("Expected the failed include left out of a 200 page, got %d %q", rec.Code, rec.Body.String())
+	}
+
+	// Sustained failures push the rate over the threshold
+	for range 20 {
+		if rec = serve(); rec.Code == http.StatusServiceUnavailable {
+			break
+		}
+	}
+	if rec.Code != http.StatusServiceUnavailable || rec.Body.String() != "<html>Down for maintenance</html>" {
+		t.Errorf("Expected the maintenance page with status 503, got %d %q", rec.Code, rec.Body.String())
+	}
+}
@@ -1,13 +1,29 @@
+// Package writer streams responses to the client while processing their ESI tags.
+//
+// A Writer hands the parts of the document to a goroutine of its own, which writes them to the
+// client. Close must be called once the upstream is done writing: it writes what is left, waits
+// until every part reached the client and stops that goroutine, which leaks otherwise.
 package writer
 
 import (
 	"bytes"
+	"fmt"
 	"net/http"
+	"sync"
 
 	"github.com/sc0rp10/go-esi/esi"
 	"go.uber.org/zap"
 )
 
+const (
+	// asyncQueueSize is the number of parts that may be pending before Write blocks on the client
+	asyncQueueSize = 64
+
+	// defaultContentType is sent when the upstream didn't set one, so the client doesn't sniff
+	// the type from whatever part happens to come first
+	defaultContentType = "text/html; charset=utf-8"
+)
+
 var logger *zap.Logger
 
 // SetLogger sets the logger to be used for ESI processing
@@ -16,14 +32,27 @@ func SetLogger(l *zap.Logger) {
 	esi.SetLogger(l)
 }
 
+// Writer streams a response to the client while processing its ESI tags. Literal content is
+// sent as soon as it is written, every tag is processed in its own goroutine, and the parts
+// are written to the client in document order as they resolve, each one flushed as it is written.
+// Close must be called once the upstream is done writing.
+//
+// The header is sent before any fragment is fetched, so an include that would fail the page
+// (onerror="error") or redirect it (propagate-redirect="true") is left out instead, see Err.
 type Writer struct {
-	buf       *bytes.Buffer
-	rw        http.ResponseWriter
-	Rq        *http.Request
-	AsyncBuf  []chan []byte
-	Done      chan bool
-	flushed   bool
-	Iteration int
+	buf *bytes.Buffer
+	rw  http.ResponseWriter
+	Rq  *http.Request
+	// Done is closed once every queued part has been written to the client
+	Done        chan bool
+	wroteHeader bool
+	Iteration   int
+
+	// parts queues the parts of the document in order, each one delivered on its own channel
+	parts chan chan []byte
+
+	mu        sync.Mutex
+	unapplied error
 }
 
 func NewWriter(buf *bytes.Buffer, rw http.ResponseWriter, rq *http.Request) *Writer {
@@ -39,13 +68,17 @@ func NewWriter(buf *bytes.Buffer, rw http.ResponseWriter, rq *http.Request) *Wri
 		rq.URL.Host = rq.Host
 	}
 
-	return &Writer{
-		buf:      buf,
-		Rq:       rq,
-		rw:       rw,
-		AsyncBuf: make([]chan []byte, 0),
-		Done:     make(chan bool),
+	w := &Writer{
+		buf:   buf,
+		Rq:    esi.WithOutputBudget(rq),
+		rw:    rw,
+		Done:  make(chan bool),
+		parts: make(chan chan []byte, asyncQueueSize),
 	}
+
+	go w.ready()
+
+	return w
 }
 
 // Header implements http.ResponseWriter.
@@ -54,27 +87,29 @@ func (w *Writer) Header() http.Header {
 }
 
 // WriteHeader implements http.ResponseWriter.
+// The upstream Content-Length no longer matches once tags are processed, so it is dropped,
+// and a missing Content-Type defaults to HTML.
 func (w *Writer) WriteHeader(statusCode int) {
 	if statusCode == 0 {
 		statusCode = http.StatusOK
 	}
-	w.rw.WriteHeader(statusCode)
-}
-
-// Flush implements http.Flusher.
-func (w *Writer) Flush() {
-	if !w.flushed {
-		if flusher, ok := w.rw.(http.Flusher); ok {
-			flusher.Flush()
-		}
-
-		w.flushed = true
+	w.wroteHeader = true
+	w.rw.Header().Del("Content-Length")
+	if w.rw.Header().Get("Content-Type") == "" {
+		w.rw.Header().Set("Content-Type", defaultContentType)
 	}
+	w.rw.WriteHeader(statusCode)
 }
 
 // Write will write the response body.
 func (w *Writer) Write(b []byte) (int, error) {
-	buf := append(w.buf.Bytes(), b...)
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+
+	// Copy into a fresh slice, b may be reused by the caller and parts are read asynchronously
+	buf := make([]byte, 0, w.buf.Len()+len(b))
+	buf = append(append(buf, w.buf.Bytes()...), b...)
 	w.buf.Reset()
 
 	if logger != nil {
@@ -84,52 +119,176 @@ func (w *Writer) Write(b []byte) (int, error) {
 			zap.Bool("has_esi", esi.HasOpenedTags(buf)))
 	}
 
-	if esi.HasOpenedTags(buf) {
-		position := 0
-		for position < len(buf) {
-			startPos, nextPos, t := esi.ReadToTag(buf[position:], position)
+	position := 0
+	for position < len(buf) {
+		next := buf[position:]
+		startPos, _, t := esi.ReadToTag(next, position)
 
-			if startPos != 0 {
-				w.AsyncBuf = append(w.AsyncBuf, make(chan []byte))
-				go func(tmpBuf []byte, i int, cw *Writer) {
-					cw.AsyncBuf[i] <- tmpBuf
-				}(buf[position:position+startPos], w.Iteration, w)
-				w.Iteration++
-			}
+		if startPos == len(next) {
+			// No more tags, but the chunk may end with the beginning of one
+			end := len(buf) - partialOpenerLength(next)
+			w.push(buf[position:end])
+			position = end
 
-			if t == nil {
-				break
-			}
+			break
+		}
 
-			closePosition := t.GetClosePosition(buf[position+startPos:])
-			if closePosition == 0 {
-				position += startPos
+		w.push(next[:startPos])
 
-				break
-			}
+		if t == nil && incompleteTagName(next[startPos:]) {
+			// Wait for the rest of the tag name in a later chunk
+			position += startPos
 
-			position += nextPos
+			break
+		}
 
-			w.AsyncBuf = append(w.AsyncBuf, make(chan []byte))
+		if t == nil {
+			// Not a tag we process, pass its opening bracket through and keep scanning
+			w.push(next[startPos : startPos+1])
+			position += startPos + 1
 
-			go func(currentTag esi.Tag, tmpBuf []byte, cw *Writer, Iteration int) {
-				p, _ := currentTag.Process(tmpBuf, cw.Rq)
-				cw.AsyncBuf[Iteration] <- p
-			}(t, buf[position:(position-nextPos)+startPos+closePosition], w, w.Iteration)
+			continue
+		}
 
-			position += startPos + closePosition - nextPos
-			w.Iteration++
+		closePosition := t.GetClosePosition(next[startPos:])
+		if closePosition == 0 {
+			// Wait for the rest of the tag in a later chunk
+			position += startPos
+
+			break
 		}
-		w.buf.Write(buf[position:])
 
-		return len(b), nil
+		w.process(next[startPos : startPos+closePosition])
+		position += startPos + closePosition
+	}
+	w.buf.Write(buf[position:])
+
+	return len(b), nil
+}
+
+// Close writes what is left of the buffer and blocks until every part reached the client.
+func (w *Writer) Close() error {
+	if w.buf.Len() > 0 {
+		w.push(bytes.Clone(w.buf.Bytes()))
+		w.buf.Reset()
+	}
+
+	close(w.parts)
+	<-w.Done
+
+	return nil
+}
+
+// Err returns the first include outcome that would have replaced the whole page, a failure under
+// onerror="error" or a propagated redirect, which can't be applied once the header is sent. Such
+// includes are left out of the streamed page. It is only complete after Close.
+func (w *Writer) Err() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.unapplied
+}
+
+// push queues literal content
+func (w *Writer) push(b []byte) {
+	if len(b) == 0 {
+		return
 	}
 
-	w.AsyncBuf = append(w.AsyncBuf, make(chan []byte))
-	w.AsyncBuf[w.Iteration] <- buf
+	part := make(chan []byte, 1)
+	part <- b
+	w.parts <- part
 	w.Iteration++
+}
 
-	return len(b), nil
+// process queues a complete tag, parsed in its own goroutine so slow includes don't hold
+// back the parsing of the rest of the document
+func (w *Writer) process(tag []byte) {
+	part := make(chan []byte, 1)
+	w.parts <- part
+	w.Iteration++
+
+	// Parse may grow the slice in place, so it gets its own copy
+	done := esi.TrackFetch()
+	go func(tag []byte) {
+		processed, result := esi.ParseWithResult(tag, w.Rq)
+		done()
+
+		w.recordUnapplied(result)
+		part <- processed
+	}(bytes.Clone(tag))
+}
+
+// recordUnapplied keeps the first page-level outcome of the includes of a tag, see Err
+func (w *Writer) recordUnapplied(result *esi.Result) {
+	err := result.Err()
+	if status, location := result.Redirect(); status != 0 {
+		err = fmt.Errorf("include redirected with status %d to %s", status, location)
+	}
+	if err == nil {
+		return
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.unapplied == nil {
+		w.unapplied = err
+	}
+}
+
+// ready writes the parts to the client in document order, flushing after each one
+func (w *Writer) ready() {
+	defer close(w.Done)
+
+	// The controller also reaches flushers behind wrapping response writers
+	rc := http.NewResponseController(w.rw)
+
+	var writeErr error
+	for part := range w.parts {
+		b := <-part
+
+		// Keep draining after a failed write so producers never block
+		if writeErr != nil {
+			continue
+		}
+
+		if _, writeErr = w.rw.Write(b); writeErr != nil {
+			if logger != nil {
+				logger.Warn("Writer failed to stream part", zap.Error(writeErr))
+			}
+
+			continue
+		}
+
+		rc.Flush()
+	}
+}
+
+// incompleteTagName reports whether b, starting with an ESI tag opener, ends inside the tag name
+func incompleteTagName(b []byte) bool {
+	name := bytes.TrimPrefix(b, []byte("<esi:"))
+	for _, c := range name {
+		if c < 'a' || c > 'z' {
+			return false
+		}
+	}
+
+	return true
+}
+
+// partialOpenerLength returns the length of a trailing prefix of an ESI tag opener in b
+func partialOpenerLength(b []byte) int {
+	longest := 0
+	for _, opener := range []string{"<esi:", "<!--esi"} {
+		for n := len(opener) - 1; n > longest; n-- {
+			if bytes.HasSuffix(b, []byte(opener[:n])) {
+				longest = n
+			}
+		}
+	}
+
+	return longest
 }
 
 var _ http.ResponseWriter = (*Writer)(nil)
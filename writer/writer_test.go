@@ -1,9 +1,12 @@
 package writer
 
 import (
+	"bytes"
 	"net/http"
 	"net/http/httptest"
 	"testing"
+
+	"github.com/sc0rp10/go-esi/esi"
 )
 
 // mockResponseWriter is a simple mock to track WriteHeader calls
@@ -123,3 +126,174 @@ func TestWriteHeader_RedirectScenario(t *testing.T) {
 		t.Errorf("Expected Location header '/new-page', got '%s'", location)
 	}
 }
+
+// TestWrite_ChunkedMatchesParse tests that streaming a page in arbitrary chunks,
+// including chunks splitting a tag, produces the same output as parsing it whole
+func TestWrite_ChunkedMatchesParse(t *testing.T) {
+	fragments := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("<p>" + r.URL.Path + "</p>"))
+	}))
+	defer fragments.Close()
+
+	page := `<html><body><esi:include src="` + fragments.URL + `/header" />` +
+		`<esi:comment text="dropped"/><main>content</main>` +
+		`<!--esi <esi:include src="` + fragments.URL + `/escaped" /> -->` +
+		`<esi:remove>fallback</esi:remove><esi:include src="` + fragments.URL + `/footer" /></body></html>`
+
+	req := httptest.NewRequest("GET", "http://example.com/page", nil)
+	expected := string(esi.Parse([]byte(page), req))
+
+	for _, size := range []int{1, 3, 7, 64, len(page)} {
+		rec := httptest.NewRecorder()
+		w := NewWriter(&bytes.Buffer{}, rec, httptest.NewRequest("GET", "http://example.com/page", nil))
+
+		for i := 0; i < len(page); i += size {
+			w.Write([]byte(page[i:min(i+size, len(page))]))
+		}
+		w.Close()
+
+		if got := rec.Body.String(); got != expected {
+			t.Errorf("Chunk size %d\nExpected: %q\nGiven:    %q", size, expected, got)
+		}
+	}
+}
+
+// TestWrite_DefaultsContentType tests that a processed response gets an HTML Content-Type when
+// the upstream omitted one, instead of being sniffed from the first part
+func TestWrite_DefaultsContentType(t *testing.T) {
+	fragments := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("plain text greeting"))
+	}))
+	defer fragments.Close()
+
+	page := `<esi:include src="` + fragments.URL + `/greeting" /><p>content</p>`
+
+	tests := []struct {
+		name     string
+		upstream string
+		expected string
+	}{
+		{"omitted Content-Type defaults to HTML", "", "text/html; charset=utf-8"},
+		{"upstream Content-Type is kept", "application/xhtml+xml", "application/xhtml+xml"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			w := NewWriter(&bytes.Buffer{}, rec, httptest.NewRequest("GET", "http://example.com/page", nil))
+			if tt.upstream != "" {
+				w.Header().Set("Content-Type", tt.upstream)
+			}
+
+			w.Write([]byte(page))
+			w.Close()
+
+			if ct := rec.Header().Get("Content-Type"); ct != tt.expected {
+				t.Errorf("Expected Content-Type %q, got %q", tt.expected, ct)
+			}
+		})
+	}
+}
+
+// TestWrite_MalformedTagsMatchParse tests that malformed tags split across chunks are left verbatim like Parse does
+func TestWrite_MalformedTagsMatchParse(t *testing.T) {
+	page := `<html><esi:unknown text="x"/><esi:comment text="dropped"/>` +
+		`<esi:vars>$(HTTP_HOST)</esi:vars><esi:comment text="unterminated" </html>`
+
+	req := httptest.NewRequest("GET", "http://example.com/page", nil)
+	expected := string(esi.Parse([]byte(page), req))
+
+	for _, size := range []int{1, 5, 16, len(page)} {
+		rec := httptest.NewRecorder()
+		w := NewWriter(&bytes.Buffer{}, rec, httptest.NewRequest("GET", "http://example.com/page", nil))
+
+		for i := 0; i < len(page); i += size {
+			w.Write([]byte(page[i:min(i+size, len(page))]))
+		}
+		w.Close()
+
+		if got := rec.Body.String(); got != expected {
+			t.Errorf("Chunk size %d\nExpected: %q\nGiven:    %q", size, expected, got)
+		}
+	}
+}
+
+// TestWrite_LeavesOutPageOutcomes tests that includes which would fail or redirect the page are
+// left out of the streamed response and reported by Err
+func TestWrite_LeavesOutPageOutcomes(t *testing.T) {
+	fragments := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/broken":
+			w.WriteHeader(http.StatusInternalServerError)
+		case "/moved":
+			http.Redirect(w, r, "/login", http.StatusFound)
+		default:
+			w.Write([]byte("<p>" + r.URL.Path + "</p>"))
+		}
+	}))
+	defer fragments.Close()
+
+	tests := []struct {
+		name    string
+		include string
+	}{
+		{"onerror error", `<esi:include src="` + fragments.URL + `/broken" onerror="error"/>`},
+		{"propagated redirect", `<esi:include src="` + fragments.URL + `/moved" propagate-redirect="true"/>`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			w := NewWriter(&bytes.Buffer{}, rec, httptest.NewRequest("GET", "http://example.com/page", nil))
+			w.Write([]byte(`<main>` + tt.include + `<esi:include src="` + fragments.URL + `/ok"/></main>`))
+			w.Close()
+
+			if rec.Code != http.StatusOK {
+				t.Errorf("Expected the status sent before the include resolved, got %d", rec.Code)
+			}
+			if got := rec.Body.String(); got != "<main><p>/ok</p></main>" {
+				t.Errorf("Expected the include left out, got %q", got)
+			}
+			if w.Err() == nil {
+				t.Error("Expected Err to report the outcome that couldn't be applied")
+			}
+		})
+	}
+
+	w := NewWriter(&bytes.Buffer{}, httptest.NewRecorder(), httptest.NewRequest("GET", "http://example.com/page", nil))
+	w.Write([]byte(`<esi:include src="` + fragments.URL + `/broken"/>`))
+	w.Close()
+	if err := w.Err(); err != nil {
+		t.Errorf("Expected no error for an include that is removed anyway, got %v", err)
+	}
+}
+
+func TestWrite_CountsTagsInActiveFetches(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+	fragments := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		w.Write([]byte("<p>slow</p>"))
+	}))
+	defer fragments.Close()
+
+	baseline := esi.ActiveFetches()
+
+	w := NewWriter(&bytes.Buffer{}, httptest.NewRecorder(), httptest.NewRequest("GET", "http://example.com/page", nil))
+	w.Write([]byte(`<esi:include src="` + fragments.URL + `/slow"/>`))
+	<-started
+
+	// The goroutine processing the tag and the worker fetching its include
+	if active := esi.ActiveFetches(); active != baseline+2 {
+		t.Errorf("Expected the tag being processed to be counted, got %d active fetches, %d before", active, baseline)
+	}
+
+	close(release)
+	w.Close()
+
+	if active := esi.ActiveFetches(); active != baseline {
+		t.Errorf("Expected the count back to %d once the tag was processed, got %d", baseline, active)
+	}
+}